@@ -0,0 +1,64 @@
+/*
+jobsdb-restore loads a dataset backup (the jobs archive and the job
+status archive uploaded by the backup loop) back into jobsdb
+
+	jobsdb-restore -prefix gw -jobs gw_jobs_3.jsonl.gz -status gw_job_status_3.jsonl.gz
+
+recreates gw_jobs_3 and gw_job_status_3. With -into-current the jobs are
+added to the current dataset under new job ids instead. Archives can be
+jsonl.gz, csv.gz or parquet.
+
+The server must be stopped while restoring, and started again afterwards:
+it only reads the list of datasets on startup, so it would not see a
+recreated dataset, and it may roll over the current dataset while jobs
+are restored into it.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+)
+
+func main() {
+	prefix := flag.String("prefix", "", "table prefix of the jobsdb to restore into (gw, rt, batch_rt)")
+	jobsArchive := flag.String("jobs", "", "jobs archive")
+	jobStatusArchive := flag.String("status", "", "job status archive")
+	intoCurrent := flag.Bool("into-current", false, "add the jobs to the current dataset under new job ids")
+	flag.Parse()
+
+	if *prefix == "" || *jobsArchive == "" || *jobStatusArchive == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger.Setup()
+
+	err := run(*prefix, *jobsArchive, *jobStatusArchive, *intoCurrent)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+//run restores the archives. It returns instead of exiting, so that the
+//jobsdb is torn down on failure too
+func run(prefix string, jobsArchive string, jobStatusArchive string, intoCurrent bool) error {
+	var jd jobsdb.HandleT
+	err := jd.SetupForRestore(prefix)
+	if err != nil {
+		return fmt.Errorf("Could not connect to the jobsdb: %v", err)
+	}
+	defer jd.TearDown()
+
+	stats, err := jd.RestoreDS(jobsArchive, jobStatusArchive, intoCurrent)
+	if err != nil {
+		return fmt.Errorf("Restore failed: %v", err)
+	}
+	fmt.Printf("Restored %d jobs and %d statuses into %s\n", stats.Jobs, stats.Statuses, stats.Dataset)
+	return nil
+}
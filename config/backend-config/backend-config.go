@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"reflect"
 	"time"
 
@@ -94,6 +95,39 @@ func getBackendConfig() (SourcesT, bool) {
 	return sourcesJSON, true
 }
 
+//TransformationCodeT is the code of a version of a user transformation
+type TransformationCodeT struct {
+	VersionID string `json:"versionId"`
+	Code      string `json:"code"`
+}
+
+//GetTransformationCode fetches the code of a version of a user
+//transformation. Versions don't change, so it can be cached
+func GetTransformationCode(versionID string) (TransformationCodeT, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	url := fmt.Sprintf("%s/transformation/getByVersionId?versionId=%s&workspaceToken=%s",
+		configBackendURL, neturl.QueryEscape(versionID), configBackendToken)
+	resp, err := client.Get(url)
+	if err != nil {
+		return TransformationCodeT{}, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return TransformationCodeT{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return TransformationCodeT{}, fmt.Errorf("fetching transformation version %s: %s %s",
+			versionID, resp.Status, string(respBody))
+	}
+	var transformationCode TransformationCodeT
+	err = json.Unmarshal(respBody, &transformationCode)
+	if err != nil {
+		return TransformationCodeT{}, err
+	}
+	return transformationCode, nil
+}
+
 func init() {
 	config.Initialize()
 	loadConfig()
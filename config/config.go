@@ -74,6 +74,14 @@ func GetDuration(key string, defaultValue time.Duration) time.Duration {
 	return viper.GetDuration(key)
 }
 
+// GetStringMapString is wrapper for viper's GetStringMapString
+func GetStringMapString(key string, defaultValue map[string]string) map[string]string {
+	if !viper.IsSet(key) {
+		return defaultValue
+	}
+	return viper.GetStringMapString(key)
+}
+
 // GetEnv returns the environment value stored in key variable
 func GetEnv(key string, defaultVal string) string {
 	if value, exists := os.LookupEnv(key); exists {
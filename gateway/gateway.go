@@ -203,6 +203,7 @@ func (gateway *HandleT) webRequestBatchDBWriter(process int) {
 				CreatedAt:    time.Now(),
 				ExpireAt:     time.Now(),
 				CustomVal:    CustomVal,
+				PartitionKey: gjson.GetBytes(body, "batch.0.anonymousId").Str,
 				EventPayload: []byte(body),
 			}
 			jobList = append(jobList, &newJob)
@@ -314,6 +315,10 @@ func (gateway *HandleT) webGroupHandler(w http.ResponseWriter, r *http.Request)
 func (gateway *HandleT) webHandler(w http.ResponseWriter, r *http.Request, reqType string) {
 	logger.LogRequest(r)
 	atomic.AddUint64(&gateway.recvCount, 1)
+	if gateway.jobsDB.IngestionPaused() {
+		http.Error(w, "Ingestion paused, database is near its size limit", http.StatusServiceUnavailable)
+		return
+	}
 	done := make(chan string)
 	req := webRequestT{request: r, writer: &w, done: done, reqType: reqType}
 	gateway.webRequestQ <- &req
@@ -0,0 +1,633 @@
+/*
+Admin API for inspecting and manipulating jobs. It is served on a separate
+port (JobsDB.adminPort) so that it is never exposed along with the gateway,
+and only on localhost unless JobsDB.adminHost says otherwise. If the
+JOBSDB_ADMIN_TOKEN env variable is set every request must carry it as
+"Authorization: Bearer <token>"; it should always be set when adminHost
+isn't localhost, since the POST endpoints change the state of jobs.
+Every HandleT registers itself on Setup and is addressed by its table prefix
+(e.g. ?prefix=rt).
+
+GET  /v1/jobsdb/datasets?prefix=                      datasets and their job id ranges
+GET  /v1/jobsdb/counts?prefix=                        job count by latest state and custom_val
+GET  /v1/jobsdb/job?prefix=&id=                       a job with its full status history
+POST /v1/jobsdb/transition?prefix=                    bulk move jobs from one state to another
+GET  /v1/jobsdb/deadletters?prefix=&customVal=&count= dead letter jobs not yet requeued
+POST /v1/jobsdb/deadletters/requeue?prefix=           requeue dead letter jobs
+GET  /v1/jobsdb/paused?prefix=                        paused custom_vals and sources
+POST /v1/jobsdb/pause?prefix=                         pause a custom_val (or one of its sources)
+POST /v1/jobsdb/resume?prefix=                        resume it
+GET  /v1/jobsdb/transformationerrors?prefix=&customVal=&count=
+                                                      transformation errors not yet retried
+POST /v1/jobsdb/transformationerrors/retry?prefix=    mark transformation errors for retry
+*/
+
+package jobsdb
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+)
+
+var (
+	enableAdminServer     bool
+	adminHost             string
+	adminPort             int
+	adminToken            string
+	requeueBatchSize      int
+	registeredHandles     = map[string]*HandleT{}
+	registeredHandlesLock sync.RWMutex
+)
+
+func loadAdminConfig() {
+	enableAdminServer = config.GetBool("JobsDB.enableAdminServer", false)
+	adminHost = config.GetString("JobsDB.adminHost", "localhost")
+	adminPort = config.GetInt("JobsDB.adminPort", 8086)
+	adminToken = config.GetEnv("JOBSDB_ADMIN_TOKEN", "")
+	requeueBatchSize = config.GetInt("JobsDB.requeueBatchSize", 1000)
+}
+
+//DatasetInfoT is the admin view of a dataset
+type DatasetInfoT struct {
+	JobTable       string
+	JobStatusTable string
+	Index          string
+	MinJobID       int64
+	MaxJobID       int64
+}
+
+//StateCountT is the number of jobs of a custom_val in a state.
+//Jobs without any status are reported in the InternalState (NP)
+type StateCountT struct {
+	CustomVal string
+	State     string
+	Count     int64
+}
+
+//JobHistoryT is a job along with every status it went through
+type JobHistoryT struct {
+	Job      *JobT
+	Statuses []*JobStatusT
+}
+
+//TransitionRequestT selects the jobs whose latest state is FromState
+//and moves them to ToState. Empty filters match everything
+type TransitionRequestT struct {
+	FromState     string
+	ToState       string
+	CustomVal     string
+	SourceID      string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+//Only transitions which are safe to apply from outside are allowed.
+//aborted->failed retries the job, failed->aborted drops it
+var allowedAdminTransitions = map[string][]string{
+	AbortedState:      {FailedState},
+	FailedState:       {AbortedState},
+	WaitingState:      {AbortedState},
+	WaitingRetryState: {AbortedState},
+}
+
+//RequeueRequestT selects dead letter jobs to requeue, either by
+//JobIDs or all the jobs of CustomVal
+type RequeueRequestT struct {
+	CustomVal string
+	JobIDs    []int64
+}
+
+func registerHandle(jd *HandleT) {
+	registeredHandlesLock.Lock()
+	defer registeredHandlesLock.Unlock()
+	registeredHandles[jd.tablePrefix] = jd
+}
+
+func getRegisteredHandle(prefix string) (*HandleT, bool) {
+	registeredHandlesLock.RLock()
+	defer registeredHandlesLock.RUnlock()
+	jd, ok := registeredHandles[prefix]
+	return jd, ok
+}
+
+/*
+GetDatasetInfo returns the datasets along with the range of job ids
+they hold. For the active (last) dataset the range is read from the DB
+*/
+func (jd *HandleT) GetDatasetInfo() []DatasetInfoT {
+
+	jd.dsListLock.RLock()
+	defer jd.dsListLock.RUnlock()
+
+	dsList := jd.getDSList(false)
+	dsRangeList := jd.getDSRangeList(false)
+
+	var infoList []DatasetInfoT
+	for _, dsRange := range dsRangeList {
+		infoList = append(infoList, DatasetInfoT{
+			JobTable:       dsRange.ds.JobTable,
+			JobStatusTable: dsRange.ds.JobStatusTable,
+			Index:          dsRange.ds.Index,
+			MinJobID:       dsRange.minJobID,
+			MaxJobID:       dsRange.maxJobID,
+		})
+	}
+	if len(dsList) > len(dsRangeList) {
+		ds := dsList[len(dsList)-1]
+		var minID, maxID sql.NullInt64
+		sqlStatement := fmt.Sprintf(`SELECT MIN(job_id), MAX(job_id) FROM %s`, ds.JobTable)
+		err := jd.readQueryRow(sqlStatement, nil, &minID, &maxID)
+		jd.assertError(err)
+		infoList = append(infoList, DatasetInfoT{
+			JobTable:       ds.JobTable,
+			JobStatusTable: ds.JobStatusTable,
+			Index:          ds.Index,
+			MinJobID:       minID.Int64,
+			MaxJobID:       maxID.Int64,
+		})
+	}
+	return infoList
+}
+
+/*
+GetStateCounts returns the number of jobs by latest state and custom_val
+across all datasets
+*/
+func (jd *HandleT) GetStateCounts() []StateCountT {
+
+	jd.dsMigrationLock.RLock()
+	jd.dsListLock.RLock()
+	defer jd.dsMigrationLock.RUnlock()
+	defer jd.dsListLock.RUnlock()
+
+	countMap := map[string]map[string]int64{}
+	for _, ds := range jd.getDSList(false) {
+		sqlStatement := fmt.Sprintf(`SELECT %[1]s.custom_val, COALESCE(job_latest_state.job_state::text, '%[3]s'), COUNT(*)
+                                       FROM %[1]s LEFT JOIN %[2]s AS job_latest_state
+                                       ON %[1]s.job_id=job_latest_state.job_id
+                                       GROUP BY 1, 2`, ds.JobTable, jd.lastStatusTableName(ds), InternalState)
+		rows, err := jd.readQuery(sqlStatement)
+		jd.assertError(err)
+		for rows.Next() {
+			var customVal, state string
+			var count int64
+			err = rows.Scan(&customVal, &state, &count)
+			jd.assertError(err)
+			if _, ok := countMap[customVal]; !ok {
+				countMap[customVal] = map[string]int64{}
+			}
+			countMap[customVal][state] += count
+		}
+		rows.Close()
+	}
+
+	var counts []StateCountT
+	for customVal, stateMap := range countMap {
+		for state, count := range stateMap {
+			counts = append(counts, StateCountT{CustomVal: customVal, State: state, Count: count})
+		}
+	}
+	return counts
+}
+
+/*
+GetJobHistory returns the job and all its statuses ordered by time.
+The second return value is false if the job doesn't exist. It reads from
+a read replica, if there is one, so it may lag behind: decisions to change
+the state of the job must be based on getJobHistoryFromPrimary
+*/
+func (jd *HandleT) GetJobHistory(jobID int64) (JobHistoryT, bool) {
+	return jd.getJobHistory(jobID, false)
+}
+
+//getJobHistoryFromPrimary is GetJobHistory reading from the primary
+func (jd *HandleT) getJobHistoryFromPrimary(jobID int64) (JobHistoryT, bool) {
+	return jd.getJobHistory(jobID, true)
+}
+
+func (jd *HandleT) getJobHistory(jobID int64, fromPrimary bool) (JobHistoryT, bool) {
+
+	queryRow := jd.readQueryRow
+	query := jd.readQuery
+	if fromPrimary {
+		queryRow = func(sqlStatement string, args []interface{}, dest ...interface{}) error {
+			return jd.dbHandle.QueryRow(sqlStatement, args...).Scan(dest...)
+		}
+		query = jd.dbHandle.Query
+	}
+
+	jd.dsMigrationLock.RLock()
+	jd.dsListLock.RLock()
+	defer jd.dsMigrationLock.RUnlock()
+	defer jd.dsListLock.RUnlock()
+
+	for _, ds := range jd.getDSList(false) {
+		var job JobT
+		var payload payloadScanT
+		sqlStatement := fmt.Sprintf(`SELECT job_id, uuid, parameters, custom_val, partition_key, event_payload,
+                                       event_payload_compressed, created_at, expire_at FROM %s WHERE job_id=$1`, ds.JobTable)
+		err := queryRow(sqlStatement, []interface{}{jobID}, &job.JobID, &job.UUID, &job.Parameters,
+			&job.CustomVal, &job.PartitionKey, &payload.plain, &payload.compressed, &job.CreatedAt, &job.ExpireAt)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		jd.assertError(err)
+		job.EventPayload = jd.decodePayload(&payload)
+
+		history := JobHistoryT{Job: &job, Statuses: []*JobStatusT{}}
+		sqlStatement = fmt.Sprintf(`SELECT job_id, job_state, attempt, exec_time, retry_time,
+                                      error_code, error_response FROM %s WHERE job_id=$1 ORDER BY id`, ds.JobStatusTable)
+		rows, err := query(sqlStatement, jobID)
+		jd.assertError(err)
+		defer rows.Close()
+		for rows.Next() {
+			var status JobStatusT
+			err = rows.Scan(&status.JobID, &status.JobState, &status.AttemptNum, &status.ExecTime,
+				&status.RetryTime, &status.ErrorCode, &status.ErrorResponse)
+			jd.assertError(err)
+			history.Statuses = append(history.Statuses, &status)
+		}
+		if len(history.Statuses) > 0 {
+			job.LastJobStatus = *history.Statuses[len(history.Statuses)-1]
+		}
+		return history, true
+	}
+	return JobHistoryT{}, false
+}
+
+/*
+TransitionJobs adds a new status (ToState) to every job whose latest status
+is FromState and which matches the filters of the request. It returns the
+number of jobs moved
+*/
+func (jd *HandleT) TransitionJobs(req TransitionRequestT) (int64, error) {
+
+	allowed := false
+	for _, st := range allowedAdminTransitions[req.FromState] {
+		if st == req.ToState {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return 0, fmt.Errorf("transition from %q to %q is not allowed", req.FromState, req.ToState)
+	}
+
+	//A retried job starts its attempts afresh, otherwise the router
+	//would abort it again on the first failure
+	resetAttempt := req.ToState == FailedState
+
+	errorResponse, err := json.Marshal(map[string]string{"reason": "admin transition from " + req.FromState})
+	jd.assertError(err)
+
+	jd.dsMigrationLock.RLock()
+	jd.dsListLock.RLock()
+	defer jd.dsMigrationLock.RUnlock()
+	defer jd.dsListLock.RUnlock()
+	//Aborted jobs go to the dead letter jobsdb, as in UpdateJobStatus
+	copyToDeadLetterDB := jd.deadLetterDB != nil && req.ToState == AbortedState
+	if copyToDeadLetterDB {
+		jd.deadLetterDB.dsListLock.RLock()
+		defer jd.deadLetterDB.dsListLock.RUnlock()
+	}
+
+	var total int64
+	for _, ds := range jd.getDSList(false) {
+		txn, err := jd.dbHandle.Begin()
+		jd.assertError(err)
+		afterID := jd.maxStatusID(txn, ds)
+
+		sqlStatement := fmt.Sprintf(`INSERT INTO %[2]s (job_id, job_state, attempt, exec_time, retry_time,
+                                        error_code, error_response)
+                                       SELECT %[1]s.job_id, $2, CASE WHEN $3 THEN 0 ELSE job_latest_state.attempt END,
+                                        $4, $4, '', $5
+                                       FROM %[1]s, %[3]s AS job_latest_state
+                                       WHERE %[1]s.job_id=job_latest_state.job_id
+                                        AND job_latest_state.job_state=$1
+                                        AND ($6 = '' OR %[1]s.custom_val=$6)
+                                        AND ($7 = '' OR %[1]s.parameters->>'source_id'=$7)
+                                        AND ($8::timestamp IS NULL OR %[1]s.created_at >= $8)
+                                        AND ($9::timestamp IS NULL OR %[1]s.created_at < $9)
+                                       RETURNING job_id`,
+			ds.JobTable, ds.JobStatusTable, jd.lastStatusTableName(ds))
+		rows, err := txn.Query(sqlStatement, req.FromState, req.ToState, resetAttempt,
+			time.Now(), string(errorResponse), req.CustomVal, req.SourceID,
+			nullTime(req.CreatedAfter), nullTime(req.CreatedBefore))
+		if err != nil {
+			txn.Rollback()
+			return total, err
+		}
+		var jobIDs []int64
+		for rows.Next() {
+			var jobID int64
+			err = rows.Scan(&jobID)
+			jd.assertError(err)
+			jobIDs = append(jobIDs, jobID)
+		}
+		jd.assertError(rows.Err())
+		rows.Close()
+		jd.updateLastStatus(txn, ds, afterID)
+		var deadLetterList []*JobT
+		if copyToDeadLetterDB {
+			deadLetterList = jd.copyToDeadLetterDS(txn, ds, jobIDs)
+		}
+		err = txn.Commit()
+		jd.assertError(err)
+		if copyToDeadLetterDB {
+			jd.deadLetterDB.deadLettersStored(deadLetterList)
+		}
+		total += int64(len(jobIDs))
+		if len(jobIDs) > 0 {
+			jd.markClearEmptyResult(ds, []string{}, []string{}, false)
+		}
+	}
+	if total > 0 {
+		var customVals []string
+		if req.CustomVal != "" {
+			customVals = []string{req.CustomVal}
+		}
+		jd.publish(customVals)
+	}
+	return total, nil
+}
+
+func nullTime(t time.Time) pq.NullTime {
+	return pq.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func writeAdminResponse(w http.ResponseWriter, data interface{}) {
+	response, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func adminHandleFromRequest(w http.ResponseWriter, r *http.Request) (*HandleT, bool) {
+	prefix := r.URL.Query().Get("prefix")
+	jd, ok := getRegisteredHandle(prefix)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown jobsdb prefix %q", prefix), http.StatusNotFound)
+	}
+	return jd, ok
+}
+
+func adminDatasetsHandler(w http.ResponseWriter, r *http.Request) {
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	writeAdminResponse(w, jd.GetDatasetInfo())
+}
+
+func adminCountsHandler(w http.ResponseWriter, r *http.Request) {
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	writeAdminResponse(w, jd.GetStateCounts())
+}
+
+func adminJobHandler(w http.ResponseWriter, r *http.Request) {
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	jobID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid job id", http.StatusBadRequest)
+		return
+	}
+	history, found := jd.GetJobHistory(jobID)
+	if !found {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeAdminResponse(w, history)
+}
+
+func adminTransitionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req TransitionRequestT
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	count, err := jd.TransitionJobs(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Infof("JobsDB admin: moved %d %s jobs from %s to %s", count, jd.tablePrefix, req.FromState, req.ToState)
+	writeAdminResponse(w, map[string]int64{"count": count})
+}
+
+func adminDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count <= 0 {
+		count = 100
+	}
+	var customValFilters []string
+	if customVal := r.URL.Query().Get("customVal"); customVal != "" {
+		customValFilters = []string{customVal}
+	}
+	writeAdminResponse(w, jd.GetDeadLetters(customValFilters, count))
+}
+
+func adminRequeueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req RequeueRequestT
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || (req.CustomVal == "" && len(req.JobIDs) == 0) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var requeued int
+	if len(req.JobIDs) > 0 {
+		var jobList []*JobT
+		for _, jobID := range req.JobIDs {
+			history, found := jd.getJobHistoryFromPrimary(jobID)
+			if !found {
+				http.Error(w, fmt.Sprintf("Job %d not found", jobID), http.StatusNotFound)
+				return
+			}
+			//Already requeued
+			if len(history.Statuses) > 0 {
+				continue
+			}
+			jobList = append(jobList, history.Job)
+		}
+		err = jd.RequeueDeadLetters(jobList)
+		requeued = len(jobList)
+	} else {
+		for {
+			jobList := jd.GetDeadLetters([]string{req.CustomVal}, requeueBatchSize)
+			if len(jobList) == 0 {
+				break
+			}
+			err = jd.RequeueDeadLetters(jobList)
+			if err != nil {
+				break
+			}
+			requeued += len(jobList)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeAdminResponse(w, map[string]int{"count": requeued})
+}
+
+func adminPausedHandler(w http.ResponseWriter, r *http.Request) {
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	writeAdminResponse(w, jd.GetPaused())
+}
+
+//adminPauseHandler pauses (or resumes) the CustomVal and SourceID of
+//the PauseT in the body
+func adminPauseHandler(w http.ResponseWriter, r *http.Request, resume bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req PauseT
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.CustomVal == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if resume {
+		jd.Resume(req.CustomVal, req.SourceID)
+	} else {
+		jd.Pause(req.CustomVal, req.SourceID)
+	}
+	writeAdminResponse(w, jd.GetPaused())
+}
+
+func adminTransformationErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count <= 0 {
+		count = 100
+	}
+	var customValFilters []string
+	if customVal := r.URL.Query().Get("customVal"); customVal != "" {
+		customValFilters = []string{customVal}
+	}
+	writeAdminResponse(w, jd.GetTransformationErrors(customValFilters, count))
+}
+
+func adminRetryTransformationErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	jd, ok := adminHandleFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req RetryTransformationErrorsRequestT
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	count, err := jd.RetryTransformationErrors(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Infof("JobsDB admin: marked %d %s transformation errors for retry", count, jd.tablePrefix)
+	writeAdminResponse(w, map[string]int{"count": count})
+}
+
+//adminAuth rejects the requests without adminToken, if there is one
+func adminAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" {
+			token := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(token), []byte("Bearer "+adminToken)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+/*
+StartAdminServer serves the admin API for every registered HandleT.
+It blocks and does nothing unless JobsDB.enableAdminServer is set
+*/
+func StartAdminServer() {
+	if !enableAdminServer {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/jobsdb/datasets", adminDatasetsHandler)
+	mux.HandleFunc("/v1/jobsdb/counts", adminCountsHandler)
+	mux.HandleFunc("/v1/jobsdb/job", adminJobHandler)
+	mux.HandleFunc("/v1/jobsdb/transition", adminTransitionHandler)
+	mux.HandleFunc("/v1/jobsdb/deadletters", adminDeadLettersHandler)
+	mux.HandleFunc("/v1/jobsdb/deadletters/requeue", adminRequeueHandler)
+	mux.HandleFunc("/v1/jobsdb/paused", adminPausedHandler)
+	mux.HandleFunc("/v1/jobsdb/pause", func(w http.ResponseWriter, r *http.Request) {
+		adminPauseHandler(w, r, false)
+	})
+	mux.HandleFunc("/v1/jobsdb/resume", func(w http.ResponseWriter, r *http.Request) {
+		adminPauseHandler(w, r, true)
+	})
+	mux.HandleFunc("/v1/jobsdb/transformationerrors", adminTransformationErrorsHandler)
+	mux.HandleFunc("/v1/jobsdb/transformationerrors/retry", adminRetryTransformationErrorsHandler)
+
+	address := net.JoinHostPort(adminHost, strconv.Itoa(adminPort))
+	if adminToken == "" && adminHost != "localhost" && adminHost != "127.0.0.1" {
+		logger.Errorf("JobsDB admin server listens on %s without JOBSDB_ADMIN_TOKEN", address)
+	}
+	logger.Infof("Starting JobsDB admin server in %s", address)
+	err := http.ListenAndServe(address, adminAuth(mux))
+	logger.Error("JobsDB admin server stopped", err)
+}
@@ -0,0 +1,393 @@
+/*
+Backup of dropped datasets. backupTable streams the rows of a table
+through a server side cursor into a file, in one of the registered
+backupFormats, and uploads the file with the jobs or job status
+FileUploader. Nothing but one fetch (backupFetchSize rows) is held in
+memory at a time.
+
+The row formats (jsonl and csv) are gzip compressed as a whole. parquet is
+columnar: a row group of backupFetchSize rows is written at a time, each
+column compressed on its own (see package parquet). BYTEA columns (the
+compressed payloads) are written base64 encoded in every format.
+
+The format is JobsDB.backupFormat, which can be set per table prefix.
+The uploaders are built from the JobsDB.backupProvider config ("s3" or
+"local") in Setup, or can be set directly with SetBackupUploaders.
+*/
+
+package jobsdb
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/jobsdb/parquet"
+	"github.com/rudderlabs/rudder-server/services/fileuploader"
+	"github.com/rudderlabs/rudder-server/utils/misc"
+)
+
+var (
+	backupFormat         string
+	backupProvider       string
+	backupLocalDirectory string
+	backupFetchSize      int
+)
+
+func loadBackupConfig() {
+	backupFormat = config.GetString("JobsDB.backupFormat", "jsonl")
+	backupProvider = config.GetString("JobsDB.backupProvider", "s3")
+	backupLocalDirectory = config.GetString("JobsDB.backupLocalDirectory", "")
+	backupFetchSize = config.GetInt("JobsDB.backupFetchSize", 10000)
+}
+
+//backupWriterT writes the rows of one table in some file format.
+//Every value is passed as its Postgres text representation, but for
+//BYTEA values which are passed base64 encoded
+type backupWriterT interface {
+	writeHeader(columns []*sql.ColumnType) error
+	writeRow(values []sql.NullString) error
+	flush() error
+}
+
+type backupFormatT struct {
+	extension string
+	//gzipped formats are written through a gzip writer
+	gzipped   bool
+	newWriter func(w io.Writer) backupWriterT
+}
+
+//backupFormats are the formats JobsDB.backupFormat can be set to
+var backupFormats = map[string]backupFormatT{
+	"jsonl":   {extension: "jsonl.gz", gzipped: true, newWriter: newJSONLBackupWriter},
+	"csv":     {extension: "csv.gz", gzipped: true, newWriter: newCSVBackupWriter},
+	"parquet": {extension: "parquet", newWriter: newParquetBackupWriter},
+}
+
+//jsonlBackupWriterT writes one JSON object per row, in the same
+//shape as row_to_json
+type jsonlBackupWriterT struct {
+	w       io.Writer
+	columns []*sql.ColumnType
+}
+
+func newJSONLBackupWriter(w io.Writer) backupWriterT {
+	return &jsonlBackupWriterT{w: w}
+}
+
+func (writer *jsonlBackupWriterT) writeHeader(columns []*sql.ColumnType) error {
+	writer.columns = columns
+	return nil
+}
+
+func (writer *jsonlBackupWriterT) writeRow(values []sql.NullString) error {
+	row := make([]byte, 0, 256)
+	row = append(row, '{')
+	for i, column := range writer.columns {
+		if i > 0 {
+			row = append(row, ',')
+		}
+		name, err := json.Marshal(column.Name())
+		if err != nil {
+			return err
+		}
+		row = append(row, name...)
+		row = append(row, ':')
+		switch {
+		case !values[i].Valid:
+			row = append(row, "null"...)
+		case isRawJSONType(column.DatabaseTypeName()):
+			row = append(row, values[i].String...)
+		default:
+			value, err := json.Marshal(values[i].String)
+			if err != nil {
+				return err
+			}
+			row = append(row, value...)
+		}
+	}
+	row = append(row, '}', '\n')
+	_, err := writer.w.Write(row)
+	return err
+}
+
+func (writer *jsonlBackupWriterT) flush() error {
+	return nil
+}
+
+//isRawJSONType tells if the text of a column type is valid JSON as is
+func isRawJSONType(typeName string) bool {
+	switch typeName {
+	case "JSON", "JSONB", "INT2", "INT4", "INT8", "FLOAT4", "FLOAT8", "NUMERIC":
+		return true
+	}
+	return false
+}
+
+//csvBackupWriterT writes a header line of column names followed by
+//one line per row. NULLs are written as empty fields
+type csvBackupWriterT struct {
+	w *csv.Writer
+}
+
+func newCSVBackupWriter(w io.Writer) backupWriterT {
+	return &csvBackupWriterT{w: csv.NewWriter(w)}
+}
+
+func (writer *csvBackupWriterT) writeHeader(columns []*sql.ColumnType) error {
+	var names []string
+	for _, column := range columns {
+		names = append(names, column.Name())
+	}
+	return writer.w.Write(names)
+}
+
+func (writer *csvBackupWriterT) writeRow(values []sql.NullString) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = value.String
+	}
+	return writer.w.Write(record)
+}
+
+func (writer *csvBackupWriterT) flush() error {
+	writer.w.Flush()
+	return writer.w.Error()
+}
+
+//parquetBackupWriterT writes a Parquet file with a row group per fetch.
+//Every column is a nullable string
+type parquetBackupWriterT struct {
+	w      io.Writer
+	writer *parquet.WriterT
+}
+
+func newParquetBackupWriter(w io.Writer) backupWriterT {
+	return &parquetBackupWriterT{w: w}
+}
+
+func (writer *parquetBackupWriterT) writeHeader(columns []*sql.ColumnType) error {
+	var names []string
+	for _, column := range columns {
+		names = append(names, column.Name())
+	}
+	var err error
+	writer.writer, err = parquet.NewWriter(writer.w, names, backupFetchSize)
+	return err
+}
+
+func (writer *parquetBackupWriterT) writeRow(values []sql.NullString) error {
+	return writer.writer.WriteRow(values)
+}
+
+func (writer *parquetBackupWriterT) flush() error {
+	return writer.writer.Close()
+}
+
+/*
+SetBackupUploaders sets where the jobs and job status tables of dropped
+datasets are uploaded. Must be called before Setup for the uploaders
+to be used instead of the configured ones
+*/
+func (jd *HandleT) SetBackupUploaders(jobsFileUploader fileuploader.FileUploader, jobStatusFileUploader fileuploader.FileUploader) {
+	jd.jobsFileUploader = jobsFileUploader
+	jd.jobStatusFileUploader = jobStatusFileUploader
+}
+
+//setupBackupUploaders builds the uploaders from config unless they
+//have been set already
+func (jd *HandleT) setupBackupUploaders() {
+	var err error
+	if jd.jobsFileUploader == nil {
+		jd.jobsFileUploader, err = fileuploader.NewFileUploader(&fileuploader.SettingsT{
+			Provider:       backupProvider,
+			AmazonS3Bucket: config.GetEnv("JOBS_BACKUP_BUCKET", "dump-gateway-jobs-test"),
+			LocalDirectory: backupLocalDirectory,
+		})
+		jd.assertError(err)
+	}
+	if jd.jobStatusFileUploader == nil {
+		jd.jobStatusFileUploader, err = fileuploader.NewFileUploader(&fileuploader.SettingsT{
+			Provider:       backupProvider,
+			AmazonS3Bucket: config.GetEnv("JOB_STATUS_BACKUP_BUCKET", "dump-gateway-job-status-test"),
+			LocalDirectory: backupLocalDirectory,
+		})
+		jd.assertError(err)
+	}
+}
+
+//getBackupFormat returns the backup format of this jobsdb
+func (jd *HandleT) getBackupFormat() string {
+	return config.GetString("JobsDB."+jd.tablePrefix+".backupFormat", backupFormat)
+}
+
+func (jd *HandleT) backupTable(tableName string) (success bool, err error) {
+	formatName := jd.getBackupFormat()
+	format, ok := backupFormats[formatName]
+	if !ok {
+		return false, fmt.Errorf("unknown backup format %q", formatName)
+	}
+
+	pathPrefix := strings.TrimPrefix(tableName, "pre_drop_")
+	backupPathDirName := "/rudder-s3-dumps/"
+	tmpdirPath := strings.TrimSuffix(config.GetEnv("RUDDER_TMPDIR", ""), "/")
+	if tmpdirPath == "" {
+		tmpdirPath, err = os.UserHomeDir()
+		misc.AssertError(err)
+	}
+	path := fmt.Sprintf(`%v%v.%v`, tmpdirPath+backupPathDirName, pathPrefix, format.extension)
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	misc.AssertError(err)
+
+	backupFile, err := os.Create(path)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(path)
+	defer backupFile.Close()
+
+	err = jd.streamTable(tableName, backupFile, format)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = backupFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	if strings.HasPrefix(pathPrefix, fmt.Sprintf("%v_job_status_", jd.tablePrefix)) {
+		err = jd.jobStatusFileUploader.Upload(backupFile)
+	} else {
+		err = jd.jobsFileUploader.Upload(backupFile)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//streamTable writes all the rows of a table, fetched backupFetchSize
+//at a time through a cursor, into file (through a gzip writer for the
+//gzipped formats)
+func (jd *HandleT) streamTable(tableName string, file io.Writer, format backupFormatT) error {
+	bufWriter := bufio.NewWriter(file)
+	var gzipWriter *gzip.Writer
+	var writer backupWriterT
+	if format.gzipped {
+		gzipWriter = gzip.NewWriter(bufWriter)
+		writer = format.newWriter(gzipWriter)
+	} else {
+		writer = format.newWriter(bufWriter)
+	}
+
+	//Cursors only live inside a transaction
+	txn, err := jd.dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	//The first column is the primary key (job_id or id). Ordering by it
+	//lets a restore replay the statuses in the order they were added
+	_, err = txn.Exec(fmt.Sprintf(`DECLARE backup_cursor NO SCROLL CURSOR FOR SELECT * FROM %s ORDER BY 1`, tableName))
+	if err != nil {
+		return err
+	}
+
+	fetchStatement := fmt.Sprintf(`FETCH %d FROM backup_cursor`, backupFetchSize)
+	wroteHeader := false
+	for {
+		rows, err := txn.Query(fetchStatement)
+		if err != nil {
+			return err
+		}
+		if !wroteHeader {
+			columns, err := rows.ColumnTypes()
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			err = writer.writeHeader(columns)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			wroteHeader = true
+		}
+		fetched, err := jd.writeRows(rows, writer)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if fetched == 0 {
+			break
+		}
+	}
+
+	_, err = txn.Exec(`CLOSE backup_cursor`)
+	if err != nil {
+		return err
+	}
+	err = writer.flush()
+	if err != nil {
+		return err
+	}
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return bufWriter.Flush()
+}
+
+//writeRows writes the fetched rows. lib/pq returns BYTEA values as raw
+//bytes rather than their text form, so they are scanned as bytes and
+//base64 encoded: as strings they would not survive the text formats
+func (jd *HandleT) writeRows(rows *sql.Rows, writer backupWriterT) (int, error) {
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	values := make([]sql.NullString, len(columns))
+	byteValues := make([][]byte, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i, column := range columns {
+		if column.DatabaseTypeName() == "BYTEA" {
+			scanArgs[i] = &byteValues[i]
+		} else {
+			scanArgs[i] = &values[i]
+		}
+	}
+
+	fetched := 0
+	for rows.Next() {
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			return fetched, err
+		}
+		for i, column := range columns {
+			if column.DatabaseTypeName() == "BYTEA" {
+				values[i] = sql.NullString{
+					String: base64.StdEncoding.EncodeToString(byteValues[i]),
+					Valid:  byteValues[i] != nil,
+				}
+			}
+		}
+		err = writer.writeRow(values)
+		if err != nil {
+			return fetched, err
+		}
+		fetched++
+	}
+	return fetched, rows.Err()
+}
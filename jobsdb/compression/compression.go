@@ -0,0 +1,82 @@
+/*
+Package compression encodes the event payloads jobsdb stores compressed.
+An encoded payload starts with the version of the codec which wrote it,
+so payloads written by any codec registered here stay readable whatever
+codec is configured afterwards.
+*/
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+//CodecT compresses payloads. Version is written as the first byte of
+//every payload it encodes and must never be reused
+type CodecT struct {
+	Name       string
+	Version    byte
+	compress   func(payload []byte) ([]byte, error)
+	decompress func(data []byte) ([]byte, error)
+}
+
+var codecs = []*CodecT{
+	{Name: "gzip", Version: 1, compress: gzipCompress, decompress: gzipDecompress},
+}
+
+//Lookup returns the codec registered with name
+func Lookup(name string) (*CodecT, bool) {
+	for _, codec := range codecs {
+		if codec.Name == name {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+//Encode compresses payload and prefixes it with the codec version
+func (codec *CodecT) Encode(payload []byte) ([]byte, error) {
+	compressed, err := codec.compress(payload)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.Version}, compressed...), nil
+}
+
+//Decode decompresses a payload written by Encode of any codec
+func Decode(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("compression: empty payload")
+	}
+	for _, codec := range codecs {
+		if codec.Version == data[0] {
+			return codec.decompress(data[1:])
+		}
+	}
+	return nil, fmt.Errorf("compression: unknown version %d", data[0])
+}
+
+func gzipCompress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(payload)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,90 @@
+package compression_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/jobsdb/compression"
+)
+
+//gatewayPayload is a gateway batch of n similar events
+func gatewayPayload(n int) []byte {
+	var events []string
+	for i := 0; i < n; i++ {
+		events = append(events, fmt.Sprintf(`{"anonymousId":"anon-%[1]d","channel":"web","context":{"app":{"build":"1.0.0","name":"RudderLabs JavaScript SDK","version":"1.0.5"},"library":{"name":"RudderLabs JavaScript SDK","version":"1.0.5"},"locale":"en-US","os":{"name":"","version":""},"page":{"path":"/products/%[1]d","referrer":"https://www.google.com/","title":"Product %[1]d","url":"https://example.com/products/%[1]d"},"screen":{"density":2},"userAgent":"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.97 Safari/537.36"},"event":"Product Viewed","integrations":{"All":true},"messageId":"msg-%[1]d","originalTimestamp":"2019-11-20T10:15:%02[2]d.123Z","properties":{"category":"Games","price":%[1]d.99,"product_id":"prod-%[1]d"},"type":"track","userId":"user-%[3]d"}`, i, i%60, i%10))
+	}
+	return []byte(`{"batch":[` + strings.Join(events, ",") + `],"writeKey":"1TGx2tkDQAVSGFaZUHHJdbqC7ab","requestIP":"127.0.0.1"}`)
+}
+
+var _ = Describe("Compression", func() {
+
+	It("looks up the registered codecs", func() {
+		codec, ok := compression.Lookup("gzip")
+		Expect(ok).To(BeTrue())
+		Expect(codec.Version).To(Equal(byte(1)))
+
+		_, ok = compression.Lookup("lz4")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("decodes what it encodes", func() {
+		codec, _ := compression.Lookup("gzip")
+		payload := gatewayPayload(10)
+		encoded, err := codec.Encode(payload)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(encoded[0]).To(Equal(codec.Version))
+		Expect(len(encoded)).To(BeNumerically("<", len(payload)/2))
+
+		decoded, err := compression.Decode(encoded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(payload))
+	})
+
+	It("rejects unknown versions and empty payloads", func() {
+		_, err := compression.Decode([]byte{0xff, 1, 2})
+		Expect(err).To(HaveOccurred())
+		_, err = compression.Decode(nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+//BenchmarkPlainJSON is what storing in JSONB costs the client: the
+//payload is only validated and sent as is
+func BenchmarkPlainJSON(b *testing.B) {
+	payload := gatewayPayload(20)
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		if !json.Valid(payload) {
+			b.Fatal("invalid payload")
+		}
+	}
+	b.ReportMetric(1, "ratio")
+}
+
+func BenchmarkGzipEncode(b *testing.B) {
+	codec, _ := compression.Lookup("gzip")
+	payload := gatewayPayload(20)
+	var encoded []byte
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		encoded, _ = codec.Encode(payload)
+	}
+	b.ReportMetric(float64(len(encoded))/float64(len(payload)), "ratio")
+}
+
+func BenchmarkGzipDecode(b *testing.B) {
+	codec, _ := compression.Lookup("gzip")
+	payload := gatewayPayload(20)
+	encoded, _ := codec.Encode(payload)
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		_, err := compression.Decode(encoded)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Dead letter queue for aborted jobs. A HandleT can be given a dead letter
+jobsdb (SetDeadLetterDB). Whenever a job of that HandleT is marked aborted,
+it is copied into the dead letter jobsdb with the same custom_val (the
+destination) along with its status history, in the transaction of the
+aborted status, be it set by UpdateJobStatus, job expiry or an admin
+transition. The copies stay unprocessed
+until they are requeued into the jobsdb they came from, so they survive
+the migration of the original dataset. Requeueing them stores them back
+and marks them succeeded in one transaction too.
+*/
+
+package jobsdb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+	uuid "github.com/satori/go.uuid"
+)
+
+//deadLetterParamsT is stored as the parameters of a dead letter job.
+//source_id is kept at the top level so that the usual filters work
+type deadLetterParamsT struct {
+	SourceID           string          `json:"source_id"`
+	OriginalPrefix     string          `json:"original_prefix"`
+	OriginalJobID      int64           `json:"original_job_id"`
+	OriginalParameters json.RawMessage `json:"original_parameters"`
+	LastErrorResponse  json.RawMessage `json:"last_error_response"`
+	Attempts           []*JobStatusT   `json:"attempts"`
+}
+
+/*
+SetDeadLetterDB makes jd copy its aborted jobs into deadLetterDB
+*/
+func (jd *HandleT) SetDeadLetterDB(deadLetterDB *HandleT) {
+	jd.assert(deadLetterDB != jd)
+	jd.deadLetterDB = deadLetterDB
+}
+
+/*
+copyToDeadLetterDS copies the jobs (along with all their statuses) from a
+dataset into the dead letter jobsdb, as part of txn, the transaction which
+marks them aborted. It returns the copies, to be passed to
+deadLettersStored once txn is committed. The caller holds the dsListLock
+of the dead letter jobsdb until then
+*/
+func (jd *HandleT) copyToDeadLetterDS(txn *sql.Tx, ds dataSetT, jobIDs []int64) []*JobT {
+
+	if len(jobIDs) == 0 {
+		return nil
+	}
+
+	sqlStatement := fmt.Sprintf(`SELECT job_id, job_state, attempt, exec_time, retry_time,
+                                   error_code, error_response FROM %s WHERE job_id = ANY($1) ORDER BY id`,
+		ds.JobStatusTable)
+	rows, err := txn.Query(sqlStatement, pq.Array(jobIDs))
+	jd.assertError(err)
+	attemptsMap := map[int64][]*JobStatusT{}
+	for rows.Next() {
+		var status JobStatusT
+		err = rows.Scan(&status.JobID, &status.JobState, &status.AttemptNum, &status.ExecTime,
+			&status.RetryTime, &status.ErrorCode, &status.ErrorResponse)
+		jd.assertError(err)
+		attemptsMap[status.JobID] = append(attemptsMap[status.JobID], &status)
+	}
+	rows.Close()
+
+	sqlStatement = fmt.Sprintf(`SELECT job_id, parameters, custom_val, partition_key, event_payload,
+                                  event_payload_compressed FROM %s WHERE job_id = ANY($1) ORDER BY job_id`, ds.JobTable)
+	rows, err = txn.Query(sqlStatement, pq.Array(jobIDs))
+	jd.assertError(err)
+
+	var deadLetterList []*JobT
+	for rows.Next() {
+		var job JobT
+		var payload payloadScanT
+		err = rows.Scan(&job.JobID, &job.Parameters, &job.CustomVal, &job.PartitionKey, &payload.plain, &payload.compressed)
+		jd.assertError(err)
+		job.EventPayload = jd.decodePayload(&payload)
+
+		var originalParams struct {
+			SourceID string `json:"source_id"`
+		}
+		json.Unmarshal(job.Parameters, &originalParams)
+
+		attempts := attemptsMap[job.JobID]
+		params := deadLetterParamsT{
+			SourceID:           originalParams.SourceID,
+			OriginalPrefix:     jd.tablePrefix,
+			OriginalJobID:      job.JobID,
+			OriginalParameters: job.Parameters,
+			LastErrorResponse:  json.RawMessage(`{}`),
+			Attempts:           attempts,
+		}
+		if len(attempts) > 0 && len(attempts[len(attempts)-1].ErrorResponse) > 0 {
+			params.LastErrorResponse = attempts[len(attempts)-1].ErrorResponse
+		}
+		paramsJSON, err := json.Marshal(params)
+		jd.assertError(err)
+
+		deadLetterList = append(deadLetterList, &JobT{
+			UUID:         uuid.NewV4(),
+			Parameters:   paramsJSON,
+			CreatedAt:    time.Now(),
+			ExpireAt:     time.Now(),
+			CustomVal:    job.CustomVal,
+			PartitionKey: job.PartitionKey,
+			EventPayload: job.EventPayload,
+		})
+	}
+	rows.Close()
+
+	if len(deadLetterList) == 0 {
+		return nil
+	}
+	logger.Debugf("Copying %d aborted %s jobs to dead letter queue", len(deadLetterList), jd.tablePrefix)
+	deadLetterDSList := jd.deadLetterDB.getDSList(false)
+	err = jd.deadLetterDB.copyJobsInTxn(txn, deadLetterDSList[len(deadLetterDSList)-1], false, deadLetterList)
+	jd.assertError(err)
+	return deadLetterList
+}
+
+//deadLettersStored clears the empty result cache of the dead letter
+//jobsdb and wakes up its subscribers once the copies are committed. The
+//caller holds the dsListLock
+func (jd *HandleT) deadLettersStored(deadLetterList []*JobT) {
+	if len(deadLetterList) == 0 {
+		return
+	}
+	dsList := jd.getDSList(false)
+	jd.markClearEmptyResult(dsList[len(dsList)-1], []string{}, []string{}, false)
+	jd.publishJobs(deadLetterList)
+}
+
+/*
+GetDeadLetters returns the jobs in a dead letter jobsdb which haven't been
+requeued yet. It must be called on the dead letter HandleT
+*/
+func (jd *HandleT) GetDeadLetters(customValFilters []string, count int) []*JobT {
+	return jd.GetUnprocessed(customValFilters, count)
+}
+
+/*
+RequeueDeadLetters stores the dead letter jobs back into the jobsdb they
+were aborted in, as new jobs, and marks them succeeded in the dead letter
+jobsdb, all in one transaction, so a job is never requeued twice. It must
+be called on the dead letter HandleT
+*/
+func (jd *HandleT) RequeueDeadLetters(jobList []*JobT) error {
+
+	if len(jobList) == 0 {
+		return nil
+	}
+	requeueMap := map[string][]*JobT{}
+	var statusList []*JobStatusT
+	for _, job := range jobList {
+		var params deadLetterParamsT
+		err := json.Unmarshal(job.Parameters, &params)
+		if err != nil || params.OriginalPrefix == "" {
+			return fmt.Errorf("job %d is not a dead letter job", job.JobID)
+		}
+		if _, ok := getRegisteredHandle(params.OriginalPrefix); !ok {
+			return fmt.Errorf("jobsdb %q of job %d is not set up", params.OriginalPrefix, job.JobID)
+		}
+		requeueMap[params.OriginalPrefix] = append(requeueMap[params.OriginalPrefix], &JobT{
+			UUID:         uuid.NewV4(),
+			Parameters:   params.OriginalParameters,
+			CreatedAt:    time.Now(),
+			ExpireAt:     time.Now(),
+			CustomVal:    job.CustomVal,
+			PartitionKey: job.PartitionKey,
+			EventPayload: job.EventPayload,
+		})
+		statusList = append(statusList, &JobStatusT{
+			JobID:         job.JobID,
+			JobState:      SucceededState,
+			AttemptNum:    1,
+			ExecTime:      time.Now(),
+			RetryTime:     time.Now(),
+			ErrorCode:     "",
+			ErrorResponse: []byte(`{"reason":"requeued"}`),
+		})
+	}
+	sort.Slice(statusList, func(i, j int) bool {
+		return statusList[i].JobID < statusList[j].JobID
+	})
+
+	//The original jobsdbs are locked before the dead letter one, as when
+	//aborted jobs are copied, so that the two can't deadlock
+	var prefixes []string
+	for prefix := range requeueMap {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		originalDB, _ := getRegisteredHandle(prefix)
+		originalDB.dsListLock.RLock()
+		defer originalDB.dsListLock.RUnlock()
+	}
+	jd.dsMigrationLock.RLock()
+	jd.dsListLock.RLock()
+	defer jd.dsMigrationLock.RUnlock()
+	defer jd.dsListLock.RUnlock()
+
+	txn, err := jd.dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	//Like Store, the requeued jobs go to the last dataset
+	originalDSMap := map[string]dataSetT{}
+	for _, prefix := range prefixes {
+		originalDB, _ := getRegisteredHandle(prefix)
+		originalDSList := originalDB.getDSList(false)
+		originalDSMap[prefix] = originalDSList[len(originalDSList)-1]
+		err = originalDB.copyJobsInTxn(txn, originalDSMap[prefix], false, requeueMap[prefix])
+		if err != nil {
+			txn.Rollback()
+			return fmt.Errorf("requeueing into %s: %v", prefix, err)
+		}
+	}
+	dsStatusList := jd.statusesByDS(statusList)
+	for _, dsStatus := range dsStatusList {
+		jd.writeJobStatusInTxn(txn, dsStatus.ds, dsStatus.statusList)
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range prefixes {
+		originalDB, _ := getRegisteredHandle(prefix)
+		originalDB.markClearEmptyResult(originalDSMap[prefix], []string{}, []string{}, false)
+		originalDB.publishJobs(requeueMap[prefix])
+		logger.Infof("Requeued %d dead letter jobs into %s", len(requeueMap[prefix]), prefix)
+	}
+	for _, dsStatus := range dsStatusList {
+		jd.markClearEmptyResult(dsStatus.ds, []string{SucceededState}, []string{}, false)
+	}
+	jd.publish([]string{})
+	return nil
+}
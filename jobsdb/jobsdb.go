@@ -2,7 +2,9 @@
 Implementation of JobsDB for keeping track of jobs (type JobT) and job status
 (type JobStatusT). Jobs are stored in jobs_%d table while job status is stored
 in job_status_%d table. Each such table pair (e.g. jobs_1, job_status_1) is called
-a dataset (type dataSetT). After a dataset grows beyond a size, a new dataset is
+a dataset (type dataSetT). The latest status of every job is also kept in
+job_last_status_%d (updated along with job_status) so that reads don't have to
+scan the whole status history. After a dataset grows beyond a size, a new dataset is
 created and jobs are written to a new dataset. When most of the jobs from a dataset
 have been processed, we migrate the remaining jobs to a new intermediate
 dataset and delete the old dataset. The range of job ids in a dataset are tracked
@@ -18,7 +20,6 @@ mostly serviced from memory cache.
 package jobsdb
 
 import (
-	"compress/gzip"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -38,6 +39,8 @@ import (
 
 	"github.com/bugsnag/bugsnag-go"
 	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/jobsdb/compression"
+	"github.com/rudderlabs/rudder-server/jobsdb/querybuilder"
 	"github.com/rudderlabs/rudder-server/services/fileuploader"
 	"github.com/rudderlabs/rudder-server/utils/misc"
 
@@ -65,6 +68,8 @@ type JobStatusT struct {
 JobT is the basic type for creating jobs. The JobID is generated
 by the system and LastJobStatus is populated when reading a processed
 job  while rest should be set by the user.
+PartitionKey is an optional ordering key (e.g. the userId). Jobs with
+the same key are expected to be processed in JobID order
 */
 type JobT struct {
 	UUID          uuid.UUID
@@ -72,22 +77,80 @@ type JobT struct {
 	CreatedAt     time.Time
 	ExpireAt      time.Time
 	CustomVal     string
+	PartitionKey  string
 	EventPayload  json.RawMessage
 	LastJobStatus JobStatusT
 	Parameters    json.RawMessage
 }
 
+/*
+QueryFiltersT restricts the jobs returned by GetUnprocessedWithFilters
+and GetProcessedWithFilters. Empty lists and zero times don't filter
+*/
+type QueryFiltersT struct {
+	CustomVals     []string
+	PartitionKeys  []string
+	SourceIDs      []string
+	DestinationIDs []string
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	//JobIDAfter pages through the jobs by job_id
+	JobIDAfter int64
+
+	//withPaused returns the jobs of paused custom_vals too
+	withPaused bool
+}
+
+func (filters QueryFiltersT) empty() bool {
+	return filters.cacheable() && len(filters.CustomVals) == 0
+}
+
+//cacheable tells if the filters are only on custom_val, which is what
+//the empty result cache is keyed by
+func (filters QueryFiltersT) cacheable() bool {
+	return len(filters.PartitionKeys) == 0 && len(filters.SourceIDs) == 0 &&
+		len(filters.DestinationIDs) == 0 && filters.CreatedAfter.IsZero() && filters.CreatedBefore.IsZero() &&
+		filters.JobIDAfter == 0
+}
+
+//applyFilters adds the filters and leaves out the paused jobs. It tells
+//if an empty result can be cached
+func (jd *HandleT) applyFilters(query *querybuilder.QueryT, filters QueryFiltersT, jobTable string) bool {
+	filters.apply(query, jobTable)
+	if filters.withPaused {
+		return filters.cacheable()
+	}
+	excluded := jd.excludePaused(query, jobTable, filters.CustomVals)
+	return filters.cacheable() && !excluded
+}
+
+func (filters QueryFiltersT) apply(query *querybuilder.QueryT, jobTable string) {
+	query.AnyOf(jobTable+".custom_val", filters.CustomVals).
+		AnyOf(jobTable+".partition_key", filters.PartitionKeys).
+		JSONAnyOf(jobTable+".parameters", "source_id", filters.SourceIDs).
+		JSONAnyOf(jobTable+".parameters", "destination_id", filters.DestinationIDs).
+		After(jobTable+".created_at", filters.CreatedAfter).
+		Before(jobTable+".created_at", filters.CreatedBefore).
+		AfterID(jobTable+".job_id", filters.JobIDAfter)
+}
+
 /*
 TransformationErrorT is for storing transformation errors.
 */
 type TransformationErrorT struct {
-	UUID         uuid.UUID
-	JobID        int64
-	SourceID     string
-	EventPayload json.RawMessage
-	Parameters   json.RawMessage
-	CreatedAt    time.Time
-	ExpireAt     time.Time
+	UUID            uuid.UUID
+	JobID           int64
+	SourceID        string
+	DestinationID   string
+	DestinationType string
+	Stage           string
+	ErrorResponse   string
+	EventPayload    json.RawMessage
+	Parameters      json.RawMessage
+	CreatedAt       time.Time
+	ExpireAt        time.Time
+	//Why its last retry was skipped, empty if it wasn't
+	SkipReason string
 }
 
 //The struct fields need to be exposed to JSON package
@@ -120,6 +183,15 @@ type HandleT struct {
 	toBackup              bool
 	jobsFileUploader      fileuploader.FileUploader
 	jobStatusFileUploader fileuploader.FileUploader
+	deadLetterDB          *HandleT
+	notifier              notifierT
+	retentionPolicy       RetentionPolicyT
+	retentionLock         sync.RWMutex
+	ingestionPaused       int32
+	stats                 jobsDBStatsT
+	replicas              replicasT
+	payloadCodec          *compression.CodecT
+	paused                pausedT
 }
 
 //The struct which is written to the journal
@@ -134,7 +206,8 @@ type StoreJobRespT struct {
 }
 
 var dbErrorMap = map[string]string{
-	"Invalid JSON": "22P02",
+	"Invalid JSON":    "22P02",
+	"Undefined Table": "42P01",
 }
 
 //Some helper functions
@@ -224,6 +297,13 @@ func loadConfig() {
 	mainCheckSleepDuration = (config.GetDuration("JobsDB.mainCheckSleepDurationInS", time.Duration(2)) * time.Second)
 	backupCheckSleepDuration = (config.GetDuration("JobsDB.backupCheckSleepDurationIns", time.Duration(2)) * time.Second)
 	useJoinForUnprocessed = config.GetBool("JobsDB.useJoinForUnprocessed", true)
+	loadAdminConfig()
+	loadNotifyConfig()
+	loadBackupConfig()
+	loadRetentionConfig()
+	loadMetricsConfig()
+	loadReplicaConfig()
+	loadPauseConfig()
 }
 
 func init() {
@@ -256,9 +336,13 @@ func (jd *HandleT) Setup(clearAll bool, tablePrefix string, retentionPeriod time
 	jd.dsRetentionPeriod = retentionPeriod
 	jd.toBackup = toBackup
 	jd.dsEmptyResultCache = map[dataSetT]map[string]map[string]bool{}
+	jd.retentionPolicy = loadRetentionPolicy(tablePrefix)
+	jd.setupPayloadCodec()
+	jd.setupStats()
 
 	jd.dbHandle, err = sql.Open("postgres", psqlInfo)
 	jd.assertError(err)
+	setupPool(jd.dbHandle)
 
 	logger.Info("Connected to DB")
 	err = jd.dbHandle.Ping()
@@ -266,17 +350,21 @@ func (jd *HandleT) Setup(clearAll bool, tablePrefix string, retentionPeriod time
 
 	logger.Info("Sent Ping")
 
+	jd.setupReplicas()
+
 	//Kill any pending queries
 	jd.terminateQueries()
 
 	if clearAll {
 		jd.dropAllDS()
 		jd.delJournal()
+		jd.dropPauseTable()
 		jd.dropAllBackupDS()
 	}
 
 	jd.setupEnumTypes()
 	jd.setupJournal()
+	jd.setupPauseTable()
 	jd.recoverFromJournal()
 
 	//Refresh in memory list. We don't take lock
@@ -285,31 +373,41 @@ func (jd *HandleT) Setup(clearAll bool, tablePrefix string, retentionPeriod time
 	jd.getDSList(true)
 	jd.getDSRangeList(true)
 
+	//Datasets created by older versions don't have the
+	//partition_key column, the last status table or
+	//the compressed payload column
+	for _, ds := range jd.datasetList {
+		jd.addPartitionKeyColumn(ds)
+		jd.setupLastStatusTable(ds)
+		jd.addCompressedPayloadColumn(ds)
+	}
+
 	//If no DS present, add one
 	if len(jd.datasetList) == 0 {
 		jd.addNewDS(true, dataSetT{})
 	}
 
 	if jd.toBackup {
-		jd.jobsFileUploader, err = fileuploader.NewFileUploader(&fileuploader.SettingsT{
-			Provider:       "s3",
-			AmazonS3Bucket: config.GetEnv("JOBS_BACKUP_BUCKET", "dump-gateway-jobs-test"),
-		})
-		jd.assertError(err)
-		jd.jobStatusFileUploader, err = fileuploader.NewFileUploader(&fileuploader.SettingsT{
-			Provider:       "s3",
-			AmazonS3Bucket: config.GetEnv("JOB_STATUS_BACKUP_BUCKET", "dump-gateway-job-status-test"),
-		})
-		jd.assertError(err)
+		jd.setupBackupUploaders()
 		go jd.backupDSLoop()
 	}
+	registerHandle(jd)
+	jd.setupNotifier()
 	go jd.mainCheckLoop()
+	go jd.abortExpiredLoop()
+	if maxDiskUsageInMB > 0 {
+		go jd.diskUsageLoop()
+	}
 }
 
 /*
 TearDown releases all the resources
 */
 func (jd *HandleT) TearDown() {
+	if jd.notifier.listener != nil {
+		jd.notifier.listener.Close()
+	}
+	jd.closeReplicas()
 	jd.dbHandle.Close()
 }
 
@@ -484,25 +582,22 @@ func (jd *HandleT) checkIfMigrateDS(ds dataSetT) (bool, int) {
 	var delCount, totalCount, statusCount int
 
 	sqlStatement := fmt.Sprintf(`SELECT COUNT(*) FROM %s`, ds.JobTable)
-	row := jd.dbHandle.QueryRow(sqlStatement)
-	err := row.Scan(&totalCount)
+	err := jd.readQueryRow(sqlStatement, nil, &totalCount)
 	jd.assertError(err)
 
 	//Jobs which have either succeded or expired
-	sqlStatement = fmt.Sprintf(`SELECT COUNT(DISTINCT(id))
+	sqlStatement = fmt.Sprintf(`SELECT COUNT(*)
                                       FROM %s
                                       WHERE job_state = '%s' OR
                                             job_state = '%s'`,
-		ds.JobStatusTable, SucceededState, AbortedState)
-	row = jd.dbHandle.QueryRow(sqlStatement)
-	err = row.Scan(&delCount)
+		jd.lastStatusTableName(ds), SucceededState, AbortedState)
+	err = jd.readQueryRow(sqlStatement, nil, &delCount)
 	jd.assertError(err)
 
 	//Total number of job status. If this table grows too big (e.g. lot of retries)
 	//we migrate to a new table and get rid of old job status
 	sqlStatement = fmt.Sprintf(`SELECT COUNT(*) FROM %s`, ds.JobStatusTable)
-	row = jd.dbHandle.QueryRow(sqlStatement)
-	err = row.Scan(&statusCount)
+	err = jd.readQueryRow(sqlStatement, nil, &statusCount)
 	jd.assertError(err)
 
 	if totalCount == 0 {
@@ -515,14 +610,18 @@ func (jd *HandleT) checkIfMigrateDS(ds dataSetT) (bool, int) {
 
 	var lastUpdate time.Time
 	sqlStatement = fmt.Sprintf(`SELECT MAX(created_at) FROM %s`, ds.JobTable)
-	row = jd.dbHandle.QueryRow(sqlStatement)
-	err = row.Scan(&lastUpdate)
+	err = jd.readQueryRow(sqlStatement, nil, &lastUpdate)
 	jd.assertError(err)
 
 	if jd.dsRetentionPeriod > time.Duration(0) && time.Since(lastUpdate) < jd.dsRetentionPeriod {
 		return false, totalCount - delCount
 	}
 
+	//Same for the custom_vals with their own retention
+	if jd.checkCustomValRetentionDS(ds) {
+		return false, totalCount - delCount
+	}
+
 	if (float64(delCount)/float64(totalCount) > jobDoneMigrateThres) ||
 		(float64(statusCount)/float64(totalCount) > jobStatusMigrateThres) {
 		return true, totalCount - delCount
@@ -535,8 +634,7 @@ func (jd *HandleT) checkIfFullDS(ds dataSetT) bool {
 	var totalCount int
 
 	sqlStatement := fmt.Sprintf(`SELECT COUNT(*) FROM %s`, ds.JobTable)
-	row := jd.dbHandle.QueryRow(sqlStatement)
-	err := row.Scan(&totalCount)
+	err := jd.readQueryRow(sqlStatement, nil, &totalCount)
 	jd.assertError(err)
 
 	if totalCount > maxDSSize {
@@ -581,6 +679,94 @@ func (jd *HandleT) createTableNames(dsIdx string) (string, string) {
 	return jobTable, jobStatusTable
 }
 
+//lastStatusTableName returns the table holding the latest status of
+//each job of the dataset
+func (jd *HandleT) lastStatusTableName(ds dataSetT) string {
+	return strings.Replace(ds.JobStatusTable, "job_status", "job_last_status", 1)
+}
+
+func (jd *HandleT) createLastStatusTable(ds dataSetT) {
+	sqlStatement := fmt.Sprintf(`CREATE TABLE %s (
+                                     job_id BIGINT PRIMARY KEY,
+                                     status_id BIGINT NOT NULL,
+                                     job_state job_state_type,
+                                     attempt SMALLINT,
+                                     exec_time TIMESTAMP,
+                                     retry_time TIMESTAMP,
+                                     error_code VARCHAR(32),
+                                     error_response JSONB);`, jd.lastStatusTableName(ds))
+	_, err := jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+
+	sqlStatement = fmt.Sprintf(`CREATE INDEX %[1]s_state_idx ON %[1]s (job_state)`, jd.lastStatusTableName(ds))
+	_, err = jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+}
+
+//setupLastStatusTable creates the last status table of a dataset
+//written by an older version and fills it from the status history
+func (jd *HandleT) setupLastStatusTable(ds dataSetT) {
+	var exists bool
+	err := jd.dbHandle.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, jd.lastStatusTableName(ds)).Scan(&exists)
+	jd.assertError(err)
+	if exists {
+		return
+	}
+	logger.Info("Creating last status table for", ds)
+	jd.createLastStatusTable(ds)
+
+	txn, err := jd.dbHandle.Begin()
+	jd.assertError(err)
+	jd.updateLastStatus(txn, ds, 0)
+	err = txn.Commit()
+	jd.assertError(err)
+}
+
+//updateLastStatus copies the latest of the statuses with id > afterID
+//into the last status table. A status never overwrites a newer one
+func (jd *HandleT) updateLastStatus(txn *sql.Tx, ds dataSetT, afterID int64) {
+	sqlStatement := fmt.Sprintf(`INSERT INTO %[1]s (job_id, status_id, job_state, attempt, exec_time,
+                                       retry_time, error_code, error_response)
+                                     SELECT DISTINCT ON (job_id) job_id, id, job_state, attempt, exec_time,
+                                       retry_time, error_code, error_response
+                                     FROM %[2]s WHERE id > $1 ORDER BY job_id, id DESC
+                                   ON CONFLICT (job_id) DO UPDATE SET
+                                     status_id=EXCLUDED.status_id, job_state=EXCLUDED.job_state,
+                                     attempt=EXCLUDED.attempt, exec_time=EXCLUDED.exec_time,
+                                     retry_time=EXCLUDED.retry_time, error_code=EXCLUDED.error_code,
+                                     error_response=EXCLUDED.error_response
+                                   WHERE %[1]s.status_id < EXCLUDED.status_id`,
+		jd.lastStatusTableName(ds), ds.JobStatusTable)
+	_, err := txn.Exec(sqlStatement, afterID)
+	jd.assertError(err)
+}
+
+//maxStatusID returns the id of the newest status visible to txn
+func (jd *HandleT) maxStatusID(txn *sql.Tx, ds dataSetT) int64 {
+	var maxID int64
+	sqlStatement := fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) FROM %s`, ds.JobStatusTable)
+	err := txn.QueryRow(sqlStatement).Scan(&maxID)
+	jd.assertError(err)
+	return maxID
+}
+
+func (jd *HandleT) createPartitionKeyIndex(ds dataSetT) {
+	sqlStatement := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %[1]s_partition_key_idx
+                                      ON %[1]s (custom_val, partition_key, job_id)`, ds.JobTable)
+	_, err := jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+}
+
+//addPartitionKeyColumn upgrades a dataset created before jobs had a
+//partition key. Existing jobs get an empty key
+func (jd *HandleT) addPartitionKeyColumn(ds dataSetT) {
+	sqlStatement := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS partition_key TEXT NOT NULL DEFAULT ''`,
+		ds.JobTable)
+	_, err := jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+	jd.createPartitionKeyIndex(ds)
+}
+
 func (jd *HandleT) addNewDS(appendLast bool, insertBeforeDS dataSetT) dataSetT {
 
 	//Get the max index
@@ -631,30 +817,7 @@ func (jd *HandleT) addNewDS(appendLast bool, insertBeforeDS dataSetT) dataSetT {
 	opID := jd.journalMarkStart(addDSOperation, opPayload)
 	defer jd.journalMarkDone(opID)
 
-	//Create the jobs and job_status tables
-	sqlStatement := fmt.Sprintf(`CREATE TABLE %s (
-                                      job_id BIGSERIAL PRIMARY KEY,
-                                      uuid UUID NOT NULL,
-									  parameters JSONB NOT NULL,
-                                      custom_val VARCHAR(64) NOT NULL,
-                                      event_payload JSONB NOT NULL,
-                                      created_at TIMESTAMP NOT NULL,
-                                      expire_at TIMESTAMP NOT NULL);`, newDS.JobTable)
-
-	_, err = jd.dbHandle.Exec(sqlStatement)
-	jd.assertError(err)
-
-	sqlStatement = fmt.Sprintf(`CREATE TABLE %s (
-                                     id BIGSERIAL PRIMARY KEY,
-                                     job_id INT REFERENCES %s(job_id),
-                                     job_state job_state_type,
-                                     attempt SMALLINT,
-                                     exec_time TIMESTAMP,
-                                     retry_time TIMESTAMP,
-                                     error_code VARCHAR(32),
-                                     error_response JSONB);`, newDS.JobStatusTable, newDS.JobTable)
-	_, err = jd.dbHandle.Exec(sqlStatement)
-	jd.assertError(err)
+	jd.createDS(newDS)
 
 	if appendLast {
 		//Refresh the in-memory list. We only need to refresh the
@@ -671,7 +834,7 @@ func (jd *HandleT) addNewDS(appendLast bool, insertBeforeDS dataSetT) dataSetT {
 		if len(dRangeList) > 0 {
 			newDSMin := dRangeList[len(dRangeList)-1].maxJobID
 			jd.assert(newDSMin > 0)
-			sqlStatement = fmt.Sprintf(`SELECT setval('%s_jobs_%s_job_id_seq', %d)`,
+			sqlStatement := fmt.Sprintf(`SELECT setval('%s_jobs_%s_job_id_seq', %d)`,
 				jd.tablePrefix, newDSIdx, newDSMin)
 			_, err = jd.dbHandle.Exec(sqlStatement)
 			jd.assertError(err)
@@ -683,6 +846,40 @@ func (jd *HandleT) addNewDS(appendLast bool, insertBeforeDS dataSetT) dataSetT {
 	return newDS
 }
 
+//createDS creates the jobs, job_status and last status tables of a dataset
+func (jd *HandleT) createDS(ds dataSetT) {
+
+	sqlStatement := fmt.Sprintf(`CREATE TABLE %s (
+                                      job_id BIGSERIAL PRIMARY KEY,
+                                      uuid UUID NOT NULL,
+									  parameters JSONB NOT NULL,
+                                      custom_val VARCHAR(64) NOT NULL,
+                                      partition_key TEXT NOT NULL DEFAULT '',
+                                      event_payload JSONB,
+                                      event_payload_compressed BYTEA,
+                                      created_at TIMESTAMP NOT NULL,
+                                      expire_at TIMESTAMP NOT NULL);`, ds.JobTable)
+
+	_, err := jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+
+	jd.createPartitionKeyIndex(ds)
+
+	sqlStatement = fmt.Sprintf(`CREATE TABLE %s (
+                                     id BIGSERIAL PRIMARY KEY,
+                                     job_id INT REFERENCES %s(job_id),
+                                     job_state job_state_type,
+                                     attempt SMALLINT,
+                                     exec_time TIMESTAMP,
+                                     retry_time TIMESTAMP,
+                                     error_code VARCHAR(32),
+                                     error_response JSONB);`, ds.JobStatusTable, ds.JobTable)
+	_, err = jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+
+	jd.createLastStatusTable(ds)
+}
+
 //Drop a dataset
 func (jd *HandleT) dropDS(ds dataSetT, allowMissing bool) {
 
@@ -691,6 +888,9 @@ func (jd *HandleT) dropDS(ds dataSetT, allowMissing bool) {
 	//happens during recovering from failed migration.
 	//For every other case, the table must exist
 	var sqlStatement string
+	//Backed up datasets don't have a last status table (see renameDS)
+	jd.dropLastStatusTable(ds)
+
 	if allowMissing {
 		sqlStatement = fmt.Sprintf(`DROP TABLE IF EXISTS %s`, ds.JobStatusTable)
 	} else {
@@ -708,9 +908,19 @@ func (jd *HandleT) dropDS(ds dataSetT, allowMissing bool) {
 	jd.assertError(err)
 }
 
-//Rename a dataset
+func (jd *HandleT) dropLastStatusTable(ds dataSetT) {
+	sqlStatement := fmt.Sprintf(`DROP TABLE IF EXISTS %s`, jd.lastStatusTableName(ds))
+	_, err := jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+}
+
+//Rename a dataset. Only jobs and job_status are backed up
+//so the last status table is dropped
 func (jd *HandleT) renameDS(ds dataSetT, allowMissing bool) {
 	var sqlStatement string
+
+	jd.dropLastStatusTable(ds)
+
 	var renamedJobStatusTable = fmt.Sprintf(`pre_drop_%s`, ds.JobStatusTable)
 	var renamedJobTable = fmt.Sprintf(`pre_drop_%s`, ds.JobTable)
 
@@ -809,13 +1019,16 @@ over. Then the status (only the latest) is set for those jobs
 
 func (jd *HandleT) migrateJobs(srcDS dataSetT, destDS dataSetT) error {
 
+	jd.stats.migrateJobsStat.Start()
+	defer jd.stats.migrateJobsStat.End()
+
 	//Unprocessed jobs
-	unprocessedList, err := jd.getUnprocessedJobsDS(srcDS, []string{}, false, 0)
+	unprocessedList, err := jd.getUnprocessedJobsDS(srcDS, QueryFiltersT{withPaused: true}, false, 0)
 	jd.assertError(err)
 
 	//Jobs which haven't finished processing
 	retryList, err := jd.getProcessedJobsDS(srcDS, true,
-		[]string{FailedState, WaitingState, WaitingRetryState, ExecutingState}, []string{}, 0)
+		[]string{FailedState, WaitingState, WaitingRetryState, ExecutingState}, QueryFiltersT{withPaused: true}, 0)
 
 	jd.assertError(err)
 
@@ -865,100 +1078,136 @@ Next set of functions are for reading/writing jobs and job_status for
 a given dataset. The names should be self explainatory
 */
 
+/*
+storeJobsDS writes the jobs using the COPY protocol (COPY FROM STDIN) in a
+single transaction. If the copy fails and retryEach is set, the transaction
+is rolled back and the jobs are inserted one at a time so that only the
+offending rows are rejected (errorMessagesMap has an entry for every job).
+Without retryEach any failure is fatal.
+*/
 func (jd *HandleT) storeJobsDS(ds dataSetT, copyID bool, retryEach bool, jobList []*JobT) (errorMessagesMap map[uuid.UUID]string) {
 
-	var stmt *sql.Stmt
-	var err error
+	errorMessagesMap = make(map[uuid.UUID]string)
+
+	err := jd.copyJobsDS(ds, copyID, jobList)
+	if err != nil {
+		jd.assert(retryEach)
+		logger.Debug("Copy of jobs failed, retrying each job", err)
+		errorMessagesMap = jd.storeJobsDSEach(ds, jobList)
+	} else if retryEach {
+		for _, job := range jobList {
+			errorMessagesMap[job.UUID] = ""
+		}
+	}
+
+	//Empty customValFilters means we want to clear for all
+	jd.markClearEmptyResult(ds, []string{}, []string{}, false)
+
+	return
+}
+
+//copyJobsDS bulk loads the jobs in one transaction. The transaction is
+//rolled back and the error returned if any row is rejected by postgres
+func (jd *HandleT) copyJobsDS(ds dataSetT, copyID bool, jobList []*JobT) error {
 
-	//Using transactions for bulk copying
 	txn, err := jd.dbHandle.Begin()
 	jd.assertError(err)
 
-	errorMessagesMap = make(map[uuid.UUID]string)
+	err = jd.copyJobsInTxn(txn, ds, copyID, jobList)
+	if err != nil {
+		txn.Rollback() // rollback started txn, to prevent dangling db connection
+		return err
+	}
+
+	return txn.Commit()
+}
+
+//copyJobsInTxn bulk loads the jobs as part of txn. The caller rolls txn
+//back if an error is returned
+func (jd *HandleT) copyJobsInTxn(txn *sql.Tx, ds dataSetT, copyID bool, jobList []*JobT) error {
+
+	var stmt *sql.Stmt
+	var err error
 
 	if copyID {
 		stmt, err = txn.Prepare(pq.CopyIn(ds.JobTable, "job_id", "uuid", "parameters", "custom_val",
-			"event_payload", "created_at", "expire_at"))
-		jd.assertError(err)
+			"partition_key", "event_payload", "event_payload_compressed", "created_at", "expire_at"))
 	} else {
-		stmt, err = txn.Prepare(pq.CopyIn(ds.JobTable, "uuid", "parameters", "custom_val", "event_payload",
-			"created_at", "expire_at"))
-		jd.assertError(err)
+		stmt, err = txn.Prepare(pq.CopyIn(ds.JobTable, "uuid", "parameters", "custom_val", "partition_key",
+			"event_payload", "event_payload_compressed", "created_at", "expire_at"))
 	}
+	jd.assertError(err)
 
-	defer stmt.Close()
 	for _, job := range jobList {
-		if retryEach {
-			errorMessagesMap[job.UUID] = ""
+		var payload, compressedPayload interface{}
+		payload, compressedPayload, err = jd.encodePayload(job.EventPayload)
+		if err != nil {
+			break
 		}
+		//pq streams rows in the background, so a bad row may
+		//be reported on any of the subsequent calls
 		if copyID {
-			_, err = stmt.Exec(job.JobID, job.UUID, job.Parameters, job.CustomVal,
-				string(job.EventPayload), job.CreatedAt, job.ExpireAt)
+			_, err = stmt.Exec(job.JobID, job.UUID, string(job.Parameters), job.CustomVal,
+				job.PartitionKey, payload, compressedPayload, job.CreatedAt, job.ExpireAt)
 		} else {
-			_, err = stmt.Exec(job.UUID, job.Parameters, job.CustomVal, string(job.EventPayload),
-				job.CreatedAt, job.ExpireAt)
+			_, err = stmt.Exec(job.UUID, string(job.Parameters), job.CustomVal, job.PartitionKey,
+				payload, compressedPayload, job.CreatedAt, job.ExpireAt)
 		}
-		jd.assertError(err)
-	}
-	_, err = stmt.Exec()
-	if err != nil && retryEach {
-		txn.Rollback() // rollback started txn, to prevent dangling db connection
-		for _, job := range jobList {
-			errorMessage := jd.storeJobDS(ds, job)
-			errorMessagesMap[job.UUID] = errorMessage
+		if err != nil {
+			break
 		}
-	} else {
-		jd.assertError(err)
-		err = txn.Commit()
-		jd.assertError(err)
 	}
-
-	//Empty customValFilters means we want to clear for all
-	jd.markClearEmptyResult(ds, []string{}, []string{}, false)
-
-	return
+	if err == nil {
+		_, err = stmt.Exec()
+	}
+	if err == nil {
+		err = stmt.Close()
+	}
+	if err != nil {
+		stmt.Close()
+	}
+	return err
 }
 
-func (jd *HandleT) storeJobDS(ds dataSetT, job *JobT) (errorMessage string) {
+//storeJobsDSEach inserts the jobs one at a time. It is only used to
+//find the offending rows once a bulk copy has failed
+func (jd *HandleT) storeJobsDSEach(ds dataSetT, jobList []*JobT) map[uuid.UUID]string {
 
-	sqlStatement := fmt.Sprintf(`INSERT INTO %s (uuid, custom_val, parameters, event_payload, created_at, expire_at)
-                                       VALUES ($1, $2, $3, $4, $5, $6) RETURNING job_id`, ds.JobTable)
+	errorMessagesMap := make(map[uuid.UUID]string)
+
+	sqlStatement := fmt.Sprintf(`INSERT INTO %s (uuid, custom_val, partition_key, parameters, event_payload,
+                                       event_payload_compressed, created_at, expire_at)
+                                       VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, ds.JobTable)
 	stmt, err := jd.dbHandle.Prepare(sqlStatement)
 	jd.assertError(err)
 	defer stmt.Close()
 
-	_, err = stmt.Exec(job.UUID, job.CustomVal, string(job.Parameters), string(job.EventPayload),
-		job.CreatedAt, job.ExpireAt)
+	for _, job := range jobList {
+		errorMessagesMap[job.UUID] = jd.storeJobDS(stmt, job)
+	}
+	return errorMessagesMap
+}
+
+func (jd *HandleT) storeJobDS(stmt *sql.Stmt, job *JobT) (errorMessage string) {
+
+	payload, compressedPayload, err := jd.encodePayload(job.EventPayload)
+	if err == errInvalidJSON {
+		return "Invalid JSON"
+	}
+	jd.assertError(err)
+	_, err = stmt.Exec(job.UUID, job.CustomVal, job.PartitionKey, string(job.Parameters),
+		payload, compressedPayload, job.CreatedAt, job.ExpireAt)
 	if err == nil {
 		return
 	}
-	pqErr := err.(*pq.Error)
-	if string(pqErr.Code) == dbErrorMap["Invalid JSON"] {
+	pqErr, ok := err.(*pq.Error)
+	if ok && string(pqErr.Code) == dbErrorMap["Invalid JSON"] {
 		return "Invalid JSON"
 	}
 	jd.assertError(err)
 	return
 }
 
-func (jd *HandleT) constructQuery(paramKey string, paramList []string, queryType string) string {
-	jd.assert(queryType == "OR" || queryType == "AND")
-	var queryList []string
-	for _, p := range paramList {
-		queryList = append(queryList, "("+paramKey+"='"+p+"')")
-	}
-	return "(" + strings.Join(queryList, " "+queryType+" ") + ")"
-}
-
-func (jd *HandleT) constructJSONQuery(paramKey string, jsonKey string, paramList []string, queryType string) string {
-	jd.assert(queryType == "OR" || queryType == "AND")
-	var queryList []string
-	for _, p := range paramList {
-		queryList = append(queryList, "("+paramKey+"@>'{"+fmt.Sprintf(`"%s"`, jsonKey)+":"+fmt.Sprintf(`"%s"`, p)+"}')")
-
-	}
-	return "(" + strings.Join(queryList, " "+queryType+" ") + ")"
-}
-
 /*
 * If a query returns empty result for a specific dataset, we cache that so that
 * future queries don't have to hit the DB.
@@ -1036,120 +1285,90 @@ func (jd *HandleT) isEmptyResult(ds dataSetT, stateFilters []string, customValFi
 
 //limitCount == 0 means return all
 func (jd *HandleT) getProcessedJobsDS(ds dataSetT, getAll bool, stateFilters []string,
-	customValFilters []string, limitCount int, sourceIDFilters ...string) ([]*JobT, error) {
-
-	var stateQuery, customValQuery, limitQuery, sourceQuery string
+	filters QueryFiltersT, limitCount int) ([]*JobT, error) {
 
 	jd.checkValidJobState(stateFilters)
 
-	if jd.isEmptyResult(ds, stateFilters, customValFilters) {
+	if filters.cacheable() && jd.isEmptyResult(ds, stateFilters, filters.CustomVals) {
 		return []*JobT{}, nil
 	}
 
-	if len(stateFilters) > 0 {
-		stateQuery = " AND " + jd.constructQuery("job_state", stateFilters, "OR")
-	} else {
-		stateQuery = ""
-	}
-	if len(customValFilters) > 0 {
-		jd.assert(!getAll)
-		customValQuery = " AND " +
-			jd.constructQuery(fmt.Sprintf("%s.custom_val", ds.JobTable),
-				customValFilters, "OR")
-	} else {
-		customValQuery = ""
-	}
-
-	if len(sourceIDFilters) > 0 {
-		jd.assert(!getAll)
-		sourceQuery += " AND " + jd.constructJSONQuery(fmt.Sprintf("%s.parameters", ds.JobTable), "source_id",
-			sourceIDFilters, "OR")
-	} else {
-		sourceQuery = ""
+	if getAll {
+		jd.assert(filters.empty() && limitCount == 0)
 	}
 
-	if limitCount > 0 {
-		jd.assert(!getAll)
-		limitQuery = fmt.Sprintf(" LIMIT %d ", limitCount)
+	var query *querybuilder.QueryT
+	var sqlStatement string
+	if getAll {
+		query = querybuilder.New()
 	} else {
-		limitQuery = ""
+		query = querybuilder.New(time.Now())
 	}
+	query.AnyOf("job_latest_state.job_state", stateFilters)
+	cacheable := jd.applyFilters(query, filters, ds.JobTable)
 
-	var rows *sql.Rows
 	if getAll {
-		sqlStatement := fmt.Sprintf(`SELECT
-                                  %[1]s.job_id, %[1]s.uuid, %[1]s.parameters,  %[1]s.custom_val, %[1]s.event_payload,
+		sqlStatement = fmt.Sprintf(`SELECT
+                                  %[1]s.job_id, %[1]s.uuid, %[1]s.parameters,  %[1]s.custom_val, %[1]s.partition_key, %[1]s.event_payload, %[1]s.event_payload_compressed,
                                   %[1]s.created_at, %[1]s.expire_at,
                                   job_latest_state.job_state, job_latest_state.attempt,
                                   job_latest_state.exec_time, job_latest_state.retry_time,
                                   job_latest_state.error_code, job_latest_state.error_response
                                  FROM
-                                  %[1]s,
-                                  (SELECT job_id, job_state, attempt, exec_time, retry_time,
-                                    error_code, error_response FROM %[2]s WHERE id IN
-                                    (SELECT MAX(id) from %[2]s GROUP BY job_id) %[3]s)
-                                  AS job_latest_state
-                                   WHERE %[1]s.job_id=job_latest_state.job_id`,
-			ds.JobTable, ds.JobStatusTable, stateQuery)
-		var err error
-		rows, err = jd.dbHandle.Query(sqlStatement)
-		defer rows.Close()
-		jd.assertError(err)
+                                  %[1]s, %[2]s AS job_latest_state
+                                   WHERE %[1]s.job_id=job_latest_state.job_id %[3]s`,
+			ds.JobTable, jd.lastStatusTableName(ds), query.Conditions())
 	} else {
-		sqlStatement := fmt.Sprintf(`SELECT
-                                               %[1]s.job_id, %[1]s.uuid,  %[1]s.parameters, %[1]s.custom_val, %[1]s.event_payload,
+		var limitQuery string
+		conditions := query.Conditions()
+		if limitCount > 0 {
+			limitQuery = " LIMIT " + query.Bind(limitCount)
+		}
+		sqlStatement = fmt.Sprintf(`SELECT
+                                               %[1]s.job_id, %[1]s.uuid,  %[1]s.parameters, %[1]s.custom_val, %[1]s.partition_key, %[1]s.event_payload, %[1]s.event_payload_compressed,
                                                %[1]s.created_at, %[1]s.expire_at,
                                                job_latest_state.job_state, job_latest_state.attempt,
                                                job_latest_state.exec_time, job_latest_state.retry_time,
                                                job_latest_state.error_code, job_latest_state.error_response
                                             FROM
-                                               %[1]s,
-                                               (SELECT job_id, job_state, attempt, exec_time, retry_time,
-                                                 error_code, error_response FROM %[2]s WHERE id IN
-                                                   (SELECT MAX(id) from %[2]s GROUP BY job_id) %[3]s)
-                                               AS job_latest_state
+                                               %[1]s, %[2]s AS job_latest_state
                                             WHERE %[1]s.job_id=job_latest_state.job_id
-                                             %[4]s %[5]s
-                                             AND job_latest_state.retry_time < $1 ORDER BY %[1]s.job_id %[6]s`,
-			ds.JobTable, ds.JobStatusTable, stateQuery, customValQuery, sourceQuery, limitQuery)
-		// fmt.Println(sqlStatement)
-
-		stmt, err := jd.dbHandle.Prepare(sqlStatement)
-
-		jd.assertError(err)
-		defer stmt.Close()
-		rows, err = stmt.Query(time.Now())
-		defer rows.Close()
-		jd.assertError(err)
+                                             AND job_latest_state.retry_time < $1 %[3]s
+                                            ORDER BY %[1]s.job_id %[4]s`,
+			ds.JobTable, jd.lastStatusTableName(ds), conditions, limitQuery)
 	}
 
+	rows, err := jd.dbHandle.Query(sqlStatement, query.Args()...)
+	jd.assertError(err)
+	defer rows.Close()
+
 	var jobList []*JobT
 	for rows.Next() {
 		var job JobT
-		err := rows.Scan(&job.JobID, &job.UUID, &job.Parameters, &job.CustomVal,
-			&job.EventPayload, &job.CreatedAt, &job.ExpireAt,
+		var payload payloadScanT
+		err := rows.Scan(&job.JobID, &job.UUID, &job.Parameters, &job.CustomVal, &job.PartitionKey,
+			&payload.plain, &payload.compressed, &job.CreatedAt, &job.ExpireAt,
 			&job.LastJobStatus.JobState, &job.LastJobStatus.AttemptNum,
 			&job.LastJobStatus.ExecTime, &job.LastJobStatus.RetryTime,
 			&job.LastJobStatus.ErrorCode, &job.LastJobStatus.ErrorResponse)
 		jd.assertError(err)
+		job.EventPayload = jd.decodePayload(&payload)
 		jobList = append(jobList, &job)
 	}
 
-	if len(jobList) == 0 {
-		jd.markClearEmptyResult(ds, stateFilters, customValFilters, true)
+	//An empty result for some partition keys (or sources, ...) says
+	//nothing about the rest of the custom_val
+	if len(jobList) == 0 && cacheable {
+		jd.markClearEmptyResult(ds, stateFilters, filters.CustomVals, true)
 	}
 
 	return jobList, nil
 }
 
 //count == 0 means return all
-func (jd *HandleT) getUnprocessedJobsDS(ds dataSetT, customValFilters []string,
-	order bool, count int, sourceIDFilters ...string) ([]*JobT, error) {
+func (jd *HandleT) getUnprocessedJobsDS(ds dataSetT, filters QueryFiltersT, order bool, count int) ([]*JobT, error) {
 
-	var rows *sql.Rows
-	var err error
-
-	if jd.isEmptyResult(ds, []string{"NP"}, customValFilters) {
+	if filters.cacheable() && jd.isEmptyResult(ds, []string{"NP"}, filters.CustomVals) {
 		return []*JobT{}, nil
 	}
 
@@ -1157,50 +1376,46 @@ func (jd *HandleT) getUnprocessedJobsDS(ds dataSetT, customValFilters []string,
 
 	if useJoinForUnprocessed {
 		sqlStatement = fmt.Sprintf(`SELECT %[1]s.job_id, %[1]s.uuid, %[1]s.parameters, %[1]s.custom_val,
-                                               %[1]s.event_payload, %[1]s.created_at,
+                                               %[1]s.partition_key, %[1]s.event_payload, %[1]s.event_payload_compressed, %[1]s.created_at,
                                                %[1]s.expire_at
                                              FROM %[1]s LEFT JOIN %[2]s ON %[1]s.job_id=%[2]s.job_id
-                                             WHERE %[2]s.job_id is NULL`, ds.JobTable, ds.JobStatusTable)
+                                             WHERE %[2]s.job_id is NULL`, ds.JobTable, jd.lastStatusTableName(ds))
 	} else {
 		sqlStatement = fmt.Sprintf(`SELECT %[1]s.job_id, %[1]s.uuid, %[1]s.parameters, %[1]s.custom_val,
-                                               %[1]s.event_payload, %[1]s.created_at,
+                                               %[1]s.partition_key, %[1]s.event_payload, %[1]s.event_payload_compressed, %[1]s.created_at,
                                                %[1]s.expire_at
-                                             FROM %[1]s WHERE %[1]s.job_id NOT IN (SELECT DISTINCT(%[2]s.job_id)
-                                             FROM %[2]s)`, ds.JobTable, ds.JobStatusTable)
+                                             FROM %[1]s WHERE %[1]s.job_id NOT IN (SELECT %[2]s.job_id
+                                             FROM %[2]s)`, ds.JobTable, jd.lastStatusTableName(ds))
 	}
 
-	if len(customValFilters) > 0 {
-		sqlStatement += " AND " + jd.constructQuery(fmt.Sprintf("%s.custom_val", ds.JobTable),
-			customValFilters, "OR")
-	}
-
-	if len(sourceIDFilters) > 0 {
-		sqlStatement += " AND " + jd.constructJSONQuery(fmt.Sprintf("%s.parameters", ds.JobTable), "source_id",
-			sourceIDFilters, "OR")
-	}
+	query := querybuilder.New()
+	cacheable := jd.applyFilters(query, filters, ds.JobTable)
+	sqlStatement += query.Conditions()
 
 	if order {
 		sqlStatement += fmt.Sprintf(" ORDER BY %s.job_id", ds.JobTable)
 	}
 	if count > 0 {
-		sqlStatement += fmt.Sprintf(" LIMIT %d", count)
+		sqlStatement += " LIMIT " + query.Bind(count)
 	}
 
-	rows, err = jd.dbHandle.Query(sqlStatement)
-	defer rows.Close()
+	rows, err := jd.dbHandle.Query(sqlStatement, query.Args()...)
 	jd.assertError(err)
+	defer rows.Close()
 
 	var jobList []*JobT
 	for rows.Next() {
 		var job JobT
-		err := rows.Scan(&job.JobID, &job.UUID, &job.Parameters, &job.CustomVal,
-			&job.EventPayload, &job.CreatedAt, &job.ExpireAt)
+		var payload payloadScanT
+		err := rows.Scan(&job.JobID, &job.UUID, &job.Parameters, &job.CustomVal, &job.PartitionKey,
+			&payload.plain, &payload.compressed, &job.CreatedAt, &job.ExpireAt)
 		jd.assertError(err)
+		job.EventPayload = jd.decodePayload(&payload)
 		jobList = append(jobList, &job)
 	}
 
-	if len(jobList) == 0 {
-		jd.markClearEmptyResult(ds, []string{"NP"}, customValFilters, true)
+	if len(jobList) == 0 && cacheable {
+		jd.markClearEmptyResult(ds, []string{"NP"}, filters.CustomVals, true)
 	}
 
 	return jobList, nil
@@ -1212,29 +1427,37 @@ func (jd *HandleT) updateJobStatusDS(ds dataSetT, statusList []*JobStatusT, cust
 		return nil
 	}
 
+	var abortedJobIDs []int64
+	for _, st := range statusList {
+		if st.JobState == AbortedState {
+			abortedJobIDs = append(abortedJobIDs, st.JobID)
+		}
+	}
+	//The aborted jobs are copied to the dead letter jobsdb in the
+	//transaction of their statuses, so a crash can't lose the copies
+	copyToDeadLetterDB := jd.deadLetterDB != nil && len(abortedJobIDs) > 0
+	if copyToDeadLetterDB {
+		jd.deadLetterDB.dsListLock.RLock()
+		defer jd.deadLetterDB.dsListLock.RUnlock()
+	}
+
 	txn, err := jd.dbHandle.Begin()
 	jd.assertError(err)
 
-	stmt, err := txn.Prepare(pq.CopyIn(ds.JobStatusTable, "job_id", "job_state", "attempt", "exec_time",
-		"retry_time", "error_code", "error_response"))
-	jd.assertError(err)
+	jd.writeJobStatusInTxn(txn, ds, statusList)
 
-	defer stmt.Close()
-	for _, status := range statusList {
-		//  Handle the case when google analytics returns gif in response
-		if !utf8.ValidString(string(status.ErrorResponse)) {
-			status.ErrorResponse, _ = json.Marshal("{}")
-		}
-		_, err = stmt.Exec(status.JobID, status.JobState, status.AttemptNum, status.ExecTime,
-			status.RetryTime, status.ErrorCode, string(status.ErrorResponse))
-		jd.assertError(err)
+	var deadLetterList []*JobT
+	if copyToDeadLetterDB {
+		deadLetterList = jd.copyToDeadLetterDS(txn, ds, abortedJobIDs)
 	}
-	_, err = stmt.Exec()
-	jd.assertError(err)
 
 	err = txn.Commit()
 	jd.assertError(err)
 
+	if copyToDeadLetterDB {
+		jd.deadLetterDB.deadLettersStored(deadLetterList)
+	}
+
 	//Get all the states and clear from empty cache
 	stateFiltersMap := map[string]bool{}
 	for _, st := range statusList {
@@ -1250,6 +1473,35 @@ func (jd *HandleT) updateJobStatusDS(ds dataSetT, statusList []*JobStatusT, cust
 	return nil
 }
 
+//writeJobStatusInTxn adds the statuses to ds as part of txn
+func (jd *HandleT) writeJobStatusInTxn(txn *sql.Tx, ds dataSetT, statusList []*JobStatusT) {
+
+	afterID := jd.maxStatusID(txn, ds)
+
+	stmt, err := txn.Prepare(pq.CopyIn(ds.JobStatusTable, "job_id", "job_state", "attempt", "exec_time",
+		"retry_time", "error_code", "error_response"))
+	jd.assertError(err)
+
+	defer stmt.Close()
+	for _, status := range statusList {
+		//  Handle the case when google analytics returns gif in response
+		if !utf8.ValidString(string(status.ErrorResponse)) {
+			status.ErrorResponse, _ = json.Marshal("{}")
+		}
+		_, err = stmt.Exec(status.JobID, status.JobState, status.AttemptNum, status.ExecTime,
+			status.RetryTime, status.ErrorCode, string(status.ErrorResponse))
+		jd.assertError(err)
+	}
+	_, err = stmt.Exec()
+	jd.assertError(err)
+	err = stmt.Close()
+	jd.assertError(err)
+
+	//Same transaction so readers never see a status
+	//without the matching last status
+	jd.updateLastStatus(txn, ds, afterID)
+}
+
 /**
 The next set of functions are the user visible functions to get/set job status.
 For reading jobs, it scans from the oldest DS to the latest till it has found
@@ -1281,11 +1533,12 @@ func (jd *HandleT) mainCheckLoop() {
 	for {
 		time.Sleep(mainCheckSleepDuration)
 		logger.Debug("Main check:Start")
+		jd.stats.mainCheckLoopStat.Start()
 		jd.dsListLock.RLock()
 		dsList := jd.getDSList(false)
 		jd.dsListLock.RUnlock()
 		latestDS := dsList[len(dsList)-1]
-		if jd.checkIfFullDS(latestDS) {
+		if jd.checkIfFullDS(latestDS) || jd.checkIfExpiredDS(latestDS) {
 			//Adding a new DS updates the list
 			//Doesn't move any data so we only
 			//take the list lock
@@ -1354,7 +1607,7 @@ func (jd *HandleT) mainCheckLoop() {
 		}
 
 		jd.dsMigrationLock.Unlock()
-
+		jd.stats.mainCheckLoopStat.End()
 	}
 }
 
@@ -1371,24 +1624,26 @@ func (jd *HandleT) backupDSLoop() {
 			continue
 		}
 
+		jd.stats.backupDSStat.Start()
 		opPayload, err := json.Marshal(&backupDS)
 		jd.assertError(err)
 		opID := jd.journalMarkStart(backupDSOperation, opPayload)
-		// write jobs table to s3
+		// write jobs table to the backup target
 		_, err = jd.backupTable(backupDS.JobTable)
 		jd.assertError(err)
 
-		// write job_status table to s3
+		// write job_status table to the backup target
 		_, err = jd.backupTable(backupDS.JobStatusTable)
 		jd.assertError(err)
 		jd.journalMarkDone(opID)
 
-		// drop dataset after successfully uploading both jobs and jobs_status to s3
+		// drop dataset after successfully uploading both jobs and jobs_status
 		opPayload, err = json.Marshal(&backupDS)
 		jd.assertError(err)
 		opID = jd.journalMarkStart(backupDropDSOperation, opPayload)
 		jd.dropDS(backupDS, false)
 		jd.journalMarkDone(opID)
+		jd.stats.backupDSStat.End()
 	}
 }
 
@@ -1408,56 +1663,6 @@ func (jd *HandleT) removeTableJSONDumps() {
 	}
 }
 
-func (jd *HandleT) backupTable(tableName string) (success bool, err error) {
-	pathPrefix := strings.TrimPrefix(tableName, "pre_drop_")
-	backupPathDirName := "/rudder-s3-dumps/"
-	tmpdirPath := strings.TrimSuffix(config.GetEnv("RUDDER_TMPDIR", ""), "/")
-	if tmpdirPath == "" {
-		tmpdirPath, err = os.UserHomeDir()
-		misc.AssertError(err)
-	}
-	path := fmt.Sprintf(`%v%v.gz`, tmpdirPath+backupPathDirName, pathPrefix)
-	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
-	misc.AssertError(err)
-
-	stmt := fmt.Sprintf(`SELECT json_agg(%[1]s) FROM %[1]s`, tableName)
-	var rawJSONRows json.RawMessage
-	err = jd.dbHandle.QueryRow(stmt).Scan(&rawJSONRows)
-	misc.AssertError(err)
-
-	var content string
-	var rows []interface{}
-	err = json.Unmarshal(rawJSONRows, &rows)
-	misc.AssertError(err)
-	for _, row := range rows {
-		rowBytes, err := json.Marshal(row)
-		misc.AssertError(err)
-		content += string(rowBytes) + "\n"
-	}
-
-	gzipFile, err := os.Create(path)
-	gzipWriter := gzip.NewWriter(gzipFile)
-	_, err = gzipWriter.Write([]byte(content))
-	misc.AssertError(err)
-	gzipWriter.Close()
-
-	file, err := os.Open(path)
-	jd.assertError(err)
-	defer file.Close()
-
-	if strings.HasPrefix(pathPrefix, fmt.Sprintf("%v_job_status_", jd.tablePrefix)) {
-		err = jd.jobStatusFileUploader.Upload(file)
-	} else {
-		err = jd.jobsFileUploader.Upload(file)
-	}
-	jd.assertError(err)
-
-	err = os.Remove(path)
-	jd.assertError(err)
-
-	return true, nil
-}
-
 func (jd *HandleT) getBackupDS() dataSetT {
 	var backupDS dataSetT
 
@@ -1532,6 +1737,7 @@ func (jd *HandleT) journalMarkStart(opType string, opPayload json.RawMessage) in
 	var opID int64
 	err = stmt.QueryRow(opType, false, opPayload, time.Now()).Scan(&opID)
 	jd.assertError(err)
+	jd.journalOpStarted(opID, opType)
 
 	return opID
 
@@ -1541,6 +1747,7 @@ func (jd *HandleT) journalMarkDone(opID int64) {
 	sqlStatement := fmt.Sprintf(`UPDATE %s_journal SET done=$2, end_time=$3 WHERE id=$1`, jd.tablePrefix)
 	_, err := jd.dbHandle.Exec(sqlStatement, opID, true, time.Now())
 	jd.assertError(err)
+	jd.journalOpDone(opID)
 }
 
 func (jd *HandleT) recoverFromCrash(goRoutineType string) {
@@ -1679,6 +1886,25 @@ func (jd *HandleT) UpdateJobStatus(statusList []*JobStatusT, customValFilters []
 	defer jd.dsMigrationLock.RUnlock()
 	defer jd.dsListLock.RUnlock()
 
+	for _, dsStatus := range jd.statusesByDS(statusList) {
+		err := jd.updateJobStatusDS(dsStatus.ds, dsStatus.statusList, customValFilters)
+		jd.assertError(err)
+	}
+
+	jd.publish(customValFilters)
+}
+
+//dsStatusListT is the statuses of the jobs of one dataset
+type dsStatusListT struct {
+	ds         dataSetT
+	statusList []*JobStatusT
+}
+
+//statusesByDS splits statusList, sorted by job id, by the dataset of
+//their jobs. The caller holds the dsMigrationLock and dsListLock
+func (jd *HandleT) statusesByDS(statusList []*JobStatusT) []dsStatusListT {
+
+	var dsStatusList []dsStatusListT
 	//We scan through the list of jobs and map them to DS
 	var lastPos int
 	dsRangeList := jd.getDSRangeList(false)
@@ -1696,9 +1922,8 @@ func (jd *HandleT) UpdateJobStatus(statusList []*JobStatusT, customValFilters []
 				if i > lastPos {
 					logger.Debug("Range:", ds, statusList[lastPos].JobID,
 						statusList[i-1].JobID, lastPos, i-1)
+					dsStatusList = append(dsStatusList, dsStatusListT{ds.ds, statusList[lastPos:i]})
 				}
-				err := jd.updateJobStatusDS(ds.ds, statusList[lastPos:i], customValFilters)
-				jd.assertError(err)
 				lastPos = i
 				break
 			}
@@ -1706,8 +1931,7 @@ func (jd *HandleT) UpdateJobStatus(statusList []*JobStatusT, customValFilters []
 		//Reached the end. Need to process this range
 		if i == len(statusList) && lastPos < i {
 			logger.Debug("Range:", ds, statusList[lastPos].JobID, statusList[i-1].JobID, lastPos, i)
-			err := jd.updateJobStatusDS(ds.ds, statusList[lastPos:i], customValFilters)
-			jd.assertError(err)
+			dsStatusList = append(dsStatusList, dsStatusListT{ds.ds, statusList[lastPos:i]})
 			lastPos = i
 			break
 		}
@@ -1720,10 +1944,9 @@ func (jd *HandleT) UpdateJobStatus(statusList []*JobStatusT, customValFilters []
 		jd.assert(len(dsRangeList) == len(dsList)-1)
 		//Update status in the last element
 		logger.Debug("RangeEnd", statusList[lastPos].JobID, lastPos, len(statusList))
-		err := jd.updateJobStatusDS(dsList[len(dsList)-1], statusList[lastPos:], customValFilters)
-		jd.assertError(err)
+		dsStatusList = append(dsStatusList, dsStatusListT{dsList[len(dsList)-1], statusList[lastPos:]})
 	}
-
+	return dsStatusList
 }
 
 /*
@@ -1736,7 +1959,9 @@ func (jd *HandleT) Store(jobList []*JobT) map[uuid.UUID]string {
 	defer jd.dsListLock.RUnlock()
 
 	dsList := jd.getDSList(false)
-	return jd.storeJobsDS(dsList[len(dsList)-1], false, true, jobList)
+	errorMessagesMap := jd.storeJobsDS(dsList[len(dsList)-1], false, true, jobList)
+	jd.publishJobs(jobList)
+	return errorMessagesMap
 }
 
 /*
@@ -1760,6 +1985,13 @@ GetUnprocessed returns the unprocessed events. Unprocessed events are
 those whose state hasn't been marked in the DB
 */
 func (jd *HandleT) GetUnprocessed(customValFilters []string, count int, sourceIDFilters ...string) []*JobT {
+	return jd.GetUnprocessedWithFilters(QueryFiltersT{CustomVals: customValFilters, SourceIDs: sourceIDFilters}, count)
+}
+
+/*
+GetUnprocessedWithFilters is GetUnprocessed for any combination of filters
+*/
+func (jd *HandleT) GetUnprocessedWithFilters(filters QueryFiltersT, count int) []*JobT {
 
 	//The order of lock is very important. The mainCheckLoop
 	//takes lock in this order so reversing this will cause
@@ -1777,7 +2009,7 @@ func (jd *HandleT) GetUnprocessed(customValFilters []string, count int, sourceID
 	}
 	for _, ds := range dsList {
 		jd.assert(count > 0)
-		jobs, err := jd.getUnprocessedJobsDS(ds, customValFilters, true, count)
+		jobs, err := jd.getUnprocessedJobsDS(ds, filters, true, count)
 		jd.assertError(err)
 		outJobs = append(outJobs, jobs...)
 		count -= len(jobs)
@@ -1798,6 +2030,13 @@ can return the same set of events. It is the responsibility of the caller to cal
 one thread, update the state (to "waiting") in the same thread and pass on the the processors
 */
 func (jd *HandleT) GetProcessed(stateFilter []string, customValFilters []string, count int, sourceIDFilters ...string) []*JobT {
+	return jd.GetProcessedWithFilters(stateFilter, QueryFiltersT{CustomVals: customValFilters, SourceIDs: sourceIDFilters}, count)
+}
+
+/*
+GetProcessedWithFilters is GetProcessed for any combination of filters
+*/
+func (jd *HandleT) GetProcessedWithFilters(stateFilter []string, filters QueryFiltersT, count int) []*JobT {
 
 	//The order of lock is very important. The mainCheckLoop
 	//takes lock in this order so reversing this will cause
@@ -1818,7 +2057,7 @@ func (jd *HandleT) GetProcessed(stateFilter []string, customValFilters []string,
 	for _, ds := range dsList {
 		//count==0 means return all which we don't want
 		jd.assert(count > 0)
-		jobs, err := jd.getProcessedJobsDS(ds, false, stateFilter, customValFilters, count, sourceIDFilters...)
+		jobs, err := jd.getProcessedJobsDS(ds, false, stateFilter, filters, count)
 		jd.assertError(err)
 		outJobs = append(outJobs, jobs...)
 		count -= len(jobs)
@@ -1854,6 +2093,47 @@ func (jd *HandleT) GetExecuting(customValFilters []string, count int, sourceIDFi
 	return jd.GetProcessed([]string{ExecutingState}, customValFilters, count, sourceIDFilters...)
 }
 
+/*
+GetUnprocessedForPartitionKeys is GetUnprocessed restricted to jobs
+whose PartitionKey is one of partitionKeys
+*/
+func (jd *HandleT) GetUnprocessedForPartitionKeys(customValFilters []string, partitionKeys []string, count int) []*JobT {
+	jd.assert(len(partitionKeys) > 0)
+	return jd.GetUnprocessedWithFilters(QueryFiltersT{CustomVals: customValFilters, PartitionKeys: partitionKeys}, count)
+}
+
+/*
+GetProcessedForPartitionKeys is GetProcessed restricted to jobs
+whose PartitionKey is one of partitionKeys
+*/
+func (jd *HandleT) GetProcessedForPartitionKeys(stateFilter []string, customValFilters []string, partitionKeys []string, count int) []*JobT {
+	jd.assert(len(partitionKeys) > 0)
+	return jd.GetProcessedWithFilters(stateFilter, QueryFiltersT{CustomVals: customValFilters, PartitionKeys: partitionKeys}, count)
+}
+
+/*
+GroupByPartitionKey splits jobList by PartitionKey. Jobs of a key are
+sorted by JobID and the keys are returned in the order of their oldest job
+*/
+func GroupByPartitionKey(jobList []*JobT) ([]string, map[string][]*JobT) {
+	sortedList := make([]*JobT, len(jobList))
+	copy(sortedList, jobList)
+	sort.Slice(sortedList, func(i, j int) bool {
+		return sortedList[i].JobID < sortedList[j].JobID
+	})
+
+	var keys []string
+	keyJobsMap := make(map[string][]*JobT)
+	for _, job := range sortedList {
+		_, ok := keyJobsMap[job.PartitionKey]
+		if !ok {
+			keys = append(keys, job.PartitionKey)
+		}
+		keyJobsMap[job.PartitionKey] = append(keyJobsMap[job.PartitionKey], job)
+	}
+	return keys, keyJobsMap
+}
+
 /*
 CheckPGHealth returns health check for pg database
 */
@@ -1874,10 +2154,14 @@ func (jd *HandleT) CheckPGHealth() bool {
 */
 
 func (jd *HandleT) dropTables() error {
-	sqlStatement := `DROP TABLE IF EXISTS job_status`
+	sqlStatement := `DROP TABLE IF EXISTS job_last_status`
 	_, err := jd.dbHandle.Exec(sqlStatement)
 	jd.assertError(err)
 
+	sqlStatement = `DROP TABLE IF EXISTS job_status`
+	_, err = jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+
 	sqlStatement = `DROP TABLE IF EXISTS  jobs`
 	_, err = jd.dbHandle.Exec(sqlStatement)
 	jd.assertError(err)
@@ -1918,7 +2202,9 @@ func (jd *HandleT) createTables() error {
 							 uuid UUID NOT NULL,
 							 parameters JSONB NOT NULL,
                              custom_val INT NOT NULL,
-                             event_payload JSONB NOT NULL,
+                             partition_key TEXT NOT NULL DEFAULT '',
+                             event_payload JSONB,
+                             event_payload_compressed BYTEA,
                              created_at TIMESTAMP NOT NULL,
                              expire_at TIMESTAMP NOT NULL);`
 	_, err := jd.dbHandle.Exec(sqlStatement)
@@ -1936,6 +2222,8 @@ func (jd *HandleT) createTables() error {
 	_, err = jd.dbHandle.Exec(sqlStatement)
 	jd.assertError(err)
 
+	jd.createLastStatusTable(dataSetT{JobTable: "jobs", JobStatusTable: "job_status"})
+
 	return nil
 }
 
@@ -1976,11 +2264,11 @@ func (jd *HandleT) staticDSTest() {
 		fmt.Println("Checking DS", elapsed)
 
 		start = time.Now()
-		unprocessedList, _ := jd.getUnprocessedJobsDS(testDS, []string{testEndPoint}, true, testNumQuery)
+		unprocessedList, _ := jd.getUnprocessedJobsDS(testDS, QueryFiltersT{CustomVals: []string{testEndPoint}}, true, testNumQuery)
 		fmt.Println("Got unprocessed events:", len(unprocessedList))
 
 		retryList, _ := jd.getProcessedJobsDS(testDS, false, []string{"failed"},
-			[]string{testEndPoint}, testNumQuery)
+			QueryFiltersT{CustomVals: []string{testEndPoint}}, testNumQuery)
 		fmt.Println("Got retry events:", len(retryList))
 		if len(unprocessedList)+len(retryList) == 0 {
 			break
@@ -2139,6 +2427,203 @@ func (jd *HandleT) dynamicTest() {
 	}
 }
 
+/*
+storeBenchmark measures the throughput of storing jobs through the COPY
+protocol against storing them one row at a time. Both write into the
+currently active dataset
+*/
+func (jd *HandleT) storeBenchmark(numBatches int, batchSize int, eventPayload json.RawMessage) {
+
+	newJobList := func() []*JobT {
+		var jobList []*JobT
+		for i := 0; i < batchSize; i++ {
+			jobList = append(jobList, &JobT{
+				UUID:         uuid.NewV4(),
+				Parameters:   []byte(`{"source_id": "benchmark"}`),
+				CreatedAt:    time.Now(),
+				ExpireAt:     time.Now(),
+				CustomVal:    "benchmark",
+				EventPayload: eventPayload,
+			})
+		}
+		return jobList
+	}
+
+	jd.dsListLock.RLock()
+	dsList := jd.getDSList(false)
+	ds := dsList[len(dsList)-1]
+	jd.dsListLock.RUnlock()
+
+	var eachElapsed, copyElapsed time.Duration
+	for i := 0; i < numBatches; i++ {
+		jobList := newJobList()
+		start := time.Now()
+		jd.storeJobsDSEach(ds, jobList)
+		eachElapsed += time.Since(start)
+
+		jobList = newJobList()
+		start = time.Now()
+		jd.storeJobsDS(ds, false, true, jobList)
+		copyElapsed += time.Since(start)
+	}
+
+	totalJobs := float64(numBatches * batchSize)
+	fmt.Println("Stored", numBatches, "batches of", batchSize, "jobs")
+	fmt.Println("Insert per row:", eachElapsed, totalJobs/eachElapsed.Seconds(), "jobs/s")
+	fmt.Println("Copy:", copyElapsed, totalJobs/copyElapsed.Seconds(), "jobs/s")
+}
+
+/*
+payloadBenchmark stores and reads back the same jobs with the payload
+as JSONB and compressed with every codec, and compares the time taken
+and the size of the jobs table
+*/
+func (jd *HandleT) payloadBenchmark(numJobs int, eventPayload json.RawMessage) {
+
+	testEndPoint := "4"
+	testDS := dataSetT{JobTable: "jobs", JobStatusTable: "job_status"}
+	savedCodec := jd.payloadCodec
+	defer func() { jd.payloadCodec = savedCodec }()
+
+	gzipCodec, _ := compression.Lookup("gzip")
+	for _, codec := range []*compression.CodecT{nil, gzipCodec} {
+		jd.dropTables()
+		jd.createTables()
+		jd.payloadCodec = codec
+
+		var jobList []*JobT
+		for i := 0; i < numJobs; i++ {
+			jobList = append(jobList, &JobT{
+				UUID:         uuid.NewV4(),
+				Parameters:   []byte(`{"source_id": "benchmark"}`),
+				CreatedAt:    time.Now(),
+				ExpireAt:     time.Now(),
+				CustomVal:    testEndPoint,
+				EventPayload: eventPayload,
+			})
+		}
+		start := time.Now()
+		jd.storeJobsDS(testDS, false, false, jobList)
+		storeElapsed := time.Since(start)
+
+		start = time.Now()
+		jobList, _ = jd.getUnprocessedJobsDS(testDS, QueryFiltersT{CustomVals: []string{testEndPoint}}, true, 0)
+		readElapsed := time.Since(start)
+		jd.assert(len(jobList) == numJobs)
+
+		var tableSize int64
+		err := jd.dbHandle.QueryRow(`SELECT pg_total_relation_size('jobs')`).Scan(&tableSize)
+		jd.assertError(err)
+
+		name := "jsonb"
+		if codec != nil {
+			name = codec.Name
+		}
+		fmt.Println("Payload:", name, "Jobs:", numJobs, "Table size:", tableSize/1024, "KB")
+		fmt.Println("Store:", storeElapsed, "Read:", readElapsed)
+	}
+}
+
+/*
+statusQueryBenchmark builds a dataset where every job has been retried
+numRetries times and compares reading the failed jobs through the status
+history (the MAX(id) GROUP BY job_id scan) with reading them through the
+last status table
+*/
+func (jd *HandleT) statusQueryBenchmark(numJobs int, numRetries int, numQuery int) {
+
+	testEndPoint := "4"
+	testDS := dataSetT{JobTable: "jobs", JobStatusTable: "job_status"}
+
+	jd.dropTables()
+	jd.createTables()
+
+	var jobList []*JobT
+	for i := 0; i < numJobs; i++ {
+		jobList = append(jobList, &JobT{
+			UUID:         uuid.NewV4(),
+			Parameters:   []byte(`{"source_id": "benchmark"}`),
+			CreatedAt:    time.Now(),
+			ExpireAt:     time.Now(),
+			CustomVal:    testEndPoint,
+			EventPayload: []byte(`{"event_type":"click"}`),
+		})
+	}
+	jd.storeJobsDS(testDS, false, false, jobList)
+	jobList, _ = jd.getUnprocessedJobsDS(testDS, QueryFiltersT{CustomVals: []string{testEndPoint}}, true, 0)
+
+	for i := 0; i < numRetries; i++ {
+		var statusList []*JobStatusT
+		for _, job := range jobList {
+			statusList = append(statusList, &JobStatusT{
+				JobID:         job.JobID,
+				JobState:      FailedState,
+				AttemptNum:    i + 1,
+				ExecTime:      time.Now(),
+				RetryTime:     time.Now(),
+				ErrorCode:     "500",
+				ErrorResponse: []byte(`{}`),
+			})
+		}
+		jd.updateJobStatusDS(testDS, statusList, []string{testEndPoint})
+	}
+
+	legacyStatement := fmt.Sprintf(`SELECT %[1]s.job_id, job_latest_state.job_state
+                                      FROM %[1]s,
+                                       (SELECT job_id, job_state, retry_time FROM %[2]s WHERE id IN
+                                         (SELECT MAX(id) from %[2]s GROUP BY job_id) AND job_state='%[3]s')
+                                       AS job_latest_state
+                                      WHERE %[1]s.job_id=job_latest_state.job_id
+                                       AND %[1]s.custom_val='%[4]s'
+                                       AND job_latest_state.retry_time < $1
+                                      ORDER BY %[1]s.job_id LIMIT %[5]d`,
+		testDS.JobTable, testDS.JobStatusTable, FailedState, testEndPoint, numQuery)
+
+	start := time.Now()
+	rows, err := jd.dbHandle.Query(legacyStatement, time.Now())
+	jd.assertError(err)
+	legacyCount := 0
+	for rows.Next() {
+		legacyCount++
+	}
+	rows.Close()
+	legacyElapsed := time.Since(start)
+
+	start = time.Now()
+	retryList, _ := jd.getProcessedJobsDS(testDS, false, []string{FailedState},
+		QueryFiltersT{CustomVals: []string{testEndPoint}}, numQuery)
+	lastStatusElapsed := time.Since(start)
+
+	jd.assert(legacyCount == len(retryList))
+	fmt.Println("Jobs:", numJobs, "Retries per job:", numRetries, "Fetched:", len(retryList))
+	fmt.Println("Status history scan:", legacyElapsed)
+	fmt.Println("Last status table:", lastStatusElapsed)
+}
+
+/*
+RunStatusQueryBenchmark compares fetching failed jobs via the status
+history and via the last status table on a high retry dataset
+*/
+func (jd *HandleT) RunStatusQueryBenchmark(numJobs int, numRetries int, numQuery int) {
+	jd.statusQueryBenchmark(numJobs, numRetries, numQuery)
+}
+
+/*
+RunPayloadBenchmark compares the storage and time taken by JSONB and
+compressed payloads
+*/
+func (jd *HandleT) RunPayloadBenchmark(numJobs int, eventPayload json.RawMessage) {
+	jd.payloadBenchmark(numJobs, eventPayload)
+}
+
+/*
+RunStoreBenchmark compares the throughput of the bulk (COPY) and per row
+store paths
+*/
+func (jd *HandleT) RunStoreBenchmark(numBatches int, batchSize int, eventPayload json.RawMessage) {
+	jd.storeBenchmark(numBatches, batchSize, eventPayload)
+}
+
 /*
 RunTest runs some internal tests
 */
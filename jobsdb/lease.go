@@ -0,0 +1,247 @@
+/*
+Consumer leases, so that several processes can consume one jobsdb.
+
+ClaimUnprocessed and ClaimToRetry atomically hand jobs to a consumer by
+adding an executing status whose retry_time is the end of the lease and
+whose error_response records the consumer ({"lease_owner": consumerID}).
+The candidate jobs are locked with FOR UPDATE SKIP LOCKED, so concurrent
+claims don't wait for each other, and are checked again once locked, as a
+claim which committed in between isn't visible to the query which locked
+them. Only the jobs the claim's own INSERT added a status to are returned,
+so a job is never handed to two consumers.
+
+A consumer renews the leases of the jobs it is still working on with
+RenewLeases and ends them by updating the status as usual. If it dies,
+its leases run out and ClaimToRetry hands the jobs to another consumer.
+
+Claims don't use the empty result cache, which only knows about the
+jobs stored by this process. Consumers sharing a jobsdb this way must not
+mark the executing jobs failed on startup, as the router does, since
+those can be leased by the other consumers.
+*/
+
+package jobsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rudderlabs/rudder-server/jobsdb/querybuilder"
+)
+
+type leaseT struct {
+	LeaseOwner string `json:"lease_owner"`
+}
+
+/*
+ClaimUnprocessed leases up to count jobs without any status to consumerID
+for leaseDuration
+*/
+func (jd *HandleT) ClaimUnprocessed(consumerID string, filters QueryFiltersT, count int, leaseDuration time.Duration) []*JobT {
+	return jd.claim(consumerID, filters, count, leaseDuration, false)
+}
+
+/*
+ClaimToRetry leases up to count jobs to consumerID for leaseDuration,
+among the failed jobs due for retry and the jobs whose lease has ended
+*/
+func (jd *HandleT) ClaimToRetry(consumerID string, filters QueryFiltersT, count int, leaseDuration time.Duration) []*JobT {
+	return jd.claim(consumerID, filters, count, leaseDuration, true)
+}
+
+func (jd *HandleT) claim(consumerID string, filters QueryFiltersT, count int, leaseDuration time.Duration, retry bool) []*JobT {
+
+	jd.assert(consumerID != "")
+
+	//The order of lock is very important. The mainCheckLoop
+	//takes lock in this order so reversing this will cause
+	//deadlocks
+	jd.dsMigrationLock.RLock()
+	jd.dsListLock.RLock()
+	defer jd.dsMigrationLock.RUnlock()
+	defer jd.dsListLock.RUnlock()
+
+	outJobs := make([]*JobT, 0)
+	jd.assert(count >= 0)
+	if count == 0 {
+		return outJobs
+	}
+	for _, ds := range jd.getDSList(false) {
+		jobs := jd.claimDS(ds, consumerID, filters, count, leaseDuration, retry)
+		outJobs = append(outJobs, jobs...)
+		count -= len(jobs)
+		jd.assert(count >= 0)
+		if count == 0 {
+			break
+		}
+	}
+	return outJobs
+}
+
+//claimableCondition adds to query the condition on the latest status
+//(last) of the jobs ClaimUnprocessed or ClaimToRetry can lease
+func claimableCondition(query *querybuilder.QueryT, retry bool, now time.Time) {
+	if !retry {
+		query.Where(`last.job_id IS NULL`)
+		return
+	}
+	query.Where(fmt.Sprintf(`last.retry_time < %s AND (last.job_state = '%s' OR
+                               (last.job_state = '%s' AND last.error_response->>'lease_owner' IS NOT NULL))`,
+		query.Bind(now), FailedState, ExecutingState))
+}
+
+func (jd *HandleT) claimDS(ds dataSetT, consumerID string, filters QueryFiltersT, count int,
+	leaseDuration time.Duration, retry bool) []*JobT {
+
+	lease, err := json.Marshal(leaseT{LeaseOwner: consumerID})
+	jd.assertError(err)
+	now := time.Now()
+
+	txn, err := jd.dbHandle.Begin()
+	jd.assertError(err)
+	defer txn.Rollback()
+	afterID := jd.maxStatusID(txn, ds)
+
+	//Lock the candidates, skipping the ones being claimed by others
+	query := querybuilder.New()
+	claimableCondition(query, retry, now)
+	jd.applyFilters(query, filters, ds.JobTable)
+	sqlStatement := fmt.Sprintf(`SELECT %[1]s.job_id FROM %[1]s LEFT JOIN %[2]s AS last ON %[1]s.job_id=last.job_id
+                                   WHERE TRUE %[3]s
+                                   ORDER BY %[1]s.job_id LIMIT %[4]s
+                                   FOR UPDATE OF %[1]s SKIP LOCKED`,
+		ds.JobTable, jd.lastStatusTableName(ds), query.Conditions(), query.Bind(count))
+	rows, err := txn.Query(sqlStatement, query.Args()...)
+	jd.assertError(err)
+	var lockedIDs []int64
+	for rows.Next() {
+		var jobID int64
+		err = rows.Scan(&jobID)
+		jd.assertError(err)
+		lockedIDs = append(lockedIDs, jobID)
+	}
+	rows.Close()
+	if len(lockedIDs) == 0 {
+		return []*JobT{}
+	}
+
+	//This statement sees the claims committed since, so the jobs
+	//claimed by someone else are left out. The latest status of those
+	//is newer than afterID too, so only the jobs it returns are ours
+	query = querybuilder.New(now, now.Add(leaseDuration), string(lease), pq.Array(lockedIDs))
+	claimableCondition(query, retry, now)
+	sqlStatement = fmt.Sprintf(`INSERT INTO %[2]s (job_id, job_state, attempt, exec_time, retry_time,
+                                   error_code, error_response)
+                                 SELECT %[1]s.job_id, '%[4]s', COALESCE(last.attempt, 0), $1, $2, '', $3
+                                 FROM %[1]s LEFT JOIN %[3]s AS last ON %[1]s.job_id=last.job_id
+                                 WHERE %[1]s.job_id = ANY($4) %[5]s
+                               RETURNING job_id`,
+		ds.JobTable, ds.JobStatusTable, jd.lastStatusTableName(ds), ExecutingState, query.Conditions())
+	rows, err = txn.Query(sqlStatement, query.Args()...)
+	jd.assertError(err)
+	var claimedIDs []int64
+	for rows.Next() {
+		var jobID int64
+		err = rows.Scan(&jobID)
+		jd.assertError(err)
+		claimedIDs = append(claimedIDs, jobID)
+	}
+	rows.Close()
+	if len(claimedIDs) == 0 {
+		return []*JobT{}
+	}
+	jd.updateLastStatus(txn, ds, afterID)
+
+	sqlStatement = fmt.Sprintf(`SELECT
+                                   %[1]s.job_id, %[1]s.uuid, %[1]s.parameters, %[1]s.custom_val, %[1]s.partition_key, %[1]s.event_payload, %[1]s.event_payload_compressed,
+                                   %[1]s.created_at, %[1]s.expire_at,
+                                   last.job_state, last.attempt, last.exec_time, last.retry_time,
+                                   last.error_code, last.error_response
+                                 FROM %[1]s, %[2]s AS last
+                                 WHERE %[1]s.job_id=last.job_id AND %[1]s.job_id = ANY($1)
+                                 ORDER BY %[1]s.job_id`,
+		ds.JobTable, jd.lastStatusTableName(ds))
+	rows, err = txn.Query(sqlStatement, pq.Array(claimedIDs))
+	jd.assertError(err)
+	jobList := []*JobT{}
+	for rows.Next() {
+		var job JobT
+		var payload payloadScanT
+		err = rows.Scan(&job.JobID, &job.UUID, &job.Parameters, &job.CustomVal, &job.PartitionKey,
+			&payload.plain, &payload.compressed, &job.CreatedAt, &job.ExpireAt,
+			&job.LastJobStatus.JobState, &job.LastJobStatus.AttemptNum,
+			&job.LastJobStatus.ExecTime, &job.LastJobStatus.RetryTime,
+			&job.LastJobStatus.ErrorCode, &job.LastJobStatus.ErrorResponse)
+		jd.assertError(err)
+		job.EventPayload = jd.decodePayload(&payload)
+		job.LastJobStatus.JobID = job.JobID
+		jobList = append(jobList, &job)
+	}
+	rows.Close()
+
+	err = txn.Commit()
+	jd.assertError(err)
+	if len(jobList) > 0 {
+		jd.markClearEmptyResult(ds, []string{}, []string{}, false)
+	}
+	return jobList
+}
+
+/*
+RenewLeases extends to leaseDuration from now the leases consumerID holds
+on jobIDs. It returns the jobs whose lease was renewed, which excludes the
+ones whose lease has already been taken over by another consumer
+*/
+func (jd *HandleT) RenewLeases(consumerID string, jobIDs []int64, leaseDuration time.Duration) []int64 {
+
+	jd.assert(consumerID != "")
+	if len(jobIDs) == 0 {
+		return []int64{}
+	}
+	lease, err := json.Marshal(leaseT{LeaseOwner: consumerID})
+	jd.assertError(err)
+	now := time.Now()
+
+	jd.dsMigrationLock.RLock()
+	jd.dsListLock.RLock()
+	defer jd.dsMigrationLock.RUnlock()
+	defer jd.dsListLock.RUnlock()
+
+	renewedIDs := []int64{}
+	for _, ds := range jd.getDSList(false) {
+		txn, err := jd.dbHandle.Begin()
+		jd.assertError(err)
+		afterID := jd.maxStatusID(txn, ds)
+
+		//Claims skip the jobs locked here, so a lease being renewed
+		//isn't taken over at the same time
+		sqlStatement := fmt.Sprintf(`SELECT job_id FROM %s WHERE job_id = ANY($1) ORDER BY job_id FOR UPDATE`,
+			ds.JobTable)
+		_, err = txn.Exec(sqlStatement, pq.Array(jobIDs))
+		jd.assertError(err)
+
+		sqlStatement = fmt.Sprintf(`INSERT INTO %[1]s (job_id, job_state, attempt, exec_time, retry_time,
+                                       error_code, error_response)
+                                     SELECT job_id, job_state, attempt, $1, $2, '', $3 FROM %[2]s
+                                     WHERE job_id = ANY($4) AND job_state = '%[3]s'
+                                       AND error_response->>'lease_owner' = $5
+                                   RETURNING job_id`,
+			ds.JobStatusTable, jd.lastStatusTableName(ds), ExecutingState)
+		rows, err := txn.Query(sqlStatement, now, now.Add(leaseDuration), string(lease), pq.Array(jobIDs), consumerID)
+		jd.assertError(err)
+		for rows.Next() {
+			var jobID int64
+			err = rows.Scan(&jobID)
+			jd.assertError(err)
+			renewedIDs = append(renewedIDs, jobID)
+		}
+		rows.Close()
+
+		jd.updateLastStatus(txn, ds, afterID)
+		err = txn.Commit()
+		jd.assertError(err)
+	}
+	return renewedIDs
+}
@@ -0,0 +1,186 @@
+/*
+Dataset metrics. Every metricsSleepDuration, metricsLoop reports for
+each jobsdb (jobsdb.<prefix>. is prefixed to every name)
+
+	datasets                                number of datasets
+	ds_rows.<index>                         jobs in each dataset (estimated)
+	<custom_val>_jobs_<state>               jobs by custom_val and latest state
+	                                        (unprocessed if they have no status)
+	<custom_val>_oldest_unprocessed_age     in seconds
+
+The loops report their timings (main_check_loop, migrate_jobs, backup_ds)
+and every journal operation is counted and timed (journal_<op>).
+*/
+
+package jobsdb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/services/stats"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+)
+
+var (
+	enableMetrics        bool
+	metricsSleepDuration time.Duration
+)
+
+func loadMetricsConfig() {
+	enableMetrics = config.GetBool("JobsDB.enableMetrics", true)
+	metricsSleepDuration = config.GetDuration("JobsDB.metricsSleepDurationInS", time.Duration(15)) * time.Second
+}
+
+type journalOpT struct {
+	opType    string
+	startTime time.Time
+}
+
+type jobsDBStatsT struct {
+	mainCheckLoopStat *stats.RudderStats
+	migrateJobsStat   *stats.RudderStats
+	backupDSStat      *stats.RudderStats
+	datasetsStat      *stats.RudderStats
+
+	//Gauges are created on demand and kept, so that a gauge whose
+	//value has disappeared (e.g. no more failed jobs) is reset to 0
+	gauges   map[string]*stats.RudderStats
+	reported map[string]bool
+
+	journalOps     map[int64]journalOpT
+	journalOpsLock sync.Mutex
+}
+
+func (jd *HandleT) statName(name string) string {
+	return fmt.Sprintf("jobsdb.%s.%s", jd.tablePrefix, name)
+}
+
+func (jd *HandleT) setupStats() {
+	jd.stats = jobsDBStatsT{
+		mainCheckLoopStat: stats.NewStat(jd.statName("main_check_loop"), stats.TimerType),
+		migrateJobsStat:   stats.NewStat(jd.statName("migrate_jobs"), stats.TimerType),
+		backupDSStat:      stats.NewStat(jd.statName("backup_ds"), stats.TimerType),
+		datasetsStat:      stats.NewStat(jd.statName("datasets"), stats.GaugeType),
+		gauges:            map[string]*stats.RudderStats{},
+		reported:          map[string]bool{},
+		journalOps:        map[int64]journalOpT{},
+	}
+	if enableMetrics {
+		go jd.metricsLoop()
+	}
+}
+
+//journalOpStarted and journalOpDone time the journal operations
+func (jd *HandleT) journalOpStarted(opID int64, opType string) {
+	stats.NewStat(jd.statName("journal_"+opType), stats.CountType).Increment()
+	jd.stats.journalOpsLock.Lock()
+	defer jd.stats.journalOpsLock.Unlock()
+	jd.stats.journalOps[opID] = journalOpT{opType: opType, startTime: time.Now()}
+}
+
+func (jd *HandleT) journalOpDone(opID int64) {
+	jd.stats.journalOpsLock.Lock()
+	op, ok := jd.stats.journalOps[opID]
+	delete(jd.stats.journalOps, opID)
+	jd.stats.journalOpsLock.Unlock()
+	if ok {
+		stats.NewStat(jd.statName("journal_"+op.opType+"_time"), stats.TimerType).SendTiming(time.Since(op.startTime))
+	}
+}
+
+func (jd *HandleT) metricsLoop() {
+	for {
+		time.Sleep(metricsSleepDuration)
+		jd.reportMetrics()
+	}
+}
+
+//reportMetrics sends the dataset gauges. Only this goroutine touches
+//the gauges and reported maps. The datasets are queried without the
+//locks, so that the scans don't hold up stores and migrations. If a
+//dataset is dropped meanwhile, nothing is reported till the next round
+func (jd *HandleT) reportMetrics() {
+	jd.dsMigrationLock.RLock()
+	jd.dsListLock.RLock()
+	dsList := jd.getDSList(false)
+	jd.dsListLock.RUnlock()
+	jd.dsMigrationLock.RUnlock()
+
+	values := map[string]int64{}
+	oldestUnprocessed := map[string]time.Time{}
+	for _, ds := range dsList {
+		err := jd.readDSMetrics(ds, values, oldestUnprocessed)
+		if pqErr, ok := err.(*pq.Error); ok && string(pqErr.Code) == dbErrorMap["Undefined Table"] {
+			logger.Debugf("%s metrics: dataset %s dropped while reading it", jd.tablePrefix, ds.Index)
+			return
+		}
+		jd.assertError(err)
+	}
+
+	for customVal, oldest := range oldestUnprocessed {
+		values[customVal+"_oldest_unprocessed_age"] = int64(time.Since(oldest) / time.Second)
+	}
+
+	jd.stats.datasetsStat.Guage(len(dsList))
+	for name := range jd.stats.reported {
+		if _, ok := values[name]; !ok {
+			values[name] = 0
+		}
+	}
+	jd.stats.reported = map[string]bool{}
+	for name, value := range values {
+		gauge, ok := jd.stats.gauges[name]
+		if !ok {
+			gauge = stats.NewStat(jd.statName(name), stats.GaugeType)
+			jd.stats.gauges[name] = gauge
+		}
+		gauge.Guage(value)
+		if value != 0 {
+			jd.stats.reported[name] = true
+		}
+	}
+}
+
+//readDSMetrics adds the rows of ds by custom_val and latest state to
+//values. The row count of the dataset is the planner's estimate, to
+//save a second scan
+func (jd *HandleT) readDSMetrics(ds dataSetT, values map[string]int64, oldestUnprocessed map[string]time.Time) error {
+	var rows int64
+	err := jd.readQueryRow(`SELECT GREATEST(reltuples, 0)::BIGINT FROM pg_class WHERE oid=$1::regclass`,
+		[]interface{}{ds.JobTable}, &rows)
+	if err != nil {
+		return err
+	}
+	values["ds_rows."+ds.Index] = rows
+
+	sqlStatement := fmt.Sprintf(`SELECT %[1]s.custom_val, COALESCE(last.job_state::text, 'unprocessed'),
+                                     COUNT(*), MIN(%[1]s.created_at)
+                                   FROM %[1]s LEFT JOIN %[2]s AS last ON %[1]s.job_id=last.job_id
+                                   GROUP BY 1, 2`, ds.JobTable, jd.lastStatusTableName(ds))
+	dbRows, err := jd.readQuery(sqlStatement)
+	if err != nil {
+		return err
+	}
+	defer dbRows.Close()
+	for dbRows.Next() {
+		var customVal, state string
+		var count int64
+		var oldest time.Time
+		err = dbRows.Scan(&customVal, &state, &count, &oldest)
+		if err != nil {
+			return err
+		}
+		values[fmt.Sprintf("%s_jobs_%s", customVal, state)] += count
+		if state != "unprocessed" {
+			continue
+		}
+		if current, ok := oldestUnprocessed[customVal]; !ok || oldest.Before(current) {
+			oldestUnprocessed[customVal] = oldest
+		}
+	}
+	return dbRows.Err()
+}
@@ -0,0 +1,182 @@
+/*
+Notifications for jobsdb consumers. Instead of polling with fixed sleeps,
+consumers Subscribe to a set of custom_vals and block on the returned
+channel. Store and UpdateJobStatus publish the affected custom_vals on the
+Postgres channel <prefix>_jobs_notify (NOTIFY), and a listener per HandleT
+(LISTEN) fans them out to the matching subscribers. An empty payload wakes
+up every subscriber.
+
+Notifications can be lost (listener reconnecting, notifications disabled)
+and jobs can become eligible without any write (retry_time passing), so
+every subscriber is also woken up every notifyPollInterval. Subscribers
+that need retry-due jobs sooner, like the router and the processor, bound
+their wait with their own shorter read sleep. When notifications are
+disabled, writes made by this process still wake up the local subscribers
+directly.
+*/
+
+package jobsdb
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+)
+
+var (
+	enableNotifications        bool
+	notifyPollInterval         time.Duration
+	notifyMinReconnectInterval time.Duration
+	notifyMaxReconnectInterval time.Duration
+)
+
+func loadNotifyConfig() {
+	enableNotifications = config.GetBool("JobsDB.enableNotifications", true)
+	notifyPollInterval = config.GetDuration("JobsDB.notifyPollIntervalInMS", time.Duration(1000)) * time.Millisecond
+	notifyMinReconnectInterval = config.GetDuration("JobsDB.notifyMinReconnectIntervalInS", time.Duration(1)) * time.Second
+	notifyMaxReconnectInterval = config.GetDuration("JobsDB.notifyMaxReconnectIntervalInS", time.Duration(60)) * time.Second
+}
+
+//subscriberT is one consumer waiting on a set of custom_vals.
+//An empty customValFilters matches every custom_val
+type subscriberT struct {
+	customValFilters map[string]bool
+	notifyChan       chan bool
+}
+
+type notifierT struct {
+	subscribers     []*subscriberT
+	subscribersLock sync.RWMutex
+	listener        *pq.Listener
+}
+
+func (jd *HandleT) notifyChannelName() string {
+	return jd.tablePrefix + "_jobs_notify"
+}
+
+//setupNotifier starts the listener (if enabled) and the fallback poll loop
+func (jd *HandleT) setupNotifier() {
+	if enableNotifications {
+		jd.notifier.listener = pq.NewListener(GetConnectionString(), notifyMinReconnectInterval,
+			notifyMaxReconnectInterval, jd.listenerEventCallback)
+		err := jd.notifier.listener.Listen(jd.notifyChannelName())
+		jd.assertError(err)
+		go jd.listenLoop()
+	}
+	go jd.notifyPollLoop()
+}
+
+func (jd *HandleT) listenerEventCallback(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+		logger.Errorf("%s notification listener: %v", jd.tablePrefix, err)
+	case pq.ListenerEventReconnected:
+		//Notifications sent while disconnected are lost
+		logger.Infof("%s notification listener reconnected", jd.tablePrefix)
+		jd.dispatchNotification("")
+	}
+}
+
+func (jd *HandleT) listenLoop() {
+	for notification := range jd.notifier.listener.Notify {
+		//nil is sent after a reconnect, which the callback handles
+		if notification == nil {
+			continue
+		}
+		jd.dispatchNotification(notification.Extra)
+	}
+}
+
+func (jd *HandleT) notifyPollLoop() {
+	for {
+		time.Sleep(notifyPollInterval)
+		jd.dispatchNotification("")
+	}
+}
+
+//dispatchNotification wakes up the subscribers of a custom_val.
+//The send never blocks; a pending wake up already covers this one
+func (jd *HandleT) dispatchNotification(customVal string) {
+	jd.notifier.subscribersLock.RLock()
+	defer jd.notifier.subscribersLock.RUnlock()
+	for _, subscriber := range jd.notifier.subscribers {
+		if customVal != "" && len(subscriber.customValFilters) > 0 && !subscriber.customValFilters[customVal] {
+			continue
+		}
+		select {
+		case subscriber.notifyChan <- true:
+		default:
+		}
+	}
+}
+
+//publish tells all the subscribers (in any process) that jobs of
+//these custom_vals changed. An empty list wakes up everyone
+func (jd *HandleT) publish(customVals []string) {
+	if len(customVals) == 0 {
+		customVals = []string{""}
+	}
+	for _, customVal := range customVals {
+		if !enableNotifications {
+			jd.dispatchNotification(customVal)
+			continue
+		}
+		_, err := jd.dbHandle.Exec(`SELECT pg_notify($1, $2)`, jd.notifyChannelName(), customVal)
+		if err != nil {
+			//The poll loop will pick up the change
+			logger.Errorf("Failed to notify %s: %v", strings.Join(customVals, ","), err)
+			jd.dispatchNotification(customVal)
+		}
+	}
+}
+
+//publishJobs publishes the distinct custom_vals of a job list
+func (jd *HandleT) publishJobs(jobList []*JobT) {
+	seen := map[string]bool{}
+	var customVals []string
+	for _, job := range jobList {
+		if !seen[job.CustomVal] {
+			seen[job.CustomVal] = true
+			customVals = append(customVals, job.CustomVal)
+		}
+	}
+	jd.publish(customVals)
+}
+
+/*
+Subscribe returns a channel which receives a value whenever jobs of one
+of the customValFilters (all custom_vals if empty) are stored or change
+status. The channel is also signalled periodically, so callers can block
+on it in place of sleeping between queries
+*/
+func (jd *HandleT) Subscribe(customValFilters []string) <-chan bool {
+	subscriber := &subscriberT{
+		customValFilters: map[string]bool{},
+		notifyChan:       make(chan bool, 1),
+	}
+	for _, customVal := range customValFilters {
+		subscriber.customValFilters[customVal] = true
+	}
+	jd.notifier.subscribersLock.Lock()
+	jd.notifier.subscribers = append(jd.notifier.subscribers, subscriber)
+	jd.notifier.subscribersLock.Unlock()
+	return subscriber.notifyChan
+}
+
+/*
+Unsubscribe stops notifications on a channel returned by Subscribe
+*/
+func (jd *HandleT) Unsubscribe(notifyChan <-chan bool) {
+	jd.notifier.subscribersLock.Lock()
+	defer jd.notifier.subscribersLock.Unlock()
+	for i, subscriber := range jd.notifier.subscribers {
+		if subscriber.notifyChan == notifyChan {
+			jd.notifier.subscribers = append(jd.notifier.subscribers[:i], jd.notifier.subscribers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,497 @@
+/*
+Package parquet writes tables of nullable text values as Apache Parquet
+files, and reads them back. It covers what dataset backups need and no
+more: every column is an optional UTF8 BYTE_ARRAY, each column chunk is a
+single PLAIN encoded data page compressed with GZIP, and a row group is
+written every rowGroupSize rows so that only one row group is held in
+memory at a time.
+
+The reader reads the files of this writer, and more generally files of
+flat BYTE_ARRAY columns in PLAIN encoded v1 data pages, uncompressed or
+GZIP compressed. Anything else (dictionary pages, nested or repeated
+columns, other codecs) is reported as unsupported.
+
+The tests check both against the files of a reference implementation
+(see testdata).
+*/
+package parquet
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const magic = "PAR1"
+
+//Values of the Parquet thrift enums used here
+const (
+	typeByteArray      = 6
+	repetitionRequired = 0
+	repetitionOptional = 1
+	convertedUTF8      = 0
+	encodingPlain      = 0
+	encodingRLE        = 3
+	codecUncompressed  = 0
+	codecGzip          = 2
+	pageTypeData       = 0
+)
+
+var errUnsupported = errors.New("parquet: unsupported file")
+
+//countingWriterT keeps the offset of what has been written, which the
+//metadata refers to
+type countingWriterT struct {
+	w     io.Writer
+	count int64
+}
+
+func (writer *countingWriterT) Write(p []byte) (int, error) {
+	n, err := writer.w.Write(p)
+	writer.count += int64(n)
+	return n, err
+}
+
+type columnChunkT struct {
+	numValues        int64
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type rowGroupT struct {
+	numRows int64
+	columns []columnChunkT
+}
+
+//WriterT writes rows to a Parquet file
+type WriterT struct {
+	w            *countingWriterT
+	columns      []string
+	rowGroupSize int
+	//The values of the current row group, by column
+	values    [][]sql.NullString
+	numRows   int64
+	rowGroups []rowGroupT
+}
+
+//NewWriter starts a Parquet file of columns on w. Close must be called
+//to write the rows left and the metadata
+func NewWriter(w io.Writer, columns []string, rowGroupSize int) (*WriterT, error) {
+	if rowGroupSize < 1 {
+		rowGroupSize = 1
+	}
+	writer := &WriterT{
+		w:            &countingWriterT{w: w},
+		columns:      columns,
+		rowGroupSize: rowGroupSize,
+		values:       make([][]sql.NullString, len(columns)),
+	}
+	_, err := io.WriteString(writer.w, magic)
+	return writer, err
+}
+
+//WriteRow adds a row, one value per column
+func (writer *WriterT) WriteRow(values []sql.NullString) error {
+	if len(values) != len(writer.columns) {
+		return fmt.Errorf("parquet: row of %d values for %d columns", len(values), len(writer.columns))
+	}
+	for i, value := range values {
+		writer.values[i] = append(writer.values[i], value)
+	}
+	if len(writer.values[0]) >= writer.rowGroupSize {
+		return writer.writeRowGroup()
+	}
+	return nil
+}
+
+//Close writes the last row group and the file metadata. It doesn't
+//close the underlying writer
+func (writer *WriterT) Close() error {
+	if len(writer.columns) > 0 && len(writer.values[0]) > 0 {
+		err := writer.writeRowGroup()
+		if err != nil {
+			return err
+		}
+	}
+	footer := writer.encodeFileMetaData()
+	_, err := writer.w.Write(footer)
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(footer)))
+	_, err = writer.w.Write(size[:])
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(writer.w, magic)
+	return err
+}
+
+func (writer *WriterT) writeRowGroup() error {
+	rowGroup := rowGroupT{numRows: int64(len(writer.values[0]))}
+	for i := range writer.columns {
+		chunk, err := writer.writeColumnChunk(writer.values[i])
+		if err != nil {
+			return err
+		}
+		rowGroup.columns = append(rowGroup.columns, chunk)
+		writer.values[i] = writer.values[i][:0]
+	}
+	writer.rowGroups = append(writer.rowGroups, rowGroup)
+	writer.numRows += rowGroup.numRows
+	return nil
+}
+
+//writeColumnChunk writes values as one data page: the definition levels
+//(1 for a value, 0 for a NULL) followed by the values which aren't NULL
+func (writer *WriterT) writeColumnChunk(values []sql.NullString) (columnChunkT, error) {
+	levels := encodeLevels(values)
+	page := make([]byte, 4, 4+len(levels))
+	binary.LittleEndian.PutUint32(page, uint32(len(levels)))
+	page = append(page, levels...)
+	var size [4]byte
+	for _, value := range values {
+		if !value.Valid {
+			continue
+		}
+		binary.LittleEndian.PutUint32(size[:], uint32(len(value.String)))
+		page = append(page, size[:]...)
+		page = append(page, value.String...)
+	}
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, err := gzipWriter.Write(page)
+	if err != nil {
+		return columnChunkT{}, err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return columnChunkT{}, err
+	}
+
+	enc := newEncoder()
+	enc.fieldI32(1, pageTypeData)
+	enc.fieldI32(2, int32(len(page)))
+	enc.fieldI32(3, int32(compressed.Len()))
+	enc.fieldStruct(5)
+	enc.fieldI32(1, int32(len(values)))
+	enc.fieldI32(2, encodingPlain)
+	enc.fieldI32(3, encodingRLE)
+	enc.fieldI32(4, encodingRLE)
+	enc.structEnd()
+	enc.structEnd()
+
+	chunk := columnChunkT{
+		numValues:        int64(len(values)),
+		offset:           writer.w.count,
+		uncompressedSize: int64(len(enc.buf) + len(page)),
+		compressedSize:   int64(len(enc.buf) + compressed.Len()),
+	}
+	_, err = writer.w.Write(enc.buf)
+	if err != nil {
+		return columnChunkT{}, err
+	}
+	_, err = compressed.WriteTo(writer.w)
+	return chunk, err
+}
+
+//encodeLevels encodes the definition levels of values as RLE runs of
+//the RLE/bit-packing hybrid, with a bit width of 1
+func encodeLevels(values []sql.NullString) []byte {
+	var levels []byte
+	var b [binary.MaxVarintLen64]byte
+	for start := 0; start < len(values); {
+		end := start + 1
+		for end < len(values) && values[end].Valid == values[start].Valid {
+			end++
+		}
+		n := binary.PutUvarint(b[:], uint64(end-start)<<1)
+		levels = append(levels, b[:n]...)
+		if values[start].Valid {
+			levels = append(levels, 1)
+		} else {
+			levels = append(levels, 0)
+		}
+		start = end
+	}
+	return levels
+}
+
+func (writer *WriterT) encodeFileMetaData() []byte {
+	enc := newEncoder()
+	enc.fieldI32(1, 1)
+	enc.fieldList(2, typeStruct, len(writer.columns)+1)
+	enc.structBegin()
+	enc.fieldBinary(4, "schema")
+	enc.fieldI32(5, int32(len(writer.columns)))
+	enc.structEnd()
+	for _, column := range writer.columns {
+		enc.structBegin()
+		enc.fieldI32(1, typeByteArray)
+		enc.fieldI32(3, repetitionOptional)
+		enc.fieldBinary(4, column)
+		enc.fieldI32(6, convertedUTF8)
+		enc.structEnd()
+	}
+	enc.fieldI64(3, writer.numRows)
+	enc.fieldList(4, typeStruct, len(writer.rowGroups))
+	for _, rowGroup := range writer.rowGroups {
+		var totalSize int64
+		enc.structBegin()
+		enc.fieldList(1, typeStruct, len(rowGroup.columns))
+		for i, chunk := range rowGroup.columns {
+			totalSize += chunk.uncompressedSize
+			enc.structBegin()
+			enc.fieldI64(2, chunk.offset)
+			enc.fieldStruct(3)
+			enc.fieldI32(1, typeByteArray)
+			enc.fieldList(2, typeI32, 2)
+			enc.zigzag(encodingPlain)
+			enc.zigzag(encodingRLE)
+			enc.fieldList(3, typeBinary, 1)
+			enc.binary(writer.columns[i])
+			enc.fieldI32(4, codecGzip)
+			enc.fieldI64(5, chunk.numValues)
+			enc.fieldI64(6, chunk.uncompressedSize)
+			enc.fieldI64(7, chunk.compressedSize)
+			enc.fieldI64(9, chunk.offset)
+			enc.structEnd()
+			enc.structEnd()
+		}
+		enc.fieldI64(2, totalSize)
+		enc.fieldI64(3, rowGroup.numRows)
+		enc.structEnd()
+	}
+	enc.fieldBinary(6, "rudder-server")
+	enc.structEnd()
+	return enc.buf
+}
+
+//ReaderT reads the rows of a Parquet file
+type ReaderT struct {
+	r         io.ReaderAt
+	columns   []string
+	optional  []bool
+	rowGroups []interface{}
+	//The values of the current row group, by column
+	values       [][]sql.NullString
+	nextRow      int
+	nextRowGroup int
+}
+
+//NewReader reads the metadata of the Parquet file of size bytes in r
+func NewReader(r io.ReaderAt, size int64) (*ReaderT, error) {
+	if size < 12 {
+		return nil, errors.New("parquet: file too short")
+	}
+	var tail [8]byte
+	_, err := r.ReadAt(tail[:], size-8)
+	if err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != magic {
+		return nil, errors.New("parquet: not a parquet file")
+	}
+	footerSize := int64(binary.LittleEndian.Uint32(tail[:4]))
+	if footerSize > size-12 {
+		return nil, errInvalidThrift
+	}
+	dec := decoderT{r: bufio.NewReader(io.NewSectionReader(r, size-8-footerSize, footerSize))}
+	metaData, err := dec.readStruct()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &ReaderT{r: r, rowGroups: metaData.getList(4)}
+	schema := metaData.getList(2)
+	if len(schema) == 0 {
+		return nil, errInvalidThrift
+	}
+	for _, item := range schema[1:] {
+		element, _ := item.(structT)
+		repetition := element.getInt(3)
+		if element.getInt(1) != typeByteArray || element.getInt(5) != 0 ||
+			(repetition != repetitionRequired && repetition != repetitionOptional) {
+			return nil, fmt.Errorf("%v: column %s isn't a flat BYTE_ARRAY", errUnsupported, element.getBinary(4))
+		}
+		reader.columns = append(reader.columns, element.getBinary(4))
+		reader.optional = append(reader.optional, repetition == repetitionOptional)
+	}
+	return reader, nil
+}
+
+//Columns returns the names of the columns
+func (reader *ReaderT) Columns() []string {
+	return reader.columns
+}
+
+//Read returns the next row, one value per column, and io.EOF once there
+//are no more. The row is only valid until the next call
+func (reader *ReaderT) Read() ([]sql.NullString, error) {
+	for len(reader.values) == 0 || reader.nextRow >= len(reader.values[0]) {
+		if reader.nextRowGroup >= len(reader.rowGroups) || len(reader.columns) == 0 {
+			return nil, io.EOF
+		}
+		err := reader.readRowGroup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	row := make([]sql.NullString, len(reader.columns))
+	for i := range reader.columns {
+		row[i] = reader.values[i][reader.nextRow]
+	}
+	reader.nextRow++
+	return row, nil
+}
+
+func (reader *ReaderT) readRowGroup() error {
+	rowGroup, _ := reader.rowGroups[reader.nextRowGroup].(structT)
+	reader.nextRowGroup++
+	reader.nextRow = 0
+	chunks := rowGroup.getList(1)
+	if len(chunks) != len(reader.columns) {
+		return errInvalidThrift
+	}
+	reader.values = make([][]sql.NullString, len(reader.columns))
+	for i, item := range chunks {
+		chunk, _ := item.(structT)
+		values, err := reader.readColumnChunk(chunk.getStruct(3), reader.optional[i])
+		if err != nil {
+			return err
+		}
+		if int64(len(values)) != rowGroup.getInt(3) {
+			return fmt.Errorf("parquet: column %s has %d values for %d rows", reader.columns[i], len(values), rowGroup.getInt(3))
+		}
+		reader.values[i] = values
+	}
+	return nil
+}
+
+func (reader *ReaderT) readColumnChunk(metaData structT, optional bool) ([]sql.NullString, error) {
+	codec := metaData.getInt(4)
+	if codec != codecUncompressed && codec != codecGzip {
+		return nil, fmt.Errorf("%v: codec %d", errUnsupported, codec)
+	}
+	numValues := metaData.getInt(5)
+	section := io.NewSectionReader(reader.r, metaData.getInt(9), metaData.getInt(7))
+	dec := decoderT{r: bufio.NewReader(section)}
+
+	values := make([]sql.NullString, 0, numValues)
+	for int64(len(values)) < numValues {
+		header, err := dec.readStruct()
+		if err != nil {
+			return nil, err
+		}
+		if header.getInt(1) != pageTypeData {
+			return nil, fmt.Errorf("%v: page type %d", errUnsupported, header.getInt(1))
+		}
+		data := make([]byte, header.getInt(3))
+		_, err = io.ReadFull(dec.r, data)
+		if err != nil {
+			return nil, err
+		}
+		if codec == codecGzip {
+			gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			data, err = ioutil.ReadAll(gzipReader)
+			if err != nil {
+				return nil, err
+			}
+		}
+		pageHeader := header.getStruct(5)
+		if pageHeader.getInt(2) != encodingPlain {
+			return nil, fmt.Errorf("%v: encoding %d", errUnsupported, pageHeader.getInt(2))
+		}
+		values, err = decodePage(values, data, int(pageHeader.getInt(1)), optional)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+var errInvalidPage = errors.New("parquet: invalid data page")
+
+//decodePage appends the n values of a PLAIN encoded data page to values
+func decodePage(values []sql.NullString, data []byte, n int, optional bool) ([]sql.NullString, error) {
+	var levels []byte
+	if optional {
+		if len(data) < 4 {
+			return nil, errInvalidPage
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		if len(data) < 4+size {
+			return nil, errInvalidPage
+		}
+		var err error
+		levels, err = decodeLevels(data[4:4+size], n)
+		if err != nil {
+			return nil, err
+		}
+		data = data[4+size:]
+	}
+	for i := 0; i < n; i++ {
+		if optional && levels[i] == 0 {
+			values = append(values, sql.NullString{})
+			continue
+		}
+		if len(data) < 4 {
+			return nil, errInvalidPage
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		if len(data) < 4+size {
+			return nil, errInvalidPage
+		}
+		values = append(values, sql.NullString{String: string(data[4 : 4+size]), Valid: true})
+		data = data[4+size:]
+	}
+	return values, nil
+}
+
+//decodeLevels decodes n definition levels of bit width 1 from the
+//RLE/bit-packing hybrid
+func decodeLevels(data []byte, n int) ([]byte, error) {
+	levels := make([]byte, 0, n)
+	for len(levels) < n {
+		header, size := binary.Uvarint(data)
+		if size <= 0 {
+			return nil, errInvalidPage
+		}
+		data = data[size:]
+		if header&1 == 0 {
+			//RLE run of one value
+			if len(data) < 1 {
+				return nil, errInvalidPage
+			}
+			for count := header >> 1; count > 0; count-- {
+				levels = append(levels, data[0]&1)
+			}
+			data = data[1:]
+			continue
+		}
+		//Bit-packed groups of 8 values, one byte each at bit width 1
+		groups := int(header >> 1)
+		if len(data) < groups {
+			return nil, errInvalidPage
+		}
+		for _, b := range data[:groups] {
+			for bit := uint(0); bit < 8; bit++ {
+				levels = append(levels, (b>>bit)&1)
+			}
+		}
+		data = data[groups:]
+	}
+	return levels[:n], nil
+}
@@ -0,0 +1,203 @@
+package parquet_test
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/jobsdb/parquet"
+)
+
+/*
+The golden files check the files against a reference implementation,
+github.com/xitongsys/parquet-go v1.6.2:
+
+  - written.parquet is written by this package from goldenRows, and
+    written.reference.json is what the reference reader read from it
+  - reference_uncompressed.parquet and reference_gzip.parquet are written
+    by the reference writer from written.reference.json (optional UTF8
+    BYTE_ARRAY columns, PLAIN encoding)
+
+Run with -update to rewrite written.parquet from the current writer. The
+other files only change by running the reference implementation again
+*/
+var update = flag.Bool("update", false, "rewrite the golden files written by this package")
+
+//goldenTableT is a table in the JSON of the golden files, NULLs as null
+type goldenTableT struct {
+	Columns []string    `json:"columns"`
+	Rows    [][]*string `json:"rows"`
+}
+
+func readGoldenTable(path string) ([]string, [][]sql.NullString) {
+	data, err := ioutil.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	var table goldenTableT
+	Expect(json.Unmarshal(data, &table)).To(Succeed())
+	var rows [][]sql.NullString
+	for _, goldenRow := range table.Rows {
+		var row []sql.NullString
+		for _, goldenValue := range goldenRow {
+			if goldenValue == nil {
+				row = append(row, sql.NullString{})
+			} else {
+				row = append(row, value(*goldenValue))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return table.Columns, rows
+}
+
+//goldenRows are jobRows with empty values, which aren't NULLs, and text
+//which isn't ASCII
+func goldenRows() [][]sql.NullString {
+	rows := jobRows(25)
+	for i, row := range rows {
+		if i%5 == 1 {
+			row[1] = value("")
+		}
+		if i%4 == 2 {
+			row[2] = value(fmt.Sprintf(`{"event":"Prüfung ✓","messageId":"msg-%d"}`, i))
+		}
+	}
+	return rows
+}
+
+func value(str string) sql.NullString {
+	return sql.NullString{String: str, Valid: true}
+}
+
+//jobRows are rows shaped like those of a jobs table, with a NULL every
+//third custom_val
+func jobRows(n int) [][]sql.NullString {
+	var rows [][]sql.NullString
+	for i := 0; i < n; i++ {
+		customVal := value("GA")
+		if i%3 == 0 {
+			customVal = sql.NullString{}
+		}
+		rows = append(rows, []sql.NullString{
+			value(fmt.Sprint(i + 1)),
+			customVal,
+			value(fmt.Sprintf(`{"event":"Product Viewed","messageId":"msg-%d"}`, i)),
+		})
+	}
+	return rows
+}
+
+func write(columns []string, rows [][]sql.NullString, rowGroupSize int) []byte {
+	var file bytes.Buffer
+	writer, err := parquet.NewWriter(&file, columns, rowGroupSize)
+	Expect(err).NotTo(HaveOccurred())
+	for _, row := range rows {
+		Expect(writer.WriteRow(row)).To(Succeed())
+	}
+	Expect(writer.Close()).To(Succeed())
+	return file.Bytes()
+}
+
+func readAll(file []byte) ([]string, [][]sql.NullString) {
+	reader, err := parquet.NewReader(bytes.NewReader(file), int64(len(file)))
+	Expect(err).NotTo(HaveOccurred())
+	var rows [][]sql.NullString
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		Expect(err).NotTo(HaveOccurred())
+		rows = append(rows, row)
+	}
+	return reader.Columns(), rows
+}
+
+var _ = Describe("Parquet", func() {
+	columns := []string{"job_id", "custom_val", "event_payload"}
+
+	It("reads back what it writes, NULLs included", func() {
+		rows := jobRows(10)
+		file := write(columns, rows, 100)
+		Expect(string(file[:4])).To(Equal("PAR1"))
+		Expect(string(file[len(file)-4:])).To(Equal("PAR1"))
+
+		readColumns, readRows := readAll(file)
+		Expect(readColumns).To(Equal(columns))
+		Expect(readRows).To(Equal(rows))
+	})
+
+	It("writes a row group every rowGroupSize rows", func() {
+		rows := jobRows(25)
+		_, readRows := readAll(write(columns, rows, 10))
+		Expect(readRows).To(Equal(rows))
+
+		//A row group per row
+		_, readRows = readAll(write(columns, rows[:3], 1))
+		Expect(readRows).To(Equal(rows[:3]))
+	})
+
+	It("compresses the columns", func() {
+		rows := jobRows(1000)
+		var size int
+		for _, row := range rows {
+			for _, value := range row {
+				size += len(value.String)
+			}
+		}
+		Expect(len(write(columns, rows, 1000))).To(BeNumerically("<", size/4))
+	})
+
+	It("writes a file without rows", func() {
+		readColumns, readRows := readAll(write(columns, nil, 10))
+		Expect(readColumns).To(Equal(columns))
+		Expect(readRows).To(BeEmpty())
+	})
+
+	It("writes the files the reference implementation reads", func() {
+		file := write(columns, goldenRows(), 10)
+		if *update {
+			Expect(ioutil.WriteFile("testdata/written.parquet", file, 0644)).To(Succeed())
+		}
+		golden, err := ioutil.ReadFile("testdata/written.parquet")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(file).To(Equal(golden), "run with -update and read testdata/written.parquet with the reference implementation")
+
+		referenceColumns, referenceRows := readGoldenTable("testdata/written.reference.json")
+		Expect(referenceColumns).To(Equal(columns))
+		Expect(referenceRows).To(Equal(goldenRows()))
+	})
+
+	It("reads the files the reference implementation writes", func() {
+		for _, path := range []string{"testdata/reference_uncompressed.parquet", "testdata/reference_gzip.parquet"} {
+			file, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			readColumns, readRows := readAll(file)
+			Expect(readColumns).To(Equal(columns), path)
+			Expect(readRows).To(Equal(goldenRows()), path)
+		}
+	})
+
+	It("rejects rows of the wrong width", func() {
+		writer, err := parquet.NewWriter(&bytes.Buffer{}, columns, 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writer.WriteRow([]sql.NullString{value("1")})).NotTo(Succeed())
+	})
+
+	It("rejects files which aren't parquet", func() {
+		file := []byte(`{"job_id":1}` + "\n" + `{"job_id":2}` + "\n")
+		_, err := parquet.NewReader(bytes.NewReader(file), int64(len(file)))
+		Expect(err).To(HaveOccurred())
+
+		//Truncated
+		file = write(columns, jobRows(5), 10)
+		file = file[:len(file)-20]
+		_, err = parquet.NewReader(bytes.NewReader(file), int64(len(file)))
+		Expect(err).To(HaveOccurred())
+	})
+})
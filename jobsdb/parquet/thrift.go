@@ -0,0 +1,245 @@
+package parquet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//Thrift compact protocol types, the ones the Parquet metadata uses
+const (
+	typeBoolTrue  = 1
+	typeBoolFalse = 2
+	typeByte      = 3
+	typeI16       = 4
+	typeI32       = 5
+	typeI64       = 6
+	typeDouble    = 7
+	typeBinary    = 8
+	typeList      = 9
+	typeSet       = 10
+	typeMap       = 11
+	typeStruct    = 12
+)
+
+//encoderT writes Thrift compact protocol structs. Fields must be written
+//in increasing id order within a struct
+type encoderT struct {
+	buf       []byte
+	lastField []int16
+}
+
+func newEncoder() *encoderT {
+	return &encoderT{lastField: []int16{0}}
+}
+
+func (enc *encoderT) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	enc.buf = append(enc.buf, b[:n]...)
+}
+
+func (enc *encoderT) zigzag(v int64) {
+	enc.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (enc *encoderT) fieldHeader(id int16, fieldType byte) {
+	last := &enc.lastField[len(enc.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		enc.buf = append(enc.buf, byte(delta)<<4|fieldType)
+	} else {
+		enc.buf = append(enc.buf, fieldType)
+		enc.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (enc *encoderT) fieldI32(id int16, v int32) {
+	enc.fieldHeader(id, typeI32)
+	enc.zigzag(int64(v))
+}
+
+func (enc *encoderT) fieldI64(id int16, v int64) {
+	enc.fieldHeader(id, typeI64)
+	enc.zigzag(v)
+}
+
+func (enc *encoderT) fieldBinary(id int16, v string) {
+	enc.fieldHeader(id, typeBinary)
+	enc.binary(v)
+}
+
+func (enc *encoderT) binary(v string) {
+	enc.varint(uint64(len(v)))
+	enc.buf = append(enc.buf, v...)
+}
+
+//fieldList starts a list field of size elements. The elements follow,
+//without field headers
+func (enc *encoderT) fieldList(id int16, elemType byte, size int) {
+	enc.fieldHeader(id, typeList)
+	if size < 15 {
+		enc.buf = append(enc.buf, byte(size)<<4|elemType)
+	} else {
+		enc.buf = append(enc.buf, 0xf0|elemType)
+		enc.varint(uint64(size))
+	}
+}
+
+//fieldStruct starts a struct field, ended by structEnd
+func (enc *encoderT) fieldStruct(id int16) {
+	enc.fieldHeader(id, typeStruct)
+	enc.structBegin()
+}
+
+//structBegin starts a struct which is a list element (or the top level
+//struct, which needs no begin)
+func (enc *encoderT) structBegin() {
+	enc.lastField = append(enc.lastField, 0)
+}
+
+func (enc *encoderT) structEnd() {
+	enc.buf = append(enc.buf, 0)
+	if len(enc.lastField) > 1 {
+		enc.lastField = enc.lastField[:len(enc.lastField)-1]
+	}
+}
+
+//structT is a decoded struct, its fields by id. Integers decode as
+//int64, binaries as []byte, lists as []interface{} and structs as structT
+type structT map[int16]interface{}
+
+func (s structT) getInt(id int16) int64 {
+	v, _ := s[id].(int64)
+	return v
+}
+
+func (s structT) getBinary(id int16) string {
+	v, _ := s[id].([]byte)
+	return string(v)
+}
+
+func (s structT) getStruct(id int16) structT {
+	v, _ := s[id].(structT)
+	return v
+}
+
+func (s structT) getList(id int16) []interface{} {
+	v, _ := s[id].([]interface{})
+	return v
+}
+
+var errInvalidThrift = errors.New("parquet: invalid thrift metadata")
+
+//decoderT reads Thrift compact protocol structs of any shape
+type decoderT struct {
+	r *bufio.Reader
+}
+
+func (dec *decoderT) readStruct() (structT, error) {
+	s := structT{}
+	var lastField int16
+	for {
+		header, err := dec.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if header == 0 {
+			return s, nil
+		}
+		fieldType := header & 0x0f
+		if delta := int16(header >> 4); delta != 0 {
+			lastField += delta
+		} else {
+			id, err := binary.ReadVarint(dec.r)
+			if err != nil {
+				return nil, err
+			}
+			lastField = int16(id)
+		}
+		s[lastField], err = dec.readValue(fieldType)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (dec *decoderT) readValue(valueType byte) (interface{}, error) {
+	switch valueType {
+	case typeBoolTrue:
+		return true, nil
+	case typeBoolFalse:
+		return false, nil
+	case typeByte:
+		b, err := dec.r.ReadByte()
+		return int64(int8(b)), err
+	case typeI16, typeI32, typeI64:
+		return binary.ReadVarint(dec.r)
+	case typeDouble:
+		var v [8]byte
+		_, err := io.ReadFull(dec.r, v[:])
+		return v, err
+	case typeBinary:
+		size, err := binary.ReadUvarint(dec.r)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]byte, size)
+		_, err = io.ReadFull(dec.r, v)
+		return v, err
+	case typeList, typeSet:
+		header, err := dec.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			size, err = binary.ReadUvarint(dec.r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		list := make([]interface{}, 0, size)
+		for i := uint64(0); i < size; i++ {
+			elemType := header & 0x0f
+			//Booleans in lists are one byte each
+			if elemType == typeBoolTrue || elemType == typeBoolFalse {
+				b, err := dec.r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, b == 1)
+				continue
+			}
+			v, err := dec.readValue(elemType)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case typeStruct:
+		return dec.readStruct()
+	case typeMap:
+		size, err := binary.ReadUvarint(dec.r)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		types, err := dec.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < size; i++ {
+			if _, err = dec.readValue(types >> 4); err != nil {
+				return nil, err
+			}
+			if _, err = dec.readValue(types & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%v: type %d", errInvalidThrift, valueType)
+}
@@ -0,0 +1,185 @@
+/*
+Pausing consumption. A custom_val (e.g. a destination during an outage),
+or only the jobs of one source in it, can be paused with Pause and
+resumed with Resume. The pauses are kept in the <prefix>_paused table.
+While paused, the jobs are left out of every Get* and Claim* fetch, so
+they keep whatever status they have and consumers don't touch them.
+Migration still moves them like any other job.
+
+Every process keeps a copy of the pauses, reloaded every
+pauseRefreshInterval so that a pause or resume done by another process
+is picked up.
+*/
+
+package jobsdb
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/jobsdb/querybuilder"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+)
+
+var pauseRefreshInterval time.Duration
+
+func loadPauseConfig() {
+	pauseRefreshInterval = config.GetDuration("JobsDB.pauseRefreshIntervalInS", time.Duration(10)) * time.Second
+}
+
+//PauseT pauses the jobs of CustomVal, only those of SourceID if set
+type PauseT struct {
+	CustomVal string
+	SourceID  string
+	PausedAt  time.Time
+}
+
+//pausedT is the in memory copy of the pauses. An empty source
+//in sources[customVal] means the whole custom_val is paused
+type pausedT struct {
+	sources map[string][]string
+	lock    sync.RWMutex
+}
+
+func (jd *HandleT) pausedTableName() string {
+	return fmt.Sprintf("%s_paused", jd.tablePrefix)
+}
+
+func (jd *HandleT) setupPauseTable() {
+	sqlStatement := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+                                   custom_val VARCHAR(64) NOT NULL,
+                                   source_id TEXT NOT NULL DEFAULT '',
+                                   paused_at TIMESTAMP NOT NULL,
+                                   PRIMARY KEY (custom_val, source_id));`, jd.pausedTableName())
+	_, err := jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+	jd.loadPaused()
+	go jd.pauseRefreshLoop()
+}
+
+func (jd *HandleT) dropPauseTable() {
+	sqlStatement := fmt.Sprintf(`DROP TABLE IF EXISTS %s`, jd.pausedTableName())
+	_, err := jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+}
+
+func (jd *HandleT) pauseRefreshLoop() {
+	for {
+		time.Sleep(pauseRefreshInterval)
+		jd.loadPaused()
+	}
+}
+
+/*
+GetPaused returns the pauses in place
+*/
+func (jd *HandleT) GetPaused() []PauseT {
+	sqlStatement := fmt.Sprintf(`SELECT custom_val, source_id, paused_at FROM %s ORDER BY custom_val, source_id`,
+		jd.pausedTableName())
+	rows, err := jd.dbHandle.Query(sqlStatement)
+	jd.assertError(err)
+	defer rows.Close()
+
+	pauses := []PauseT{}
+	for rows.Next() {
+		var pause PauseT
+		err = rows.Scan(&pause.CustomVal, &pause.SourceID, &pause.PausedAt)
+		jd.assertError(err)
+		pauses = append(pauses, pause)
+	}
+	return pauses
+}
+
+//loadPaused reloads the in memory copy. Jobs which were left out of
+//fetches may have been cached as empty results, so the cache is
+//cleared and the consumers woken up if anything was resumed
+func (jd *HandleT) loadPaused() {
+	sources := map[string][]string{}
+	for _, pause := range jd.GetPaused() {
+		sources[pause.CustomVal] = append(sources[pause.CustomVal], pause.SourceID)
+	}
+
+	jd.paused.lock.Lock()
+	previous := jd.paused.sources
+	jd.paused.sources = sources
+	jd.paused.lock.Unlock()
+
+	var resumed []string
+	for customVal, previousSources := range previous {
+		if !reflect.DeepEqual(previousSources, sources[customVal]) {
+			resumed = append(resumed, customVal)
+		}
+	}
+	if len(resumed) == 0 {
+		return
+	}
+	jd.dsListLock.RLock()
+	for _, ds := range jd.getDSList(false) {
+		jd.markClearEmptyResult(ds, []string{}, []string{}, false)
+	}
+	jd.dsListLock.RUnlock()
+	jd.publish(resumed)
+}
+
+/*
+Pause stops the jobs of customVal from being fetched, or only those
+of sourceID if it isn't empty
+*/
+func (jd *HandleT) Pause(customVal string, sourceID string) {
+	jd.assert(customVal != "")
+	sqlStatement := fmt.Sprintf(`INSERT INTO %s (custom_val, source_id, paused_at) VALUES ($1, $2, $3)
+                                   ON CONFLICT (custom_val, source_id) DO NOTHING`, jd.pausedTableName())
+	_, err := jd.dbHandle.Exec(sqlStatement, customVal, sourceID, time.Now())
+	jd.assertError(err)
+	logger.Infof("Paused %s jobs of %s (source %q)", jd.tablePrefix, customVal, sourceID)
+	jd.loadPaused()
+}
+
+/*
+Resume removes the pause set by Pause with the same arguments
+*/
+func (jd *HandleT) Resume(customVal string, sourceID string) {
+	sqlStatement := fmt.Sprintf(`DELETE FROM %s WHERE custom_val=$1 AND source_id=$2`, jd.pausedTableName())
+	_, err := jd.dbHandle.Exec(sqlStatement, customVal, sourceID)
+	jd.assertError(err)
+	logger.Infof("Resumed %s jobs of %s (source %q)", jd.tablePrefix, customVal, sourceID)
+	jd.loadPaused()
+}
+
+//excludePaused adds to query the conditions leaving out the paused jobs
+//of customValFilters (of every custom_val if empty). It tells if any
+//condition was added, in which case an empty result mustn't be cached
+func (jd *HandleT) excludePaused(query *querybuilder.QueryT, jobTable string, customValFilters []string) bool {
+	jd.paused.lock.RLock()
+	defer jd.paused.lock.RUnlock()
+
+	var pausedCustomVals []string
+	excluded := false
+	for customVal, sources := range jd.paused.sources {
+		if len(customValFilters) > 0 && !contains(customValFilters, customVal) {
+			continue
+		}
+		if contains(sources, "") {
+			pausedCustomVals = append(pausedCustomVals, customVal)
+			continue
+		}
+		query.Where(fmt.Sprintf(`NOT (%[1]s.custom_val = %[2]s AND COALESCE(%[1]s.parameters->>'source_id', '') = ANY(%[3]s))`,
+			jobTable, query.Bind(customVal), query.Bind(pq.Array(sources))))
+		excluded = true
+	}
+	query.NoneOf(jobTable+".custom_val", pausedCustomVals)
+	return excluded || len(pausedCustomVals) > 0
+}
+
+func contains(list []string, value string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+/*
+Event payload compression. With JobsDB.payloadCompression (which can be
+overridden per table prefix in a [JobsDB.<prefix>] table) set to a codec
+of the compression package, jobs are stored with their payload encoded
+in the event_payload_compressed BYTEA column and a NULL event_payload.
+
+The two layouts can be mixed in a dataset: readers decode whichever
+column is set, so payloads stored before the setting changed stay
+readable, and migration rewrites the jobs it copies with the current
+setting. JSON is validated before compression, as postgres can't.
+*/
+
+package jobsdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/jobsdb/compression"
+)
+
+var errInvalidJSON = errors.New("invalid JSON payload")
+
+func (jd *HandleT) setupPayloadCodec() {
+	name := config.GetString("JobsDB.payloadCompression", "none")
+	name = config.GetString("JobsDB."+jd.tablePrefix+".payloadCompression", name)
+	if name == "none" || name == "" {
+		jd.payloadCodec = nil
+		return
+	}
+	codec, ok := compression.Lookup(name)
+	if !ok {
+		jd.assertError(fmt.Errorf("unknown payload compression %q", name))
+	}
+	jd.payloadCodec = codec
+}
+
+//addCompressedPayloadColumn upgrades a dataset created before payloads
+//could be compressed
+func (jd *HandleT) addCompressedPayloadColumn(ds dataSetT) {
+	sqlStatement := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS event_payload_compressed BYTEA,
+                                   ALTER COLUMN event_payload DROP NOT NULL`, ds.JobTable)
+	_, err := jd.dbHandle.Exec(sqlStatement)
+	jd.assertError(err)
+}
+
+//encodePayload returns the event_payload and event_payload_compressed
+//values to store. One of them is nil
+func (jd *HandleT) encodePayload(payload json.RawMessage) (interface{}, interface{}, error) {
+	if jd.payloadCodec == nil {
+		return string(payload), nil, nil
+	}
+	if !json.Valid(payload) {
+		return nil, nil, errInvalidJSON
+	}
+	compressed, err := jd.payloadCodec.Encode(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, compressed, nil
+}
+
+//payloadScanT holds the event_payload and event_payload_compressed
+//columns of a row until decodePayload
+type payloadScanT struct {
+	plain      json.RawMessage
+	compressed []byte
+}
+
+func (jd *HandleT) decodePayload(scan *payloadScanT) json.RawMessage {
+	if len(scan.compressed) == 0 {
+		return scan.plain
+	}
+	payload, err := compression.Decode(scan.compressed)
+	jd.assertError(err)
+	return payload
+}
@@ -0,0 +1,124 @@
+/*
+Package querybuilder builds the conditions of a WHERE clause with every
+value passed as a bound parameter. Lists are bound as one array
+parameter and matched with = ANY($n), so the statement text doesn't
+depend on the values at all.
+
+	q := querybuilder.New(time.Now())   // $1 is already used by the caller
+	q.AnyOf("jobs.custom_val", customVals).JSONAnyOf("jobs.parameters", "source_id", sourceIDs)
+	sqlStatement := "SELECT ... WHERE retry_time < $1" + q.Conditions()
+	rows, err := db.Query(sqlStatement, q.Args()...)
+
+Column names and JSON keys come from the code, never from the caller's
+data, and are checked to be plain identifiers.
+*/
+package querybuilder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var identifierRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)?$`)
+
+//QueryT collects conditions and their parameters
+type QueryT struct {
+	conditions []string
+	args       []interface{}
+}
+
+//New returns a QueryT whose parameters are numbered after args
+func New(args ...interface{}) *QueryT {
+	return &QueryT{args: args}
+}
+
+func checkIdentifier(identifier string) {
+	if !identifierRegexp.MatchString(identifier) {
+		panic(fmt.Errorf("querybuilder: %q is not an identifier", identifier))
+	}
+}
+
+//Bind adds a parameter and returns its placeholder
+func (q *QueryT) Bind(value interface{}) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+//Where adds a condition. Any value in it must come from Bind
+func (q *QueryT) Where(condition string) *QueryT {
+	q.conditions = append(q.conditions, "("+condition+")")
+	return q
+}
+
+//AnyOf adds column = ANY(values). Empty values add nothing
+func (q *QueryT) AnyOf(column string, values []string) *QueryT {
+	if len(values) == 0 {
+		return q
+	}
+	checkIdentifier(column)
+	return q.Where(fmt.Sprintf("%s = ANY(%s)", column, q.Bind(pq.Array(values))))
+}
+
+//NoneOf adds NOT (column = ANY(values)). Empty values add nothing
+func (q *QueryT) NoneOf(column string, values []string) *QueryT {
+	if len(values) == 0 {
+		return q
+	}
+	checkIdentifier(column)
+	return q.Where(fmt.Sprintf("NOT (%s = ANY(%s))", column, q.Bind(pq.Array(values))))
+}
+
+//JSONAnyOf adds column->>'key' = ANY(values). Empty values add nothing
+func (q *QueryT) JSONAnyOf(column string, key string, values []string) *QueryT {
+	if len(values) == 0 {
+		return q
+	}
+	checkIdentifier(column)
+	checkIdentifier(key)
+	return q.Where(fmt.Sprintf("%s->>'%s' = ANY(%s)", column, key, q.Bind(pq.Array(values))))
+}
+
+//After adds column > t. A zero t adds nothing
+func (q *QueryT) After(column string, t time.Time) *QueryT {
+	if t.IsZero() {
+		return q
+	}
+	checkIdentifier(column)
+	return q.Where(fmt.Sprintf("%s > %s", column, q.Bind(t)))
+}
+
+//Before adds column < t. A zero t adds nothing
+func (q *QueryT) Before(column string, t time.Time) *QueryT {
+	if t.IsZero() {
+		return q
+	}
+	checkIdentifier(column)
+	return q.Where(fmt.Sprintf("%s < %s", column, q.Bind(t)))
+}
+
+//AfterID adds column > id. A zero id adds nothing
+func (q *QueryT) AfterID(column string, id int64) *QueryT {
+	if id == 0 {
+		return q
+	}
+	checkIdentifier(column)
+	return q.Where(fmt.Sprintf("%s > %s", column, q.Bind(id)))
+}
+
+//Conditions returns the conditions as " AND c1 AND c2", to be appended
+//to a WHERE clause. It is empty if there are no conditions
+func (q *QueryT) Conditions() string {
+	if len(q.conditions) == 0 {
+		return ""
+	}
+	return " AND " + strings.Join(q.conditions, " AND ")
+}
+
+//Args returns the parameters, including those New was called with
+func (q *QueryT) Args() []interface{} {
+	return q.args
+}
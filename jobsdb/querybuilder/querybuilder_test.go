@@ -0,0 +1,103 @@
+package querybuilder_test
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/jobsdb/querybuilder"
+)
+
+var _ = Describe("QueryBuilder", func() {
+
+	Context("without conditions", func() {
+
+		It("adds nothing to the statement", func() {
+			q := querybuilder.New()
+			Expect(q.Conditions()).To(Equal(""))
+			Expect(q.Args()).To(BeEmpty())
+		})
+
+		It("skips empty lists and zero times", func() {
+			q := querybuilder.New().
+				AnyOf("jobs.custom_val", []string{}).
+				JSONAnyOf("jobs.parameters", "source_id", nil).
+				After("jobs.created_at", time.Time{}).
+				Before("jobs.created_at", time.Time{})
+			Expect(q.Conditions()).To(Equal(""))
+			Expect(q.Args()).To(BeEmpty())
+		})
+	})
+
+	Context("with conditions", func() {
+
+		It("excludes lists with NOT ANY", func() {
+			q := querybuilder.New().NoneOf("jobs.custom_val", []string{"GA"})
+			Expect(q.Conditions()).To(Equal(" AND (NOT (jobs.custom_val = ANY($1)))"))
+			Expect(q.Args()).To(Equal([]interface{}{pq.Array([]string{"GA"})}))
+		})
+
+		It("binds lists as one array parameter", func() {
+			q := querybuilder.New().AnyOf("jobs.custom_val", []string{"GA", "AM"})
+			Expect(q.Conditions()).To(Equal(" AND (jobs.custom_val = ANY($1))"))
+			Expect(q.Args()).To(Equal([]interface{}{pq.Array([]string{"GA", "AM"})}))
+		})
+
+		It("matches JSON keys of a column", func() {
+			q := querybuilder.New().JSONAnyOf("jobs.parameters", "source_id", []string{"src"})
+			Expect(q.Conditions()).To(Equal(" AND (jobs.parameters->>'source_id' = ANY($1))"))
+			Expect(q.Args()).To(Equal([]interface{}{pq.Array([]string{"src"})}))
+		})
+
+		It("binds time ranges", func() {
+			after := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			before := after.Add(time.Hour)
+			q := querybuilder.New().After("created_at", after).Before("created_at", before)
+			Expect(q.Conditions()).To(Equal(" AND (created_at > $1) AND (created_at < $2)"))
+			Expect(q.Args()).To(Equal([]interface{}{after, before}))
+		})
+
+		It("binds job id lower bounds", func() {
+			q := querybuilder.New().AfterID("jobs.job_id", 0)
+			Expect(q.Conditions()).To(Equal(""))
+			q.AfterID("jobs.job_id", 42)
+			Expect(q.Conditions()).To(Equal(" AND (jobs.job_id > $1)"))
+			Expect(q.Args()).To(Equal([]interface{}{int64(42)}))
+		})
+
+		It("numbers parameters after the ones it was created with", func() {
+			now := time.Now()
+			q := querybuilder.New(now).AnyOf("state", []string{"failed"})
+			q.Where("attempt < " + q.Bind(3))
+			Expect(q.Conditions()).To(Equal(" AND (state = ANY($2)) AND (attempt < $3)"))
+			Expect(q.Args()).To(Equal([]interface{}{now, pq.Array([]string{"failed"}), 3}))
+		})
+
+		It("never puts values in the statement", func() {
+			malicious := []string{"x') OR ('1'='1", `{"a":"b"}`}
+			q := querybuilder.New().
+				AnyOf("jobs.custom_val", malicious).
+				JSONAnyOf("jobs.parameters", "source_id", malicious)
+			for _, value := range malicious {
+				Expect(q.Conditions()).NotTo(ContainSubstring(value))
+			}
+			Expect(q.Args()).To(HaveLen(2))
+		})
+	})
+
+	Context("with bad identifiers", func() {
+
+		It("panics on columns which aren't identifiers", func() {
+			Expect(func() {
+				querybuilder.New().AnyOf("custom_val; DROP TABLE jobs", []string{"GA"})
+			}).To(Panic())
+		})
+
+		It("panics on JSON keys which aren't identifiers", func() {
+			Expect(func() {
+				querybuilder.New().JSONAnyOf("parameters", "source_id'--", []string{"src"})
+			}).To(Panic())
+		})
+	})
+})
@@ -0,0 +1,161 @@
+/*
+Read replicas and connection pools. Read only queries which can live
+with slightly stale data (the migration counts, the GET endpoints of the
+admin API and the dataset metrics) go to a replica through readQueryRow
+and readQuery. Reads which decide a change of state, like whether a dead
+letter was already requeued, stay on the primary.
+The replicas are set as a ;-separated list of connection strings in the
+JOBS_DB_READ_REPLICAS environment variable.
+
+replicaCheckLoop measures the replication lag of every replica. One
+lagging by more than maxReplicaLag, or which can't be reached, isn't
+used until it catches up. Without a usable replica, or if a query fails
+on the replica (e.g. the table of a new dataset hasn't been replicated
+yet), the query runs on the primary.
+
+The pool settings apply to the primary and to every replica.
+*/
+
+package jobsdb
+
+import (
+	"database/sql"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+)
+
+var (
+	maxOpenConns              int
+	maxIdleConns              int
+	connMaxLifetime           time.Duration
+	readReplicas              []string
+	maxReplicaLag             time.Duration
+	replicaCheckSleepDuration time.Duration
+)
+
+func loadReplicaConfig() {
+	maxOpenConns = config.GetInt("JobsDB.maxOpenConns", 0)
+	maxIdleConns = config.GetInt("JobsDB.maxIdleConns", 2)
+	connMaxLifetime = config.GetDuration("JobsDB.connMaxLifetimeInS", time.Duration(0)) * time.Second
+	maxReplicaLag = config.GetDuration("JobsDB.maxReplicaLagInS", time.Duration(5)) * time.Second
+	replicaCheckSleepDuration = config.GetDuration("JobsDB.replicaCheckSleepDurationInS", time.Duration(5)) * time.Second
+
+	readReplicas = []string{}
+	for _, connectionString := range strings.Split(config.GetEnv("JOBS_DB_READ_REPLICAS", ""), ";") {
+		if strings.TrimSpace(connectionString) != "" {
+			readReplicas = append(readReplicas, strings.TrimSpace(connectionString))
+		}
+	}
+}
+
+type replicaT struct {
+	dbHandle *sql.DB
+	usable   int32
+}
+
+type replicasT struct {
+	list []*replicaT
+	next uint32
+}
+
+//setupPool applies the pool settings to a connection pool
+func setupPool(dbHandle *sql.DB) {
+	dbHandle.SetMaxOpenConns(maxOpenConns)
+	dbHandle.SetMaxIdleConns(maxIdleConns)
+	dbHandle.SetConnMaxLifetime(connMaxLifetime)
+}
+
+func (jd *HandleT) setupReplicas() {
+	if len(readReplicas) == 0 {
+		return
+	}
+	for _, connectionString := range readReplicas {
+		dbHandle, err := sql.Open("postgres", connectionString)
+		jd.assertError(err)
+		setupPool(dbHandle)
+		jd.replicas.list = append(jd.replicas.list, &replicaT{dbHandle: dbHandle})
+	}
+	jd.checkReplicas()
+	go jd.replicaCheckLoop()
+}
+
+func (jd *HandleT) closeReplicas() {
+	for _, replica := range jd.replicas.list {
+		replica.dbHandle.Close()
+	}
+}
+
+func (jd *HandleT) replicaCheckLoop() {
+	for {
+		time.Sleep(replicaCheckSleepDuration)
+		jd.checkReplicas()
+	}
+}
+
+//checkReplicas marks usable the replicas within maxReplicaLag
+//of the primary
+func (jd *HandleT) checkReplicas() {
+	for i, replica := range jd.replicas.list {
+		//A replica which has replayed all it has received is up to date,
+		//even if the last replayed transaction is old (the primary is idle)
+		var lagInS float64
+		err := replica.dbHandle.QueryRow(`SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+                                            ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`).Scan(&lagInS)
+		lag := time.Duration(lagInS * float64(time.Second))
+		usable := err == nil && lag <= maxReplicaLag
+
+		wasUsable := atomic.LoadInt32(&replica.usable) == 1
+		if usable && !wasUsable {
+			logger.Infof("Using %s read replica %d", jd.tablePrefix, i)
+			atomic.StoreInt32(&replica.usable, 1)
+		} else if !usable && wasUsable {
+			if err != nil {
+				logger.Errorf("Not using %s read replica %d: %v", jd.tablePrefix, i, err)
+			} else {
+				logger.Errorf("Not using %s read replica %d: lagging by %v", jd.tablePrefix, i, lag)
+			}
+			atomic.StoreInt32(&replica.usable, 0)
+		}
+	}
+}
+
+//readHandle returns the next usable replica, round robin, or nil
+func (jd *HandleT) readHandle() *sql.DB {
+	count := len(jd.replicas.list)
+	for i := 0; i < count; i++ {
+		replica := jd.replicas.list[int(atomic.AddUint32(&jd.replicas.next, 1))%count]
+		if atomic.LoadInt32(&replica.usable) == 1 {
+			return replica.dbHandle
+		}
+	}
+	return nil
+}
+
+//readQueryRow is QueryRow(...).Scan(dest...) on a replica, falling back
+//to the primary. sql.ErrNoRows from the replica is returned as is
+func (jd *HandleT) readQueryRow(sqlStatement string, args []interface{}, dest ...interface{}) error {
+	if dbHandle := jd.readHandle(); dbHandle != nil {
+		err := dbHandle.QueryRow(sqlStatement, args...).Scan(dest...)
+		if err == nil || err == sql.ErrNoRows {
+			return err
+		}
+		logger.Debugf("Read replica query failed, using the primary: %v", err)
+	}
+	return jd.dbHandle.QueryRow(sqlStatement, args...).Scan(dest...)
+}
+
+//readQuery is Query on a replica, falling back to the primary
+func (jd *HandleT) readQuery(sqlStatement string, args ...interface{}) (*sql.Rows, error) {
+	if dbHandle := jd.readHandle(); dbHandle != nil {
+		rows, err := dbHandle.Query(sqlStatement, args...)
+		if err == nil {
+			return rows, nil
+		}
+		logger.Debugf("Read replica query failed, using the primary: %v", err)
+	}
+	return jd.dbHandle.Query(sqlStatement, args...)
+}
@@ -0,0 +1,652 @@
+/*
+Restore of datasets from the archives written by backupTable (or by the
+older json_agg backups). A jobs archive and its job status archive can be
+restored in two ways
+
+1. As the dataset they were backed up from (<prefix>_jobs_N and
+<prefix>_job_status_N), keeping job ids and status ids. This is only
+possible if the dataset doesn't exist and its job ids fit between those
+of the datasets around it.
+
+2. Into the current (last) dataset, as new jobs. Job ids are taken from
+the dataset's sequence and the statuses are replayed on the new ids.
+
+The jobs and statuses of a restore are loaded in one transaction, so no
+job shows up without its statuses, or as unprocessed when it had
+succeeded. Restores are meant to be run with SetupForRestore while the
+server is stopped: a running server neither picks up a recreated dataset
+(its list of datasets is only read from the database on Setup) nor
+expects jobs in the current dataset under ids it didn't hand out, and
+may be rolling that dataset over meanwhile.
+*/
+
+package jobsdb
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rudderlabs/rudder-server/jobsdb/compression"
+	"github.com/rudderlabs/rudder-server/jobsdb/parquet"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+	uuid "github.com/satori/go.uuid"
+)
+
+//RestoreStatsT is the result of a restore
+type RestoreStatsT struct {
+	Dataset  string
+	Jobs     int
+	Statuses int
+}
+
+//archiveRowT is one row of an archive. Values are in their Postgres
+//text representation; NULLs are missing
+type archiveRowT map[string]string
+
+//readArchive calls handleRow for every row of a gzipped jsonl or csv
+//archive, or of a parquet archive, picking the format from the file name
+func readArchive(path string, handleRow func(row archiveRowT) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if strings.HasSuffix(path, ".parquet") {
+		return readParquetArchive(file, handleRow)
+	}
+	gzipReader, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	if strings.HasSuffix(path, ".csv.gz") {
+		return readCSVArchive(gzipReader, handleRow)
+	}
+	return readJSONLArchive(gzipReader, handleRow)
+}
+
+func readJSONLArchive(reader io.Reader, handleRow func(row archiveRowT) error) error {
+	decoder := json.NewDecoder(reader)
+	for {
+		var rawRow map[string]json.RawMessage
+		err := decoder.Decode(&rawRow)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row := archiveRowT{}
+		for column, value := range rawRow {
+			switch {
+			case string(value) == "null":
+			case len(value) > 0 && value[0] == '"':
+				var str string
+				err = json.Unmarshal(value, &str)
+				if err != nil {
+					return err
+				}
+				row[column] = str
+			default:
+				row[column] = string(value)
+			}
+		}
+		err = handleRow(row)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readCSVArchive(reader io.Reader, handleRow func(row archiveRowT) error) error {
+	csvReader := csv.NewReader(reader)
+	header, err := csvReader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row := archiveRowT{}
+		for i, column := range header {
+			if record[i] != "" {
+				row[column] = record[i]
+			}
+		}
+		err = handleRow(row)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readParquetArchive(file *os.File, handleRow func(row archiveRowT) error) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	reader, err := parquet.NewReader(file, info.Size())
+	if err != nil {
+		return err
+	}
+	columns := reader.Columns()
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row := archiveRowT{}
+		for i, column := range columns {
+			if values[i].Valid {
+				row[column] = values[i].String
+			}
+		}
+		err = handleRow(row)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//archiveTimeLayouts are the ways timestamps show up in archives.
+//json_agg writes TIMESTAMP columns without a zone
+var archiveTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999"}
+
+func (row archiveRowT) getTime(column string) (time.Time, error) {
+	for _, layout := range archiveTimeLayouts {
+		t, err := time.Parse(layout, row[column])
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q", column, row[column])
+}
+
+func (row archiveRowT) getInt(column string) (int64, error) {
+	value, err := strconv.ParseInt(row[column], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", column, row[column])
+	}
+	return value, nil
+}
+
+func (row archiveRowT) getJSON(column string) json.RawMessage {
+	if value, ok := row[column]; ok {
+		return json.RawMessage(value)
+	}
+	return json.RawMessage(`{}`)
+}
+
+func (row archiveRowT) toJob() (*JobT, error) {
+	var job JobT
+	var err error
+	job.JobID, err = row.getInt("job_id")
+	if err != nil {
+		return nil, err
+	}
+	job.UUID, err = uuid.FromString(row["uuid"])
+	if err != nil {
+		return nil, err
+	}
+	job.CreatedAt, err = row.getTime("created_at")
+	if err != nil {
+		return nil, err
+	}
+	job.ExpireAt, err = row.getTime("expire_at")
+	if err != nil {
+		return nil, err
+	}
+	job.Parameters = row.getJSON("parameters")
+	job.EventPayload = row.getJSON("event_payload")
+	if value, ok := row["event_payload_compressed"]; ok {
+		job.EventPayload, err = decodeArchivedPayload(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	job.CustomVal = row["custom_val"]
+	job.PartitionKey = row["partition_key"]
+	return &job, nil
+}
+
+//decodeArchivedPayload decodes a compressed payload, base64 encoded as
+//backupTable writes it, or in the hex text form of the json_agg backups
+func decodeArchivedPayload(value string) (json.RawMessage, error) {
+	var compressed []byte
+	var err error
+	if strings.HasPrefix(value, `\x`) {
+		compressed, err = hex.DecodeString(strings.TrimPrefix(value, `\x`))
+	} else {
+		compressed, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid event_payload_compressed: %v", err)
+	}
+	return compression.Decode(compressed)
+}
+
+//toStatus returns the status of a row along with its id in the archive
+func (row archiveRowT) toStatus() (*JobStatusT, int64, error) {
+	var status JobStatusT
+	statusID, err := row.getInt("id")
+	if err != nil {
+		return nil, 0, err
+	}
+	status.JobID, err = row.getInt("job_id")
+	if err != nil {
+		return nil, 0, err
+	}
+	attempt, err := row.getInt("attempt")
+	if err != nil {
+		return nil, 0, err
+	}
+	status.AttemptNum = int(attempt)
+	status.ExecTime, err = row.getTime("exec_time")
+	if err != nil {
+		return nil, 0, err
+	}
+	status.RetryTime, err = row.getTime("retry_time")
+	if err != nil {
+		return nil, 0, err
+	}
+	status.JobState = row["job_state"]
+	if _, ok := validJobStates[status.JobState]; !ok {
+		return nil, 0, fmt.Errorf("invalid job_state %q", status.JobState)
+	}
+	status.ErrorCode = row["error_code"]
+	status.ErrorResponse = row.getJSON("error_response")
+	return &status, statusID, nil
+}
+
+/*
+SetupForRestore opens the database for RestoreDS only. Unlike Setup it
+doesn't terminate the queries of other connections, recover from the
+journal or start any of the loops (migration, backup, expiry, disk
+usage), so it never touches what a server may have in flight. A restore
+which crashes half way leaves an unfinished journal entry, which the next
+Setup recovers from by dropping the half restored dataset
+*/
+func (jd *HandleT) SetupForRestore(tablePrefix string) error {
+
+	jd.assert(tablePrefix != "")
+	jd.tablePrefix = tablePrefix
+	jd.dsEmptyResultCache = map[dataSetT]map[string]map[string]bool{}
+	jd.setupPayloadCodec()
+
+	var err error
+	jd.dbHandle, err = sql.Open("postgres", GetConnectionString())
+	if err != nil {
+		return err
+	}
+	err = jd.dbHandle.Ping()
+	if err != nil {
+		return err
+	}
+	jd.setupEnumTypes()
+	jd.setupJournal()
+
+	jd.getDSList(true)
+	jd.getDSRangeList(true)
+	return nil
+}
+
+//archiveIndex returns the dataset index of a jobs archive of this jobsdb
+func (jd *HandleT) archiveIndex(jobsArchive string) (string, error) {
+	archiveRegexp := regexp.MustCompile(`^` + regexp.QuoteMeta(jd.tablePrefix) + `_jobs_([0-9]+(_[0-9]+)?)\.`)
+	match := archiveRegexp.FindStringSubmatch(filepath.Base(jobsArchive))
+	if match == nil {
+		return "", fmt.Errorf("%s is not a jobs archive of %s", jobsArchive, jd.tablePrefix)
+	}
+	return match[1], nil
+}
+
+/*
+RestoreDS restores a jobs archive and its job status archive. With
+intoCurrentDS the jobs are added to the current dataset under new job
+ids, otherwise the dataset they were backed up from is recreated
+*/
+func (jd *HandleT) RestoreDS(jobsArchive string, jobStatusArchive string, intoCurrentDS bool) (RestoreStatsT, error) {
+	if intoCurrentDS {
+		return jd.restoreIntoCurrentDS(jobsArchive, jobStatusArchive)
+	}
+	return jd.restoreAsDS(jobsArchive, jobStatusArchive)
+}
+
+func (jd *HandleT) restoreAsDS(jobsArchive string, jobStatusArchive string) (stats RestoreStatsT, err error) {
+
+	dsIndex, err := jd.archiveIndex(jobsArchive)
+	if err != nil {
+		return stats, err
+	}
+	var ds dataSetT
+	ds.JobTable, ds.JobStatusTable = jd.createTableNames(dsIndex)
+	ds.Index = dsIndex
+	stats.Dataset = ds.JobTable
+
+	//We change the list of datasets
+	jd.dsMigrationLock.Lock()
+	jd.dsListLock.Lock()
+	defer jd.dsMigrationLock.Unlock()
+	defer jd.dsListLock.Unlock()
+
+	dsList := jd.getDSList(true)
+	dnumList := []string{dsIndex}
+	for _, existingDS := range dsList {
+		if existingDS.Index == dsIndex {
+			return stats, fmt.Errorf("dataset %s already exists", ds.JobTable)
+		}
+		dnumList = append(dnumList, existingDS.Index)
+	}
+	jd.sortDnumList(dnumList)
+	//The last dataset is being written to and must stay last
+	if dnumList[len(dnumList)-1] == dsIndex {
+		return stats, fmt.Errorf("dataset %s would come after the current dataset", ds.JobTable)
+	}
+
+	//If we crash, the journal makes us drop the half restored dataset
+	opPayload, err := json.Marshal(&journalOpPayloadT{To: ds})
+	jd.assertError(err)
+	opID := jd.journalMarkStart(addDSOperation, opPayload)
+	defer jd.journalMarkDone(opID)
+
+	jd.createDS(ds)
+	txn, err := jd.dbHandle.Begin()
+	jd.assertError(err)
+	stats, err = jd.loadArchivesDS(txn, ds, jobsArchive, jobStatusArchive, true)
+	stats.Dataset = ds.JobTable
+	if err == nil {
+		err = jd.checkRestoredRange(txn, ds, dnumList)
+	}
+	if err == nil {
+		err = txn.Commit()
+	} else {
+		txn.Rollback()
+	}
+	if err != nil {
+		jd.dropDS(ds, true)
+		jd.getDSList(true)
+		return stats, err
+	}
+
+	jd.getDSList(true)
+	jd.getDSRangeList(true)
+	jd.markClearEmptyResult(ds, []string{}, []string{}, false)
+	jd.publish([]string{})
+	logger.Infof("Restored %d jobs and %d statuses into %s", stats.Jobs, stats.Statuses, ds.JobTable)
+	return stats, nil
+}
+
+//checkRestoredRange makes sure the job ids of a restored dataset lie
+//between those of the datasets before and after it
+func (jd *HandleT) checkRestoredRange(txn *sql.Tx, ds dataSetT, dnumList []string) error {
+	var minID, maxID sql.NullInt64
+	sqlStatement := fmt.Sprintf(`SELECT MIN(job_id), MAX(job_id) FROM %s`, ds.JobTable)
+	err := txn.QueryRow(sqlStatement).Scan(&minID, &maxID)
+	jd.assertError(err)
+	if !minID.Valid {
+		return errors.New("jobs archive is empty")
+	}
+
+	var pos int
+	for pos = range dnumList {
+		if dnumList[pos] == ds.Index {
+			break
+		}
+	}
+	if pos > 0 {
+		prevJobTable, _ := jd.createTableNames(dnumList[pos-1])
+		var prevMax sql.NullInt64
+		sqlStatement = fmt.Sprintf(`SELECT MAX(job_id) FROM %s`, prevJobTable)
+		err = txn.QueryRow(sqlStatement).Scan(&prevMax)
+		jd.assertError(err)
+		if prevMax.Valid && prevMax.Int64 >= minID.Int64 {
+			return fmt.Errorf("job ids of %s overlap with %s", ds.JobTable, prevJobTable)
+		}
+	}
+
+	nextJobTable, _ := jd.createTableNames(dnumList[pos+1])
+	var nextMin sql.NullInt64
+	sqlStatement = fmt.Sprintf(`SELECT MIN(job_id) FROM %s`, nextJobTable)
+	err = txn.QueryRow(sqlStatement).Scan(&nextMin)
+	jd.assertError(err)
+	if nextMin.Valid && nextMin.Int64 <= maxID.Int64 {
+		return fmt.Errorf("job ids of %s overlap with %s", ds.JobTable, nextJobTable)
+	}
+	if !nextMin.Valid {
+		//The (empty) current dataset must hand out ids after ours
+		sqlStatement = fmt.Sprintf(`SELECT setval('%[1]s_job_id_seq', GREATEST(last_value, %[2]d))
+                                      FROM %[1]s_job_id_seq`, nextJobTable, maxID.Int64)
+		_, err = txn.Exec(sqlStatement)
+		jd.assertError(err)
+	}
+	return nil
+}
+
+func (jd *HandleT) restoreIntoCurrentDS(jobsArchive string, jobStatusArchive string) (stats RestoreStatsT, err error) {
+
+	//Like Store, we only write to the last dataset
+	jd.dsListLock.RLock()
+	defer jd.dsListLock.RUnlock()
+
+	dsList := jd.getDSList(false)
+	if len(dsList) == 0 {
+		return stats, fmt.Errorf("%s has no dataset to restore into", jd.tablePrefix)
+	}
+	ds := dsList[len(dsList)-1]
+	txn, err := jd.dbHandle.Begin()
+	jd.assertError(err)
+	stats, err = jd.loadArchivesDS(txn, ds, jobsArchive, jobStatusArchive, false)
+	stats.Dataset = ds.JobTable
+	if err != nil {
+		txn.Rollback()
+		return stats, err
+	}
+	err = txn.Commit()
+	if err != nil {
+		return stats, err
+	}
+	jd.markClearEmptyResult(ds, []string{}, []string{}, false)
+	jd.publish([]string{})
+	logger.Infof("Restored %d jobs and %d statuses into %s", stats.Jobs, stats.Statuses, ds.JobTable)
+	return stats, nil
+}
+
+//loadArchivesDS copies the jobs and then the statuses of the archives
+//into ds as part of txn, backupFetchSize rows at a time. With keepIDs the
+//job and status ids of the archive are kept, otherwise jobs get new ids
+//from the dataset's sequence
+func (jd *HandleT) loadArchivesDS(txn *sql.Tx, ds dataSetT, jobsArchive string, jobStatusArchive string, keepIDs bool) (stats RestoreStatsT, err error) {
+
+	jobIDMap := map[int64]int64{}
+	var jobList []*JobT
+	flushJobs := func() error {
+		if len(jobList) == 0 {
+			return nil
+		}
+		if !keepIDs {
+			jd.assignNewJobIDs(txn, ds, jobList, jobIDMap)
+		}
+		err := jd.copyJobsInTxn(txn, ds, true, jobList)
+		if err != nil {
+			return err
+		}
+		stats.Jobs += len(jobList)
+		jobList = nil
+		return nil
+	}
+	err = readArchive(jobsArchive, func(row archiveRowT) error {
+		job, err := row.toJob()
+		if err != nil {
+			return err
+		}
+		jobList = append(jobList, job)
+		if len(jobList) >= backupFetchSize {
+			return flushJobs()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flushJobs()
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	var statusList []*JobStatusT
+	var statusIDs []int64
+	flushStatuses := func() error {
+		if len(statusList) == 0 {
+			return nil
+		}
+		if !keepIDs {
+			statusIDs = nil
+		}
+		err := jd.copyJobStatusDS(txn, ds, statusList, statusIDs)
+		if err != nil {
+			return err
+		}
+		stats.Statuses += len(statusList)
+		statusList = nil
+		statusIDs = nil
+		return nil
+	}
+	err = readArchive(jobStatusArchive, func(row archiveRowT) error {
+		status, statusID, err := row.toStatus()
+		if err != nil {
+			return err
+		}
+		if !keepIDs {
+			newJobID, ok := jobIDMap[status.JobID]
+			if !ok {
+				return fmt.Errorf("status %d is for job %d which isn't in the jobs archive", statusID, status.JobID)
+			}
+			status.JobID = newJobID
+		}
+		statusList = append(statusList, status)
+		statusIDs = append(statusIDs, statusID)
+		if len(statusList) >= backupFetchSize {
+			return flushStatuses()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flushStatuses()
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	if keepIDs {
+		//Archived statuses need not be in id order, so the last
+		//status table is filled once all of them are in
+		jd.updateLastStatus(txn, ds, 0)
+
+		sqlStatement := fmt.Sprintf(`SELECT setval('%[1]s_id_seq', COALESCE(MAX(id), 1)) FROM %[1]s`, ds.JobStatusTable)
+		_, err = txn.Exec(sqlStatement)
+		jd.assertError(err)
+		sqlStatement = fmt.Sprintf(`SELECT setval('%[1]s_job_id_seq', COALESCE(MAX(job_id), 1)) FROM %[1]s`, ds.JobTable)
+		_, err = txn.Exec(sqlStatement)
+		jd.assertError(err)
+	}
+	return stats, nil
+}
+
+//assignNewJobIDs gives the jobs ids from the dataset's sequence and
+//records the mapping from the archived ids
+func (jd *HandleT) assignNewJobIDs(txn *sql.Tx, ds dataSetT, jobList []*JobT, jobIDMap map[int64]int64) {
+	sqlStatement := fmt.Sprintf(`SELECT nextval('%s_job_id_seq') FROM generate_series(1, $1)`, ds.JobTable)
+	rows, err := txn.Query(sqlStatement, len(jobList))
+	jd.assertError(err)
+	defer rows.Close()
+
+	var newJobIDs []int64
+	for rows.Next() {
+		var jobID int64
+		err = rows.Scan(&jobID)
+		jd.assertError(err)
+		newJobIDs = append(newJobIDs, jobID)
+	}
+	jd.assert(len(newJobIDs) == len(jobList))
+	sort.Slice(newJobIDs, func(i, j int) bool { return newJobIDs[i] < newJobIDs[j] })
+
+	for i, job := range jobList {
+		jobIDMap[job.JobID] = newJobIDs[i]
+		job.JobID = newJobIDs[i]
+		job.UUID = uuid.NewV4()
+	}
+}
+
+//copyJobStatusDS copies restored statuses as part of txn. Without
+//statusIDs, they get new ids and the last status table is brought up to
+//date; with them, the caller must do it. Unlike updateJobStatusDS it
+//doesn't copy aborted jobs to the dead letter jobsdb
+func (jd *HandleT) copyJobStatusDS(txn *sql.Tx, ds dataSetT, statusList []*JobStatusT, statusIDs []int64) error {
+
+	afterID := jd.maxStatusID(txn, ds)
+
+	var err error
+	var stmt *sql.Stmt
+	if statusIDs != nil {
+		stmt, err = txn.Prepare(pq.CopyIn(ds.JobStatusTable, "id", "job_id", "job_state", "attempt",
+			"exec_time", "retry_time", "error_code", "error_response"))
+	} else {
+		stmt, err = txn.Prepare(pq.CopyIn(ds.JobStatusTable, "job_id", "job_state", "attempt",
+			"exec_time", "retry_time", "error_code", "error_response"))
+	}
+	jd.assertError(err)
+	defer stmt.Close()
+
+	for i, status := range statusList {
+		if statusIDs != nil {
+			_, err = stmt.Exec(statusIDs[i], status.JobID, status.JobState, status.AttemptNum, status.ExecTime,
+				status.RetryTime, status.ErrorCode, string(status.ErrorResponse))
+		} else {
+			_, err = stmt.Exec(status.JobID, status.JobState, status.AttemptNum, status.ExecTime,
+				status.RetryTime, status.ErrorCode, string(status.ErrorResponse))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+	err = stmt.Close()
+	if err != nil {
+		return err
+	}
+
+	if statusIDs == nil {
+		jd.updateLastStatus(txn, ds, afterID)
+	}
+	return nil
+}
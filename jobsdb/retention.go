@@ -0,0 +1,229 @@
+/*
+Retention policies. On top of the row count (maxDSSize) and migration
+thresholds, each jobsdb has a RetentionPolicyT which
+
+1. rolls the current dataset over once its oldest job is MaxDSAge old
+2. aborts jobs which haven't finished MaxJobAge after being created
+3. keeps a dataset from being migrated (and so dropped) while it has
+jobs of a custom_val newer than CustomValRetention[custom_val]
+
+The policy is read from the JobsDB section of the config, where every
+key can be overridden per table prefix in a [JobsDB.<prefix>] table.
+
+Separately, the disk usage guard pauses ingestion (see IngestionPaused)
+while the database is bigger than maxDiskUsageInMB.
+*/
+
+package jobsdb
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+)
+
+//RetentionPolicyT is the time based dataset management of a jobsdb.
+//Zero values disable the corresponding check
+type RetentionPolicyT struct {
+	MaxDSAge           time.Duration
+	MaxJobAge          time.Duration
+	CustomValRetention map[string]time.Duration
+}
+
+var (
+	maxDiskUsageInMB          int64
+	diskUsageResumeFraction   float64
+	diskCheckSleepDuration    time.Duration
+	abortExpiredSleepDuration time.Duration
+)
+
+func loadRetentionConfig() {
+	maxDiskUsageInMB = config.GetInt64("JobsDB.maxDiskUsageInMB", 0)
+	diskUsageResumeFraction = config.GetFloat64("JobsDB.diskUsageResumeFraction", 0.9)
+	diskCheckSleepDuration = config.GetDuration("JobsDB.diskCheckSleepDurationInS", time.Duration(10)) * time.Second
+	abortExpiredSleepDuration = config.GetDuration("JobsDB.abortExpiredSleepDurationInS", time.Duration(60)) * time.Second
+}
+
+//getPrefixDuration reads JobsDB.<prefix>.<key>, falling back to JobsDB.<key>
+func getPrefixDuration(prefix string, key string, unit time.Duration) time.Duration {
+	value := config.GetDuration("JobsDB."+key, time.Duration(0))
+	return config.GetDuration("JobsDB."+prefix+"."+key, value) * unit
+}
+
+//loadRetentionPolicy builds the policy of a prefix from config
+func loadRetentionPolicy(prefix string) RetentionPolicyT {
+	policy := RetentionPolicyT{
+		MaxDSAge:           getPrefixDuration(prefix, "maxDSAgeInMin", time.Minute),
+		MaxJobAge:          getPrefixDuration(prefix, "maxJobAgeInMin", time.Minute),
+		CustomValRetention: map[string]time.Duration{},
+	}
+	retentionMap := config.GetStringMapString("JobsDB.customValRetentionInMin", map[string]string{})
+	for customVal, minutes := range config.GetStringMapString("JobsDB."+prefix+".customValRetentionInMin", map[string]string{}) {
+		retentionMap[customVal] = minutes
+	}
+	for customVal, minutes := range retentionMap {
+		retentionInMin, err := strconv.Atoi(minutes)
+		if err != nil {
+			logger.Errorf("Invalid retention %q for %s", minutes, customVal)
+			continue
+		}
+		policy.CustomValRetention[customVal] = time.Duration(retentionInMin) * time.Minute
+	}
+	return policy
+}
+
+/*
+SetRetentionPolicy replaces the policy read from config
+*/
+func (jd *HandleT) SetRetentionPolicy(policy RetentionPolicyT) {
+	jd.retentionLock.Lock()
+	defer jd.retentionLock.Unlock()
+	jd.retentionPolicy = policy
+}
+
+func (jd *HandleT) getRetentionPolicy() RetentionPolicyT {
+	jd.retentionLock.RLock()
+	defer jd.retentionLock.RUnlock()
+	return jd.retentionPolicy
+}
+
+//checkIfExpiredDS tells if the oldest job of the (current) dataset
+//is older than MaxDSAge
+func (jd *HandleT) checkIfExpiredDS(ds dataSetT) bool {
+	maxDSAge := jd.getRetentionPolicy().MaxDSAge
+	if maxDSAge == 0 {
+		return false
+	}
+	var expired bool
+	sqlStatement := fmt.Sprintf(`SELECT COALESCE(MIN(created_at) < $1, false) FROM %s`, ds.JobTable)
+	err := jd.dbHandle.QueryRow(sqlStatement, time.Now().Add(-maxDSAge)).Scan(&expired)
+	jd.assertError(err)
+	return expired
+}
+
+//checkCustomValRetentionDS tells if a dataset still has jobs which
+//have to be retained for their custom_val
+func (jd *HandleT) checkCustomValRetentionDS(ds dataSetT) bool {
+	for customVal, retention := range jd.getRetentionPolicy().CustomValRetention {
+		var retained bool
+		sqlStatement := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE custom_val=$1 AND created_at > $2)`,
+			ds.JobTable)
+		err := jd.readQueryRow(sqlStatement, []interface{}{customVal, time.Now().Add(-retention)}, &retained)
+		jd.assertError(err)
+		if retained {
+			return true
+		}
+	}
+	return false
+}
+
+func (jd *HandleT) abortExpiredLoop() {
+	for {
+		time.Sleep(abortExpiredSleepDuration)
+		maxJobAge := jd.getRetentionPolicy().MaxJobAge
+		if maxJobAge == 0 {
+			continue
+		}
+		jd.abortExpiredJobs(time.Now().Add(-maxJobAge))
+	}
+}
+
+//abortExpiredJobs marks aborted the jobs created before createdBefore
+//which are neither succeeded nor aborted yet
+func (jd *HandleT) abortExpiredJobs(createdBefore time.Time) {
+
+	//The order of lock is very important. The mainCheckLoop
+	//takes lock in this order so reversing this will cause
+	//deadlocks
+	jd.dsMigrationLock.RLock()
+	jd.dsListLock.RLock()
+	defer jd.dsMigrationLock.RUnlock()
+	defer jd.dsListLock.RUnlock()
+	if jd.deadLetterDB != nil {
+		jd.deadLetterDB.dsListLock.RLock()
+		defer jd.deadLetterDB.dsListLock.RUnlock()
+	}
+
+	var total int
+	for _, ds := range jd.getDSList(false) {
+		txn, err := jd.dbHandle.Begin()
+		jd.assertError(err)
+		afterID := jd.maxStatusID(txn, ds)
+
+		sqlStatement := fmt.Sprintf(`INSERT INTO %[2]s (job_id, job_state, attempt, exec_time, retry_time,
+                                           error_code, error_response)
+                                         SELECT %[1]s.job_id, '%[4]s', COALESCE(last.attempt, 0), $2, $2,
+                                           '', '{"reason":"expired"}'
+                                         FROM %[1]s LEFT JOIN %[3]s AS last ON %[1]s.job_id=last.job_id
+                                         WHERE %[1]s.created_at < $1
+                                           AND (last.job_state IS NULL OR last.job_state NOT IN ('%[5]s', '%[4]s'))
+                                       RETURNING job_id`,
+			ds.JobTable, ds.JobStatusTable, jd.lastStatusTableName(ds), AbortedState, SucceededState)
+		rows, err := txn.Query(sqlStatement, createdBefore, time.Now())
+		jd.assertError(err)
+		var abortedJobIDs []int64
+		for rows.Next() {
+			var jobID int64
+			err = rows.Scan(&jobID)
+			jd.assertError(err)
+			abortedJobIDs = append(abortedJobIDs, jobID)
+		}
+		rows.Close()
+
+		jd.updateLastStatus(txn, ds, afterID)
+		var deadLetterList []*JobT
+		if jd.deadLetterDB != nil {
+			deadLetterList = jd.copyToDeadLetterDS(txn, ds, abortedJobIDs)
+		}
+		err = txn.Commit()
+		jd.assertError(err)
+
+		if len(abortedJobIDs) == 0 {
+			continue
+		}
+		total += len(abortedJobIDs)
+		if jd.deadLetterDB != nil {
+			jd.deadLetterDB.deadLettersStored(deadLetterList)
+		}
+		jd.markClearEmptyResult(ds, []string{}, []string{}, false)
+	}
+	if total > 0 {
+		logger.Infof("Aborted %d %s jobs created before %v", total, jd.tablePrefix, createdBefore)
+		jd.publish([]string{})
+	}
+}
+
+/*
+IngestionPaused tells if the database has grown beyond maxDiskUsageInMB.
+Producers (the gateway) should stop accepting jobs while it is set
+*/
+func (jd *HandleT) IngestionPaused() bool {
+	return atomic.LoadInt32(&jd.ingestionPaused) == 1
+}
+
+//diskUsageLoop pauses ingestion once the database size reaches
+//maxDiskUsageInMB and resumes it once the size drops below
+//diskUsageResumeFraction of it (datasets being migrated and dropped)
+func (jd *HandleT) diskUsageLoop() {
+	maxDiskUsage := maxDiskUsageInMB * 1024 * 1024
+	for {
+		var dbSize int64
+		err := jd.dbHandle.QueryRow(`SELECT pg_database_size(current_database())`).Scan(&dbSize)
+		jd.assertError(err)
+
+		if !jd.IngestionPaused() && dbSize >= maxDiskUsage {
+			logger.Errorf("Database size %d MB reached the limit of %d MB, pausing %s ingestion",
+				dbSize/(1024*1024), maxDiskUsageInMB, jd.tablePrefix)
+			atomic.StoreInt32(&jd.ingestionPaused, 1)
+		} else if jd.IngestionPaused() && float64(dbSize) < diskUsageResumeFraction*float64(maxDiskUsage) {
+			logger.Infof("Database size %d MB is below the limit, resuming %s ingestion",
+				dbSize/(1024*1024), jd.tablePrefix)
+			atomic.StoreInt32(&jd.ingestionPaused, 0)
+		}
+		time.Sleep(diskCheckSleepDuration)
+	}
+}
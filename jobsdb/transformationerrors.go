@@ -0,0 +1,238 @@
+/*
+Transformation errors. The processor stores the events a transformation
+failed on (TransformationErrorT) into a jobsdb of their own, one job per
+event with the destination type as custom_val and the event sent to the
+transformer as payload. They stay unprocessed until they are marked for
+retry with RetryTransformationErrors, once the transformer is fixed. The
+processor then picks them up with GetTransformationErrorsToRetry,
+transforms them again and marks them succeeded. Events which fail again
+are stored as new transformation errors. The ones the processor can't
+transform again, e.g. as their destination is disabled, are marked
+skipped (a waiting status with the reason) and are listed and can be
+retried like the ones never retried.
+*/
+
+package jobsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+//transformationErrorParamsT is stored as the parameters of a
+//transformation error job. source_id is kept at the top level so that
+//the usual filters work
+type transformationErrorParamsT struct {
+	SourceID      string `json:"source_id"`
+	DestinationID string `json:"destination_id"`
+	Stage         string `json:"stage"`
+	ErrorResponse string `json:"error_response"`
+}
+
+//RetryTransformationErrorsRequestT selects the transformation errors to
+//retry, either by JobIDs or all the ones of CustomVal (and SourceID if set)
+type RetryTransformationErrorsRequestT struct {
+	CustomVal string
+	SourceID  string
+	JobIDs    []int64
+}
+
+/*
+StoreTransformationErrors stores errList. It must be called on the
+transformation errors HandleT
+*/
+func (jd *HandleT) StoreTransformationErrors(errList []*TransformationErrorT) {
+	if len(errList) == 0 {
+		return
+	}
+	jobList := make([]*JobT, 0, len(errList))
+	for _, transformationError := range errList {
+		params, err := json.Marshal(transformationErrorParamsT{
+			SourceID:      transformationError.SourceID,
+			DestinationID: transformationError.DestinationID,
+			Stage:         transformationError.Stage,
+			ErrorResponse: transformationError.ErrorResponse,
+		})
+		jd.assertError(err)
+		jobList = append(jobList, &JobT{
+			UUID:         uuid.NewV4(),
+			Parameters:   params,
+			CreatedAt:    time.Now(),
+			ExpireAt:     time.Now(),
+			CustomVal:    transformationError.DestinationType,
+			EventPayload: transformationError.EventPayload,
+		})
+	}
+	jd.Store(jobList)
+}
+
+//skipReasonT is the error response of a skipped transformation error
+type skipReasonT struct {
+	Reason string `json:"reason"`
+}
+
+func (jd *HandleT) transformationErrorsFromJobs(jobList []*JobT) []*TransformationErrorT {
+	errList := make([]*TransformationErrorT, 0, len(jobList))
+	for _, job := range jobList {
+		var params transformationErrorParamsT
+		json.Unmarshal(job.Parameters, &params)
+		var skipReason skipReasonT
+		if job.LastJobStatus.JobState == WaitingState {
+			json.Unmarshal(job.LastJobStatus.ErrorResponse, &skipReason)
+		}
+		errList = append(errList, &TransformationErrorT{
+			UUID:            job.UUID,
+			JobID:           job.JobID,
+			SourceID:        params.SourceID,
+			DestinationID:   params.DestinationID,
+			DestinationType: job.CustomVal,
+			Stage:           params.Stage,
+			ErrorResponse:   params.ErrorResponse,
+			EventPayload:    job.EventPayload,
+			Parameters:      job.Parameters,
+			CreatedAt:       job.CreatedAt,
+			ExpireAt:        job.ExpireAt,
+			SkipReason:      skipReason.Reason,
+		})
+	}
+	return errList
+}
+
+/*
+GetTransformationErrors returns the transformation errors of the
+destination types in customValFilters (of all if empty) which haven't
+been retried yet, the never retried ones first and then the skipped ones
+*/
+func (jd *HandleT) GetTransformationErrors(customValFilters []string, count int) []*TransformationErrorT {
+	jobList := jd.GetUnprocessed(customValFilters, count)
+	if len(jobList) < count {
+		jobList = append(jobList, jd.GetWaiting(customValFilters, count-len(jobList))...)
+	}
+	return jd.transformationErrorsFromJobs(jobList)
+}
+
+/*
+GetTransformationErrorsToRetry returns the transformation errors marked
+for retry
+*/
+func (jd *HandleT) GetTransformationErrorsToRetry(count int) []*TransformationErrorT {
+	return jd.transformationErrorsFromJobs(jd.GetToRetry([]string{}, count))
+}
+
+/*
+RetryTransformationErrors marks the transformation errors selected by req
+for retry and returns how many were. Errors which were already retried,
+or are marked for retry, are left alone
+*/
+func (jd *HandleT) RetryTransformationErrors(req RetryTransformationErrorsRequestT) (int, error) {
+	if req.CustomVal == "" && len(req.JobIDs) == 0 {
+		return 0, fmt.Errorf("either CustomVal or JobIDs must be set")
+	}
+
+	var jobIDs []int64
+	if len(req.JobIDs) > 0 {
+		for _, jobID := range req.JobIDs {
+			history, found := jd.getJobHistoryFromPrimary(jobID)
+			if !found {
+				return 0, fmt.Errorf("transformation error %d not found", jobID)
+			}
+			statuses := history.Statuses
+			if len(statuses) == 0 || statuses[len(statuses)-1].JobState == WaitingState {
+				jobIDs = append(jobIDs, jobID)
+			}
+		}
+		jd.markForRetry(jobIDs)
+		return len(jobIDs), nil
+	}
+
+	filters := QueryFiltersT{CustomVals: []string{req.CustomVal}}
+	if req.SourceID != "" {
+		filters.SourceIDs = []string{req.SourceID}
+	}
+	retried := 0
+	for {
+		//Marked jobs aren't unprocessed or skipped anymore
+		jobList := jd.GetUnprocessedWithFilters(filters, requeueBatchSize)
+		if len(jobList) == 0 {
+			jobList = jd.GetProcessedWithFilters([]string{WaitingState}, filters, requeueBatchSize)
+		}
+		if len(jobList) == 0 {
+			break
+		}
+		jobIDs = jobIDs[:0]
+		for _, job := range jobList {
+			jobIDs = append(jobIDs, job.JobID)
+		}
+		jd.markForRetry(jobIDs)
+		retried += len(jobList)
+	}
+	return retried, nil
+}
+
+func (jd *HandleT) markForRetry(jobIDs []int64) {
+	var statusList []*JobStatusT
+	for _, jobID := range jobIDs {
+		statusList = append(statusList, &JobStatusT{
+			JobID:         jobID,
+			JobState:      FailedState,
+			AttemptNum:    1,
+			ExecTime:      time.Now(),
+			RetryTime:     time.Now(),
+			ErrorCode:     "",
+			ErrorResponse: []byte(`{"reason":"retry requested"}`),
+		})
+	}
+	if len(statusList) > 0 {
+		jd.UpdateJobStatus(statusList, []string{})
+	}
+}
+
+/*
+MarkTransformationErrorsRetried marks errList, returned by
+GetTransformationErrorsToRetry, as done
+*/
+func (jd *HandleT) MarkTransformationErrorsRetried(errList []*TransformationErrorT) {
+	var statusList []*JobStatusT
+	for _, transformationError := range errList {
+		statusList = append(statusList, &JobStatusT{
+			JobID:         transformationError.JobID,
+			JobState:      SucceededState,
+			AttemptNum:    2,
+			ExecTime:      time.Now(),
+			RetryTime:     time.Now(),
+			ErrorCode:     "",
+			ErrorResponse: []byte(`{"reason":"retried"}`),
+		})
+	}
+	if len(statusList) > 0 {
+		jd.UpdateJobStatus(statusList, []string{})
+	}
+}
+
+/*
+MarkTransformationErrorsSkipped marks errList, returned by
+GetTransformationErrorsToRetry, as skipped, reasons having the reason of
+each by job id. They can be retried again
+*/
+func (jd *HandleT) MarkTransformationErrorsSkipped(errList []*TransformationErrorT, reasons map[int64]string) {
+	var statusList []*JobStatusT
+	for _, transformationError := range errList {
+		errorResponse, err := json.Marshal(skipReasonT{Reason: reasons[transformationError.JobID]})
+		jd.assertError(err)
+		statusList = append(statusList, &JobStatusT{
+			JobID:         transformationError.JobID,
+			JobState:      WaitingState,
+			AttemptNum:    1,
+			ExecTime:      time.Now(),
+			RetryTime:     time.Now(),
+			ErrorCode:     "",
+			ErrorResponse: errorResponse,
+		})
+	}
+	if len(statusList) > 0 {
+		jd.UpdateJobStatus(statusList, []string{})
+	}
+}
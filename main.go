@@ -30,6 +30,9 @@ var (
 	maxProcess                                  int
 	gwDBRetention, routerDBRetention            time.Duration
 	enableProcessor, enableRouter, enableBackup bool
+	enableDeadLetterQueue                       bool
+	enableTransformationErrors                  bool
+	enableQuarantine                            bool
 	enabledDestinations                         []backendconfig.DestinationT
 	configSubscriberLock                        sync.RWMutex
 	rawDataDestinations                         []string
@@ -42,6 +45,9 @@ func loadConfig() {
 	enableProcessor = config.GetBool("enableProcessor", true)
 	enableRouter = config.GetBool("enableRouter", true)
 	enableBackup = config.GetBool("JobsDB.enableBackup", true)
+	enableDeadLetterQueue = config.GetBool("JobsDB.enableDeadLetterQueue", true)
+	enableTransformationErrors = config.GetBool("JobsDB.enableTransformationErrors", true)
+	enableQuarantine = config.GetBool("JobsDB.enableQuarantine", true)
 	rawDataDestinations = []string{"S3"}
 }
 
@@ -187,6 +193,9 @@ func main() {
 	var gatewayDB jobsdb.HandleT
 	var routerDB jobsdb.HandleT
 	var batchRouterDB jobsdb.HandleT
+	var deadLetterDB jobsdb.HandleT
+	var transformationErrorDB jobsdb.HandleT
+	var quarantineDB jobsdb.HandleT
 
 	runtime.GOMAXPROCS(maxProcess)
 	logger.Info("Clearing DB", *clearDB)
@@ -196,6 +205,11 @@ func main() {
 	gatewayDB.Setup(*clearDB, "gw", gwDBRetention, enableBackup && true)
 	routerDB.Setup(*clearDB, "rt", routerDBRetention, false)
 	batchRouterDB.Setup(*clearDB, "batch_rt", routerDBRetention, false)
+	if enableDeadLetterQueue {
+		deadLetterDB.Setup(*clearDB, "dlq", 0, false)
+		routerDB.SetDeadLetterDB(&deadLetterDB)
+		batchRouterDB.SetDeadLetterDB(&deadLetterDB)
+	}
 
 	//Setup the three modules, the gateway, the router and the processor
 
@@ -205,9 +219,19 @@ func main() {
 
 	if enableProcessor {
 		var processor processor.HandleT
+		if enableTransformationErrors {
+			transformationErrorDB.Setup(*clearDB, "proc_error", 0, false)
+			processor.SetTransformationErrorDB(&transformationErrorDB)
+		}
+		if enableQuarantine {
+			quarantineDB.Setup(*clearDB, "proc_quarantine", 0, false)
+			processor.SetQuarantineDB(&quarantineDB)
+		}
 		processor.Setup(&gatewayDB, &routerDB, &batchRouterDB)
 	}
 
+	go jobsdb.StartAdminServer()
+
 	var gateway gateway.HandleT
 	gateway.Setup(&gatewayDB)
 	//go readIOforResume(router) //keeping it as input from IO, to be replaced by UI
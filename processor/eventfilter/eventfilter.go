@@ -0,0 +1,240 @@
+/*
+Package eventfilter decides which events are sent to a destination, from
+the rules in the "eventFilters" list of the destination config, e.g.
+
+	"eventFilters": [
+		{"name": "orders", "action": "allow", "eventTypes": ["track"],
+		 "eventNames": ["Order Completed"]},
+		{"name": "tests", "action": "drop",
+		 "properties": [{"path": "properties.test", "op": "eq", "value": true}]}
+	]
+
+A rule matches an event when all of its conditions do. An event is
+dropped by the first drop rule it matches and, if there are allow rules,
+when it matches none of them. Otherwise it is kept.
+*/
+package eventfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	//ActionAllow keeps the events the rule matches
+	ActionAllow = "allow"
+	//ActionDrop drops the events the rule matches
+	ActionDrop = "drop"
+
+	//NoAllowRule is the rule an event matching none of the allow rules
+	//is reported as dropped by
+	NoAllowRule = "no_allow_rule"
+
+	configKey = "eventFilters"
+)
+
+//PredicateT compares the value at Path (dot separated, e.g.
+//properties.revenue) in the event with Value. Op is one of eq, neq,
+//in, nin, gt, gte, lt, lte, contains, exists and notexists
+type PredicateT struct {
+	Path  string      `json:"path"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+//RuleT matches the events of one of EventTypes, named one of
+//EventNames, on which all Properties predicates hold. Empty
+//conditions match every event
+type RuleT struct {
+	Name       string       `json:"name"`
+	Action     string       `json:"action"`
+	EventTypes []string     `json:"eventTypes"`
+	EventNames []string     `json:"eventNames"`
+	Properties []PredicateT `json:"properties"`
+}
+
+//RuleSetT is the rules of a destination
+type RuleSetT struct {
+	Rules    []RuleT
+	hasAllow bool
+}
+
+var ops = map[string]bool{
+	"eq": true, "neq": true, "in": true, "nin": true, "gt": true, "gte": true,
+	"lt": true, "lte": true, "contains": true, "exists": true, "notexists": true,
+}
+
+//Parse reads the rules from a destination config. It returns nil, and
+//no error, if there are none
+func Parse(destinationConfig interface{}) (*RuleSetT, error) {
+	configMap, ok := destinationConfig.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	rulesConfig, ok := configMap[configKey]
+	if !ok || rulesConfig == nil {
+		return nil, nil
+	}
+	rulesJSON, err := json.Marshal(rulesConfig)
+	if err != nil {
+		return nil, err
+	}
+	var rules []RuleT
+	err = json.Unmarshal(rulesJSON, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("eventfilter: invalid %s: %v", configKey, err)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	ruleSet := &RuleSetT{Rules: rules}
+	for idx, rule := range rules {
+		if rule.Name == "" {
+			ruleSet.Rules[idx].Name = fmt.Sprintf("rule_%d", idx)
+		}
+		switch rule.Action {
+		case ActionAllow:
+			ruleSet.hasAllow = true
+		case ActionDrop:
+		default:
+			return nil, fmt.Errorf("eventfilter: rule %d has invalid action %q", idx, rule.Action)
+		}
+		for _, predicate := range rule.Properties {
+			if predicate.Path == "" || !ops[predicate.Op] {
+				return nil, fmt.Errorf("eventfilter: rule %d has invalid predicate %+v", idx, predicate)
+			}
+		}
+	}
+	return ruleSet, nil
+}
+
+//Evaluate tells if event (the message) is kept and, if it isn't, the
+//name of the rule which dropped it
+func (ruleSet *RuleSetT) Evaluate(event map[string]interface{}) (bool, string) {
+	if ruleSet == nil {
+		return true, ""
+	}
+	allowed := !ruleSet.hasAllow
+	for _, rule := range ruleSet.Rules {
+		if !rule.matches(event) {
+			continue
+		}
+		if rule.Action == ActionDrop {
+			return false, rule.Name
+		}
+		allowed = true
+	}
+	if !allowed {
+		return false, NoAllowRule
+	}
+	return true, ""
+}
+
+func (rule *RuleT) matches(event map[string]interface{}) bool {
+	if len(rule.EventTypes) > 0 {
+		eventType, _ := event["type"].(string)
+		if !containsString(rule.EventTypes, eventType) {
+			return false
+		}
+	}
+	if len(rule.EventNames) > 0 {
+		eventName, _ := event["event"].(string)
+		if !containsString(rule.EventNames, eventName) {
+			return false
+		}
+	}
+	for _, predicate := range rule.Properties {
+		if !predicate.holds(event) {
+			return false
+		}
+	}
+	return true
+}
+
+func (predicate *PredicateT) holds(event map[string]interface{}) bool {
+	value, found := lookup(event, predicate.Path)
+	switch predicate.Op {
+	case "exists":
+		return found
+	case "notexists":
+		return !found
+	case "neq":
+		return !found || !equal(value, predicate.Value)
+	case "nin":
+		return !found || !in(value, predicate.Value)
+	}
+	if !found {
+		return false
+	}
+	switch predicate.Op {
+	case "eq":
+		return equal(value, predicate.Value)
+	case "in":
+		return in(value, predicate.Value)
+	case "contains":
+		str, ok := value.(string)
+		substr, ok2 := predicate.Value.(string)
+		return ok && ok2 && strings.Contains(str, substr)
+	}
+	number, ok := value.(float64)
+	bound, ok2 := predicate.Value.(float64)
+	if !ok || !ok2 {
+		return false
+	}
+	switch predicate.Op {
+	case "gt":
+		return number > bound
+	case "gte":
+		return number >= bound
+	case "lt":
+		return number < bound
+	case "lte":
+		return number <= bound
+	}
+	return false
+}
+
+//lookup returns the value at the dot separated path in event
+func lookup(event map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = event
+	for _, key := range strings.Split(path, ".") {
+		valueMap, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = valueMap[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func equal(value interface{}, expected interface{}) bool {
+	return reflect.DeepEqual(value, expected)
+}
+
+func in(value interface{}, expected interface{}) bool {
+	list, ok := expected.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, element := range list {
+		if equal(value, element) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
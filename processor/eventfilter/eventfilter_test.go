@@ -0,0 +1,92 @@
+package eventfilter_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/processor/eventfilter"
+)
+
+func parseJSON(data string) interface{} {
+	var value interface{}
+	err := json.Unmarshal([]byte(data), &value)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+func event(data string) map[string]interface{} {
+	return parseJSON(data).(map[string]interface{})
+}
+
+var _ = Describe("Eventfilter", func() {
+
+	orderCompleted := event(`{"type":"track","event":"Order Completed","properties":{"revenue":120,"currency":"USD"}}`)
+	productViewed := event(`{"type":"track","event":"Product Viewed","properties":{"test":true}}`)
+	page := event(`{"type":"page","name":"Home"}`)
+
+	It("keeps every event without rules", func() {
+		ruleSet, err := eventfilter.Parse(parseJSON(`{"trackingId":"UA-1"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ruleSet).To(BeNil())
+		kept, _ := ruleSet.Evaluate(page)
+		Expect(kept).To(BeTrue())
+	})
+
+	It("keeps only the events matching an allow rule", func() {
+		ruleSet, err := eventfilter.Parse(parseJSON(`{"eventFilters":[
+			{"name":"orders","action":"allow","eventTypes":["track"],"eventNames":["Order Completed"]}]}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		kept, _ := ruleSet.Evaluate(orderCompleted)
+		Expect(kept).To(BeTrue())
+		kept, rule := ruleSet.Evaluate(productViewed)
+		Expect(kept).To(BeFalse())
+		Expect(rule).To(Equal(eventfilter.NoAllowRule))
+		kept, _ = ruleSet.Evaluate(page)
+		Expect(kept).To(BeFalse())
+	})
+
+	It("drops the events matching a drop rule", func() {
+		ruleSet, err := eventfilter.Parse(parseJSON(`{"eventFilters":[
+			{"name":"tests","action":"drop","properties":[{"path":"properties.test","op":"eq","value":true}]}]}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		kept, rule := ruleSet.Evaluate(productViewed)
+		Expect(kept).To(BeFalse())
+		Expect(rule).To(Equal("tests"))
+		kept, _ = ruleSet.Evaluate(orderCompleted)
+		Expect(kept).To(BeTrue())
+	})
+
+	It("evaluates property predicates", func() {
+		predicates := map[string]bool{
+			`{"path":"properties.revenue","op":"gt","value":100}`:            true,
+			`{"path":"properties.revenue","op":"lte","value":100}`:           false,
+			`{"path":"properties.currency","op":"in","value":["USD","EUR"]}`: true,
+			`{"path":"properties.currency","op":"nin","value":["USD"]}`:      false,
+			`{"path":"properties.currency","op":"neq","value":"EUR"}`:        true,
+			`{"path":"properties.coupon","op":"notexists"}`:                  true,
+			`{"path":"properties.coupon","op":"exists"}`:                     false,
+			`{"path":"event","op":"contains","value":"Order"}`:               true,
+			`{"path":"properties.currency.code","op":"eq","value":"USD"}`:    false,
+		}
+		for predicate, expected := range predicates {
+			ruleSet, err := eventfilter.Parse(parseJSON(`{"eventFilters":[{"action":"allow","properties":[` + predicate + `]}]}`))
+			Expect(err).NotTo(HaveOccurred())
+			kept, _ := ruleSet.Evaluate(orderCompleted)
+			Expect(kept).To(Equal(expected), predicate)
+		}
+	})
+
+	It("rejects invalid rules", func() {
+		_, err := eventfilter.Parse(parseJSON(`{"eventFilters":[{"action":"forward"}]}`))
+		Expect(err).To(HaveOccurred())
+		_, err = eventfilter.Parse(parseJSON(`{"eventFilters":[{"action":"drop","properties":[{"path":"type","op":"like"}]}]}`))
+		Expect(err).To(HaveOccurred())
+		_, err = eventfilter.Parse(parseJSON(`{"eventFilters":{"action":"drop"}}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
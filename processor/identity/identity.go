@@ -0,0 +1,206 @@
+/*
+Package identity stitches the anonymous ids of a user to their user id, so
+that the events sent before and after the user is identified are handled
+as the events of one user.
+
+identify events link their anonymousId to their userId and alias events
+link their previousId to their userId. The links form trees whose root is
+the canonical id of all the ids in them. An id is linked once: a later
+identify of the same anonymousId with another userId (e.g. a shared
+device) is a conflict, and the first link is kept.
+
+The links are held in memory by a ResolverT and saved to a StoreT, which
+is read back when the resolver is created.
+*/
+package identity
+
+import (
+	"strings"
+	"sync"
+)
+
+//CanonicalIDKey is the field of the events sent to the transformers
+//({"message", "destination"}) the canonical id of their message is set
+//in. It is kept out of the message, which is what the customer sent
+const CanonicalIDKey = "canonicalId"
+
+//LinkT links the id From to the id To
+type LinkT struct {
+	From string
+	To   string
+}
+
+//StoreT persists the links, in the order they were made
+type StoreT interface {
+	Load() ([]LinkT, error)
+	Save(links []LinkT) error
+}
+
+//ResolverT resolves ids to their canonical id. It is thread safe
+type ResolverT struct {
+	store StoreT
+
+	lock      sync.Mutex
+	parent    map[string]string
+	pending   []LinkT
+	conflicts int
+}
+
+//NewResolver returns a resolver with the links saved in store
+func NewResolver(store StoreT) (*ResolverT, error) {
+	resolver := &ResolverT{
+		store:  store,
+		parent: make(map[string]string),
+	}
+	links, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		resolver.link(link.From, link.To)
+	}
+	//They are saved already
+	resolver.pending = nil
+	resolver.conflicts = 0
+	return resolver, nil
+}
+
+//root returns the canonical id of id. The caller holds lock
+func (resolver *ResolverT) root(id string) string {
+	root := id
+	for {
+		parent, ok := resolver.parent[root]
+		if !ok {
+			break
+		}
+		root = parent
+	}
+	//Path compression
+	for id != root {
+		next := resolver.parent[id]
+		resolver.parent[id] = root
+		id = next
+	}
+	return root
+}
+
+//link links from to to and returns the canonical ids merged by it. The
+//caller holds lock
+func (resolver *ResolverT) link(from string, to string) (LinkT, bool) {
+	if from == "" || to == "" {
+		return LinkT{}, false
+	}
+	fromRoot := resolver.root(from)
+	toRoot := resolver.root(to)
+	if fromRoot == toRoot {
+		return LinkT{}, false
+	}
+	if fromRoot != from {
+		resolver.conflicts++
+		return LinkT{}, false
+	}
+	resolver.parent[from] = toRoot
+	resolver.pending = append(resolver.pending, LinkT{From: from, To: to})
+	return LinkT{From: fromRoot, To: toRoot}, true
+}
+
+//Link links from to to. It returns the canonical id from had and the one
+//it has now, if they differ
+func (resolver *ResolverT) Link(from string, to string) (LinkT, bool) {
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	return resolver.link(from, to)
+}
+
+//Canonical returns the canonical id of id
+func (resolver *ResolverT) Canonical(id string) string {
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	return resolver.root(id)
+}
+
+//MessageCanonicalID returns the canonical id of the user of message,
+//empty if it has no id
+func (resolver *ResolverT) MessageCanonicalID(message map[string]interface{}) string {
+	id := messageID(message)
+	if id == "" {
+		return ""
+	}
+	return resolver.Canonical(id)
+}
+
+//ResolveBatch links the ids of the identify and alias messages of
+//events, a batch as received by the gateway. It returns the canonical id
+//of the first message and the canonical ids merged by the batch
+func (resolver *ResolverT) ResolveBatch(events []interface{}) (string, []LinkT) {
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+
+	var merged []LinkT
+	for _, event := range events {
+		message, ok := event.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		userID := stringField(message, "userId")
+		var from string
+		switch strings.ToLower(stringField(message, "type")) {
+		case "identify":
+			from = stringField(message, "anonymousId")
+		case "alias":
+			from = stringField(message, "previousId")
+		default:
+			continue
+		}
+		if link, ok := resolver.link(from, userID); ok {
+			merged = append(merged, link)
+		}
+	}
+
+	canonicalID := ""
+	if len(events) > 0 {
+		if message, ok := events[0].(map[string]interface{}); ok {
+			if id := messageID(message); id != "" {
+				canonicalID = resolver.root(id)
+			}
+		}
+	}
+	return canonicalID, merged
+}
+
+//Flush saves the links made since the last Flush. It returns the number
+//of links saved and of conflicting links ignored since then
+func (resolver *ResolverT) Flush() (int, int, error) {
+	resolver.lock.Lock()
+	pending := resolver.pending
+	conflicts := resolver.conflicts
+	resolver.pending = nil
+	resolver.conflicts = 0
+	resolver.lock.Unlock()
+
+	if len(pending) == 0 {
+		return 0, conflicts, nil
+	}
+	err := resolver.store.Save(pending)
+	if err != nil {
+		//Try again on the next Flush
+		resolver.lock.Lock()
+		resolver.pending = append(pending, resolver.pending...)
+		resolver.lock.Unlock()
+		return 0, conflicts, err
+	}
+	return len(pending), conflicts, nil
+}
+
+//messageID returns the id a message is from, its userId if it has one
+func messageID(message map[string]interface{}) string {
+	if userID := stringField(message, "userId"); userID != "" {
+		return userID
+	}
+	return stringField(message, "anonymousId")
+}
+
+func stringField(message map[string]interface{}, key string) string {
+	value, _ := message[key].(string)
+	return value
+}
@@ -0,0 +1,142 @@
+package identity_test
+
+import (
+	"encoding/json"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/processor/identity"
+)
+
+//memoryStoreT stands in for the Postgres table
+type memoryStoreT struct {
+	links   []identity.LinkT
+	saveErr error
+}
+
+func (store *memoryStoreT) Load() ([]identity.LinkT, error) {
+	return store.links, nil
+}
+
+func (store *memoryStoreT) Save(links []identity.LinkT) error {
+	if store.saveErr != nil {
+		return store.saveErr
+	}
+	store.links = append(store.links, links...)
+	return nil
+}
+
+func batch(data string) []interface{} {
+	var events []interface{}
+	err := json.Unmarshal([]byte(data), &events)
+	if err != nil {
+		panic(err)
+	}
+	return events
+}
+
+func canonicalIDs(resolver *identity.ResolverT, events []interface{}) []string {
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, resolver.MessageCanonicalID(event.(map[string]interface{})))
+	}
+	return ids
+}
+
+var _ = Describe("Identity", func() {
+
+	var store *memoryStoreT
+	var resolver *identity.ResolverT
+
+	BeforeEach(func() {
+		store = &memoryStoreT{}
+		var err error
+		resolver, err = identity.NewResolver(store)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("stitches the events before and after identify", func() {
+		userID, merged := resolver.ResolveBatch(batch(`[
+			{"type":"page","anonymousId":"a1"}
+		]`))
+		Expect(userID).To(Equal("a1"))
+		Expect(merged).To(BeEmpty())
+
+		events := batch(`[
+			{"type":"track","anonymousId":"a1","event":"Signed Up"},
+			{"type":"identify","anonymousId":"a1","userId":"u1"},
+			{"type":"track","anonymousId":"a1","userId":"u1","event":"Logged In"}
+		]`)
+		userID, merged = resolver.ResolveBatch(events)
+		Expect(userID).To(Equal("u1"))
+		Expect(merged).To(Equal([]identity.LinkT{{From: "a1", To: "u1"}}))
+		Expect(canonicalIDs(resolver, events)).To(Equal([]string{"u1", "u1", "u1"}))
+		//The messages are left as they were sent
+		for _, event := range events {
+			Expect(event).NotTo(HaveKey(identity.CanonicalIDKey))
+		}
+		Expect(resolver.MessageCanonicalID(map[string]interface{}{"type": "page"})).To(BeEmpty())
+
+		userID, _ = resolver.ResolveBatch(batch(`[{"type":"page","anonymousId":"a1"}]`))
+		Expect(userID).To(Equal("u1"))
+	})
+
+	It("follows aliases", func() {
+		resolver.ResolveBatch(batch(`[{"type":"identify","anonymousId":"a1","userId":"u1"}]`))
+		_, merged := resolver.ResolveBatch(batch(`[{"type":"alias","previousId":"u1","userId":"u2"}]`))
+		Expect(merged).To(Equal([]identity.LinkT{{From: "u1", To: "u2"}}))
+		Expect(resolver.Canonical("a1")).To(Equal("u2"))
+		Expect(resolver.Canonical("u1")).To(Equal("u2"))
+		Expect(resolver.Canonical("other")).To(Equal("other"))
+	})
+
+	It("keeps the first link of an id", func() {
+		resolver.ResolveBatch(batch(`[{"type":"identify","anonymousId":"a1","userId":"u1"}]`))
+		_, merged := resolver.ResolveBatch(batch(`[{"type":"identify","anonymousId":"a1","userId":"u2"}]`))
+		Expect(merged).To(BeEmpty())
+		Expect(resolver.Canonical("a1")).To(Equal("u1"))
+
+		saved, conflicts, err := resolver.Flush()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(saved).To(Equal(1))
+		Expect(conflicts).To(Equal(1))
+	})
+
+	It("doesn't link ids in a cycle", func() {
+		resolver.Link("a1", "u1")
+		_, ok := resolver.Link("u1", "a1")
+		Expect(ok).To(BeFalse())
+		Expect(resolver.Canonical("u1")).To(Equal("u1"))
+	})
+
+	It("reloads the saved links", func() {
+		resolver.ResolveBatch(batch(`[
+			{"type":"identify","anonymousId":"a1","userId":"u1"},
+			{"type":"alias","previousId":"u1","userId":"u2"}
+		]`))
+		_, _, err := resolver.Flush()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.links).To(HaveLen(2))
+
+		reloaded, err := identity.NewResolver(store)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reloaded.Canonical("a1")).To(Equal("u2"))
+		saved, _, _ := reloaded.Flush()
+		Expect(saved).To(Equal(0))
+	})
+
+	It("saves the links again after a failed save", func() {
+		resolver.Link("a1", "u1")
+		store.saveErr = errors.New("connection refused")
+		_, _, err := resolver.Flush()
+		Expect(err).To(HaveOccurred())
+
+		store.saveErr = nil
+		resolver.Link("a2", "u1")
+		saved, _, err := resolver.Flush()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(saved).To(Equal(2))
+		Expect(store.links).To(Equal([]identity.LinkT{{From: "a1", To: "u1"}, {From: "a2", To: "u1"}}))
+	})
+})
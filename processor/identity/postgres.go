@@ -0,0 +1,77 @@
+package identity
+
+import (
+	"database/sql"
+	"fmt"
+
+	//Postgres driver
+	_ "github.com/lib/pq"
+)
+
+//PostgresStoreT saves the links in a Postgres table. A link is saved once,
+//as the resolver links an id once
+type PostgresStoreT struct {
+	dbHandle *sql.DB
+	table    string
+}
+
+//NewPostgresStore returns a store saving the links in table, creating it
+//if needed
+func NewPostgresStore(dbHandle *sql.DB, table string) (*PostgresStoreT, error) {
+	sqlStatement := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+                                     id BIGSERIAL PRIMARY KEY,
+                                     from_id TEXT NOT NULL UNIQUE,
+                                     to_id TEXT NOT NULL,
+                                     created_at TIMESTAMP NOT NULL DEFAULT NOW());`, table)
+	_, err := dbHandle.Exec(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStoreT{dbHandle: dbHandle, table: table}, nil
+}
+
+//Load returns the links in the order they were saved
+func (store *PostgresStoreT) Load() ([]LinkT, error) {
+	sqlStatement := fmt.Sprintf(`SELECT from_id, to_id FROM %s ORDER BY id`, store.table)
+	rows, err := store.dbHandle.Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []LinkT
+	for rows.Next() {
+		var link LinkT
+		err = rows.Scan(&link.From, &link.To)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+//Save saves links in one transaction. Links from an id which has one
+//already, e.g. made by another processor, are ignored
+func (store *PostgresStoreT) Save(links []LinkT) error {
+	txn, err := store.dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	sqlStatement := fmt.Sprintf(`INSERT INTO %s (from_id, to_id) VALUES ($1, $2)
+                                     ON CONFLICT (from_id) DO NOTHING`, store.table)
+	stmt, err := txn.Prepare(sqlStatement)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, link := range links {
+		_, err = stmt.Exec(link.From, link.To)
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit()
+}
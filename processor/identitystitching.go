@@ -0,0 +1,146 @@
+/*
+Identity stitching. With enableIdentityStitching on, the processor links
+the anonymousId of identify events (and the previousId of alias events)
+to their userId with an identity.ResolverT, whose links are saved in the
+identity_links table of the jobsdb database. The events sent to the
+transformers carry the canonical id of the user of their message as
+canonicalId, next to the message which is left as it was sent, and
+
+	sessions are keyed by the canonical id of the first message of a job,
+	rather than its anonymousId. The session of an id is merged into the
+	one of its canonical id once they are linked, its jobs first
+
+	router jobs are partitioned by the canonical id of the event they
+	were transformed from, when the transformer response can be mapped
+	back to it, i.e. all the events of the request have the same
+	canonical id, so the events of a user go to the same router worker
+
+The links are saved before the jobs of their events are marked, so that
+the sessions recovered after a restart are regrouped by canonical id too.
+*/
+
+package processor
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/processor/identity"
+	"github.com/rudderlabs/rudder-server/processor/sessions"
+	"github.com/rudderlabs/rudder-server/services/stats"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+	"github.com/rudderlabs/rudder-server/utils/misc"
+)
+
+const identityLinksTable = "identity_links"
+
+var enableIdentityStitching bool
+
+func loadIdentityConfig() {
+	enableIdentityStitching = config.GetBool("Processor.enableIdentityStitching", false)
+}
+
+type identityStatsT struct {
+	links          *stats.RudderStats
+	conflicts      *stats.RudderStats
+	mergedSessions *stats.RudderStats
+}
+
+func newIdentityStats() identityStatsT {
+	return identityStatsT{
+		links:          stats.NewStat("processor.identity.links", stats.CountType),
+		conflicts:      stats.NewStat("processor.identity.conflicting_links", stats.CountType),
+		mergedSessions: stats.NewStat("processor.identity.merged_sessions", stats.CountType),
+	}
+}
+
+//setupIdentityResolver loads the saved links. It is called by Setup,
+//before crashRecover
+func (proc *HandleT) setupIdentityResolver() {
+	proc.identityStats = newIdentityStats()
+	if !enableIdentityStitching {
+		return
+	}
+	dbHandle, err := sql.Open("postgres", jobsdb.GetConnectionString())
+	misc.AssertError(err)
+	store, err := identity.NewPostgresStore(dbHandle, identityLinksTable)
+	misc.AssertError(err)
+	proc.identityResolver, err = identity.NewResolver(store)
+	misc.AssertError(err)
+	logger.Info("Identity stitching enabled")
+}
+
+//resolveIdentities sets the canonical id of the messages of a job and
+//returns the user the job is from, along with the canonical ids it merged
+func (proc *HandleT) resolveIdentities(eventList []interface{}) (string, []identity.LinkT, bool) {
+	if proc.identityResolver == nil {
+		userID, ok := misc.GetRudderEventUserID(eventList)
+		return userID, nil, ok
+	}
+	userID, merged := proc.identityResolver.ResolveBatch(eventList)
+	return userID, merged, userID != ""
+}
+
+//saveIdentityLinks saves the links made since the last call
+func (proc *HandleT) saveIdentityLinks() {
+	if proc.identityResolver == nil {
+		return
+	}
+	saved, conflicts, err := proc.identityResolver.Flush()
+	//Without the links, recovered sessions are regrouped by their
+	//old ids, which only splits them
+	if err != nil {
+		logger.Errorf("Failed to save identity links: %v", err)
+	}
+	proc.identityStats.links.Count(saved)
+	proc.identityStats.conflicts.Count(conflicts)
+}
+
+//mergeSessions merges the sessions of the ids merged into another
+//canonical id into the session of the latter. The caller holds
+//userPQLock
+func (proc *HandleT) mergeSessions(merged []identity.LinkT, processUserIDs map[string]bool) {
+	for _, link := range merged {
+		fromJobs, ok := proc.userJobListMap[link.From]
+		if !ok {
+			continue
+		}
+		toUserID := proc.identityResolver.Canonical(link.From)
+		if toUserID == link.From {
+			continue
+		}
+		fromEvents := proc.userEventsMap[link.From]
+		proc.userJobListMap[toUserID] = append(fromJobs, proc.userJobListMap[toUserID]...)
+		proc.userEventsMap[toUserID] = append(fromEvents, proc.userEventsMap[toUserID]...)
+		delete(proc.userJobListMap, link.From)
+		delete(proc.userEventsMap, link.From)
+		proc.sessionTracker.Remove(link.From)
+		if processUserIDs[link.From] {
+			delete(processUserIDs, link.From)
+			processUserIDs[toUserID] = true
+		}
+		proc.sessionTracker.Touch(toUserID, time.Now())
+		proc.identityStats.mergedSessions.Increment()
+	}
+}
+
+//canonicalSessionTag rewrites the tag of a job buffered in a session with
+//the canonical id of its user, so that Regroup merges the sessions which
+//were linked while the jobs were buffered
+func (proc *HandleT) canonicalSessionTag(errorResponse json.RawMessage) json.RawMessage {
+	if proc.identityResolver == nil {
+		return errorResponse
+	}
+	tag, ok := sessions.ParseTag(errorResponse)
+	if !ok {
+		return errorResponse
+	}
+	canonicalID := proc.identityResolver.Canonical(tag.UserID)
+	if canonicalID == tag.UserID {
+		return errorResponse
+	}
+	return sessions.Tag(tag.SessionID, canonicalID)
+}
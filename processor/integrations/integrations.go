@@ -3,21 +3,54 @@ package integrations
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"strings"
+	"sync"
 
 	backendconfig "github.com/rudderlabs/rudder-server/config/backend-config"
 
 	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/processor/integrations/native"
 	"github.com/rudderlabs/rudder-server/utils/misc"
 	"github.com/tidwall/gjson"
 )
 
 var (
 	destTransformURL, userTransformURL string
+	destinationTransformers            = map[string]DestinationTransformer{}
+	destinationTransformersLock        sync.RWMutex
 )
 
+//DestinationTransformer transforms the events of a destination type in
+//process, instead of through the transformer service. message is the
+//event and destinationConfig the Config of the destination it is sent
+//to. It returns the router payloads, as the service does, or why the
+//event can't be sent
+type DestinationTransformer interface {
+	Transform(message map[string]interface{}, destinationConfig map[string]interface{}) ([]interface{}, error)
+}
+
 func init() {
 	loadConfig()
+	RegisterDestinationTransformer("GA", native.GA{})
+	RegisterDestinationTransformer("AM", native.AM{})
+}
+
+//RegisterDestinationTransformer makes transformer the in process
+//transformation of the destinations named destName
+func RegisterDestinationTransformer(destName string, transformer DestinationTransformer) {
+	destinationTransformersLock.Lock()
+	defer destinationTransformersLock.Unlock()
+	destinationTransformers[destName] = transformer
+}
+
+//GetDestinationTransformer returns the in process transformation of the
+//destinations named destName, if one is registered
+func GetDestinationTransformer(destName string) (DestinationTransformer, bool) {
+	destinationTransformersLock.RLock()
+	defer destinationTransformersLock.RUnlock()
+	transformer, ok := destinationTransformers[destName]
+	return transformer, ok
 }
 
 func loadConfig() {
@@ -104,3 +137,9 @@ func GetDestinationURL(destID string) string {
 func GetUserTransformURL() string {
 	return userTransformURL
 }
+
+//GetUserTransformVersionURL returns the URL running a version of a
+//user transformation
+func GetUserTransformVersionURL(versionID string) string {
+	return fmt.Sprintf("%s/customTransform?versionId=%s", userTransformURL, url.QueryEscape(versionID))
+}
@@ -0,0 +1,95 @@
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const amEndpoint = "https://api.amplitude.com/httpapi"
+
+//AM sends events to the Amplitude HTTP API. The destination config
+//needs an apiKey
+type AM struct{}
+
+//Transform turns identify, page, screen and track messages into
+//Amplitude events
+func (AM) Transform(message map[string]interface{}, destinationConfig map[string]interface{}) ([]interface{}, error) {
+	apiKey, _ := destinationConfig["apiKey"].(string)
+	if apiKey == "" {
+		return nil, fmt.Errorf("AM: apiKey is not set")
+	}
+	deviceID := anonymousID(message)
+	userID := getString(message, "userId")
+	if userID == "" {
+		userID = deviceID
+	}
+	if userID == "" {
+		return nil, fmt.Errorf("AM: message has neither anonymousId nor userId")
+	}
+
+	event := map[string]interface{}{
+		"user_id": userID,
+	}
+	if deviceID != "" {
+		event["device_id"] = deviceID
+	}
+	if t := timestamp(message); !t.IsZero() {
+		event["time"] = t.UnixNano() / 1e6
+	}
+	setIfPresent(event, "insert_id", message, "messageId")
+	setIfPresent(event, "insert_id", message, "message_id")
+	setIfPresent(event, "ip", message, "request_ip")
+	setIfPresent(event, "platform", message, "channel")
+	setIfPresent(event, "os_name", message, "context.os.name")
+	setIfPresent(event, "os_version", message, "context.os.version")
+	setIfPresent(event, "device_model", message, "context.device.model")
+	setIfPresent(event, "device_manufacturer", message, "context.device.manufacturer")
+	setIfPresent(event, "app_version", message, "context.app.version")
+	setIfPresent(event, "language", message, "context.locale")
+
+	properties := getMap(message, "properties")
+	messageType := strings.ToLower(getString(message, "type"))
+	switch messageType {
+	case "identify":
+		event["event_type"] = "$identify"
+		traits := map[string]interface{}{}
+		for _, path := range []string{"context.traits", "traits"} {
+			for key, value := range getMap(message, path) {
+				traits[key] = value
+			}
+		}
+		event["user_properties"] = traits
+	case "page":
+		event["event_type"] = "Loaded a Page"
+		event["event_properties"] = properties
+	case "screen":
+		event["event_type"] = "Viewed Screen"
+		event["event_properties"] = properties
+	case "track":
+		eventType := getString(message, "event")
+		if eventType == "" {
+			return nil, fmt.Errorf("AM: track message has no event")
+		}
+		event["event_type"] = eventType
+		event["event_properties"] = properties
+		//Amplitude takes the revenue fields at the top level
+		setIfPresent(event, "productId", properties, "product_id")
+		setIfPresent(event, "price", properties, "price")
+		setIfPresent(event, "quantity", properties, "quantity")
+		setIfPresent(event, "revenue", properties, "revenue")
+		setIfPresent(event, "revenueType", properties, "revenue_type")
+	default:
+		return nil, fmt.Errorf("AM: message type %q is not supported", messageType)
+	}
+
+	eventJSON, err := json.Marshal([]interface{}{event})
+	if err != nil {
+		return nil, fmt.Errorf("AM: %v", err)
+	}
+	payload := map[string]interface{}{
+		"api_key": apiKey,
+		"event":   string(eventJSON),
+	}
+	return []interface{}{routerPayload(amEndpoint, userID, payload)}, nil
+}
@@ -0,0 +1,147 @@
+package native
+
+import (
+	"fmt"
+	"strings"
+)
+
+const gaEndpoint = "https://www.google-analytics.com/collect"
+
+//gaProductActions maps the ecommerce events to their GA product action
+var gaProductActions = map[string]string{
+	"Product Clicked":  "click",
+	"Product Viewed":   "detail",
+	"Product Added":    "add",
+	"Product Removed":  "remove",
+	"Checkout Started": "checkout",
+	"Order Completed":  "purchase",
+	"Order Refunded":   "refund",
+}
+
+//GA sends events to the Google Analytics measurement protocol. The
+//destination config needs a trackingID
+type GA struct{}
+
+//Transform turns page, screen and track messages into GA hits
+func (GA) Transform(message map[string]interface{}, destinationConfig map[string]interface{}) ([]interface{}, error) {
+	trackingID, _ := destinationConfig["trackingID"].(string)
+	if trackingID == "" {
+		return nil, fmt.Errorf("GA: trackingID is not set")
+	}
+	clientID := anonymousID(message)
+	if clientID == "" {
+		clientID = getString(message, "userId")
+	}
+	if clientID == "" {
+		return nil, fmt.Errorf("GA: message has neither anonymousId nor userId")
+	}
+
+	payload := map[string]interface{}{
+		"v":   1,
+		"tid": trackingID,
+		"cid": clientID,
+	}
+	setIfPresent(payload, "uid", message, "userId")
+	setIfPresent(payload, "ds", message, "channel")
+	setIfPresent(payload, "uip", message, "request_ip")
+	setIfPresent(payload, "ul", message, "context.locale")
+	setIfPresent(payload, "an", message, "context.app.name")
+	setIfPresent(payload, "av", message, "context.app.version")
+	if userAgent := getString(message, "context.userAgent", "context.user_agent"); userAgent != "" {
+		payload["ua"] = userAgent
+	}
+
+	properties := getMap(message, "properties")
+	messageType := strings.ToLower(getString(message, "type"))
+	switch messageType {
+	case "page":
+		payload["t"] = "pageview"
+		setIfPresent(payload, "dl", properties, "url")
+		setIfPresent(payload, "dp", properties, "path")
+		setIfPresent(payload, "dt", properties, "title")
+		setIfPresent(payload, "dr", properties, "referrer")
+	case "screen":
+		payload["t"] = "screenview"
+		screenName := getString(message, "name", "properties.name", "event")
+		if screenName == "" {
+			return nil, fmt.Errorf("GA: screen message has no name")
+		}
+		payload["cd"] = screenName
+	case "track":
+		event := getString(message, "event")
+		if event == "" {
+			return nil, fmt.Errorf("GA: track message has no event")
+		}
+		payload["t"] = "event"
+		payload["ea"] = event
+		payload["ec"] = event
+		setIfPresent(payload, "el", properties, "label")
+		setIfPresent(payload, "dl", properties, "url")
+		setIntIfPresent(payload, "ev", properties, "value")
+		//The category of ecommerce events is the event, the category
+		//property being the one of the product
+		if action, ok := gaProductActions[event]; ok {
+			gaEcommerce(payload, action, properties)
+		} else {
+			setIfPresent(payload, "ec", properties, "category")
+		}
+	default:
+		return nil, fmt.Errorf("GA: message type %q is not supported", messageType)
+	}
+	return []interface{}{routerPayload(gaEndpoint, clientID, payload)}, nil
+}
+
+//gaEcommerce adds the enhanced ecommerce parameters of a product action.
+//The products are taken from properties.products, or properties itself
+//for single product events
+func gaEcommerce(payload map[string]interface{}, action string, properties map[string]interface{}) {
+	payload["pa"] = action
+	setIfPresent(payload, "ti", properties, "order_id")
+	setIfPresent(payload, "tr", properties, "revenue")
+	setIfPresent(payload, "tr", properties, "total")
+	setIfPresent(payload, "ts", properties, "shipping")
+	setIfPresent(payload, "tt", properties, "tax")
+	setIfPresent(payload, "cu", properties, "currency")
+	isOrder := action == "purchase" || action == "refund"
+	if isOrder {
+		setIfPresent(payload, "tcc", properties, "coupon")
+	}
+
+	products, _ := properties["products"].([]interface{})
+	if len(products) == 0 {
+		products = []interface{}{properties}
+	}
+	for idx, product := range products {
+		productMap, ok := product.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		prefix := fmt.Sprintf("pr%d", idx+1)
+		setIfPresent(payload, prefix+"id", productMap, "sku")
+		setIfPresent(payload, prefix+"id", productMap, "product_id")
+		setIfPresent(payload, prefix+"nm", productMap, "name")
+		setIfPresent(payload, prefix+"ca", productMap, "category")
+		setIfPresent(payload, prefix+"br", productMap, "brand")
+		setIfPresent(payload, prefix+"va", productMap, "variant")
+		setIfPresent(payload, prefix+"pr", productMap, "price")
+		setIntIfPresent(payload, prefix+"qt", productMap, "quantity")
+		setIntIfPresent(payload, prefix+"ps", productMap, "position")
+		if !isOrder {
+			setIfPresent(payload, prefix+"cc", productMap, "coupon")
+		}
+		dimensions, _ := productMap["dimensions"].([]interface{})
+		for dimensionIdx, dimension := range dimensions {
+			payload[fmt.Sprintf("%scd%d", prefix, dimensionIdx)] = dimension
+		}
+	}
+}
+
+//setIntIfPresent is setIfPresent for the parameters GA only takes
+//integers for
+func setIntIfPresent(payload map[string]interface{}, key string, properties map[string]interface{}, path string) {
+	if value, ok := get(properties, path); ok {
+		if number, isNumber := value.(float64); isNumber {
+			payload[key] = int64(number)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Package native has Go implementations of destination transformations of
+the transformer service, run in process by the processor. They take the
+event and the destination config and return the same router payloads as
+the service:
+
+	{"endpoint": ..., "userId": ..., "payload": {...}, "header": {...},
+	 "requestConfig": {"requestFormat": "PARAMS"|"JSON", "requestMethod": "POST"|"GET"}}
+
+An error means the event can't be sent to the destination, as a 400 of
+the service does.
+*/
+package native
+
+import (
+	"strings"
+	"time"
+)
+
+//get returns the value at the dot separated path in message
+func get(message map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = message
+	for _, key := range strings.Split(path, ".") {
+		valueMap, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = valueMap[key]
+		if !ok || value == nil {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+//getString returns the first non empty string among paths
+func getString(message map[string]interface{}, paths ...string) string {
+	for _, path := range paths {
+		value, _ := get(message, path)
+		if str, ok := value.(string); ok && str != "" {
+			return str
+		}
+	}
+	return ""
+}
+
+//getMap returns the object at path, empty if there is none
+func getMap(message map[string]interface{}, path string) map[string]interface{} {
+	value, _ := get(message, path)
+	valueMap, ok := value.(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return valueMap
+}
+
+//setIfPresent copies the value at path in message to payload[key]
+func setIfPresent(payload map[string]interface{}, key string, message map[string]interface{}, path string) {
+	if value, ok := get(message, path); ok {
+		if str, isString := value.(string); isString && str == "" {
+			return
+		}
+		payload[key] = value
+	}
+}
+
+//anonymousID returns the anonymous id of the message, in the current
+//or older SDK layout
+func anonymousID(message map[string]interface{}) string {
+	return getString(message, "anonymousId", "anonymous_id", "context.traits.anonymous_id")
+}
+
+//timestamp returns the time of the message, the zero time if it has none
+func timestamp(message map[string]interface{}) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05-0700"} {
+		t, err := time.Parse(layout, getString(message, "timestamp", "originalTimestamp"))
+		if err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func routerPayload(endpoint string, userID string, payload map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"endpoint": endpoint,
+		"userId":   userID,
+		"payload":  payload,
+		"header":   map[string]interface{}{},
+		"requestConfig": map[string]interface{}{
+			"requestFormat": "PARAMS",
+			"requestMethod": "POST",
+		},
+	}
+}
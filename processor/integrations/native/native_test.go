@@ -0,0 +1,182 @@
+package native_test
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/processor/integrations/native"
+)
+
+//The golden files hold the router payloads expected for the inputs, in
+//the format of the transformer service (the product_clicked_legacy
+//inputs are the message of utils/tests/GA/mapping.json). Run with
+//-update to rewrite them from the current implementations, and review
+//the diff. The payloads are also checked against the hits of the
+//reference mapping, which doesn't come from these implementations
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+const referenceMappingFile = "../../../utils/tests/GA/mapping.json"
+
+type transformer interface {
+	Transform(message map[string]interface{}, destinationConfig map[string]interface{}) ([]interface{}, error)
+}
+
+type goldenInputT struct {
+	DestinationConfig map[string]interface{} `json:"destinationConfig"`
+	Message           map[string]interface{} `json:"message"`
+}
+
+type goldenOutputT struct {
+	Output []interface{} `json:"output,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+func readInput(inputFile string) goldenInputT {
+	data, err := ioutil.ReadFile(inputFile)
+	Expect(err).NotTo(HaveOccurred())
+	var input goldenInputT
+	Expect(json.Unmarshal(data, &input)).To(Succeed())
+	return input
+}
+
+func transformInput(destTransformer transformer, input goldenInputT) goldenOutputT {
+	output, err := destTransformer.Transform(input.Message, input.DestinationConfig)
+	if err != nil {
+		return goldenOutputT{Error: err.Error()}
+	}
+	//Compare the JSON the processor stores, not the Go values
+	data, err := json.Marshal(output)
+	Expect(err).NotTo(HaveOccurred())
+	var outputJSON []interface{}
+	Expect(json.Unmarshal(data, &outputJSON)).To(Succeed())
+	return goldenOutputT{Output: outputJSON}
+}
+
+func checkGoldenFiles(dir string, destTransformer transformer) {
+	inputFiles, err := filepath.Glob(filepath.Join("testdata", dir, "*.input.json"))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(inputFiles).NotTo(BeEmpty())
+
+	for _, inputFile := range inputFiles {
+		goldenFile := strings.TrimSuffix(inputFile, ".input.json") + ".golden.json"
+		output := transformInput(destTransformer, readInput(inputFile))
+		if *update {
+			data, err := json.MarshalIndent(output, "", "  ")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(goldenFile, append(data, '\n'), 0644)).To(Succeed())
+			continue
+		}
+
+		data, err := ioutil.ReadFile(goldenFile)
+		Expect(err).NotTo(HaveOccurred(), goldenFile)
+		var golden goldenOutputT
+		Expect(json.Unmarshal(data, &golden)).To(Succeed())
+		Expect(output).To(Equal(golden), inputFile)
+	}
+}
+
+//lookup returns the value at the dot separated path, whose parts index
+//the arrays they are in
+func lookup(value interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = container[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx >= len(container) {
+				return nil, false
+			}
+			value = container[idx]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+//checkReferenceHit checks that payload has the parameters of the
+//reference hit of event for dest, e.g. GA: the ones of event[dest] and
+//the ones mapped from the message by event[dest+"Mapping"]. Several
+//message fields can map to one parameter, which must then have one of
+//their values
+func checkReferenceHit(event map[string]interface{}, dest string, payload map[string]interface{}) {
+	for key, value := range event[dest].(map[string]interface{}) {
+		Expect(payload).To(HaveKeyWithValue(key, value), dest)
+	}
+	expected := make(map[string][]interface{})
+	for path, key := range event[dest+"Mapping"].(map[string]interface{}) {
+		if value, ok := lookup(event["rudder"], path); ok {
+			expected[key.(string)] = append(expected[key.(string)], value)
+		}
+	}
+	Expect(expected).NotTo(BeEmpty())
+	for key, values := range expected {
+		value, ok := lookup(payload, key)
+		Expect(ok).To(BeTrue(), dest+" "+key)
+		Expect(values).To(ContainElement(value), dest+" "+key)
+	}
+}
+
+var _ = Describe("Native", func() {
+
+	It("transforms GA events like the golden files", func() {
+		checkGoldenFiles("ga", native.GA{})
+	})
+
+	It("transforms Amplitude events like the golden files", func() {
+		checkGoldenFiles("am", native.AM{})
+	})
+
+	//The other reference events have fixed parameters which don't come
+	//from their message, e.g. the "ea" of Track
+	It("transforms the Product Clicked event like the reference mapping", func() {
+		data, err := ioutil.ReadFile(referenceMappingFile)
+		Expect(err).NotTo(HaveOccurred())
+		var mapping struct {
+			Events []map[string]interface{} `json:"events"`
+		}
+		Expect(json.Unmarshal(data, &mapping)).To(Succeed())
+
+		var event map[string]interface{}
+		for _, mappingEvent := range mapping.Events {
+			if mappingEvent["name"] == "Product Clicked" {
+				event = mappingEvent
+			}
+		}
+		Expect(event).NotTo(BeNil())
+		message := event["rudder"].(map[string]interface{})["message"].(map[string]interface{})
+		ga := event["GA"].(map[string]interface{})
+		am := event["AM"].(map[string]interface{})
+
+		output := transformInput(native.GA{}, goldenInputT{
+			DestinationConfig: map[string]interface{}{"trackingID": ga["tid"]},
+			Message:           message,
+		})
+		Expect(output.Error).To(BeEmpty())
+		Expect(output.Output).To(HaveLen(1))
+		checkReferenceHit(event, "GA", output.Output[0].(map[string]interface{})["payload"].(map[string]interface{}))
+
+		output = transformInput(native.AM{}, goldenInputT{
+			DestinationConfig: map[string]interface{}{"apiKey": am["api_key"]},
+			Message:           message,
+		})
+		Expect(output.Error).To(BeEmpty())
+		Expect(output.Output).To(HaveLen(1))
+		payload := output.Output[0].(map[string]interface{})["payload"].(map[string]interface{})
+		//The Amplitude events are sent as a JSON string
+		var events []interface{}
+		Expect(json.Unmarshal([]byte(payload["event"].(string)), &events)).To(Succeed())
+		payload["event"] = events
+		checkReferenceHit(event, "AM", payload)
+	})
+})
@@ -0,0 +1,92 @@
+/*
+Package pipeline runs the stages of the processor concurrently. Every
+stage runs on its own goroutine and takes the items of the previous one
+from a bounded channel, so a slow stage makes the earlier ones block
+rather than pile up items in memory.
+
+Stages handle the items one at a time, in the order they were put in the
+pipeline, so the order of the events of a user is kept from one stage to
+the next. Parallelism within a stage is left to the stage (see Parallel).
+*/
+package pipeline
+
+import (
+	"sync"
+)
+
+//StageFuncT handles an item and returns what is passed to the next stage,
+//nil to pass nothing
+type StageFuncT func(item interface{}) interface{}
+
+//PipelineT runs items through its stages
+type PipelineT struct {
+	input chan interface{}
+	done  sync.WaitGroup
+}
+
+//New starts a pipeline of stages, with at most bufferSize items waiting
+//in front of each stage
+func New(bufferSize int, stages ...StageFuncT) *PipelineT {
+	pipeline := &PipelineT{
+		input: make(chan interface{}, bufferSize),
+	}
+	input := pipeline.input
+	for idx, stage := range stages {
+		var output chan interface{}
+		if idx < len(stages)-1 {
+			output = make(chan interface{}, bufferSize)
+		}
+		pipeline.done.Add(1)
+		go pipeline.runStage(stage, input, output)
+		input = output
+	}
+	return pipeline
+}
+
+func (pipeline *PipelineT) runStage(stage StageFuncT, input <-chan interface{}, output chan<- interface{}) {
+	defer pipeline.done.Done()
+	if output != nil {
+		defer close(output)
+	}
+	for item := range input {
+		result := stage(item)
+		if output != nil && result != nil {
+			output <- result
+		}
+	}
+}
+
+//Put adds item to the pipeline. It blocks while the first stage has
+//bufferSize items waiting
+func (pipeline *PipelineT) Put(item interface{}) {
+	pipeline.input <- item
+}
+
+//Close waits for the items put in the pipeline to go through every stage
+//and stops it
+func (pipeline *PipelineT) Close() {
+	close(pipeline.input)
+	pipeline.done.Wait()
+}
+
+//Parallel runs fn for every index below count, on at most parallelism
+//goroutines, and returns once they are all done
+func Parallel(count int, parallelism int, fn func(idx int)) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, parallelism)
+	for idx := 0; idx < count; idx++ {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(idx int) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			fn(idx)
+		}(idx)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,55 @@
+package pipeline_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rudderlabs/rudder-server/processor/pipeline"
+)
+
+//The benchmarks process batches the way the processor does: read, route,
+//transform for numDestinations destinations and store, each step taking
+//stepTime, as waiting on the database or the transformer does
+const (
+	numDestinations = 4
+	stepTime        = time.Millisecond
+)
+
+func step(item interface{}) interface{} {
+	time.Sleep(stepTime)
+	return item
+}
+
+func transformSerially(item interface{}) interface{} {
+	for i := 0; i < numDestinations; i++ {
+		time.Sleep(stepTime)
+	}
+	return item
+}
+
+func transformInParallel(item interface{}) interface{} {
+	pipeline.Parallel(numDestinations, numDestinations, func(int) {
+		time.Sleep(stepTime)
+	})
+	return item
+}
+
+//BenchmarkSequential is the processor before the pipeline: one batch at
+//a time, one destination at a time
+func BenchmarkSequential(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		step(i)
+		step(i)
+		transformSerially(i)
+		step(i)
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	p := pipeline.New(4, step, transformInParallel, step)
+	for i := 0; i < b.N; i++ {
+		step(i)
+		p.Put(i)
+	}
+	p.Close()
+}
@@ -0,0 +1,105 @@
+package pipeline_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/processor/pipeline"
+)
+
+var _ = Describe("Pipeline", func() {
+
+	It("runs the items through the stages in order", func() {
+		var output []int
+		p := pipeline.New(2,
+			func(item interface{}) interface{} { return item.(int) * 10 },
+			func(item interface{}) interface{} {
+				if item.(int)%20 == 0 {
+					return nil
+				}
+				return item.(int) + 1
+			},
+			func(item interface{}) interface{} {
+				output = append(output, item.(int))
+				return nil
+			},
+		)
+		for i := 1; i <= 6; i++ {
+			p.Put(i)
+		}
+		p.Close()
+		Expect(output).To(Equal([]int{11, 31, 51}))
+	})
+
+	It("overlaps the stages", func() {
+		var lock sync.Mutex
+		running, maxRunning := 0, 0
+		stage := func(item interface{}) interface{} {
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return item
+		}
+		p := pipeline.New(1, stage, stage, stage)
+		for i := 0; i < 5; i++ {
+			p.Put(i)
+		}
+		p.Close()
+		Expect(maxRunning).To(BeNumerically(">", 1))
+	})
+
+	It("blocks Put while the stages are full", func() {
+		release := make(chan struct{})
+		p := pipeline.New(1, func(item interface{}) interface{} {
+			<-release
+			return nil
+		})
+		put := make(chan int, 10)
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 5; i++ {
+				p.Put(i)
+				put <- i
+			}
+			close(done)
+		}()
+		//One item in the stage, one waiting in front of it
+		Eventually(func() int { return len(put) }).Should(Equal(2))
+		Consistently(func() int { return len(put) }, 50*time.Millisecond).Should(Equal(2))
+		close(release)
+		Eventually(done).Should(BeClosed())
+		Expect(put).To(HaveLen(5))
+		p.Close()
+	})
+
+	It("runs Parallel on at most parallelism goroutines", func() {
+		var running, maxRunning int32
+		results := make([]int, 20)
+		pipeline.Parallel(20, 4, func(idx int) {
+			now := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if now <= max || atomic.CompareAndSwapInt32(&maxRunning, max, now) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			results[idx] = idx * 2
+			atomic.AddInt32(&running, -1)
+		})
+		Expect(maxRunning).To(BeNumerically("<=", 4))
+		for idx, result := range results {
+			Expect(result).To(Equal(idx * 2))
+		}
+	})
+})
@@ -13,7 +13,13 @@ import (
 	backendconfig "github.com/rudderlabs/rudder-server/config/backend-config"
 	"github.com/rudderlabs/rudder-server/gateway"
 	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/processor/eventfilter"
+	"github.com/rudderlabs/rudder-server/processor/identity"
 	"github.com/rudderlabs/rudder-server/processor/integrations"
+	"github.com/rudderlabs/rudder-server/processor/pipeline"
+	"github.com/rudderlabs/rudder-server/processor/scriptengine"
+	"github.com/rudderlabs/rudder-server/processor/sessions"
+	"github.com/rudderlabs/rudder-server/processor/trackingplan"
 	"github.com/rudderlabs/rudder-server/services/stats"
 	"github.com/rudderlabs/rudder-server/utils"
 	"github.com/rudderlabs/rudder-server/utils/logger"
@@ -25,6 +31,7 @@ import (
 //HandleT is an handle to this object used in main.go
 type HandleT struct {
 	gatewayDB      *jobsdb.HandleT
+	gatewayNotify  <-chan bool
 	routerDB       *jobsdb.HandleT
 	batchRouterDB  *jobsdb.HandleT
 	transformer    *transformerHandleT
@@ -36,15 +43,35 @@ type HandleT struct {
 	statDBW        *stats.RudderStats
 	userJobListMap map[string][]*jobsdb.JobT
 	userEventsMap  map[string][]interface{}
-	userPQItemMap  map[string]*pqItemT
-	userJobPQ      pqT
+	sessionTracker *sessions.TrackerT
+	sessionBuffer  sessionBufferT
 	userPQLock     sync.Mutex
+
+	//Links the ids of the users, when identity stitching is enabled
+	identityResolver *identity.ResolverT
+	identityStats    identityStatsT
+
+	//Stages the jobs are processed in
+	pipeline      *pipeline.PipelineT
+	pipelineStats pipelineStatsT
+	sessionOrder  *sessionOrderT
+
+	userTransformStats userTransformStatsT
+
+	transformationErrorDB    *jobsdb.HandleT
+	transformationErrorStats transformationErrorStatsT
+
+	//Stores the events violating tracking plans which quarantine them
+	quarantineDB *jobsdb.HandleT
+
+	//Runs the user transformations in process when set
+	scriptEngine *scriptengine.EngineT
 }
 
 //Print the internal structure
 func (proc *HandleT) Print() {
 	logger.Debug("PriorityQueue")
-	proc.userJobPQ.Print()
+	proc.sessionTracker.Print()
 	logger.Debug("JobList")
 	for k, v := range proc.userJobListMap {
 		logger.Debug(k, ":", len(v))
@@ -53,10 +80,6 @@ func (proc *HandleT) Print() {
 	for k, v := range proc.userEventsMap {
 		logger.Debug(k, ":", len(v))
 	}
-	logger.Debug("PQItem")
-	for k, v := range proc.userPQItemMap {
-		logger.Debug(k, ":", *v)
-	}
 }
 
 func init() {
@@ -67,6 +90,7 @@ func init() {
 //Setup initializes the module
 func (proc *HandleT) Setup(gatewayDB *jobsdb.HandleT, routerDB *jobsdb.HandleT, batchRouterDB *jobsdb.HandleT) {
 	proc.gatewayDB = gatewayDB
+	proc.gatewayNotify = gatewayDB.Subscribe([]string{gateway.CustomVal})
 	proc.routerDB = routerDB
 	proc.batchRouterDB = batchRouterDB
 	proc.transformer = &transformerHandleT{}
@@ -75,8 +99,8 @@ func (proc *HandleT) Setup(gatewayDB *jobsdb.HandleT, routerDB *jobsdb.HandleT,
 	proc.statsDBW = &misc.PerfStats{}
 	proc.userJobListMap = make(map[string][]*jobsdb.JobT)
 	proc.userEventsMap = make(map[string][]interface{})
-	proc.userPQItemMap = make(map[string]*pqItemT)
-	proc.userJobPQ = make(pqT, 0)
+	proc.sessionTracker = sessions.NewTracker()
+	proc.sessionBuffer = newSessionBuffer()
 	proc.statsJobs.Setup("ProcessorJobs")
 	proc.statsDBR.Setup("ProcessorDBRead")
 	proc.statsDBW.Setup("ProcessorDBWrite")
@@ -84,11 +108,21 @@ func (proc *HandleT) Setup(gatewayDB *jobsdb.HandleT, routerDB *jobsdb.HandleT,
 	proc.statJobs = stats.NewStat("processor.jobs", stats.CountType)
 	proc.statDBR = stats.NewStat("processor.db_read", stats.CountType)
 	proc.statDBW = stats.NewStat("processor.db_write", stats.CountType)
+	proc.userTransformStats = newUserTransformStats()
+	proc.transformationErrorStats = newTransformationErrorStats()
+	if enableEmbeddedUserTransform {
+		proc.scriptEngine = scriptengine.New(userTransformLimits, fetchTransformationCode)
+	}
 
 	go backendConfigSubscriber()
 	proc.transformer.Setup()
+	proc.setupIdentityResolver()
+	proc.setupPipeline()
 	proc.crashRecover()
 	go proc.mainLoop()
+	if proc.transformationErrorDB != nil {
+		go proc.transformationErrorsRetryLoop()
+	}
 	if processSessions {
 		logger.Info("Starting session processor")
 		go proc.createSessions()
@@ -103,8 +137,16 @@ var (
 	sessionThresholdEvents int
 	processSessions        bool
 	writeKeyDestinationMap map[string][]backendconfig.DestinationT
+	destinationIDMap       map[string]backendconfig.DestinationT
+	destinationFilterMap   map[string]*eventfilter.RuleSetT
 	rawDataDestinations    []string
 	configSubscriberLock   sync.RWMutex
+	//Use the in process destination transformations where there are
+	enableNativeTransformers bool
+	//Run the user transformations in process rather than through the
+	//user transformer service
+	enableEmbeddedUserTransform bool
+	userTransformLimits         scriptengine.LimitsT
 )
 
 func loadConfig() {
@@ -118,7 +160,20 @@ func loadConfig() {
 	numTransformWorker = config.GetInt("Processor.numTransformWorker", 32)
 	maxRetry = config.GetInt("Processor.maxRetry", 3)
 	retrySleep = config.GetDuration("Processor.retrySleepInMS", time.Duration(100)) * time.Millisecond
+	enableNativeTransformers = config.GetBool("Processor.enableNativeTransformers", false)
+	enableEmbeddedUserTransform = config.GetBool("Processor.enableEmbeddedUserTransform", false)
+	userTransformLimits = scriptengine.LimitsT{
+		Timeout:          config.GetDuration("Processor.userTransformTimeoutInMS", time.Duration(1000)) * time.Millisecond,
+		MaxCallStackSize: config.GetInt("Processor.userTransformMaxCallStackSize", 1000),
+		MaxInputBytes:    config.GetInt("Processor.userTransformMaxInputSizeInMB", 16) << 20,
+		MaxOutputBytes:   config.GetInt("Processor.userTransformMaxOutputSizeInMB", 16) << 20,
+		MaxHeapBytes:     uint64(config.GetInt64("Processor.userTransformMaxProcessHeapInMB", 4096)) << 20,
+	}
+	transformationErrorsRetrySleep = config.GetDuration("Processor.transformationErrorsRetrySleepInS", time.Duration(5)) * time.Second
 	rawDataDestinations = []string{"S3"}
+	loadSessionBufferConfig()
+	loadIdentityConfig()
+	loadPipelineConfig()
 }
 
 func backendConfigSubscriber() {
@@ -128,10 +183,30 @@ func backendConfigSubscriber() {
 		config := <-ch
 		configSubscriberLock.Lock()
 		writeKeyDestinationMap = make(map[string][]backendconfig.DestinationT)
+		destinationIDMap = make(map[string]backendconfig.DestinationT)
+		destinationFilterMap = make(map[string]*eventfilter.RuleSetT)
+		writeKeyTrackingPlanMap = make(map[string]*trackingplan.PlanT)
 		sources := config.Data.(backendconfig.SourcesT)
 		for _, source := range sources.Sources {
 			if source.Enabled {
 				writeKeyDestinationMap[source.WriteKey] = source.Destinations
+				plan, err := trackingplan.Parse(source.Config)
+				if err != nil {
+					//Like no plan, as a wrong plan would drop everything
+					logger.Errorf("Ignoring tracking plan of source %s: %v", source.ID, err)
+				} else if plan != nil {
+					writeKeyTrackingPlanMap[source.WriteKey] = plan
+				}
+				for _, destination := range source.Destinations {
+					destinationIDMap[destination.ID] = destination
+					ruleSet, err := eventfilter.Parse(destination.Config)
+					if err != nil {
+						//Keep sending everything rather than nothing
+						logger.Errorf("Ignoring event filters of destination %s: %v", destination.ID, err)
+						continue
+					}
+					destinationFilterMap[destination.ID] = ruleSet
+				}
 			}
 		}
 		configSubscriberLock.Unlock()
@@ -144,70 +219,68 @@ func (proc *HandleT) addJobsToSessions(jobList []*jobsdb.JobT) {
 
 	//List of users whose jobs need to be processed
 	processUserIDs := make(map[string]bool)
+	//Mark all as executing so next query doesn't pick it up. The jobs
+	//added to a session are tagged with it, for crashRecover
+	var statusList []*jobsdb.JobStatusT
 
 	for _, job := range jobList {
+		newStatus := jobsdb.JobStatusT{
+			JobID:         job.JobID,
+			JobState:      jobsdb.ExecutingState,
+			AttemptNum:    1,
+			ExecTime:      time.Now(),
+			RetryTime:     time.Now(),
+			ErrorCode:     "200",
+			ErrorResponse: []byte(`{"success":"OK"}`),
+		}
+		statusList = append(statusList, &newStatus)
+
 		//Append to job to list. If over threshold, just process them
 		eventList, ok := misc.ParseRudderEventBatch(job.EventPayload)
 		if !ok {
 			//bad event
 			continue
 		}
-		userID, ok := misc.GetRudderEventUserID(eventList)
+		userID, merged, ok := proc.resolveIdentities(eventList)
 		if !ok {
 			logger.Error("Failed to get userID for job")
 			continue
 		}
-		_, ok = proc.userJobListMap[userID]
-		if !ok {
-			proc.userJobListMap[userID] = make([]*jobsdb.JobT, 0)
-			proc.userEventsMap[userID] = make([]interface{}, 0)
-		}
+		proc.mergeSessions(merged, processUserIDs)
+		sessionID := proc.sessionTracker.Touch(userID, newStatus.ExecTime)
+		newStatus.ErrorResponse = sessions.Tag(sessionID, userID)
 		//Add the job to the userID specific lists
-		proc.userJobListMap[userID] = append(proc.userJobListMap[userID], job)
-		proc.userEventsMap[userID] = append(proc.userEventsMap[userID], eventList...)
+		proc.bufferJob(userID, job, eventList)
 		//If we have enough events from that user, we process jobs
 		if len(proc.userEventsMap[userID]) > sessionThresholdEvents {
 			processUserIDs[userID] = true
 		}
-		pqItem, ok := proc.userPQItemMap[userID]
-		if !ok {
-			pqItem := &pqItemT{
-				userID: userID,
-				lastTS: time.Now(),
-				index:  -1,
-			}
-			proc.userPQItemMap[userID] = pqItem
-			proc.userJobPQ.Add(pqItem)
-		} else {
-			misc.Assert(pqItem.index != -1)
-			proc.userJobPQ.Update(pqItem, time.Now())
-		}
-
 	}
+	proc.saveIdentityLinks()
+	proc.gatewayDB.UpdateJobStatus(statusList, []string{gateway.CustomVal})
 
-	if len(processUserIDs) > 0 {
-		userJobsToProcess := make(map[string][]*jobsdb.JobT)
-		userEventsToProcess := make(map[string][]interface{})
-		logger.Debug("Post Add Processing")
-		proc.Print()
-
-		//We clear the data structure for these users
-		for userID := range processUserIDs {
-			userJobsToProcess[userID] = proc.userJobListMap[userID]
-			userEventsToProcess[userID] = proc.userEventsMap[userID]
-			delete(proc.userJobListMap, userID)
-			delete(proc.userEventsMap, userID)
-			proc.userJobPQ.Remove(proc.userPQItemMap[userID])
-			delete(proc.userPQItemMap, userID)
-		}
-		logger.Debug("Processing")
-		proc.Print()
-		//We release the block before actually processing
+	userJobsToProcess := make(map[string][]*jobsdb.JobT)
+	userEventsToProcess := make(map[string][]interface{})
+	//We clear the data structure for these users
+	for userID := range processUserIDs {
+		proc.takeSession(userID, userJobsToProcess, userEventsToProcess)
+	}
+	if flushSessionsWhenBufferFull {
+		proc.flushOldestSessions(userJobsToProcess, userEventsToProcess)
+	}
+	proc.reportSessionBuffer()
+	if len(userJobsToProcess) == 0 {
 		proc.userPQLock.Unlock()
-		proc.processUserJobs(userJobsToProcess, userEventsToProcess)
 		return
 	}
+	logger.Debug("Processing")
+	proc.Print()
+	ticket := proc.sessionOrder.ticket()
 	proc.userPQLock.Unlock()
+
+	proc.sessionOrder.inTurn(ticket, func() {
+		proc.processUserJobs(userJobsToProcess, userEventsToProcess)
+	})
 }
 
 func (proc *HandleT) processUserJobs(userJobs map[string][]*jobsdb.JobT, userEvents map[string][]interface{}) {
@@ -282,17 +355,17 @@ func (proc *HandleT) createSessions() {
 	for {
 		proc.userPQLock.Lock()
 		//Now jobs
-		if proc.userJobPQ.Len() == 0 {
+		_, oldestTS, ok := proc.sessionTracker.Oldest()
+		if !ok {
 			proc.userPQLock.Unlock()
 			time.Sleep(loopSleep)
 			continue
 		}
 
 		//Enough time hasn't transpired since last
-		oldestItem := proc.userJobPQ.Top()
-		if time.Since(oldestItem.lastTS) < time.Duration(sessionThresholdInS) {
+		if time.Since(oldestTS) < time.Duration(sessionThresholdInS) {
 			proc.userPQLock.Unlock()
-			sleepTime := time.Duration(sessionThresholdInS) - time.Since(oldestItem.lastTS)
+			sleepTime := time.Duration(sessionThresholdInS) - time.Since(oldestTS)
 			logger.Debug("Sleeping", sleepTime)
 			time.Sleep(sleepTime)
 			continue
@@ -302,31 +375,30 @@ func (proc *HandleT) createSessions() {
 		userEventsToProcess := make(map[string][]interface{})
 		//Find all jobs that need to be processed
 		for {
-			if proc.userJobPQ.Len() == 0 {
+			userID, lastTS, ok := proc.sessionTracker.Oldest()
+			if !ok {
 				break
 			}
-			oldestItem := proc.userJobPQ.Top()
-			if time.Since(oldestItem.lastTS) > time.Duration(sessionThresholdInS) {
-				userID := oldestItem.userID
-				pqItem, ok := proc.userPQItemMap[userID]
-				misc.Assert(ok && pqItem == oldestItem)
-				userJobsToProcess[userID] = proc.userJobListMap[userID]
-				userEventsToProcess[userID] = proc.userEventsMap[userID]
+			if time.Since(lastTS) > time.Duration(sessionThresholdInS) {
 				//Clear from the map
-				delete(proc.userJobListMap, userID)
-				delete(proc.userEventsMap, userID)
-				proc.userJobPQ.Remove(proc.userPQItemMap[userID])
-				delete(proc.userPQItemMap, userID)
+				proc.takeSession(userID, userJobsToProcess, userEventsToProcess)
 				continue
 			}
 			break
 		}
+		proc.reportSessionBuffer()
+		if len(userJobsToProcess) == 0 {
+			proc.userPQLock.Unlock()
+			continue
+		}
+		logger.Debug("Processing Session Check")
+		proc.Print()
+		ticket := proc.sessionOrder.ticket()
 		proc.userPQLock.Unlock()
-		if len(userJobsToProcess) > 0 {
-			logger.Debug("Processing Session Check")
-			proc.Print()
+
+		proc.sessionOrder.inTurn(ticket, func() {
 			proc.processUserJobs(userJobsToProcess, userEventsToProcess)
-		}
+		})
 	}
 }
 
@@ -342,6 +414,30 @@ func getEnabledDestinations(writeKey string, destinationName string) []backendco
 	return enabledDests
 }
 
+//getEnabledDestination returns the destination with id if it is enabled
+func getEnabledDestination(id string) (backendconfig.DestinationT, bool) {
+	configSubscriberLock.RLock()
+	defer configSubscriberLock.RUnlock()
+	destination, ok := destinationIDMap[id]
+	return destination, ok && destination.Enabled
+}
+
+//getEventFilter returns the event filtering rules of the destination
+//with id, nil if it has none
+func getEventFilter(id string) *eventfilter.RuleSetT {
+	configSubscriberLock.RLock()
+	defer configSubscriberLock.RUnlock()
+	return destinationFilterMap[id]
+}
+
+//countFilteredEvents sends the count of events dropped by every rule,
+//keyed by destination id and rule name
+func countFilteredEvents(filteredCounts map[[2]string]int) {
+	for key, count := range filteredCounts {
+		stats.NewStat(fmt.Sprintf("processor.event_filter.%s.%s.filtered_events", key[0], key[1]), stats.CountType).Count(count)
+	}
+}
+
 func getEnabledDestinationTypes(writeKey string) map[string]backendconfig.DestinationDefinitionT {
 	configSubscriberLock.RLock()
 	defer configSubscriberLock.RUnlock()
@@ -371,14 +467,33 @@ func getTimestampFromEvent(event map[string]interface{}, field string) time.Time
 	return timestamp
 }
 
+//processJobsForDest queues jobList in the pipeline, which transforms the
+//events of the jobs for their destinations and stores them. The jobs must
+//be marked executing, so that they aren't read again meanwhile
 func (proc *HandleT) processJobsForDest(jobList []*jobsdb.JobT, parsedEventList [][]interface{}) {
+	proc.pipeline.Put(&processBatchT{
+		jobList:         jobList,
+		parsedEventList: parsedEventList,
+		start:           time.Now(),
+	})
+}
 
-	proc.statsJobs.Start()
+//routeJobs parses the events of the jobs of batch and groups them by the
+//destinations they go to
+func (proc *HandleT) routeJobs(batch *processBatchT) {
 
-	var destJobs []*jobsdb.JobT
-	var batchDestJobs []*jobsdb.JobT
+	jobList := batch.jobList
+	parsedEventList := batch.parsedEventList
 	var statusList []*jobsdb.JobStatusT
 	var eventsByDest = make(map[string][]interface{})
+	//Events of the destinations with user transformations are
+	//transformed before being added to eventsByDest
+	var userTransformGroups = make(map[string]*userTransformGroupT)
+	var userTransformDestIDs []string
+	//Events dropped by the event filtering rules
+	var filteredCounts = make(map[[2]string]int)
+	//Events violating the tracking plan of their source
+	var violationCounts = make(map[[2]string]int)
 
 	misc.Assert(parsedEventList == nil || len(jobList) == len(parsedEventList))
 	//Each block we receive from a client has a bunch of
@@ -397,6 +512,9 @@ func (proc *HandleT) processJobsForDest(jobList []*jobsdb.JobT, parsedEventList
 		var ok bool
 		if parsedEventList == nil {
 			eventList, ok = misc.ParseRudderEventBatch(batchEvent.EventPayload)
+			if ok && proc.identityResolver != nil {
+				proc.identityResolver.ResolveBatch(eventList)
+			}
 		} else {
 			eventList = parsedEventList[idx]
 			ok = (eventList != nil)
@@ -404,12 +522,21 @@ func (proc *HandleT) processJobsForDest(jobList []*jobsdb.JobT, parsedEventList
 		writeKey := gjson.Get(string(batchEvent.EventPayload), "writeKey").Str
 		requestIP := gjson.Get(string(batchEvent.EventPayload), "requestIP").Str
 		receivedAt := gjson.Get(string(batchEvent.EventPayload), "receivedAt").Time()
+		trackingPlan := getTrackingPlan(writeKey)
 
 		if ok {
 			//Iterate through all the events in the batch
 			for _, singularEvent := range eventList {
 				//We count this as one, not destination specific ones
 				totalEvents++
+				if trackingPlan != nil {
+					message, ok := singularEvent.(map[string]interface{})
+					misc.Assert(ok)
+					sourceID := gjson.GetBytes(batchEvent.Parameters, "source_id").Str
+					if !proc.enforceTrackingPlan(trackingPlan, sourceID, message, batch, violationCounts) {
+						continue
+					}
+				}
 				//Getting all the destinations which are enabled for this
 				//event
 				destTypesFromConfig := getEnabledDestinationTypes(writeKey)
@@ -432,8 +559,17 @@ func (proc *HandleT) processJobsForDest(jobList []*jobsdb.JobT, parsedEventList
 						shallowEventCopy := make(map[string]interface{})
 						singularEventMap, ok := singularEvent.(map[string]interface{})
 						misc.Assert(ok)
+						if kept, rule := getEventFilter(destination.ID).Evaluate(singularEventMap); !kept {
+							filteredCounts[[2]string{destination.ID, rule}]++
+							continue
+						}
 						shallowEventCopy["message"] = singularEventMap
 						shallowEventCopy["destination"] = reflect.ValueOf(destination).Interface()
+						if proc.identityResolver != nil {
+							if canonicalID := proc.identityResolver.MessageCanonicalID(singularEventMap); canonicalID != "" {
+								shallowEventCopy[identity.CanonicalIDKey] = canonicalID
+							}
+						}
 						shallowEventCopy["message"].(map[string]interface{})["request_ip"] = requestIP
 						shallowEventCopy["message"].(map[string]interface{})["source_id"] = gjson.GetBytes(batchEvent.Parameters, "source_id").Str
 
@@ -447,6 +583,17 @@ func (proc *HandleT) processJobsForDest(jobList []*jobsdb.JobT, parsedEventList
 						shallowEventCopy["message"].(map[string]interface{})["sentAt"] = sentAt.Format(time.RFC3339)
 						shallowEventCopy["message"].(map[string]interface{})["timestamp"] = receivedAt.Add(-sentAt.Sub(originalTimestamp)).Format(time.RFC3339)
 
+						if len(destination.Transformations) > 0 {
+							group, ok := userTransformGroups[destination.ID]
+							if !ok {
+								group = &userTransformGroupT{destType: destType, destination: destination}
+								userTransformGroups[destination.ID] = group
+								userTransformDestIDs = append(userTransformDestIDs, destination.ID)
+							}
+							group.events = append(group.events, shallowEventCopy)
+							continue
+						}
+
 						//We have at-least one event so marking it good
 						_, ok = eventsByDest[destType]
 						if !ok {
@@ -472,66 +619,138 @@ func (proc *HandleT) processJobsForDest(jobList []*jobsdb.JobT, parsedEventList
 		statusList = append(statusList, &newStatus)
 	}
 
-	//Now do the actual transformation. We call it in batches, once
-	//for each destination ID
-	for destID, destEventList := range eventsByDest {
-		//Call transform for this destination. Returns
-		//the JSON we can send to the destination
-		url := integrations.GetDestinationURL(destID)
-		logger.Debug("Transform input size", len(destEventList))
-		response := proc.transformer.Transform(destEventList, url, transformBatchSize, true)
-		destTransformEventList := response.Events
-		logger.Debug("Transform output size", len(destTransformEventList))
-		if !response.Success {
-			continue
-		}
-
-		//Save the JSON in DB. This is what the rotuer uses
-		for idx, destEvent := range destTransformEventList {
-			destEventJSON, err := json.Marshal(destEvent)
-			//Should be a valid JSON since its our transformation
-			//but we handle anyway
-			if err != nil {
-				continue
-			}
-
-			//Need to replace UUID his with messageID from client
-			id := uuid.NewV4()
-			sourceID := response.SourceIDList[idx]
-			newJob := jobsdb.JobT{
-				UUID:         id,
-				Parameters:   []byte(fmt.Sprintf(`{"source_id": "%v"}`, sourceID)),
-				CreatedAt:    time.Now(),
-				ExpireAt:     time.Now(),
-				CustomVal:    destID,
-				EventPayload: destEventJSON,
-			}
-			if misc.Contains(rawDataDestinations, newJob.CustomVal) {
-				batchDestJobs = append(batchDestJobs, &newJob)
-			} else {
-				destJobs = append(destJobs, &newJob)
-			}
-		}
-	}
-
+	countFilteredEvents(filteredCounts)
+	countViolations(violationCounts)
 	misc.Assert(len(statusList) == len(jobList))
 
+	batch.statusList = statusList
+	batch.eventsByDest = eventsByDest
+	batch.userTransformGroups = userTransformGroups
+	batch.userTransformDestIDs = userTransformDestIDs
+	batch.totalEvents = totalEvents
+}
+
+//storeJobs stores the router jobs of batch and marks its gateway jobs
+//processed
+func (proc *HandleT) storeJobs(batch *processBatchT) {
+	proc.saveIdentityLinks()
 	proc.statsDBW.Start()
 	//XX: Need to do this in a transaction
-	proc.routerDB.Store(destJobs)
-	proc.batchRouterDB.Store(batchDestJobs)
-	proc.gatewayDB.UpdateJobStatus(statusList, []string{gateway.CustomVal})
+	proc.routerDB.Store(batch.destJobs)
+	proc.batchRouterDB.Store(batch.batchDestJobs)
+	proc.storeTransformationErrors(batch.errList)
+	if proc.quarantineDB != nil {
+		proc.quarantineDB.Store(batch.quarantineJobs)
+	}
+	proc.gatewayDB.UpdateJobStatus(batch.statusList, []string{gateway.CustomVal})
 	//XX: End of transaction
-	proc.statsDBW.End(len(statusList))
-	proc.statsJobs.End(totalEvents)
+	proc.statsDBW.End(len(batch.statusList))
+	proc.statsJobs.Rate(batch.totalEvents, time.Since(batch.start))
 
-	proc.statJobs.Count(totalEvents)
-	proc.statDBW.Count(len(statusList))
+	proc.statJobs.Count(batch.totalEvents)
+	proc.statDBW.Count(len(batch.statusList))
 
 	proc.statsJobs.Print()
 	proc.statsDBW.Print()
 }
 
+//destinationTransform runs the destination transformations on
+//eventsByDest and returns the router and batch router jobs, along with
+//the events the transformer failed on
+func (proc *HandleT) destinationTransform(eventsByDest map[string][]interface{}) ([]*jobsdb.JobT,
+	[]*jobsdb.JobT, []*jobsdb.TransformationErrorT) {
+
+	var destJobs []*jobsdb.JobT
+	var batchDestJobs []*jobsdb.JobT
+	var errList []*jobsdb.TransformationErrorT
+
+	destIDs := sortedKeys(eventsByDest)
+	results := make([]destTransformResultT, len(destIDs))
+	//Now do the actual transformation. We call it in batches, once
+	//for each destination ID, and the destinations in parallel
+	pipeline.Parallel(len(destIDs), maxParallelDestinations, func(idx int) {
+		results[idx] = proc.transformDestination(destIDs[idx], eventsByDest[destIDs[idx]])
+	})
+	for _, result := range results {
+		destJobs = append(destJobs, result.destJobs...)
+		batchDestJobs = append(batchDestJobs, result.batchDestJobs...)
+		errList = append(errList, result.errList...)
+	}
+	return destJobs, batchDestJobs, errList
+}
+
+//destTransformResultT is what transformDestination returns
+type destTransformResultT struct {
+	destJobs      []*jobsdb.JobT
+	batchDestJobs []*jobsdb.JobT
+	errList       []*jobsdb.TransformationErrorT
+}
+
+//transformDestination runs the transformation of the destination type
+//destID on destEventList
+func (proc *HandleT) transformDestination(destID string, destEventList []interface{}) destTransformResultT {
+	var destJobs []*jobsdb.JobT
+	var batchDestJobs []*jobsdb.JobT
+	var errList []*jobsdb.TransformationErrorT
+
+	//Call transform for this destination. Returns
+	//the JSON we can send to the destination
+	logger.Debug("Transform input size", len(destEventList))
+	var response ResponseT
+	if nativeTransformer, ok := integrations.GetDestinationTransformer(destID); ok && enableNativeTransformers {
+		response = nativeTransform(nativeTransformer, destEventList)
+	} else {
+		url := integrations.GetDestinationURL(destID)
+		response = proc.transformer.Transform(destEventList, url, transformBatchSize, true)
+	}
+	destTransformEventList := response.Events
+	logger.Debug("Transform output size", len(destTransformEventList))
+	if !response.Success {
+		for _, event := range destEventList {
+			errList = append(errList, newTransformationError(destTransformStage, event, "transformation failed"))
+		}
+		return destTransformResultT{errList: errList}
+	}
+	for _, failure := range response.Failures {
+		errList = append(errList, newTransformationError(destTransformStage, failure.Event, failure.Response))
+	}
+
+	//Save the JSON in DB. This is what the rotuer uses
+	for idx, destEvent := range destTransformEventList {
+		destEventJSON, err := json.Marshal(destEvent)
+		//Should be a valid JSON since its our transformation
+		//but we handle anyway
+		if err != nil {
+			continue
+		}
+
+		//Need to replace UUID his with messageID from client
+		id := uuid.NewV4()
+		sourceID := response.SourceIDList[idx]
+		//The router keeps the events of a user in order by
+		//partition key, so all the ids of a user should map to one
+		partitionKey := gjson.GetBytes(destEventJSON, "userId").Str
+		if idx < len(response.CanonicalIDList) && response.CanonicalIDList[idx] != "" {
+			partitionKey = response.CanonicalIDList[idx]
+		}
+		newJob := jobsdb.JobT{
+			UUID:         id,
+			Parameters:   []byte(fmt.Sprintf(`{"source_id": "%v"}`, sourceID)),
+			CreatedAt:    time.Now(),
+			ExpireAt:     time.Now(),
+			CustomVal:    destID,
+			PartitionKey: partitionKey,
+			EventPayload: destEventJSON,
+		}
+		if misc.Contains(rawDataDestinations, newJob.CustomVal) {
+			batchDestJobs = append(batchDestJobs, &newJob)
+		} else {
+			destJobs = append(destJobs, &newJob)
+		}
+	}
+	return destTransformResultT{destJobs: destJobs, batchDestJobs: batchDestJobs, errList: errList}
+}
+
 func (proc *HandleT) mainLoop() {
 
 	logger.Info("Processor loop started")
@@ -540,6 +759,11 @@ func (proc *HandleT) mainLoop() {
 		proc.statsDBR.Start()
 
 		toQuery := dbReadBatchSize
+		if processSessions {
+			if room := proc.waitForSessionBufferRoom(); room < toQuery {
+				toQuery = room
+			}
+		}
 		//Should not have any failure while processing (in v0) so
 		//retryList should be empty. Remove the assert
 		retryList := proc.gatewayDB.GetToRetry([]string{gateway.CustomVal}, toQuery)
@@ -548,7 +772,13 @@ func (proc *HandleT) mainLoop() {
 
 		if len(unprocessedList)+len(retryList) == 0 {
 			proc.statsDBR.End(0)
-			time.Sleep(loopSleep)
+			//Wait till the gateway stores new jobs, but query again after
+			//loopSleep, as failed jobs become due for retry without a
+			//notification
+			select {
+			case <-proc.gatewayNotify:
+			case <-time.After(loopSleep):
+			}
 			continue
 		}
 
@@ -564,31 +794,39 @@ func (proc *HandleT) mainLoop() {
 		})
 
 		if processSessions {
-			//Mark all as executing so next query doesn't pick it up
-			var statusList []*jobsdb.JobStatusT
-			for _, batchEvent := range combinedList {
-				newStatus := jobsdb.JobStatusT{
-					JobID:         batchEvent.JobID,
-					JobState:      jobsdb.ExecutingState,
-					AttemptNum:    1,
-					ExecTime:      time.Now(),
-					RetryTime:     time.Now(),
-					ErrorCode:     "200",
-					ErrorResponse: []byte(`{"success":"OK"}`),
-				}
-				statusList = append(statusList, &newStatus)
-			}
-			proc.gatewayDB.UpdateJobStatus(statusList, []string{gateway.CustomVal})
 			proc.addJobsToSessions(combinedList)
 		} else {
+			proc.markExecuting(combinedList)
 			proc.processJobsForDest(combinedList, nil)
 		}
 
 	}
 }
 
+//markExecuting marks the jobs executing, so that the next query doesn't
+//pick them up while they are in the pipeline
+func (proc *HandleT) markExecuting(jobList []*jobsdb.JobT) {
+	var statusList []*jobsdb.JobStatusT
+	for _, job := range jobList {
+		statusList = append(statusList, &jobsdb.JobStatusT{
+			JobID:         job.JobID,
+			JobState:      jobsdb.ExecutingState,
+			AttemptNum:    job.LastJobStatus.AttemptNum + 1,
+			ExecTime:      time.Now(),
+			RetryTime:     time.Now(),
+			ErrorCode:     "200",
+			ErrorResponse: []byte(`{"success":"OK"}`),
+		})
+	}
+	proc.gatewayDB.UpdateJobStatus(statusList, []string{gateway.CustomVal})
+}
+
 func (proc *HandleT) crashRecover() {
 
+	if processSessions {
+		proc.recoverSessions()
+		return
+	}
 	for {
 		execList := proc.gatewayDB.GetExecuting([]string{gateway.CustomVal}, dbReadBatchSize)
 
@@ -614,3 +852,74 @@ func (proc *HandleT) crashRecover() {
 		proc.gatewayDB.UpdateJobStatus(statusList, []string{gateway.CustomVal})
 	}
 }
+
+//recoverSessions puts the jobs which were buffered in sessions when the
+//processor stopped back into their sessions, from their tagged executing
+//statuses, and marks the other executing jobs failed
+func (proc *HandleT) recoverSessions() {
+
+	jobMap := make(map[int64]*jobsdb.JobT)
+	var records []sessions.RecordT
+	var afterID int64
+	for {
+		execList := proc.gatewayDB.GetProcessedWithFilters([]string{jobsdb.ExecutingState},
+			jobsdb.QueryFiltersT{CustomVals: []string{gateway.CustomVal}, JobIDAfter: afterID}, dbReadBatchSize)
+		if len(execList) == 0 {
+			break
+		}
+		for _, job := range execList {
+			jobMap[job.JobID] = job
+			records = append(records, sessions.RecordT{
+				JobID:         job.JobID,
+				ExecTime:      job.LastJobStatus.ExecTime,
+				ErrorResponse: proc.canonicalSessionTag(job.LastJobStatus.ErrorResponse),
+			})
+			if job.JobID > afterID {
+				afterID = job.JobID
+			}
+		}
+	}
+
+	recovered, failedIDs := sessions.Regroup(records)
+	proc.userPQLock.Lock()
+	defer proc.userPQLock.Unlock()
+	recoveredJobs := 0
+	for _, session := range recovered {
+		for _, jobID := range session.JobIDs {
+			job := jobMap[jobID]
+			eventList, ok := misc.ParseRudderEventBatch(job.EventPayload)
+			if !ok {
+				failedIDs = append(failedIDs, jobID)
+				continue
+			}
+			if proc.identityResolver != nil {
+				proc.identityResolver.ResolveBatch(eventList)
+			}
+			proc.bufferJob(session.UserID, job, eventList)
+			recoveredJobs++
+		}
+		if _, ok := proc.userJobListMap[session.UserID]; ok {
+			proc.sessionTracker.Restore(session)
+		}
+	}
+
+	var statusList []*jobsdb.JobStatusT
+	for _, jobID := range failedIDs {
+		statusList = append(statusList, &jobsdb.JobStatusT{
+			JobID:         jobID,
+			AttemptNum:    jobMap[jobID].LastJobStatus.AttemptNum + 1,
+			ExecTime:      time.Now(),
+			RetryTime:     time.Now(),
+			JobState:      jobsdb.FailedState,
+			ErrorCode:     "",
+			ErrorResponse: []byte(`{}`),
+		})
+	}
+	if len(statusList) > 0 {
+		proc.gatewayDB.UpdateJobStatus(statusList, []string{gateway.CustomVal})
+	}
+	proc.saveIdentityLinks()
+	proc.reportSessionBuffer()
+	logger.Infof("Processor recovered %d sessions with %d jobs, %d jobs failed",
+		proc.sessionTracker.Len(), recoveredJobs, len(statusList))
+}
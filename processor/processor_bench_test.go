@@ -0,0 +1,147 @@
+// +build bench
+
+package processor
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	backendconfig "github.com/rudderlabs/rudder-server/config/backend-config"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/processor/pipeline"
+	"github.com/rudderlabs/rudder-server/services/stats"
+)
+
+//The benchmark needs the processor config, so it is only built with the
+//bench tag:
+//CONFIG_PATH=$PWD/config/config.toml go test -tags bench -run - -bench . ./processor/
+//
+//It runs the sessions the buffer hands out through the route and
+//transform stages, with the in process GA transformation and without
+//the database, as the main loop and the session loop do concurrently
+const (
+	benchWriteKey        = "bench-write-key"
+	benchSessionTakers   = 2
+	benchUsersPerSession = 50
+	benchEventsPerUser   = 4
+)
+
+func benchEvent(userID string, idx int) interface{} {
+	return map[string]interface{}{
+		"anonymousId":       userID,
+		"type":              "track",
+		"event":             "Product Clicked",
+		"messageId":         fmt.Sprintf("%s-%d", userID, idx),
+		"originalTimestamp": "2019-07-19T10:38:03.000Z",
+		"sentAt":            "2019-07-19T10:38:04.000Z",
+		"integrations":      map[string]interface{}{"All": true},
+		"properties": map[string]interface{}{
+			"product_id": "507f1f77bcf86cd799439011",
+			"name":       "Monopoly: 3rd Edition",
+			"category":   "Games",
+			"price":      19.0,
+			"quantity":   1.0,
+			"position":   1.0,
+		},
+	}
+}
+
+//benchSession returns the jobs and events of usersPerSession users, as
+//takeSession leaves them
+func benchSession(sessionIdx int, jobID *int64) (map[string][]*jobsdb.JobT, map[string][]interface{}) {
+	userJobs := make(map[string][]*jobsdb.JobT)
+	userEvents := make(map[string][]interface{})
+	for user := 0; user < benchUsersPerSession; user++ {
+		userID := fmt.Sprintf("user-%d-%d", sessionIdx, user)
+		for idx := 0; idx < benchEventsPerUser; idx++ {
+			*jobID++
+			userJobs[userID] = append(userJobs[userID], &jobsdb.JobT{
+				JobID:        *jobID,
+				EventPayload: []byte(`{"writeKey":"` + benchWriteKey + `","requestIP":"127.0.0.1","receivedAt":"2019-07-19T10:38:05.000Z"}`),
+				Parameters:   []byte(`{"source_id":"bench-source"}`),
+			})
+			userEvents[userID] = append(userEvents[userID], benchEvent(userID, idx))
+		}
+	}
+	return userJobs, userEvents
+}
+
+func BenchmarkProcessUserJobs(b *testing.B) {
+	configSubscriberLock.Lock()
+	writeKeyDestinationMap = map[string][]backendconfig.DestinationT{
+		benchWriteKey: {{
+			ID:      "bench-ga",
+			Enabled: true,
+			Config:  map[string]interface{}{"trackingID": "UA-000000-1"},
+			DestinationDefinition: backendconfig.DestinationDefinitionT{
+				Name:        "GA",
+				DisplayName: "Google Analytics",
+			},
+		}},
+	}
+	configSubscriberLock.Unlock()
+	enableNativeTransformers = true
+
+	var storedJobs int64
+	proc := &HandleT{
+		pipelineStats: pipelineStatsT{
+			routeTime:     stats.NewStat("processor.pipeline.route_time", stats.TimerType),
+			transformTime: stats.NewStat("processor.pipeline.transform_time", stats.TimerType),
+			storeTime:     stats.NewStat("processor.pipeline.store_time", stats.TimerType),
+		},
+		userTransformStats:       newUserTransformStats(),
+		transformationErrorStats: newTransformationErrorStats(),
+		sessionOrder:             newSessionOrder(),
+	}
+	//Counts the router jobs instead of storing them
+	count := func(item interface{}) interface{} {
+		batch := item.(*processBatchT)
+		atomic.AddInt64(&storedJobs, int64(len(batch.destJobs)))
+		return nil
+	}
+	proc.pipeline = pipeline.New(pipelineBufferSize, proc.routeStage, proc.transformStage, count)
+
+	type sessionT struct {
+		userJobs   map[string][]*jobsdb.JobT
+		userEvents map[string][]interface{}
+	}
+	sessions := make(chan sessionT, b.N)
+	var jobID int64
+	for i := 0; i < b.N; i++ {
+		userJobs, userEvents := benchSession(i, &jobID)
+		sessions <- sessionT{userJobs: userJobs, userEvents: userEvents}
+	}
+	close(sessions)
+
+	b.ResetTimer()
+	var takers sync.WaitGroup
+	for i := 0; i < benchSessionTakers; i++ {
+		takers.Add(1)
+		go func() {
+			defer takers.Done()
+			for {
+				proc.userPQLock.Lock()
+				session, ok := <-sessions
+				if !ok {
+					proc.userPQLock.Unlock()
+					return
+				}
+				ticket := proc.sessionOrder.ticket()
+				proc.userPQLock.Unlock()
+
+				proc.sessionOrder.inTurn(ticket, func() {
+					proc.processUserJobs(session.userJobs, session.userEvents)
+				})
+			}
+		}()
+	}
+	takers.Wait()
+	proc.pipeline.Close()
+	b.StopTimer()
+
+	if storedJobs != jobID {
+		b.Fatalf("stored %d router jobs for %d events", storedJobs, jobID)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+Package scriptengine runs user transformations in process, in an embedded
+JavaScript interpreter (goja), instead of through the user transformer
+service.
+
+A transformation defines
+
+	function transformEvent(message, destination) { ... }
+
+which returns the message to send, an array of messages to split it into,
+or null (or an empty array) to drop it. Like a request to the service,
+a batch of events is transformed or fails as a whole.
+
+Every batch runs in a new interpreter, which has no I/O, with limits on
+its running time, call stack size and on the size of its input and
+output JSON. Go can't account for the memory of one interpreter, so
+memory is only guarded process wide: while batches run, one sampler of
+the engine reads the heap size every memoryCheckInterval and, once it
+is over MaxHeapBytes, interrupts all of them. Which batch used the memory
+can't be told, so the ones running at the time all fail. The compiled
+programs are cached by transformation version, as versions don't change.
+*/
+package scriptengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	memoryCheckInterval = 100 * time.Millisecond
+
+	//driverSource transforms the events of __input, a JSON array of
+	//{"message", "destination"}, into a JSON array holding the array of
+	//messages of each event
+	driverSource = `(function() {
+	if (typeof transformEvent !== "function") {
+		throw new Error("transformEvent is not defined");
+	}
+	var events = JSON.parse(__input);
+	var output = [];
+	for (var i = 0; i < events.length; i++) {
+		var result = transformEvent(events[i].message, events[i].destination);
+		if (result === null || result === undefined) {
+			result = [];
+		} else if (!Array.isArray(result)) {
+			result = [result];
+		}
+		output.push(result);
+	}
+	return JSON.stringify(output);
+})()`
+)
+
+var driverProgram = goja.MustCompile("driver", driverSource, true)
+
+//LimitsT are the limits of the transformation of one batch, but for
+//MaxHeapBytes which is the heap size of the whole process the batches
+//are stopped at. Zero means no limit
+type LimitsT struct {
+	Timeout          time.Duration
+	MaxCallStackSize int
+	MaxInputBytes    int
+	MaxOutputBytes   int
+	MaxHeapBytes     uint64
+}
+
+//CodeFetcherT returns the code of a transformation version
+type CodeFetcherT func(versionID string) (string, error)
+
+//EngineT transforms batches with the transformation versions fetched
+//by fetchCode
+type EngineT struct {
+	limits    LimitsT
+	fetchCode CodeFetcherT
+
+	programs     map[string]*goja.Program
+	programsLock sync.RWMutex
+
+	//The interpreters running, watched by the memory sampler while there
+	//are any
+	running      map[*goja.Runtime]struct{}
+	runningLock  sync.Mutex
+	stopSampling chan struct{}
+}
+
+//New returns an engine
+func New(limits LimitsT, fetchCode CodeFetcherT) *EngineT {
+	return &EngineT{
+		limits:    limits,
+		fetchCode: fetchCode,
+		programs:  make(map[string]*goja.Program),
+		running:   make(map[*goja.Runtime]struct{}),
+	}
+}
+
+//program returns the compiled code of versionID, fetching and
+//compiling it the first time
+func (engine *EngineT) program(versionID string) (*goja.Program, error) {
+	engine.programsLock.RLock()
+	program, ok := engine.programs[versionID]
+	engine.programsLock.RUnlock()
+	if ok {
+		return program, nil
+	}
+
+	code, err := engine.fetchCode(versionID)
+	if err != nil {
+		return nil, err
+	}
+	program, err = goja.Compile(versionID, code, false)
+	if err != nil {
+		return nil, fmt.Errorf("compiling transformation version %s: %v", versionID, err)
+	}
+	engine.programsLock.Lock()
+	engine.programs[versionID] = program
+	engine.programsLock.Unlock()
+	return program, nil
+}
+
+//Transform runs transformation versionID on events, a batch of
+//{"message", "destination"}, and returns the array of messages of
+//every event
+func (engine *EngineT) Transform(versionID string, events []interface{}) ([]interface{}, error) {
+	program, err := engine.program(versionID)
+	if err != nil {
+		return nil, err
+	}
+	input, err := json.Marshal(events)
+	if err != nil {
+		return nil, err
+	}
+	if engine.limits.MaxInputBytes > 0 && len(input) > engine.limits.MaxInputBytes {
+		return nil, fmt.Errorf("transformation input of %d bytes is over %d bytes",
+			len(input), engine.limits.MaxInputBytes)
+	}
+
+	vm := goja.New()
+	if engine.limits.MaxCallStackSize > 0 {
+		vm.SetMaxCallStackSize(engine.limits.MaxCallStackSize)
+	}
+	stopLimits := engine.enforceLimits(vm)
+	output, err := engine.run(vm, program, string(input))
+	stopLimits()
+	if err != nil {
+		return nil, err
+	}
+	if engine.limits.MaxOutputBytes > 0 && len(output) > engine.limits.MaxOutputBytes {
+		return nil, fmt.Errorf("transformation output of %d bytes is over %d bytes",
+			len(output), engine.limits.MaxOutputBytes)
+	}
+
+	var results []interface{}
+	err = json.Unmarshal([]byte(output), &results)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(events) {
+		return nil, fmt.Errorf("transformation version %s returned %d results for %d events",
+			versionID, len(results), len(events))
+	}
+	return results, nil
+}
+
+func (engine *EngineT) run(vm *goja.Runtime, program *goja.Program, input string) (output string, err error) {
+	//goja panics on some errors, e.g. running out of stack in Go code
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("transformation panicked: %v", r)
+		}
+	}()
+
+	_, err = vm.RunProgram(program)
+	if err != nil {
+		return "", err
+	}
+	err = vm.Set("__input", input)
+	if err != nil {
+		return "", err
+	}
+	result, err := vm.RunProgram(driverProgram)
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+//enforceLimits interrupts vm once it has run for too long and has the
+//memory sampler watch it. The returned func stops both
+func (engine *EngineT) enforceLimits(vm *goja.Runtime) func() {
+	var timer *time.Timer
+	if engine.limits.Timeout > 0 {
+		timeout := engine.limits.Timeout
+		timer = time.AfterFunc(timeout, func() {
+			vm.Interrupt(fmt.Sprintf("transformation timed out after %v", timeout))
+		})
+	}
+	if engine.limits.MaxHeapBytes > 0 {
+		engine.watch(vm)
+	}
+
+	return func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		if engine.limits.MaxHeapBytes > 0 {
+			engine.unwatch(vm)
+		}
+	}
+}
+
+//watch adds vm to the running interpreters, starting the sampler if it
+//is the first one
+func (engine *EngineT) watch(vm *goja.Runtime) {
+	engine.runningLock.Lock()
+	defer engine.runningLock.Unlock()
+	engine.running[vm] = struct{}{}
+	if len(engine.running) == 1 {
+		engine.stopSampling = make(chan struct{})
+		go engine.sampleMemory(engine.stopSampling)
+	}
+}
+
+//unwatch removes vm from the running interpreters, stopping the sampler
+//if it was the last one
+func (engine *EngineT) unwatch(vm *goja.Runtime) {
+	engine.runningLock.Lock()
+	defer engine.runningLock.Unlock()
+	delete(engine.running, vm)
+	if len(engine.running) == 0 {
+		close(engine.stopSampling)
+	}
+}
+
+//sampleMemory interrupts the running interpreters whenever the heap of
+//the process is over MaxHeapBytes, until stop is closed
+func (engine *EngineT) sampleMemory(stop chan struct{}) {
+	maxHeap := engine.limits.MaxHeapBytes
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	var memStats runtime.MemStats
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			runtime.ReadMemStats(&memStats)
+			if memStats.HeapAlloc <= maxHeap {
+				continue
+			}
+			engine.runningLock.Lock()
+			for vm := range engine.running {
+				vm.Interrupt(fmt.Sprintf("transformation stopped, the process heap is over %d bytes", maxHeap))
+			}
+			engine.runningLock.Unlock()
+		}
+	}
+}
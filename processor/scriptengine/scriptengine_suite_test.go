@@ -0,0 +1,13 @@
+package scriptengine_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestScriptengine(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Scriptengine Suite")
+}
@@ -0,0 +1,139 @@
+package scriptengine_test
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/processor/scriptengine"
+)
+
+var scripts = map[string]string{
+	"rename": `function transformEvent(message, destination) {
+		message.event = message.event + " (" + destination.ID + ")";
+		return message;
+	}`,
+	"filter": `function transformEvent(message) {
+		if (message.event === "Test") {
+			return null;
+		}
+		if (message.event === "Split") {
+			return [{event: "First"}, {event: "Second"}];
+		}
+		return message;
+	}`,
+	"throw":     `function transformEvent(message) { throw new Error("bad event"); }`,
+	"loop":      `function transformEvent(message) { while (true) {} }`,
+	"recursion": `function f(n) { return f(n + 1) + 1; } function transformEvent(message) { return f(0); }`,
+	"memory": `function transformEvent(message) {
+		var list = [];
+		while (true) { list.push("xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx" + list.length); }
+	}`,
+	"large":     `function transformEvent(message) { return {event: new Array(128 << 10).join("x")}; }`,
+	"undefined": `var x = 1;`,
+	"syntax":    `function transformEvent(message) {`,
+}
+
+func event(name string) interface{} {
+	return map[string]interface{}{
+		"message":     map[string]interface{}{"event": name, "source_id": "src-1"},
+		"destination": map[string]interface{}{"ID": "dest-1"},
+	}
+}
+
+var _ = Describe("Scriptengine", func() {
+
+	var fetched map[string]int
+	var engine *scriptengine.EngineT
+
+	BeforeEach(func() {
+		fetched = map[string]int{}
+		engine = scriptengine.New(scriptengine.LimitsT{
+			Timeout:          200 * time.Millisecond,
+			MaxCallStackSize: 1000,
+			MaxInputBytes:    64 << 10,
+			MaxOutputBytes:   64 << 10,
+			MaxHeapBytes:     1 << 30,
+		}, func(versionID string) (string, error) {
+			fetched[versionID]++
+			code, ok := scripts[versionID]
+			if !ok {
+				return "", fmt.Errorf("version %s not found", versionID)
+			}
+			return code, nil
+		})
+	})
+
+	It("returns the messages of every event", func() {
+		results, err := engine.Transform("rename", []interface{}{event("Order Completed")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(Equal([]interface{}{
+			[]interface{}{map[string]interface{}{"event": "Order Completed (dest-1)", "source_id": "src-1"}},
+		}))
+	})
+
+	It("drops and splits events", func() {
+		results, err := engine.Transform("filter", []interface{}{event("Test"), event("Split"), event("Kept")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(3))
+		Expect(results[0]).To(BeEmpty())
+		Expect(results[1]).To(HaveLen(2))
+		Expect(results[2]).To(HaveLen(1))
+	})
+
+	It("doesn't change the input events", func() {
+		input := event("Order Completed")
+		_, err := engine.Transform("rename", []interface{}{input})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(input).To(Equal(event("Order Completed")))
+	})
+
+	It("caches the compiled versions", func() {
+		for i := 0; i < 3; i++ {
+			_, err := engine.Transform("rename", []interface{}{event("Order Completed")})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(fetched["rename"]).To(Equal(1))
+	})
+
+	It("fails the batch on script errors", func() {
+		for _, versionID := range []string{"throw", "undefined", "syntax", "missing"} {
+			_, err := engine.Transform(versionID, []interface{}{event("Kept")})
+			Expect(err).To(HaveOccurred(), versionID)
+		}
+	})
+
+	It("enforces the limits", func() {
+		start := time.Now()
+		_, err := engine.Transform("loop", []interface{}{event("Kept")})
+		Expect(err).To(MatchError(ContainSubstring("timed out")))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+
+		_, err = engine.Transform("recursion", []interface{}{event("Kept")})
+		Expect(err).To(HaveOccurred())
+
+		_, err = engine.Transform("rename", []interface{}{event(strings.Repeat("x", 128<<10))})
+		Expect(err).To(MatchError(ContainSubstring("input")))
+
+		_, err = engine.Transform("large", []interface{}{event("Kept")})
+		Expect(err).To(MatchError(ContainSubstring("output")))
+	})
+
+	It("stops every running batch once the process heap is too large", func() {
+		engine = scriptengine.New(scriptengine.LimitsT{MaxHeapBytes: 64 << 20}, func(versionID string) (string, error) {
+			return scripts[versionID], nil
+		})
+		errs := make(chan error, 2)
+		for _, versionID := range []string{"memory", "loop"} {
+			go func(versionID string) {
+				_, err := engine.Transform(versionID, []interface{}{event("Kept")})
+				errs <- err
+			}(versionID)
+		}
+		for i := 0; i < 2; i++ {
+			Eventually(errs, 10*time.Second).Should(Receive(MatchError(ContainSubstring("process heap"))))
+		}
+	})
+})
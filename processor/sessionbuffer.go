@@ -0,0 +1,164 @@
+/*
+Session buffer limits. With processSessions on, the jobs of a user are
+held in memory (userJobListMap, userEventsMap) until their session ends,
+so a flood of distinct users would grow the buffer without bound. The
+buffer has a budget of maxSessionBufferJobs jobs and
+maxSessionBufferSizeInMB of event payloads. Once it is exceeded
+
+	flushSessionsWhenBufferFull = true    the oldest sessions are processed
+	                                      early, right after the read, until
+	                                      it fits again. Reads are capped to
+	                                      maxSessionBufferJobs
+	flushSessionsWhenBufferFull = false   the gateway jobsdb isn't read
+	                                      until sessions end and make room.
+	                                      Reads are capped to the jobs left
+	                                      in the budget
+
+The buffer is reported as the gauges
+processor.session_buffer.{sessions,jobs,events,bytes}, with the counters
+processor.session_buffer.early_flushed_sessions and
+processor.session_buffer.paused_reads.
+*/
+
+package processor
+
+import (
+	"time"
+
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/services/stats"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+)
+
+var (
+	maxSessionBufferJobs        int
+	maxSessionBufferBytes       int
+	flushSessionsWhenBufferFull bool
+)
+
+func loadSessionBufferConfig() {
+	maxSessionBufferJobs = config.GetInt("Processor.maxSessionBufferJobs", 100000)
+	maxSessionBufferBytes = config.GetInt("Processor.maxSessionBufferSizeInMB", 512) << 20
+	flushSessionsWhenBufferFull = config.GetBool("Processor.flushSessionsWhenBufferFull", true)
+}
+
+//sessionBufferT is the size of what is buffered in sessions. It is
+//guarded by userPQLock
+type sessionBufferT struct {
+	jobs   int
+	events int
+	bytes  int
+
+	sessionsStat     *stats.RudderStats
+	jobsStat         *stats.RudderStats
+	eventsStat       *stats.RudderStats
+	bytesStat        *stats.RudderStats
+	earlyFlushedStat *stats.RudderStats
+	pausedReadsStat  *stats.RudderStats
+}
+
+func newSessionBuffer() sessionBufferT {
+	return sessionBufferT{
+		sessionsStat:     stats.NewStat("processor.session_buffer.sessions", stats.GaugeType),
+		jobsStat:         stats.NewStat("processor.session_buffer.jobs", stats.GaugeType),
+		eventsStat:       stats.NewStat("processor.session_buffer.events", stats.GaugeType),
+		bytesStat:        stats.NewStat("processor.session_buffer.bytes", stats.GaugeType),
+		earlyFlushedStat: stats.NewStat("processor.session_buffer.early_flushed_sessions", stats.CountType),
+		pausedReadsStat:  stats.NewStat("processor.session_buffer.paused_reads", stats.CountType),
+	}
+}
+
+//bufferJob adds job and its events to the session of userID. The caller
+//holds userPQLock
+func (proc *HandleT) bufferJob(userID string, job *jobsdb.JobT, eventList []interface{}) {
+	proc.userJobListMap[userID] = append(proc.userJobListMap[userID], job)
+	proc.userEventsMap[userID] = append(proc.userEventsMap[userID], eventList...)
+	proc.sessionBuffer.jobs++
+	proc.sessionBuffer.events += len(eventList)
+	proc.sessionBuffer.bytes += len(job.EventPayload)
+}
+
+//takeSession ends the session of userID and moves its jobs and events to
+//userJobs and userEvents. The caller holds userPQLock
+func (proc *HandleT) takeSession(userID string, userJobs map[string][]*jobsdb.JobT, userEvents map[string][]interface{}) {
+	jobList, ok := proc.userJobListMap[userID]
+	if !ok {
+		return
+	}
+	eventList := proc.userEventsMap[userID]
+	userJobs[userID] = jobList
+	userEvents[userID] = eventList
+	proc.sessionBuffer.jobs -= len(jobList)
+	proc.sessionBuffer.events -= len(eventList)
+	for _, job := range jobList {
+		proc.sessionBuffer.bytes -= len(job.EventPayload)
+	}
+	delete(proc.userJobListMap, userID)
+	delete(proc.userEventsMap, userID)
+	proc.sessionTracker.Remove(userID)
+}
+
+//sessionBufferFull tells whether the buffer is over its budget. The
+//caller holds userPQLock
+func (proc *HandleT) sessionBufferFull() bool {
+	return proc.sessionBuffer.jobs > maxSessionBufferJobs || proc.sessionBuffer.bytes > maxSessionBufferBytes
+}
+
+//flushOldestSessions takes the oldest sessions, even if they haven't
+//ended, until the buffer fits its budget. The caller holds userPQLock
+func (proc *HandleT) flushOldestSessions(userJobs map[string][]*jobsdb.JobT, userEvents map[string][]interface{}) {
+	flushed := 0
+	for proc.sessionBufferFull() {
+		userID, _, ok := proc.sessionTracker.Oldest()
+		if !ok {
+			break
+		}
+		proc.takeSession(userID, userJobs, userEvents)
+		flushed++
+	}
+	if flushed > 0 {
+		logger.Debugf("Session buffer full, flushed %d sessions early", flushed)
+		proc.sessionBuffer.earlyFlushedStat.Count(flushed)
+	}
+}
+
+//sessionBufferRoom returns the number of jobs mainLoop may read, 0 if
+//reads are paused until sessions end
+func (proc *HandleT) sessionBufferRoom() int {
+	proc.userPQLock.Lock()
+	defer proc.userPQLock.Unlock()
+	if flushSessionsWhenBufferFull {
+		//The oldest sessions make room for whatever is read
+		return maxSessionBufferJobs
+	}
+	room := maxSessionBufferJobs - proc.sessionBuffer.jobs
+	if room < 0 || proc.sessionBuffer.bytes >= maxSessionBufferBytes {
+		return 0
+	}
+	return room
+}
+
+//waitForSessionBufferRoom blocks mainLoop until the buffer has room and
+//returns how many jobs it may read
+func (proc *HandleT) waitForSessionBufferRoom() int {
+	room := proc.sessionBufferRoom()
+	if room > 0 {
+		return room
+	}
+	proc.sessionBuffer.pausedReadsStat.Increment()
+	logger.Debug("Session buffer full, pausing reads")
+	for room == 0 {
+		time.Sleep(loopSleep)
+		room = proc.sessionBufferRoom()
+	}
+	return room
+}
+
+//reportSessionBuffer updates the gauges. The caller holds userPQLock
+func (proc *HandleT) reportSessionBuffer() {
+	proc.sessionBuffer.sessionsStat.Guage(proc.sessionTracker.Len())
+	proc.sessionBuffer.jobsStat.Guage(proc.sessionBuffer.jobs)
+	proc.sessionBuffer.eventsStat.Guage(proc.sessionBuffer.events)
+	proc.sessionBuffer.bytesStat.Guage(proc.sessionBuffer.bytes)
+}
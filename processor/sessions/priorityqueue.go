@@ -1,4 +1,4 @@
-package processor
+package sessions
 
 import (
 	"container/heap"
@@ -10,9 +10,10 @@ import (
 //We keep a priority queue of user_id to last event
 //timestamp from that user
 type pqItemT struct {
-	userID string    //userID
-	lastTS time.Time //last timestamp
-	index  int       //index in priority queue
+	userID    string    //userID
+	sessionID string    //session the jobs of the user are buffered in
+	lastTS    time.Time //last timestamp
+	index     int       //index in priority queue
 }
 
 type pqT []*pqItemT
@@ -45,8 +46,10 @@ func (pq *pqT) Pop() interface{} {
 	return item
 }
 
+//Top returns the item with the oldest timestamp, which is the root of
+//the heap
 func (pq *pqT) Top() *pqItemT {
-	item := (*pq)[len(*pq)-1]
+	item := (*pq)[0]
 	return item
 }
 
@@ -0,0 +1,185 @@
+/*
+Package sessions keeps track of the sessions the processor buffers the
+gateway jobs of a user in, until the user has been inactive for a while
+or has sent enough events.
+
+The jobs of a session are marked executing in the gateway jobsdb with a
+Tag ({"session_id", "user_id"}) as error_response, at the time they are
+added (exec_time). That is all it takes to rebuild the sessions after a
+restart: Regroup orders the executing jobs back into their sessions,
+with the time of their last job, and Restore puts them back in a
+TrackerT.
+*/
+package sessions
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+//TagT is stored as the error_response of the executing status of the
+//jobs buffered in a session
+type TagT struct {
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+}
+
+//Tag returns the error_response tagging a job of a session
+func Tag(sessionID string, userID string) json.RawMessage {
+	tag, _ := json.Marshal(TagT{SessionID: sessionID, UserID: userID})
+	return tag
+}
+
+//ParseTag returns the tag of an executing status, if it has one
+func ParseTag(errorResponse json.RawMessage) (TagT, bool) {
+	var tag TagT
+	err := json.Unmarshal(errorResponse, &tag)
+	if err != nil || tag.SessionID == "" || tag.UserID == "" {
+		return TagT{}, false
+	}
+	return tag, true
+}
+
+//TrackerT keeps the session of every user with buffered jobs, ordered
+//by the time of their last job. It isn't thread safe
+type TrackerT struct {
+	items map[string]*pqItemT
+	pq    pqT
+}
+
+//NewTracker returns an empty tracker
+func NewTracker() *TrackerT {
+	return &TrackerT{
+		items: make(map[string]*pqItemT),
+		pq:    make(pqT, 0),
+	}
+}
+
+//Touch records a job of userID at now and returns the session it belongs
+//to, starting a new one if the user has none
+func (tracker *TrackerT) Touch(userID string, now time.Time) string {
+	item, ok := tracker.items[userID]
+	if !ok {
+		item = &pqItemT{
+			userID:    userID,
+			sessionID: uuid.NewV4().String(),
+			lastTS:    now,
+			index:     -1,
+		}
+		tracker.items[userID] = item
+		tracker.pq.Add(item)
+		return item.sessionID
+	}
+	tracker.pq.Update(item, now)
+	return item.sessionID
+}
+
+//Restore puts back a session rebuilt by Regroup
+func (tracker *TrackerT) Restore(session RecoveredSessionT) {
+	if item, ok := tracker.items[session.UserID]; ok {
+		if session.LastTS.After(item.lastTS) {
+			tracker.pq.Update(item, session.LastTS)
+		}
+		return
+	}
+	item := &pqItemT{
+		userID:    session.UserID,
+		sessionID: session.SessionID,
+		lastTS:    session.LastTS,
+		index:     -1,
+	}
+	tracker.items[session.UserID] = item
+	tracker.pq.Add(item)
+}
+
+//Remove ends the session of userID
+func (tracker *TrackerT) Remove(userID string) {
+	item, ok := tracker.items[userID]
+	if !ok {
+		return
+	}
+	tracker.pq.Remove(item)
+	delete(tracker.items, userID)
+}
+
+//Len returns the number of sessions
+func (tracker *TrackerT) Len() int {
+	return tracker.pq.Len()
+}
+
+//Oldest returns the user whose last job is the oldest and its time
+func (tracker *TrackerT) Oldest() (string, time.Time, bool) {
+	if tracker.pq.Len() == 0 {
+		return "", time.Time{}, false
+	}
+	item := tracker.pq.Top()
+	return item.userID, item.lastTS, true
+}
+
+//Print logs the sessions
+func (tracker *TrackerT) Print() {
+	tracker.pq.Print()
+}
+
+//RecordT is what the gateway jobsdb holds of a job buffered in a
+//session: its id and its executing status
+type RecordT struct {
+	JobID         int64
+	ExecTime      time.Time
+	ErrorResponse json.RawMessage
+}
+
+//RecoveredSessionT is a session rebuilt from its jobs
+type RecoveredSessionT struct {
+	SessionID string
+	UserID    string
+	JobIDs    []int64
+	LastTS    time.Time
+}
+
+//Regroup rebuilds the sessions the records were buffered in. The jobs
+//of a session are in job id order, as they were added, and the sessions
+//are in the order of their last job. The records without a tag are
+//returned apart
+func Regroup(records []RecordT) ([]RecoveredSessionT, []int64) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].JobID < records[j].JobID
+	})
+
+	var untagged []int64
+	//A user may have jobs of an older session, if the processor
+	//stopped while transforming it. They go in the newest one
+	userSessionMap := make(map[string]*RecoveredSessionT)
+	for _, record := range records {
+		tag, ok := ParseTag(record.ErrorResponse)
+		if !ok {
+			untagged = append(untagged, record.JobID)
+			continue
+		}
+		session, ok := userSessionMap[tag.UserID]
+		if !ok {
+			session = &RecoveredSessionT{SessionID: tag.SessionID, UserID: tag.UserID}
+			userSessionMap[tag.UserID] = session
+		}
+		session.JobIDs = append(session.JobIDs, record.JobID)
+		if record.ExecTime.After(session.LastTS) {
+			session.LastTS = record.ExecTime
+			session.SessionID = tag.SessionID
+		}
+	}
+
+	sessions := make([]RecoveredSessionT, 0, len(userSessionMap))
+	for _, session := range userSessionMap {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].LastTS.Equal(sessions[j].LastTS) {
+			return sessions[i].UserID < sessions[j].UserID
+		}
+		return sessions[i].LastTS.Before(sessions[j].LastTS)
+	})
+	return sessions, untagged
+}
@@ -0,0 +1,153 @@
+package sessions_test
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/processor/sessions"
+)
+
+//processorT buffers jobs in sessions as the processor does, keeping the
+//executing statuses it would write to the gateway jobsdb
+type processorT struct {
+	tracker  *sessions.TrackerT
+	statuses map[int64]sessions.RecordT
+}
+
+func newProcessor() *processorT {
+	return &processorT{
+		tracker:  sessions.NewTracker(),
+		statuses: make(map[int64]sessions.RecordT),
+	}
+}
+
+func (proc *processorT) add(jobID int64, userID string, now time.Time) string {
+	sessionID := proc.tracker.Touch(userID, now)
+	proc.statuses[jobID] = sessions.RecordT{
+		JobID:         jobID,
+		ExecTime:      now,
+		ErrorResponse: sessions.Tag(sessionID, userID),
+	}
+	return sessionID
+}
+
+//kill drops everything held in memory and returns what a restarted
+//processor reads back from jobsdb
+func (proc *processorT) kill() []sessions.RecordT {
+	var records []sessions.RecordT
+	for _, record := range proc.statuses {
+		records = append(records, record)
+	}
+	proc.tracker = nil
+	return records
+}
+
+var _ = Describe("Sessions", func() {
+
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	It("tags jobs with their session", func() {
+		tag, ok := sessions.ParseTag(sessions.Tag("s1", "u1"))
+		Expect(ok).To(BeTrue())
+		Expect(tag).To(Equal(sessions.TagT{SessionID: "s1", UserID: "u1"}))
+
+		_, ok = sessions.ParseTag(json.RawMessage(`{"success":"OK"}`))
+		Expect(ok).To(BeFalse())
+		_, ok = sessions.ParseTag(json.RawMessage(`not json`))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("keeps a session per user, oldest first", func() {
+		tracker := sessions.NewTracker()
+		s1 := tracker.Touch("u1", at(0))
+		s2 := tracker.Touch("u2", at(1))
+		tracker.Touch("u3", at(2))
+		Expect(tracker.Touch("u1", at(3))).To(Equal(s1))
+		Expect(s2).NotTo(Equal(s1))
+		Expect(tracker.Len()).To(Equal(3))
+
+		userID, lastTS, ok := tracker.Oldest()
+		Expect(ok).To(BeTrue())
+		Expect(userID).To(Equal("u2"))
+		Expect(lastTS).To(Equal(at(1)))
+
+		tracker.Remove("u2")
+		userID, _, _ = tracker.Oldest()
+		Expect(userID).To(Equal("u3"))
+		tracker.Remove("u3")
+		tracker.Remove("u1")
+		_, _, ok = tracker.Oldest()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("rebuilds the sessions of a processor killed mid-session", func() {
+		proc := newProcessor()
+		s1 := proc.add(1, "u1", at(0))
+		s2 := proc.add(2, "u2", at(1))
+		proc.add(3, "u1", at(2))
+		s3 := proc.add(4, "u3", at(3))
+		proc.add(5, "u2", at(4))
+		//Job 6 was picked up but not tagged yet when the processor died
+		proc.statuses[6] = sessions.RecordT{JobID: 6, ExecTime: at(5), ErrorResponse: json.RawMessage(`{"success":"OK"}`)}
+
+		recovered, untagged := sessions.Regroup(proc.kill())
+		Expect(untagged).To(Equal([]int64{6}))
+		Expect(recovered).To(Equal([]sessions.RecoveredSessionT{
+			{SessionID: s1, UserID: "u1", JobIDs: []int64{1, 3}, LastTS: at(2)},
+			{SessionID: s3, UserID: "u3", JobIDs: []int64{4}, LastTS: at(3)},
+			{SessionID: s2, UserID: "u2", JobIDs: []int64{2, 5}, LastTS: at(4)},
+		}))
+
+		tracker := sessions.NewTracker()
+		for _, session := range recovered {
+			tracker.Restore(session)
+		}
+		Expect(tracker.Len()).To(Equal(3))
+		userID, lastTS, _ := tracker.Oldest()
+		Expect(userID).To(Equal("u1"))
+		Expect(lastTS).To(Equal(at(2)))
+
+		//New jobs of the users go on in their sessions
+		Expect(tracker.Touch("u1", at(6))).To(Equal(s1))
+		userID, _, _ = tracker.Oldest()
+		Expect(userID).To(Equal("u3"))
+	})
+
+	It("survives being killed twice", func() {
+		proc := newProcessor()
+		s1 := proc.add(1, "u1", at(0))
+		proc.add(2, "u2", at(1))
+
+		recovered, _ := sessions.Regroup(proc.kill())
+		proc.tracker = sessions.NewTracker()
+		for _, session := range recovered {
+			proc.tracker.Restore(session)
+		}
+		Expect(proc.add(3, "u1", at(2))).To(Equal(s1))
+
+		recovered, untagged := sessions.Regroup(proc.kill())
+		Expect(untagged).To(BeEmpty())
+		Expect(recovered).To(HaveLen(2))
+		Expect(recovered[1]).To(Equal(sessions.RecoveredSessionT{
+			SessionID: s1, UserID: "u1", JobIDs: []int64{1, 3}, LastTS: at(2),
+		}))
+	})
+
+	It("merges jobs of an older session of a user into the newest one", func() {
+		records := []sessions.RecordT{
+			{JobID: 3, ExecTime: at(5), ErrorResponse: sessions.Tag("new", "u1")},
+			{JobID: 1, ExecTime: at(0), ErrorResponse: sessions.Tag("old", "u1")},
+			{JobID: 2, ExecTime: at(1), ErrorResponse: sessions.Tag("old", "u1")},
+		}
+		recovered, untagged := sessions.Regroup(records)
+		Expect(untagged).To(BeEmpty())
+		Expect(recovered).To(Equal([]sessions.RecoveredSessionT{
+			{SessionID: "new", UserID: "u1", JobIDs: []int64{1, 2, 3}, LastTS: at(5)},
+		}))
+	})
+})
@@ -0,0 +1,186 @@
+/*
+Processing pipeline. The jobs read by mainLoop (or ending a session) go
+through three stages, each on its own goroutine, with at most
+pipelineBufferSize batches waiting in front of each
+
+	route       parse the events of the jobs and group them by destination
+	transform   run the user and destination transformations, the
+	            destinations in parallel (maxParallelDestinations at most)
+	store       store the router jobs and mark the gateway jobs processed
+
+so reading the next batch, transforming this one and storing the previous
+one overlap. The batches go through every stage in the order they were
+read, and the events of a destination keep their order within a batch, so
+the events of a user stay in order. The sessions are taken from the
+buffer under userPQLock, which is released before they are queued, as
+queuing blocks while the pipeline is full. They are queued in the order
+they were taken (see sessionOrderT), so the sessions of a user stay in
+order too. The time of every stage is reported as
+processor.pipeline.<stage>_time.
+*/
+
+package processor
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/processor/pipeline"
+	"github.com/rudderlabs/rudder-server/services/stats"
+)
+
+var (
+	pipelineBufferSize      int
+	maxParallelDestinations int
+)
+
+func loadPipelineConfig() {
+	pipelineBufferSize = config.GetInt("Processor.pipelineBufferSize", 4)
+	maxParallelDestinations = config.GetInt("Processor.maxParallelDestinations", 8)
+}
+
+//processBatchT is a batch of gateway jobs going through the pipeline
+type processBatchT struct {
+	jobList         []*jobsdb.JobT
+	parsedEventList [][]interface{}
+	start           time.Time
+
+	//Set by the route stage
+	statusList           []*jobsdb.JobStatusT
+	quarantineJobs       []*jobsdb.JobT
+	eventsByDest         map[string][]interface{}
+	userTransformGroups  map[string]*userTransformGroupT
+	userTransformDestIDs []string
+	totalEvents          int
+
+	//Set by the transform stage
+	destJobs      []*jobsdb.JobT
+	batchDestJobs []*jobsdb.JobT
+	errList       []*jobsdb.TransformationErrorT
+}
+
+type pipelineStatsT struct {
+	routeTime     *stats.RudderStats
+	transformTime *stats.RudderStats
+	storeTime     *stats.RudderStats
+}
+
+//setupPipeline starts the stages. It is called by Setup, before the
+//loops which queue jobs
+func (proc *HandleT) setupPipeline() {
+	proc.pipelineStats = pipelineStatsT{
+		routeTime:     stats.NewStat("processor.pipeline.route_time", stats.TimerType),
+		transformTime: stats.NewStat("processor.pipeline.transform_time", stats.TimerType),
+		storeTime:     stats.NewStat("processor.pipeline.store_time", stats.TimerType),
+	}
+	proc.pipeline = pipeline.New(pipelineBufferSize, proc.routeStage, proc.transformStage, proc.storeStage)
+	proc.sessionOrder = newSessionOrder()
+}
+
+//sessionOrderT queues the sessions taken from the buffer in the order
+//they were taken. Whoever takes sessions gets a ticket under userPQLock,
+//and queues them once the sessions of the earlier tickets are queued
+type sessionOrderT struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	next int64
+	turn int64
+}
+
+func newSessionOrder() *sessionOrderT {
+	order := &sessionOrderT{}
+	order.cond = sync.NewCond(&order.lock)
+	return order
+}
+
+//ticket returns the turn of the sessions being taken. The caller holds
+//userPQLock, and must call inTurn with it
+func (order *sessionOrderT) ticket() int64 {
+	order.lock.Lock()
+	defer order.lock.Unlock()
+	ticket := order.next
+	order.next++
+	return ticket
+}
+
+//inTurn runs queue once the sessions of the tickets before ticket are
+//queued
+func (order *sessionOrderT) inTurn(ticket int64, queue func()) {
+	order.lock.Lock()
+	for order.turn != ticket {
+		order.cond.Wait()
+	}
+	order.lock.Unlock()
+
+	queue()
+
+	order.lock.Lock()
+	order.turn++
+	order.cond.Broadcast()
+	order.lock.Unlock()
+}
+
+func (proc *HandleT) routeStage(item interface{}) interface{} {
+	batch := item.(*processBatchT)
+	start := time.Now()
+	proc.routeJobs(batch)
+	proc.pipelineStats.routeTime.SendTiming(time.Since(start))
+	return batch
+}
+
+func (proc *HandleT) transformStage(item interface{}) interface{} {
+	batch := item.(*processBatchT)
+	start := time.Now()
+	batch.destJobs, batch.batchDestJobs, batch.errList = proc.transformEvents(batch.eventsByDest,
+		batch.userTransformGroups, batch.userTransformDestIDs)
+	proc.pipelineStats.transformTime.SendTiming(time.Since(start))
+	return batch
+}
+
+func (proc *HandleT) storeStage(item interface{}) interface{} {
+	batch := item.(*processBatchT)
+	start := time.Now()
+	proc.storeJobs(batch)
+	proc.pipelineStats.storeTime.SendTiming(time.Since(start))
+	return nil
+}
+
+//transformEvents runs the user transformations of userTransformGroups,
+//adds their events to eventsByDest and runs the destination
+//transformations on them. The destinations are transformed in parallel
+func (proc *HandleT) transformEvents(eventsByDest map[string][]interface{},
+	userTransformGroups map[string]*userTransformGroupT,
+	userTransformDestIDs []string) ([]*jobsdb.JobT, []*jobsdb.JobT, []*jobsdb.TransformationErrorT) {
+
+	transformedEvents := make([][]interface{}, len(userTransformDestIDs))
+	userTransformErrLists := make([][]*jobsdb.TransformationErrorT, len(userTransformDestIDs))
+	pipeline.Parallel(len(userTransformDestIDs), maxParallelDestinations, func(idx int) {
+		group := userTransformGroups[userTransformDestIDs[idx]]
+		transformedEvents[idx], userTransformErrLists[idx] = proc.userTransform(group)
+	})
+
+	//In the order of the destinations, so the events keep theirs
+	var errList []*jobsdb.TransformationErrorT
+	for idx, destID := range userTransformDestIDs {
+		group := userTransformGroups[destID]
+		eventsByDest[group.destType] = append(eventsByDest[group.destType], transformedEvents[idx]...)
+		errList = append(errList, userTransformErrLists[idx]...)
+	}
+
+	destJobs, batchDestJobs, destTransformErrList := proc.destinationTransform(eventsByDest)
+	errList = append(errList, destTransformErrList...)
+	return destJobs, batchDestJobs, errList
+}
+
+//sortedKeys returns the keys of eventsByDest in order
+func sortedKeys(eventsByDest map[string][]interface{}) []string {
+	keys := make([]string, 0, len(eventsByDest))
+	for key := range eventsByDest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,299 @@
+/*
+Package trackingplan validates the events of a source against the
+tracking plan in the "trackingPlan" object of the source config, e.g.
+
+	"trackingPlan": {
+		"id": "tp_web", "version": 3, "violationAction": "forward",
+		"events": [
+			{"name": "Order Completed", "properties": {
+				"revenue":  {"type": ["number"], "required": true, "minimum": 0},
+				"currency": {"type": ["string"], "enum": ["USD", "EUR"]},
+				"coupon":   {"type": ["string", "null"], "pattern": "^[A-Z0-9]+$"}}},
+			{"name": "Product Viewed", "allowUnplannedProperties": true}
+		]
+	}
+
+Only track events are validated, by their event name. An event which
+isn't in the plan is a violation unless allowUnplannedEvents is set, and
+so is a property which isn't in the plan of the event unless
+allowUnplannedProperties is set. violationAction is what the processor
+does with the events which violate the plan: drop them, forward them with
+their violations in context.violationErrors, or quarantine them.
+*/
+package trackingplan
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+const (
+	//ActionDrop drops the violating events
+	ActionDrop = "drop"
+	//ActionForward sends the violating events on with their violations
+	ActionForward = "forward"
+	//ActionQuarantine stores the violating events in the quarantine
+	//jobsdb instead of sending them
+	ActionQuarantine = "quarantine"
+
+	//Violation types
+	UnplannedEvent    = "unplanned_event"
+	UnplannedProperty = "unplanned_property"
+	RequiredMissing   = "required_missing"
+	DatatypeMismatch  = "datatype_mismatch"
+	EnumMismatch      = "enum_mismatch"
+	PatternMismatch   = "pattern_mismatch"
+	OutOfRange        = "out_of_range"
+
+	configKey = "trackingPlan"
+)
+
+var types = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true,
+	"object": true, "array": true, "null": true,
+}
+
+//PropertyT is the schema of a property. Empty conditions accept every
+//value
+type PropertyT struct {
+	Type     []string      `json:"type"`
+	Required bool          `json:"required"`
+	Enum     []interface{} `json:"enum"`
+	Pattern  string        `json:"pattern"`
+	Minimum  *float64      `json:"minimum"`
+	Maximum  *float64      `json:"maximum"`
+
+	pattern *regexp.Regexp
+}
+
+//EventT is the plan of the track events named Name
+type EventT struct {
+	Name                     string               `json:"name"`
+	Properties               map[string]PropertyT `json:"properties"`
+	AllowUnplannedProperties bool                 `json:"allowUnplannedProperties"`
+}
+
+//PlanT is the tracking plan of a source
+type PlanT struct {
+	ID                   string   `json:"id"`
+	Version              int      `json:"version"`
+	ViolationAction      string   `json:"violationAction"`
+	AllowUnplannedEvents bool     `json:"allowUnplannedEvents"`
+	Events               []EventT `json:"events"`
+
+	eventMap map[string]*EventT
+}
+
+//ViolationT is one way an event violates the plan. Property is empty for
+//the violations of the event itself
+type ViolationT struct {
+	Type     string `json:"type"`
+	Property string `json:"property,omitempty"`
+	Message  string `json:"message"`
+}
+
+//Parse reads the tracking plan from a source config. It returns nil, and
+//no error, if there is none
+func Parse(sourceConfig interface{}) (*PlanT, error) {
+	configMap, ok := sourceConfig.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	planConfig, ok := configMap[configKey]
+	if !ok || planConfig == nil {
+		return nil, nil
+	}
+	planJSON, err := json.Marshal(planConfig)
+	if err != nil {
+		return nil, err
+	}
+	var plan PlanT
+	err = json.Unmarshal(planJSON, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("trackingplan: invalid %s: %v", configKey, err)
+	}
+
+	switch plan.ViolationAction {
+	case "":
+		plan.ViolationAction = ActionForward
+	case ActionDrop, ActionForward, ActionQuarantine:
+	default:
+		return nil, fmt.Errorf("trackingplan: invalid violationAction %q", plan.ViolationAction)
+	}
+	plan.eventMap = make(map[string]*EventT)
+	for idx := range plan.Events {
+		event := &plan.Events[idx]
+		if event.Name == "" {
+			return nil, fmt.Errorf("trackingplan: event %d has no name", idx)
+		}
+		for name, property := range event.Properties {
+			for _, propertyType := range property.Type {
+				if !types[propertyType] {
+					return nil, fmt.Errorf("trackingplan: property %s of %s has invalid type %q",
+						name, event.Name, propertyType)
+				}
+			}
+			if property.Pattern != "" {
+				property.pattern, err = regexp.Compile(property.Pattern)
+				if err != nil {
+					return nil, fmt.Errorf("trackingplan: property %s of %s has invalid pattern: %v",
+						name, event.Name, err)
+				}
+				event.Properties[name] = property
+			}
+		}
+		plan.eventMap[event.Name] = event
+	}
+	return &plan, nil
+}
+
+//HasEvent tells if the track events named name are in the plan
+func (plan *PlanT) HasEvent(name string) bool {
+	_, ok := plan.eventMap[name]
+	return ok
+}
+
+//Validate returns the violations of event (the message), none if it
+//follows the plan
+func (plan *PlanT) Validate(event map[string]interface{}) []ViolationT {
+	if plan == nil {
+		return nil
+	}
+	if eventType, _ := event["type"].(string); eventType != "track" {
+		return nil
+	}
+	eventName, _ := event["event"].(string)
+	eventPlan, ok := plan.eventMap[eventName]
+	if !ok {
+		if plan.AllowUnplannedEvents {
+			return nil
+		}
+		return []ViolationT{{
+			Type:    UnplannedEvent,
+			Message: fmt.Sprintf("event %q is not in the tracking plan", eventName),
+		}}
+	}
+
+	properties, _ := event["properties"].(map[string]interface{})
+	var violations []ViolationT
+	//In name order, so that the violations of an event are always the same
+	names := make([]string, 0, len(eventPlan.Properties))
+	for name := range eventPlan.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property := eventPlan.Properties[name]
+		value, found := properties[name]
+		if !found {
+			if property.Required {
+				violations = append(violations, ViolationT{
+					Type:     RequiredMissing,
+					Property: name,
+					Message:  fmt.Sprintf("required property %s is missing", name),
+				})
+			}
+			continue
+		}
+		if violation, ok := property.check(name, value); !ok {
+			violations = append(violations, violation)
+		}
+	}
+
+	if !eventPlan.AllowUnplannedProperties {
+		var unplanned []string
+		for name := range properties {
+			if _, ok := eventPlan.Properties[name]; !ok {
+				unplanned = append(unplanned, name)
+			}
+		}
+		sort.Strings(unplanned)
+		for _, name := range unplanned {
+			violations = append(violations, ViolationT{
+				Type:     UnplannedProperty,
+				Property: name,
+				Message:  fmt.Sprintf("property %s is not in the tracking plan", name),
+			})
+		}
+	}
+	return violations
+}
+
+func (property *PropertyT) check(name string, value interface{}) (ViolationT, bool) {
+	if len(property.Type) > 0 && !hasType(property.Type, typeOf(value)) {
+		return ViolationT{
+			Type:     DatatypeMismatch,
+			Property: name,
+			Message:  fmt.Sprintf("property %s is %s, not %v", name, typeOf(value), property.Type),
+		}, false
+	}
+	if len(property.Enum) > 0 && !inEnum(property.Enum, value) {
+		return ViolationT{
+			Type:     EnumMismatch,
+			Property: name,
+			Message:  fmt.Sprintf("property %s is %v, not one of %v", name, value, property.Enum),
+		}, false
+	}
+	if str, ok := value.(string); ok && property.pattern != nil && !property.pattern.MatchString(str) {
+		return ViolationT{
+			Type:     PatternMismatch,
+			Property: name,
+			Message:  fmt.Sprintf("property %s does not match %s", name, property.Pattern),
+		}, false
+	}
+	if number, ok := value.(float64); ok {
+		if (property.Minimum != nil && number < *property.Minimum) ||
+			(property.Maximum != nil && number > *property.Maximum) {
+			return ViolationT{
+				Type:     OutOfRange,
+				Property: name,
+				Message:  fmt.Sprintf("property %s is %v, out of range", name, number),
+			}, false
+		}
+	}
+	return ViolationT{}, true
+}
+
+//typeOf returns the JSON schema type of a decoded JSON value. Integral
+//numbers are integers, which are numbers too (see hasType)
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func hasType(propertyTypes []string, valueType string) bool {
+	for _, propertyType := range propertyTypes {
+		if propertyType == valueType || (propertyType == "number" && valueType == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, item := range enum {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+package trackingplan_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTrackingplan(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Trackingplan Suite")
+}
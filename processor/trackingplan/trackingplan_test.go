@@ -0,0 +1,121 @@
+package trackingplan_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/processor/trackingplan"
+)
+
+func parseJSON(data string) map[string]interface{} {
+	var value map[string]interface{}
+	err := json.Unmarshal([]byte(data), &value)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+func violationTypes(violations []trackingplan.ViolationT) []string {
+	var types []string
+	for _, violation := range violations {
+		types = append(types, violation.Type+":"+violation.Property)
+	}
+	return types
+}
+
+var _ = Describe("Trackingplan", func() {
+
+	sourceConfig := parseJSON(`{"trackingPlan": {
+		"id": "tp_web", "version": 3, "violationAction": "quarantine",
+		"events": [
+			{"name": "Order Completed", "properties": {
+				"revenue":  {"type": ["number"], "required": true, "minimum": 0},
+				"quantity": {"type": ["integer"]},
+				"currency": {"type": ["string"], "enum": ["USD", "EUR"]},
+				"coupon":   {"type": ["string", "null"], "pattern": "^[A-Z0-9]+$"}}},
+			{"name": "Product Viewed", "allowUnplannedProperties": true}
+		]
+	}}`)
+
+	var plan *trackingplan.PlanT
+	BeforeEach(func() {
+		var err error
+		plan, err = trackingplan.Parse(sourceConfig)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reads the plan from the source config", func() {
+		Expect(plan.ID).To(Equal("tp_web"))
+		Expect(plan.Version).To(Equal(3))
+		Expect(plan.ViolationAction).To(Equal(trackingplan.ActionQuarantine))
+
+		plan, err := trackingplan.Parse(parseJSON(`{"trackingPlan": {"events": []}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan.ViolationAction).To(Equal(trackingplan.ActionForward))
+	})
+
+	It("returns no plan without one", func() {
+		plan, err := trackingplan.Parse(parseJSON(`{"apiKey": "key"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plan).To(BeNil())
+		Expect(plan.Validate(parseJSON(`{"type":"track","event":"Anything"}`))).To(BeEmpty())
+	})
+
+	It("rejects invalid plans", func() {
+		for _, config := range []string{
+			`{"trackingPlan": {"violationAction": "ignore"}}`,
+			`{"trackingPlan": {"events": [{"properties": {}}]}}`,
+			`{"trackingPlan": {"events": [{"name": "A", "properties": {"p": {"type": ["date"]}}}]}}`,
+			`{"trackingPlan": {"events": [{"name": "A", "properties": {"p": {"pattern": "("}}}]}}`,
+			`{"trackingPlan": {"events": "A"}}`,
+		} {
+			_, err := trackingplan.Parse(parseJSON(config))
+			Expect(err).To(HaveOccurred(), config)
+		}
+	})
+
+	It("accepts events which follow the plan", func() {
+		Expect(plan.Validate(parseJSON(`{"type":"track","event":"Order Completed",
+			"properties":{"revenue":12.5,"quantity":2,"currency":"EUR","coupon":null}}`))).To(BeEmpty())
+		Expect(plan.Validate(parseJSON(`{"type":"track","event":"Order Completed",
+			"properties":{"revenue":10,"coupon":"SPRING20"}}`))).To(BeEmpty())
+		Expect(plan.Validate(parseJSON(`{"type":"track","event":"Product Viewed",
+			"properties":{"anything":true}}`))).To(BeEmpty())
+	})
+
+	It("only validates track events", func() {
+		Expect(plan.Validate(parseJSON(`{"type":"page","name":"Home","properties":{"x":1}}`))).To(BeEmpty())
+	})
+
+	It("reports unplanned events", func() {
+		violations := plan.Validate(parseJSON(`{"type":"track","event":"Signed Up"}`))
+		Expect(violationTypes(violations)).To(Equal([]string{trackingplan.UnplannedEvent + ":"}))
+
+		plan.AllowUnplannedEvents = true
+		Expect(plan.Validate(parseJSON(`{"type":"track","event":"Signed Up"}`))).To(BeEmpty())
+		Expect(plan.HasEvent("Signed Up")).To(BeFalse())
+		Expect(plan.HasEvent("Product Viewed")).To(BeTrue())
+	})
+
+	It("reports every property violation", func() {
+		violations := plan.Validate(parseJSON(`{"type":"track","event":"Order Completed",
+			"properties":{"quantity":1.5,"currency":"GBP","coupon":"spring","discount":5}}`))
+		Expect(violationTypes(violations)).To(Equal([]string{
+			trackingplan.PatternMismatch + ":coupon",
+			trackingplan.EnumMismatch + ":currency",
+			trackingplan.DatatypeMismatch + ":quantity",
+			trackingplan.RequiredMissing + ":revenue",
+			trackingplan.UnplannedProperty + ":discount",
+		}))
+
+		violations = plan.Validate(parseJSON(`{"type":"track","event":"Order Completed",
+			"properties":{"revenue":-1}}`))
+		Expect(violationTypes(violations)).To(Equal([]string{trackingplan.OutOfRange + ":revenue"}))
+
+		violations = plan.Validate(parseJSON(`{"type":"track","event":"Order Completed",
+			"properties":{"revenue":"12"}}`))
+		Expect(violationTypes(violations)).To(Equal([]string{trackingplan.DatatypeMismatch + ":revenue"}))
+	})
+})
@@ -0,0 +1,128 @@
+/*
+Tracking plans. The events of a source with a tracking plan (see package
+trackingplan) are validated before they are routed to the destinations,
+and the violating ones are, depending on the violationAction of the plan
+
+	drop         dropped
+	forward      sent with their violations in context.violationErrors
+	quarantine   stored in the quarantine jobsdb (proc_quarantine) with
+	             their violations, as {"message", "violationErrors"}. They
+	             are dropped if the quarantine jobsdb is disabled
+
+The violating events are counted per source and event name as
+processor.tracking_plan.<source_id>.<event>.violating_events.
+*/
+
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/processor/trackingplan"
+	"github.com/rudderlabs/rudder-server/services/stats"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	//Filled by backendConfigSubscriber, under configSubscriberLock
+	writeKeyTrackingPlanMap map[string]*trackingplan.PlanT
+	//statNameRegex matches what event names can't have in a stat name
+	statNameRegex = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+)
+
+type quarantineParamsT struct {
+	SourceID            string `json:"source_id"`
+	TrackingPlanID      string `json:"tracking_plan_id"`
+	TrackingPlanVersion int    `json:"tracking_plan_version"`
+}
+
+/*
+SetQuarantineDB makes the processor store the events violating tracking
+plans with violationAction quarantine into quarantineDB. It must be
+called before Setup
+*/
+func (proc *HandleT) SetQuarantineDB(quarantineDB *jobsdb.HandleT) {
+	proc.quarantineDB = quarantineDB
+}
+
+//getTrackingPlan returns the tracking plan of the source of writeKey, nil
+//if it has none
+func getTrackingPlan(writeKey string) *trackingplan.PlanT {
+	configSubscriberLock.RLock()
+	defer configSubscriberLock.RUnlock()
+	return writeKeyTrackingPlanMap[writeKey]
+}
+
+//unplannedEventsStatName is the event name the violations of the events
+//which aren't in the plan are counted under. Their names come from the
+//clients, so counting them by name would make a stat of every name
+const unplannedEventsStatName = "unplanned"
+
+//enforceTrackingPlan validates message against plan and tells if it is
+//routed to the destinations. The quarantined messages are added to
+//batch.quarantineJobs and violationCounts counts the violating ones by
+//event name, for the events in the plan
+func (proc *HandleT) enforceTrackingPlan(plan *trackingplan.PlanT, sourceID string,
+	message map[string]interface{}, batch *processBatchT, violationCounts map[[2]string]int) bool {
+
+	violations := plan.Validate(message)
+	if len(violations) == 0 {
+		return true
+	}
+	eventName, _ := message["event"].(string)
+	if !plan.HasEvent(eventName) {
+		eventName = unplannedEventsStatName
+	}
+	violationCounts[[2]string{sourceID, eventName}]++
+
+	switch plan.ViolationAction {
+	case trackingplan.ActionForward:
+		context, ok := message["context"].(map[string]interface{})
+		if !ok {
+			context = make(map[string]interface{})
+			message["context"] = context
+		}
+		context["violationErrors"] = violations
+		return true
+	case trackingplan.ActionQuarantine:
+		if proc.quarantineDB == nil {
+			return false
+		}
+		payload, err := json.Marshal(map[string]interface{}{
+			"message":         message,
+			"violationErrors": violations,
+		})
+		if err != nil {
+			logger.Errorf("Dropping an event violating tracking plan %s: %v", plan.ID, err)
+			return false
+		}
+		params, _ := json.Marshal(quarantineParamsT{
+			SourceID:            sourceID,
+			TrackingPlanID:      plan.ID,
+			TrackingPlanVersion: plan.Version,
+		})
+		batch.quarantineJobs = append(batch.quarantineJobs, &jobsdb.JobT{
+			UUID:         uuid.NewV4(),
+			Parameters:   params,
+			CreatedAt:    time.Now(),
+			ExpireAt:     time.Now(),
+			CustomVal:    sourceID,
+			EventPayload: payload,
+		})
+		return false
+	}
+	return false
+}
+
+func countViolations(violationCounts map[[2]string]int) {
+	for key, count := range violationCounts {
+		eventName := statNameRegex.ReplaceAllString(key[1], "_")
+		stats.NewStat(fmt.Sprintf("processor.tracking_plan.%s.%s.violating_events", key[0], eventName),
+			stats.CountType).Count(count)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Transformation errors. The events the user or destination transformer
+fails on are stored, with the transformer's response, in the
+transformation errors jobsdb (see jobsdb/transformationerrors.go) instead
+of being dropped. The gateway jobs they came from are still marked
+succeeded, as their other events went through.
+
+Once marked for retry, they are picked up by transformationErrorsRetryLoop
+and transformed again with the current config of their destination,
+starting from the stage they failed in. An event which failed in a later
+user transformation of a destination goes through all of them again. The
+ones which can't be, as their destination is gone or disabled or their
+payload is invalid, are marked skipped with the reason rather than
+retried.
+*/
+
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	backendconfig "github.com/rudderlabs/rudder-server/config/backend-config"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/services/stats"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+	"github.com/rudderlabs/rudder-server/utils/misc"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	userTransformStage = "user_transform"
+	destTransformStage = "dest_transform"
+)
+
+var transformationErrorsRetrySleep time.Duration
+
+type transformationErrorStatsT struct {
+	userTransformErrors *stats.RudderStats
+	destTransformErrors *stats.RudderStats
+	retried             *stats.RudderStats
+}
+
+func newTransformationErrorStats() transformationErrorStatsT {
+	return transformationErrorStatsT{
+		userTransformErrors: stats.NewStat("processor.user_transform_errors", stats.CountType),
+		destTransformErrors: stats.NewStat("processor.dest_transform_errors", stats.CountType),
+		retried:             stats.NewStat("processor.transformation_errors_retried", stats.CountType),
+	}
+}
+
+/*
+SetTransformationErrorDB makes the processor store the events
+transformations fail on into transformationErrorDB. It must be called
+before Setup
+*/
+func (proc *HandleT) SetTransformationErrorDB(transformationErrorDB *jobsdb.HandleT) {
+	proc.transformationErrorDB = transformationErrorDB
+}
+
+//newTransformationError records that the transformer failed on event,
+//one of the {"message", "destination"} events sent to it
+func newTransformationError(stage string, event interface{}, response string) *jobsdb.TransformationErrorT {
+	eventMap, _ := event.(map[string]interface{})
+	destination, _ := eventMap["destination"].(backendconfig.DestinationT)
+	message, _ := eventMap["message"].(map[string]interface{})
+	sourceID, _ := message["source_id"].(string)
+	payload, err := json.Marshal(event)
+	misc.AssertError(err)
+	return &jobsdb.TransformationErrorT{
+		UUID:            uuid.NewV4(),
+		SourceID:        sourceID,
+		DestinationID:   destination.ID,
+		DestinationType: destination.DestinationDefinition.Name,
+		Stage:           stage,
+		ErrorResponse:   response,
+		EventPayload:    payload,
+		CreatedAt:       time.Now(),
+		ExpireAt:        time.Now(),
+	}
+}
+
+func (proc *HandleT) storeTransformationErrors(errList []*jobsdb.TransformationErrorT) {
+	if len(errList) == 0 {
+		return
+	}
+	for _, transformationError := range errList {
+		if transformationError.Stage == userTransformStage {
+			proc.transformationErrorStats.userTransformErrors.Increment()
+		} else {
+			proc.transformationErrorStats.destTransformErrors.Increment()
+		}
+	}
+	if proc.transformationErrorDB == nil {
+		logger.Errorf("Dropping %d events transformations failed on", len(errList))
+		return
+	}
+	proc.transformationErrorDB.StoreTransformationErrors(errList)
+}
+
+func (proc *HandleT) transformationErrorsRetryLoop() {
+	logger.Info("Transformation errors retry loop started")
+	for {
+		errList := proc.transformationErrorDB.GetTransformationErrorsToRetry(dbReadBatchSize)
+		if len(errList) == 0 {
+			time.Sleep(transformationErrorsRetrySleep)
+			continue
+		}
+		proc.retryTransformationErrors(errList)
+	}
+}
+
+//retryTransformationErrors transforms the events of errList again and
+//stores them like the pipeline does. The ones which can't be are marked
+//skipped
+func (proc *HandleT) retryTransformationErrors(errList []*jobsdb.TransformationErrorT) {
+
+	var eventsByDest = make(map[string][]interface{})
+	var userTransformGroups = make(map[string]*userTransformGroupT)
+	var userTransformDestIDs []string
+	var retriedList, skippedList []*jobsdb.TransformationErrorT
+	skipReasons := make(map[int64]string)
+
+	for _, transformationError := range errList {
+		destination, ok := getEnabledDestination(transformationError.DestinationID)
+		if !ok {
+			reason := fmt.Sprintf("destination %s is not enabled", transformationError.DestinationID)
+			logger.Errorf("Not retrying transformation error %d, %s", transformationError.JobID, reason)
+			skippedList = append(skippedList, transformationError)
+			skipReasons[transformationError.JobID] = reason
+			continue
+		}
+		var event map[string]interface{}
+		err := json.Unmarshal(transformationError.EventPayload, &event)
+		if err != nil {
+			reason := fmt.Sprintf("invalid payload: %v", err)
+			logger.Errorf("Not retrying transformation error %d, %s", transformationError.JobID, reason)
+			skippedList = append(skippedList, transformationError)
+			skipReasons[transformationError.JobID] = reason
+			continue
+		}
+		retriedList = append(retriedList, transformationError)
+		event["destination"] = destination
+		destType := destination.DestinationDefinition.Name
+
+		if transformationError.Stage == userTransformStage && len(destination.Transformations) > 0 {
+			group, ok := userTransformGroups[destination.ID]
+			if !ok {
+				group = &userTransformGroupT{destType: destType, destination: destination}
+				userTransformGroups[destination.ID] = group
+				userTransformDestIDs = append(userTransformDestIDs, destination.ID)
+			}
+			group.events = append(group.events, event)
+			continue
+		}
+		eventsByDest[destType] = append(eventsByDest[destType], event)
+	}
+
+	destJobs, batchDestJobs, newErrList := proc.transformEvents(eventsByDest, userTransformGroups, userTransformDestIDs)
+
+	proc.routerDB.Store(destJobs)
+	proc.batchRouterDB.Store(batchDestJobs)
+	proc.storeTransformationErrors(newErrList)
+	proc.transformationErrorDB.MarkTransformationErrorsRetried(retriedList)
+	proc.transformationErrorDB.MarkTransformationErrorsSkipped(skippedList, skipReasons)
+
+	logger.Infof("Retried %d transformation errors, %d failed again, skipped %d",
+		len(retriedList), len(newErrList), len(skippedList))
+	proc.transformationErrorStats.retried.Count(len(retriedList))
+}
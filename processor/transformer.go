@@ -3,30 +3,34 @@ package processor
 import (
 	"bytes"
 	"encoding/json"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"sort"
 	"sync"
 	"time"
 
+	backendconfig "github.com/rudderlabs/rudder-server/config/backend-config"
+	"github.com/rudderlabs/rudder-server/processor/identity"
+	"github.com/rudderlabs/rudder-server/processor/integrations"
 	"github.com/rudderlabs/rudder-server/utils/logger"
 	"github.com/rudderlabs/rudder-server/utils/misc"
 )
 
-//Structure which is used to pass message to the transformer workers
+//Structure which is used to pass message to the transformer workers.
+//The response is sent back on the responseQ of the request
 type transformMessageT struct {
-	index int
-	data  interface{}
-	url   string
+	index         int
+	data          interface{}
+	url           string
+	errorResponse string
+	responseQ     chan *transformMessageT
 }
 
 //HandleT is the handle for this class
 type transformerHandleT struct {
-	requestQ   chan *transformMessageT
-	responseQ  chan *transformMessageT
-	accessLock sync.Mutex
-	perfStats  *misc.PerfStats
+	requestQ      chan *transformMessageT
+	perfStats     *misc.PerfStats
+	perfStatsLock sync.Mutex
 }
 
 var (
@@ -65,26 +69,23 @@ func (trans *transformerHandleT) transformWorker() {
 			resp.StatusCode == http.StatusBadRequest)
 
 		var toSendData interface{}
+		respData, err := ioutil.ReadAll(resp.Body)
+		misc.AssertError(err)
 		if resp.StatusCode == http.StatusOK {
-			respData, err := ioutil.ReadAll(resp.Body)
-			misc.AssertError(err)
 			err = json.Unmarshal(respData, &toSendData)
 			//This is returned by our JS engine so should  be parsable
 			//but still handling it
 			misc.AssertError(err)
-		} else {
-			io.Copy(ioutil.Discard, resp.Body)
 		}
 		resp.Body.Close()
 
-		trans.responseQ <- &transformMessageT{data: toSendData, index: job.index}
+		job.responseQ <- &transformMessageT{data: toSendData, index: job.index, errorResponse: string(respData)}
 	}
 }
 
 //Setup initializes this class
 func (trans *transformerHandleT) Setup() {
 	trans.requestQ = make(chan *transformMessageT, maxChanSize)
-	trans.responseQ = make(chan *transformMessageT, maxChanSize)
 	trans.perfStats = &misc.PerfStats{}
 	trans.perfStats.Setup("JS Call")
 	for i := 0; i < numTransformWorker; i++ {
@@ -93,39 +94,53 @@ func (trans *transformerHandleT) Setup() {
 	}
 }
 
+//FailedEventT is an input event the transformer returned nothing for,
+//Index being its position in the input and Response the transformer's
+//response to the request it was sent in
+type FailedEventT struct {
+	Index    int
+	Event    interface{}
+	Response string
+}
+
 type ResponseT struct {
 	Events       []interface{}
 	Success      bool
 	SourceIDList []string
+	//Canonical id of the event each event was transformed from, empty
+	//if it can't be told
+	CanonicalIDList []string
+	Failures        []FailedEventT
 }
 
 //Transform function is used to invoke transformer API
-//Transformer is not thread safe. If performance becomes
-//an issue we can create multiple transformer instances
-//but given that they are hitting the same NodeJS
-//process it may not be an issue if batch sizes (len clientEvents)
-//are big enough to saturate NodeJS. Right now the transformer
-//instance is shared between both user specific transformation
+//Transform is thread safe: the requests of every call share the
+//transformer workers, and their responses come back on a channel of the
+//call. This lets the processor transform destinations in parallel. The
+//transformer instance is shared between both user specific transformation
 //code and destination transformation code.
 func (trans *transformerHandleT) Transform(clientEvents []interface{},
 	url string, batchSize int, oneToMany bool) ResponseT {
 
-	trans.accessLock.Lock()
-	defer trans.accessLock.Unlock()
-
 	var transformResponse = make([]*transformMessageT, 0)
 	//Enqueue all the jobs
 	inputIdx := 0
 	outputIdx := 0
 	totalSent := 0
 	reqQ := trans.requestQ
-	resQ := trans.responseQ
+	responseQ := make(chan *transformMessageT, maxChanSize)
+	resQ := responseQ
 
-	trans.perfStats.Start()
+	start := time.Now()
 	var toSendData interface{}
 	sourceIDList := []string{}
+	canonicalIDList := []string{}
 	for _, clientEvent := range clientEvents {
-		sourceIDList = append(sourceIDList, clientEvent.(map[string]interface{})["message"].(map[string]interface{})["source_id"].(string))
+		clientEventMap := clientEvent.(map[string]interface{})
+		message := clientEventMap["message"].(map[string]interface{})
+		sourceIDList = append(sourceIDList, message["source_id"].(string))
+		canonicalID, _ := clientEventMap[identity.CanonicalIDKey].(string)
+		canonicalIDList = append(canonicalIDList, canonicalID)
 	}
 
 	for {
@@ -151,7 +166,7 @@ func (trans *transformerHandleT) Transform(clientEvents []interface{},
 		}
 		select {
 		//In case of batch event, index is the next Index
-		case reqQ <- &transformMessageT{index: inputIdx, data: toSendData, url: url}:
+		case reqQ <- &transformMessageT{index: inputIdx, data: toSendData, url: url, responseQ: responseQ}:
 			totalSent++
 			toSendData = nil
 			if inputIdx == len(clientEvents) {
@@ -182,39 +197,107 @@ func (trans *transformerHandleT) Transform(clientEvents []interface{},
 
 	outClientEvents := make([]interface{}, 0)
 	outClientEventsSourceIDs := []string{}
+	outClientEventsCanonicalIDs := []string{}
+	failures := []FailedEventT{}
 
+	//A response covers the inputs from the index of the previous one
+	prevIndex := 0
 	for idx, resp := range transformResponse {
+		startIndex := prevIndex
+		prevIndex = resp.index
 		if resp.data == nil {
+			for failedIdx := startIndex; failedIdx < resp.index; failedIdx++ {
+				failures = append(failures, FailedEventT{
+					Index:    failedIdx,
+					Event:    clientEvents[failedIdx],
+					Response: resp.errorResponse,
+				})
+			}
 			if !oneToMany {
 				outClientEvents = append(outClientEvents, nil)
 				outClientEventsSourceIDs = append(outClientEventsSourceIDs, "")
+				outClientEventsCanonicalIDs = append(outClientEventsCanonicalIDs, "")
 			}
 			continue
 		}
 		if oneToMany {
 			respArray, ok := resp.data.([]interface{})
 			misc.Assert(ok)
+			//Which input an element of the response comes from
+			//can't be told, so it only has the canonical id of
+			//the request if all of its inputs have the same
+			canonicalID := canonicalIDList[startIndex]
+			for _, requestCanonicalID := range canonicalIDList[startIndex:resp.index] {
+				if requestCanonicalID != canonicalID {
+					canonicalID = ""
+					break
+				}
+			}
 			//Transform is one to many mapping so returned
 			//response for each is an array. We flatten it out
 			for _, respElem := range respArray {
 				outClientEvents = append(outClientEvents, respElem)
 				outClientEventsSourceIDs = append(outClientEventsSourceIDs, sourceIDList[idx])
-
+				outClientEventsCanonicalIDs = append(outClientEventsCanonicalIDs, canonicalID)
 			}
 		} else {
 			//One to one mapping so no flattening is
 			//required
 			outClientEvents = append(outClientEvents, resp.data)
 			outClientEventsSourceIDs = append(outClientEventsSourceIDs, sourceIDList[idx])
+			outClientEventsCanonicalIDs = append(outClientEventsCanonicalIDs, "")
 		}
 	}
 	misc.Assert(oneToMany || len(outClientEvents) == len(clientEvents))
-	trans.perfStats.End(len(clientEvents))
+	trans.perfStatsLock.Lock()
+	trans.perfStats.Rate(len(clientEvents), time.Since(start))
 	trans.perfStats.Print()
+	trans.perfStatsLock.Unlock()
+
+	return ResponseT{
+		Events:          outClientEvents,
+		Success:         true,
+		SourceIDList:    outClientEventsSourceIDs,
+		CanonicalIDList: outClientEventsCanonicalIDs,
+		Failures:        failures,
+	}
+}
 
+//nativeTransform runs an in process destination transformation on
+//clientEvents and returns what Transform would for the transformer
+//service
+func nativeTransform(transformer integrations.DestinationTransformer, clientEvents []interface{}) ResponseT {
+	outClientEvents := make([]interface{}, 0)
+	outClientEventsSourceIDs := []string{}
+	outClientEventsCanonicalIDs := []string{}
+	failures := []FailedEventT{}
+	for idx, clientEvent := range clientEvents {
+		clientEventMap := clientEvent.(map[string]interface{})
+		message := clientEventMap["message"].(map[string]interface{})
+		destination, _ := clientEventMap["destination"].(backendconfig.DestinationT)
+		destinationConfig, ok := destination.Config.(map[string]interface{})
+		if !ok {
+			destinationConfig = map[string]interface{}{}
+		}
+		sourceID, _ := message["source_id"].(string)
+		canonicalID, _ := clientEventMap[identity.CanonicalIDKey].(string)
+
+		outEvents, err := transformer.Transform(message, destinationConfig)
+		if err != nil {
+			failures = append(failures, FailedEventT{Index: idx, Event: clientEvent, Response: err.Error()})
+			continue
+		}
+		for _, outEvent := range outEvents {
+			outClientEvents = append(outClientEvents, outEvent)
+			outClientEventsSourceIDs = append(outClientEventsSourceIDs, sourceID)
+			outClientEventsCanonicalIDs = append(outClientEventsCanonicalIDs, canonicalID)
+		}
+	}
 	return ResponseT{
-		Events:       outClientEvents,
-		Success:      true,
-		SourceIDList: outClientEventsSourceIDs,
+		Events:          outClientEvents,
+		Success:         true,
+		SourceIDList:    outClientEventsSourceIDs,
+		CanonicalIDList: outClientEventsCanonicalIDs,
+		Failures:        failures,
 	}
 }
@@ -0,0 +1,130 @@
+package processor
+
+import (
+	"sync"
+
+	backendconfig "github.com/rudderlabs/rudder-server/config/backend-config"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/processor/integrations"
+	"github.com/rudderlabs/rudder-server/processor/usertransform"
+	"github.com/rudderlabs/rudder-server/services/stats"
+)
+
+//userTransformGroupT is the events of one destination which has user
+//transformations, in the shape sent to the destination transformer
+type userTransformGroupT struct {
+	destType    string
+	destination backendconfig.DestinationT
+	events      []interface{}
+}
+
+type userTransformStatsT struct {
+	inputEvents   *stats.RudderStats
+	outputEvents  *stats.RudderStats
+	droppedEvents *stats.RudderStats
+	splitEvents   *stats.RudderStats
+	failedEvents  *stats.RudderStats
+}
+
+func newUserTransformStats() userTransformStatsT {
+	return userTransformStatsT{
+		inputEvents:   stats.NewStat("processor.user_transform_input_events", stats.CountType),
+		outputEvents:  stats.NewStat("processor.user_transform_output_events", stats.CountType),
+		droppedEvents: stats.NewStat("processor.user_transform_dropped_events", stats.CountType),
+		splitEvents:   stats.NewStat("processor.user_transform_split_events", stats.CountType),
+		failedEvents:  stats.NewStat("processor.user_transform_failed_events", stats.CountType),
+	}
+}
+
+//userTransform runs the transformations of the destination on its events
+//(see package usertransform) and returns the events to send to the
+//destination transformer, and the failed ones as transformation errors
+func (proc *HandleT) userTransform(group *userTransformGroupT) ([]interface{}, []*jobsdb.TransformationErrorT) {
+	versionIDs := make([]string, 0, len(group.destination.Transformations))
+	for _, transformation := range group.destination.Transformations {
+		versionIDs = append(versionIDs, transformation.VersionID)
+	}
+	events, failures, counts := usertransform.Run(group.destination.ID, group.destination, versionIDs,
+		group.events, proc.runUserTransformation)
+
+	proc.userTransformStats.inputEvents.Count(counts.Input)
+	proc.userTransformStats.outputEvents.Count(counts.Output)
+	proc.userTransformStats.droppedEvents.Count(counts.Dropped)
+	proc.userTransformStats.splitEvents.Count(counts.Split)
+	proc.userTransformStats.failedEvents.Count(counts.Failed)
+	var errList []*jobsdb.TransformationErrorT
+	for _, failure := range failures {
+		errList = append(errList, newTransformationError(userTransformStage, failure.Event, failure.Response))
+	}
+	return events, errList
+}
+
+//runUserTransformation runs a user transformation version, with the script
+//engine if there is one, through the user transformer service otherwise
+func (proc *HandleT) runUserTransformation(versionID string, events []interface{}) usertransform.ResultT {
+	var response ResponseT
+	if proc.scriptEngine != nil {
+		response = proc.embeddedUserTransform(versionID, events)
+	} else {
+		url := integrations.GetUserTransformVersionURL(versionID)
+		response = proc.transformer.Transform(events, url, transformBatchSize, true)
+	}
+	failures := make([]usertransform.FailureT, 0, len(response.Failures))
+	for _, failure := range response.Failures {
+		failures = append(failures, usertransform.FailureT(failure))
+	}
+	return usertransform.ResultT{Events: response.Events, Success: response.Success, Failures: failures}
+}
+
+func fetchTransformationCode(versionID string) (string, error) {
+	transformationCode, err := backendconfig.GetTransformationCode(versionID)
+	return transformationCode.Code, err
+}
+
+//embeddedUserTransform runs a user transformation version with the
+//script engine and returns what Transform would for the user
+//transformer service. The batches run on numTransformWorker goroutines
+func (proc *HandleT) embeddedUserTransform(versionID string, events []interface{}) ResponseT {
+	batchSize := transformBatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	numBatches := (len(events) + batchSize - 1) / batchSize
+	batchResults := make([][]interface{}, numBatches)
+	batchErrors := make([]error, numBatches)
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, numTransformWorker)
+	for batch := 0; batch < numBatches; batch++ {
+		start := batch * batchSize
+		end := start + batchSize
+		if end > len(events) {
+			end = len(events)
+		}
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(batch int, batchEvents []interface{}) {
+			defer wg.Done()
+			batchResults[batch], batchErrors[batch] = proc.scriptEngine.Transform(versionID, batchEvents)
+			<-workers
+		}(batch, events[start:end])
+	}
+	wg.Wait()
+
+	outEvents := make([]interface{}, 0)
+	failures := []FailedEventT{}
+	for batch := 0; batch < numBatches; batch++ {
+		if batchErrors[batch] != nil {
+			for idx := batch * batchSize; idx < len(events) && idx < (batch+1)*batchSize; idx++ {
+				failures = append(failures, FailedEventT{Index: idx, Event: events[idx], Response: batchErrors[batch].Error()})
+			}
+			continue
+		}
+		outEvents = append(outEvents, batchResults[batch]...)
+	}
+	return ResponseT{
+		Events:   outEvents,
+		Success:  true,
+		Failures: failures,
+	}
+}
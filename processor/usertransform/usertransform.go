@@ -0,0 +1,127 @@
+/*
+Package usertransform runs the user transformations of a destination, in
+order, on its events.
+
+A transformation gets the events ({"message", "destination"}) and returns,
+for every event it doesn't fail on, one array of messages. An empty array
+drops the event, more than one message splits it. The source_id of an
+event is kept on the messages it is transformed into, and its canonicalId
+on the events of these messages.
+The events a transformation fails on, or all of its events if its response
+doesn't match them, are returned as failures rather than sent
+untransformed.
+*/
+package usertransform
+
+import (
+	"fmt"
+
+	"github.com/rudderlabs/rudder-server/processor/identity"
+	"github.com/rudderlabs/rudder-server/utils/logger"
+)
+
+//ResultT is what a transformation returned for a list of events: the
+//failed events, by their index, and in order, one array of messages for
+//every other event. Success false means the response can't be used
+type ResultT struct {
+	Events   []interface{}
+	Success  bool
+	Failures []FailureT
+}
+
+//FailureT is an event a transformation failed on and the reason
+type FailureT struct {
+	Index    int
+	Event    interface{}
+	Response string
+}
+
+//TransformFunc runs the transformation version versionID on events
+type TransformFunc func(versionID string, events []interface{}) ResultT
+
+//CountsT counts the events going through the transformations, summed
+//over all of them
+type CountsT struct {
+	Input   int
+	Output  int
+	Dropped int
+	Split   int
+	Failed  int
+}
+
+/*
+Run runs the transformations versionIDs of the destination destID on
+events with transform and returns the resulting events, with destination
+set as their "destination", and the events which failed
+*/
+func Run(destID string, destination interface{}, versionIDs []string, events []interface{},
+	transform TransformFunc) ([]interface{}, []FailureT, CountsT) {
+
+	var failures []FailureT
+	var counts CountsT
+	for _, versionID := range versionIDs {
+		counts.Input += len(events)
+		result := transform(versionID, events)
+
+		failed := make(map[int]bool)
+		for _, failure := range result.Failures {
+			failed[failure.Index] = true
+			failures = append(failures, failure)
+		}
+		counts.Failed += len(failed)
+		if !result.Success || len(result.Events)+len(failed) != len(events) {
+			errorResponse := fmt.Sprintf("user transformation %s returned %d results for %d events",
+				versionID, len(result.Events), len(events)-len(failed))
+			logger.Errorf("User transformation of destination %s: %s", destID, errorResponse)
+			for idx, event := range events {
+				if !failed[idx] {
+					failures = append(failures, FailureT{Index: idx, Event: event, Response: errorResponse})
+				}
+			}
+			counts.Failed += len(events) - len(failed)
+			return nil, failures, counts
+		}
+
+		var transformedEvents []interface{}
+		resultIdx := 0
+		for idx, event := range events {
+			if failed[idx] {
+				continue
+			}
+			messages, ok := result.Events[resultIdx].([]interface{})
+			resultIdx++
+			if !ok || len(messages) == 0 {
+				counts.Dropped++
+				continue
+			}
+			if len(messages) > 1 {
+				counts.Split++
+			}
+			eventMap := event.(map[string]interface{})
+			sourceID := eventMap["message"].(map[string]interface{})["source_id"]
+			canonicalID, hasCanonicalID := eventMap[identity.CanonicalIDKey]
+			for _, message := range messages {
+				messageMap, ok := message.(map[string]interface{})
+				if !ok {
+					counts.Dropped++
+					continue
+				}
+				messageMap["source_id"] = sourceID
+				transformedEvent := map[string]interface{}{
+					"message":     messageMap,
+					"destination": destination,
+				}
+				if hasCanonicalID {
+					transformedEvent[identity.CanonicalIDKey] = canonicalID
+				}
+				transformedEvents = append(transformedEvents, transformedEvent)
+			}
+		}
+		counts.Output += len(transformedEvents)
+		events = transformedEvents
+		if len(events) == 0 {
+			break
+		}
+	}
+	return events, failures, counts
+}
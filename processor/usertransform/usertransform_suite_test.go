@@ -0,0 +1,13 @@
+package usertransform_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestUsertransform(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Usertransform Suite")
+}
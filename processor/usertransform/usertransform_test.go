@@ -0,0 +1,139 @@
+package usertransform_test
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/processor/identity"
+	"github.com/rudderlabs/rudder-server/processor/usertransform"
+)
+
+//stubTransformer transforms the events by versionID, one message per
+//event unless the version says otherwise
+//
+//	drop       an empty array for every event
+//	split      two messages for every event, "<event> 1" and "<event> 2"
+//	rename     the event named "<versionID>(<event>)"
+//	fail       fails the whole batch
+//	failsecond fails the second event only
+//	mismatch   one result less than the events
+func stubTransformer(versionID string, events []interface{}) usertransform.ResultT {
+	result := usertransform.ResultT{Events: []interface{}{}, Success: true}
+	for idx, event := range events {
+		message := event.(map[string]interface{})["message"].(map[string]interface{})
+		name := message["event"].(string)
+		newMessage := func(name string) map[string]interface{} {
+			return map[string]interface{}{"event": name}
+		}
+		switch versionID {
+		case "drop":
+			result.Events = append(result.Events, []interface{}{})
+		case "split":
+			result.Events = append(result.Events, []interface{}{newMessage(name + " 1"), newMessage(name + " 2")})
+		case "fail":
+			result.Failures = append(result.Failures, usertransform.FailureT{Index: idx, Event: event, Response: "boom"})
+		case "failsecond":
+			if idx == 1 {
+				result.Failures = append(result.Failures, usertransform.FailureT{Index: idx, Event: event, Response: "boom"})
+				continue
+			}
+			result.Events = append(result.Events, []interface{}{newMessage(name)})
+		case "mismatch":
+			if idx > 0 {
+				result.Events = append(result.Events, []interface{}{newMessage(name)})
+			}
+		default:
+			result.Events = append(result.Events, []interface{}{newMessage(fmt.Sprintf("%s(%s)", versionID, name))})
+		}
+	}
+	return result
+}
+
+func inputEvents(names ...string) []interface{} {
+	var events []interface{}
+	for _, name := range names {
+		events = append(events, map[string]interface{}{
+			"message":     map[string]interface{}{"event": name, "source_id": "src-" + name},
+			"destination": "dest",
+		})
+	}
+	return events
+}
+
+var _ = Describe("Usertransform", func() {
+
+	table.DescribeTable("runs the transformations in order",
+		func(versionIDs []string, input []interface{}, expectedEvents []string, expectedSourceIDs []string,
+			expectedFailures []string, expectedCounts usertransform.CountsT) {
+
+			events, failures, counts := usertransform.Run("dest-id", "dest", versionIDs, input, stubTransformer)
+
+			var names, sourceIDs []string
+			for _, event := range events {
+				eventMap := event.(map[string]interface{})
+				Expect(eventMap["destination"]).To(Equal("dest"))
+				message := eventMap["message"].(map[string]interface{})
+				names = append(names, message["event"].(string))
+				sourceIDs = append(sourceIDs, message["source_id"].(string))
+			}
+			Expect(names).To(Equal(expectedEvents))
+			Expect(sourceIDs).To(Equal(expectedSourceIDs))
+
+			var failedNames []string
+			for _, failure := range failures {
+				message := failure.Event.(map[string]interface{})["message"].(map[string]interface{})
+				failedNames = append(failedNames, message["event"].(string))
+				Expect(failure.Response).NotTo(BeEmpty())
+			}
+			Expect(failedNames).To(Equal(expectedFailures))
+			Expect(counts).To(Equal(expectedCounts))
+		},
+		table.Entry("transforms every event", []string{"v1"}, inputEvents("a", "b"),
+			[]string{"v1(a)", "v1(b)"}, []string{"src-a", "src-b"}, nil,
+			usertransform.CountsT{Input: 2, Output: 2}),
+		table.Entry("drops the events transformed into an empty array", []string{"drop"}, inputEvents("a", "b"),
+			nil, nil, nil,
+			usertransform.CountsT{Input: 2, Dropped: 2}),
+		table.Entry("splits the events transformed into several messages", []string{"split"}, inputEvents("a", "b"),
+			[]string{"a 1", "a 2", "b 1", "b 2"}, []string{"src-a", "src-a", "src-b", "src-b"}, nil,
+			usertransform.CountsT{Input: 2, Output: 4, Split: 2}),
+		table.Entry("returns the events of a failed batch as failures", []string{"fail"}, inputEvents("a", "b"),
+			nil, nil, []string{"a", "b"},
+			usertransform.CountsT{Input: 2, Failed: 2}),
+		table.Entry("keeps the events a transformation didn't fail on", []string{"failsecond"}, inputEvents("a", "b", "c"),
+			[]string{"a", "c"}, []string{"src-a", "src-c"}, []string{"b"},
+			usertransform.CountsT{Input: 3, Output: 2, Failed: 1}),
+		table.Entry("fails every event when the results don't match them", []string{"mismatch"}, inputEvents("a", "b"),
+			nil, nil, []string{"a", "b"},
+			usertransform.CountsT{Input: 2, Failed: 2}),
+		table.Entry("runs the next transformation on the results of the previous one", []string{"split", "v2"},
+			inputEvents("a", "b"),
+			[]string{"v2(a 1)", "v2(a 2)", "v2(b 1)", "v2(b 2)"}, []string{"src-a", "src-a", "src-b", "src-b"}, nil,
+			usertransform.CountsT{Input: 6, Output: 8, Split: 2}),
+		table.Entry("stops once every event is dropped", []string{"drop", "v2"}, inputEvents("a"),
+			nil, nil, nil,
+			usertransform.CountsT{Input: 1, Dropped: 1}),
+		table.Entry("returns the failures of every transformation", []string{"failsecond", "mismatch"},
+			inputEvents("a", "b", "c"),
+			nil, nil, []string{"b", "a", "c"},
+			usertransform.CountsT{Input: 5, Output: 2, Failed: 3}),
+	)
+
+	It("keeps the canonical id of an event next to the messages it is transformed into", func() {
+		input := inputEvents("a", "b")
+		input[0].(map[string]interface{})[identity.CanonicalIDKey] = "user-a"
+		events, _, _ := usertransform.Run("dest-id", "dest", []string{"split"}, input, stubTransformer)
+		Expect(events).To(HaveLen(4))
+		for idx, event := range events {
+			eventMap := event.(map[string]interface{})
+			Expect(eventMap["message"]).NotTo(HaveKey(identity.CanonicalIDKey))
+			if idx < 2 {
+				Expect(eventMap).To(HaveKeyWithValue(identity.CanonicalIDKey, "user-a"))
+			} else {
+				Expect(eventMap).NotTo(HaveKey(identity.CanonicalIDKey))
+			}
+		}
+	})
+})
@@ -32,9 +32,10 @@ var (
 )
 
 type HandleT struct {
-	processQ  chan BatchJobsT
-	jobsDB    *jobsdb.HandleT
-	isEnabled bool
+	processQ   chan BatchJobsT
+	jobsDB     *jobsdb.HandleT
+	jobsNotify <-chan bool
+	isEnabled  bool
 }
 
 func backendConfigSubscriber() {
@@ -183,7 +184,10 @@ func (brt *HandleT) mainLoop() {
 			time.Sleep(time.Duration(2*mainLoopSleepInS) * time.Second)
 			continue
 		}
+		//mainLoopSleepInS is the minimum gap between two upload rounds,
+		//after which we wait for new jobs of any destination
 		time.Sleep(time.Duration(mainLoopSleepInS) * time.Second)
+		<-brt.jobsNotify
 		for _, batchDestination := range batchDestinations {
 			if inProgressMap[batchDestination.Source.ID] {
 				continue
@@ -280,6 +284,7 @@ func init() {
 func (brt *HandleT) Setup(jobsDB *jobsdb.HandleT) {
 	logger.Info("BRT: Batch Router started")
 	brt.jobsDB = jobsDB
+	brt.jobsNotify = jobsDB.Subscribe([]string{})
 	brt.processQ = make(chan BatchJobsT)
 	brt.crashRecover()
 
@@ -24,6 +24,7 @@ type HandleT struct {
 	requestQ              chan *jobsdb.JobT
 	responseQ             chan jobResponseT
 	jobsDB                *jobsdb.HandleT
+	jobsNotify            <-chan bool
 	netHandle             *NetHandleT
 	destID                string
 	workers               []*workerT
@@ -93,8 +94,7 @@ func (rt *HandleT) workerProcess(worker *workerT) {
 		workerDurationStat.Start()
 		logger.Debug("Router :: trying to send payload to GA", respBody)
 
-		postInfo := integrations.GetPostInfo(job.EventPayload)
-		userID := postInfo.UserID
+		userID := getUserID(job)
 		misc.Assert(userID != "")
 
 		//If sink is not enabled mark all jobs as waiting
@@ -264,15 +264,24 @@ func getHash(s string) int {
 	return int(h.Sum32())
 }
 
+//getUserID returns the ordering key of the job. Jobs stored before
+//partition keys were set carry the userId only in the payload
+func getUserID(job *jobsdb.JobT) string {
+	if job.PartitionKey != "" {
+		return job.PartitionKey
+	}
+	return integrations.GetPostInfo(job.EventPayload).UserID
+}
+
 func (rt *HandleT) findWorker(job *jobsdb.JobT) *workerT {
 
-	postInfo := integrations.GetPostInfo(job.EventPayload)
+	userID := getUserID(job)
 
 	var index int
 	if randomWorkerAssign {
 		index = rand.Intn(noOfWorkers)
 	} else {
-		index = int(math.Abs(float64(getHash(postInfo.UserID) % noOfWorkers)))
+		index = int(math.Abs(float64(getHash(userID) % noOfWorkers)))
 	}
 
 	worker := rt.workers[index]
@@ -281,7 +290,7 @@ func (rt *HandleT) findWorker(job *jobsdb.JobT) *workerT {
 	//#JobOrder (see other #JobOrder comment)
 	worker.failedJobIDMutex.RLock()
 	defer worker.failedJobIDMutex.RUnlock()
-	blockJobID, found := worker.failedJobIDMap[postInfo.UserID]
+	blockJobID, found := worker.failedJobIDMap[userID]
 	if !found {
 		return worker
 	}
@@ -447,7 +456,13 @@ func (rt *HandleT) generatorLoop() {
 		toQuery -= len(waitList)
 		unprocessedList := rt.jobsDB.GetUnprocessed([]string{rt.destID}, toQuery)
 		if len(waitList)+len(unprocessedList)+len(retryList) == 0 {
-			time.Sleep(readSleep)
+			//Wait till jobs for this destination are stored or updated, but
+			//query again after readSleep, as failed jobs become due for
+			//retry without a notification
+			select {
+			case <-rt.jobsNotify:
+			case <-time.After(readSleep):
+			}
 			continue
 		}
 
@@ -555,6 +570,7 @@ func (rt *HandleT) Setup(jobsDB *jobsdb.HandleT, destID string) {
 	logger.Info("Router started")
 	rt.jobsDB = jobsDB
 	rt.destID = destID
+	rt.jobsNotify = jobsDB.Subscribe([]string{destID})
 	rt.crashRecover()
 	rt.requestQ = make(chan *jobsdb.JobT, jobQueryBatchSize)
 	rt.responseQ = make(chan jobResponseT, jobQueryBatchSize)
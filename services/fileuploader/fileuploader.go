@@ -14,6 +14,7 @@ type FileUploader interface {
 type SettingsT struct {
 	Provider       string
 	AmazonS3Bucket string
+	LocalDirectory string
 }
 
 // NewFileUploader returns FileFileUploader backed by configured privider
@@ -23,6 +24,13 @@ func NewFileUploader(settings *SettingsT) (FileUploader, error) {
 		return &S3Uploader{
 			bucket: settings.AmazonS3Bucket,
 		}, nil
+	case "local":
+		if settings.LocalDirectory == "" {
+			return nil, errors.New("No directory configured for local FileUploader")
+		}
+		return &LocalUploader{
+			directory: settings.LocalDirectory,
+		}, nil
 	}
 	return nil, errors.New("No provider configured for FileUploader")
 }
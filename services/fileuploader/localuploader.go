@@ -0,0 +1,32 @@
+package fileuploader
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Upload copies passed in file into the local directory
+func (uploader *LocalUploader) Upload(file *os.File, prefixes ...string) error {
+	dirPath := filepath.Join(append([]string{uploader.directory}, prefixes...)...)
+	err := os.MkdirAll(dirPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	destFile, err := os.Create(filepath.Join(dirPath, filepath.Base(file.Name())))
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destFile, file)
+	return err
+}
+
+// LocalUploader contains config for copying files to a local directory
+type LocalUploader struct {
+	directory string
+}
@@ -1,6 +1,8 @@
 package stats
 
 import (
+	"time"
+
 	"github.com/rudderlabs/rudder-server/config"
 	"github.com/rudderlabs/rudder-server/utils/misc"
 	"github.com/rudderlabs/rudder-server/utils/logger"
@@ -100,6 +102,16 @@ func (rStats *RudderStats) End() {
 	rStats.Timing.Send(rStats.Name)
 }
 
+// SendTiming sends a duration measured by the caller, for timings which
+// don't fit a Start/End pair (e.g. concurrent or spread over functions)
+func (rStats *RudderStats) SendTiming(duration time.Duration) {
+	if !statsEnabled {
+		return
+	}
+	misc.Assert(rStats.StatType == TimerType)
+	client.Timing(rStats.Name, int(duration/time.Millisecond))
+}
+
 func (rStats *RudderStats) DeferredTimer() {
 	if !statsEnabled {
 		return
@@ -0,0 +1,13 @@
+package backups_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestBackups(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Backups Suite")
+}
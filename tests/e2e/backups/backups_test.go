@@ -0,0 +1,115 @@
+package backups_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/config"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	"github.com/rudderlabs/rudder-server/tests/helpers"
+	uuid "github.com/satori/go.uuid"
+)
+
+//More jobs than JobsDB.maxDSSize, so that the first dataset fills up,
+//is migrated once its jobs succeed and is backed up
+const jobCount = 20
+
+var dbHandle *sql.DB
+var backupDirectory string
+
+var _ = BeforeSuite(func() {
+	var err error
+	dbHandle, err = sql.Open("postgres", jobsdb.GetConnectionString())
+	Expect(err).NotTo(HaveOccurred())
+	backupDirectory = config.GetString("JobsDB.backupLocalDirectory", "")
+	Expect(os.RemoveAll(backupDirectory)).To(Succeed())
+})
+
+//payload is not ASCII, as the compressed payloads aren't text either
+func payload(i int) string {
+	return fmt.Sprintf(`{"index": %d, "event": "Prüfung ✓"}`, i)
+}
+
+//backupAndRestore stores jobs in a compressed jobsdb with the backup
+//format of tablePrefix, waits for their dataset to be backed up and
+//restores the archives into another jobsdb
+func backupAndRestore(tablePrefix string, extension string) {
+	var jobsDB jobsdb.HandleT
+	jobsDB.Setup(true, tablePrefix, 0, true)
+	defer jobsDB.TearDown()
+
+	var jobList []*jobsdb.JobT
+	for i := 0; i < jobCount; i++ {
+		jobList = append(jobList, &jobsdb.JobT{
+			UUID:         uuid.NewV4(),
+			Parameters:   []byte(`{"source_id": "source"}`),
+			CreatedAt:    time.Now(),
+			ExpireAt:     time.Now(),
+			CustomVal:    "BACKUP",
+			EventPayload: []byte(payload(i)),
+		})
+	}
+	jobsDB.Store(jobList)
+	stored := jobsDB.GetUnprocessed([]string{"BACKUP"}, jobCount)
+	Expect(stored).To(HaveLen(jobCount))
+	var statusList []*jobsdb.JobStatusT
+	for _, job := range stored {
+		statusList = append(statusList, &jobsdb.JobStatusT{
+			JobID:         job.JobID,
+			JobState:      jobsdb.SucceededState,
+			AttemptNum:    1,
+			ExecTime:      time.Now(),
+			RetryTime:     time.Now(),
+			ErrorCode:     "200",
+			ErrorResponse: []byte(`{}`),
+		})
+	}
+	jobsDB.UpdateJobStatus(statusList, []string{"BACKUP"})
+
+	By("waiting for the dataset to be backed up and dropped")
+	jobsArchive := filepath.Join(backupDirectory, tablePrefix+"_jobs_1."+extension)
+	jobStatusArchive := filepath.Join(backupDirectory, tablePrefix+"_job_status_1."+extension)
+	Eventually(jobStatusArchive, 60, 1).Should(BeAnExistingFile())
+	//The dataset is dropped once both archives are uploaded
+	Eventually(func() []string {
+		return helpers.GetTableNamesWithPrefix(dbHandle, "pre_drop_"+tablePrefix+"_")
+	}, 10, 1).Should(BeEmpty())
+	Expect(jobsArchive).To(BeAnExistingFile())
+
+	By("restoring the archives")
+	var restoreDB jobsdb.HandleT
+	restoreDB.Setup(true, tablePrefix+"_restore", 0, false)
+	defer restoreDB.TearDown()
+	stats, err := restoreDB.RestoreDS(jobsArchive, jobStatusArchive, true)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(stats.Jobs).To(Equal(jobCount))
+	Expect(stats.Statuses).To(Equal(jobCount))
+
+	restored := restoreDB.GetProcessed([]string{jobsdb.SucceededState}, []string{"BACKUP"}, jobCount+1)
+	Expect(restored).To(HaveLen(jobCount))
+	for i, job := range restored {
+		Expect(string(job.EventPayload)).To(MatchJSON(payload(i)))
+		Expect(job.LastJobStatus.JobState).To(Equal(jobsdb.SucceededState))
+	}
+}
+
+var _ = Describe("Backups", func() {
+	Context("Compressed payloads", func() {
+		It("should restore jsonl backups", func() {
+			backupAndRestore("backup_jsonl", "jsonl.gz")
+		})
+
+		It("should restore csv backups", func() {
+			backupAndRestore("backup_csv", "csv.gz")
+		})
+
+		It("should restore parquet backups", func() {
+			backupAndRestore("backup_parquet", "parquet")
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package deadletters_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestDeadLetters(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dead Letters Suite")
+}
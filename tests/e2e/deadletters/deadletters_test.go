@@ -0,0 +1,81 @@
+package deadletters_test
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	uuid "github.com/satori/go.uuid"
+)
+
+const jobCount = 10
+
+var jobsDB, deadLetterDB jobsdb.HandleT
+
+var _ = BeforeSuite(func() {
+	deadLetterDB.Setup(true, "dead_letter_test", 0, false)
+	jobsDB.Setup(true, "dead_letter_origin_test", 0, false)
+	jobsDB.SetDeadLetterDB(&deadLetterDB)
+})
+
+var _ = AfterSuite(func() {
+	jobsDB.TearDown()
+	deadLetterDB.TearDown()
+})
+
+func statuses(jobList []*jobsdb.JobT, state string) []*jobsdb.JobStatusT {
+	var statusList []*jobsdb.JobStatusT
+	for _, job := range jobList {
+		statusList = append(statusList, &jobsdb.JobStatusT{
+			JobID:         job.JobID,
+			JobState:      state,
+			AttemptNum:    1,
+			ExecTime:      time.Now(),
+			RetryTime:     time.Now(),
+			ErrorCode:     "400",
+			ErrorResponse: []byte(`{"reason": "bad request"}`),
+		})
+	}
+	return statusList
+}
+
+var _ = Describe("Dead letters", func() {
+	It("should requeue aborted jobs once", func() {
+		var jobList []*jobsdb.JobT
+		for i := 0; i < jobCount; i++ {
+			jobList = append(jobList, &jobsdb.JobT{
+				UUID:         uuid.NewV4(),
+				Parameters:   []byte(`{"source_id": "source"}`),
+				CreatedAt:    time.Now(),
+				ExpireAt:     time.Now(),
+				CustomVal:    "DEAD",
+				EventPayload: []byte(fmt.Sprintf(`{"index": %d}`, i)),
+			})
+		}
+		jobsDB.Store(jobList)
+		stored := jobsDB.GetUnprocessed([]string{"DEAD"}, jobCount)
+		Expect(stored).To(HaveLen(jobCount))
+
+		By("aborting the jobs")
+		jobsDB.UpdateJobStatus(statuses(stored, jobsdb.AbortedState), []string{"DEAD"})
+		deadLetters := deadLetterDB.GetDeadLetters([]string{"DEAD"}, jobCount+1)
+		Expect(deadLetters).To(HaveLen(jobCount))
+
+		By("requeueing them")
+		Expect(deadLetterDB.RequeueDeadLetters(deadLetters)).To(Succeed())
+		Expect(deadLetterDB.GetDeadLetters([]string{"DEAD"}, jobCount+1)).To(BeEmpty())
+		requeued := jobsDB.GetUnprocessed([]string{"DEAD"}, jobCount+1)
+		Expect(requeued).To(HaveLen(jobCount))
+		for i, job := range requeued {
+			Expect(string(job.EventPayload)).To(MatchJSON(fmt.Sprintf(`{"index": %d}`, i)))
+			Expect(string(job.Parameters)).To(MatchJSON(`{"source_id": "source"}`))
+		}
+	})
+
+	It("should only requeue dead letter jobs", func() {
+		err := deadLetterDB.RequeueDeadLetters([]*jobsdb.JobT{{JobID: 1, Parameters: []byte(`{}`)}})
+		Expect(err).To(HaveOccurred())
+	})
+})
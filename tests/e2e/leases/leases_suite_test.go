@@ -0,0 +1,13 @@
+package leases_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestLeases(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Leases Suite")
+}
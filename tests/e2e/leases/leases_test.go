@@ -0,0 +1,82 @@
+package leases_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	jobCount      = 500
+	claimSize     = 7
+	leaseDuration = time.Minute
+)
+
+var jobsDB jobsdb.HandleT
+
+var _ = BeforeSuite(func() {
+	jobsDB.Setup(true, "lease_test", 0, false)
+})
+
+var _ = AfterSuite(func() {
+	jobsDB.TearDown()
+})
+
+//claimAll claims jobs as consumerID until there is none left
+func claimAll(consumerID string, claimed map[int64]bool) {
+	for {
+		jobs := jobsDB.ClaimUnprocessed(consumerID, jobsdb.QueryFiltersT{CustomVals: []string{"LEASE"}},
+			claimSize, leaseDuration)
+		if len(jobs) == 0 {
+			return
+		}
+		for _, job := range jobs {
+			claimed[job.JobID] = true
+		}
+	}
+}
+
+var _ = Describe("Leases", func() {
+	Context("Concurrent consumers", func() {
+		It("should never hand a job to two consumers", func() {
+			var jobList []*jobsdb.JobT
+			for i := 0; i < jobCount; i++ {
+				jobList = append(jobList, &jobsdb.JobT{
+					UUID:         uuid.NewV4(),
+					Parameters:   []byte(`{}`),
+					CreatedAt:    time.Now(),
+					ExpireAt:     time.Now(),
+					CustomVal:    "LEASE",
+					EventPayload: []byte(fmt.Sprintf(`{"index": %d}`, i)),
+				})
+			}
+			jobsDB.Store(jobList)
+
+			claimedA := make(map[int64]bool)
+			claimedB := make(map[int64]bool)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				claimAll("consumer-a", claimedA)
+			}()
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				claimAll("consumer-b", claimedB)
+			}()
+			wg.Wait()
+
+			for jobID := range claimedA {
+				Expect(claimedB).NotTo(HaveKey(jobID))
+			}
+			Expect(len(claimedA) + len(claimedB)).To(Equal(jobCount))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package transformationerrors_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTransformationErrors(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Transformation Errors Suite")
+}
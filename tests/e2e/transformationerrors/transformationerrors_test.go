@@ -0,0 +1,92 @@
+package transformationerrors_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rudderlabs/rudder-server/jobsdb"
+	uuid "github.com/satori/go.uuid"
+)
+
+var errorDB jobsdb.HandleT
+
+var _ = BeforeSuite(func() {
+	errorDB.Setup(true, "proc_error_test", 0, false)
+})
+
+var _ = AfterSuite(func() {
+	errorDB.TearDown()
+})
+
+func newTransformationError(destinationID string) *jobsdb.TransformationErrorT {
+	return &jobsdb.TransformationErrorT{
+		UUID:            uuid.NewV4(),
+		SourceID:        "source",
+		DestinationID:   destinationID,
+		DestinationType: "GA",
+		Stage:           "dest_transform",
+		ErrorResponse:   "transformer failed",
+		EventPayload:    []byte(`{"message": {"event": "test", "source_id": "source"}}`),
+		CreatedAt:       time.Now(),
+		ExpireAt:        time.Now(),
+	}
+}
+
+func jobIDs(errList []*jobsdb.TransformationErrorT) []int64 {
+	var ids []int64
+	for _, transformationError := range errList {
+		ids = append(ids, transformationError.JobID)
+	}
+	return ids
+}
+
+var _ = Describe("Transformation errors", func() {
+	It("should store, retry and skip transformation errors", func() {
+		By("capturing the errors")
+		errorDB.StoreTransformationErrors([]*jobsdb.TransformationErrorT{
+			newTransformationError("enabled"), newTransformationError("disabled")})
+		stored := errorDB.GetTransformationErrors([]string{"GA"}, 10)
+		Expect(stored).To(HaveLen(2))
+		for _, transformationError := range stored {
+			Expect(transformationError.SourceID).To(Equal("source"))
+			Expect(transformationError.Stage).To(Equal("dest_transform"))
+			Expect(transformationError.ErrorResponse).To(Equal("transformer failed"))
+			Expect(transformationError.SkipReason).To(BeEmpty())
+		}
+		Expect(errorDB.GetTransformationErrorsToRetry(10)).To(BeEmpty())
+
+		By("marking them for retry")
+		count, err := errorDB.RetryTransformationErrors(jobsdb.RetryTransformationErrorsRequestT{CustomVal: "GA"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(2))
+		Expect(errorDB.GetTransformationErrors([]string{"GA"}, 10)).To(BeEmpty())
+		toRetry := errorDB.GetTransformationErrorsToRetry(10)
+		Expect(jobIDs(toRetry)).To(ConsistOf(jobIDs(stored)))
+
+		By("marking the retried one done and the other skipped")
+		var retried, skipped *jobsdb.TransformationErrorT
+		for _, transformationError := range toRetry {
+			if transformationError.DestinationID == "enabled" {
+				retried = transformationError
+			} else {
+				skipped = transformationError
+			}
+		}
+		errorDB.MarkTransformationErrorsRetried([]*jobsdb.TransformationErrorT{retried})
+		errorDB.MarkTransformationErrorsSkipped([]*jobsdb.TransformationErrorT{skipped},
+			map[int64]string{skipped.JobID: "destination disabled is not enabled"})
+		Expect(errorDB.GetTransformationErrorsToRetry(10)).To(BeEmpty())
+
+		listed := errorDB.GetTransformationErrors([]string{"GA"}, 10)
+		Expect(jobIDs(listed)).To(Equal([]int64{skipped.JobID}))
+		Expect(listed[0].SkipReason).To(Equal("destination disabled is not enabled"))
+
+		By("retrying the skipped one only")
+		count, err = errorDB.RetryTransformationErrors(jobsdb.RetryTransformationErrorsRequestT{
+			JobIDs: []int64{retried.JobID, skipped.JobID}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(1))
+		Expect(jobIDs(errorDB.GetTransformationErrorsToRetry(10))).To(Equal([]int64{skipped.JobID}))
+	})
+})
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"math/rand"
 	"sort"
@@ -82,7 +83,7 @@ func storeProcess(jd *jobsdb.HandleT) {
 		time.Sleep(storeSleep)
 		var jobList []*jobsdb.JobT
 		for i := 0; i < batchSize; i++ {
-			id, _ := uuid.NewV4()
+			id := uuid.NewV4()
 			uuidWriteMap[id] = true
 			newJob := jobsdb.JobT{
 				UUID:         id,
@@ -168,7 +169,7 @@ func readProcess(jd *jobsdb.HandleT) {
 		}
 
 		start = time.Now()
-		jd.UpdateJobStatus(statusList)
+		jd.UpdateJobStatus(statusList, []string{endPoint})
 		elapsed = time.Since(start)
 		totalUpdateTime += float64(elapsed.Seconds())
 
@@ -178,14 +179,34 @@ func readProcess(jd *jobsdb.HandleT) {
 			fmt.Println("**********Average update time:", totalLoop, numQuery, totalUpdateTime/float64(totalLoop))
 		}
 	}
-	fmt.Println("**********Breaking read thread\n")
+	fmt.Println("**********Breaking read thread")
 	wg.Done()
 }
 
 func main() {
+	storeBench := flag.Bool("store-bench", false, "compare bulk copy and per row store throughput")
+	statusBench := flag.Bool("status-bench", false, "compare status history and last status reads on a high retry dataset")
+	payloadBench := flag.Bool("payload-bench", false, "compare storage and time of JSONB and compressed payloads")
+	flag.Parse()
+
 	var jd jobsdb.HandleT
 
-	jd.Setup(true, "prof", time.Duration(0))
+	jd.Setup(true, "prof", time.Duration(0), false)
+
+	if *storeBench {
+		jd.RunStoreBenchmark(numLoops, numQuery/10, []byte(sampleEvent))
+		return
+	}
+
+	if *statusBench {
+		jd.RunStatusQueryBenchmark(numQuery*10, numLoops/10, numQuery)
+		return
+	}
+
+	if *payloadBench {
+		jd.RunPayloadBenchmark(numQuery*10, []byte(sampleEvent))
+		return
+	}
 
 	for i := 0; i < numLoops; i++ {
 
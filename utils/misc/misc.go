@@ -187,7 +187,12 @@ func (stats *PerfStats) Start() {
 
 //End marks the end of one round of stat collection. events is number of events processed since start
 func (stats *PerfStats) End(events int) {
-	elapsed := time.Since(stats.tmpStart)
+	stats.Rate(events, time.Since(stats.tmpStart))
+}
+
+//Rate records a round of events processed in elapsed, for rounds timed by
+//the caller (e.g. when several run at once)
+func (stats *PerfStats) Rate(events int, elapsed time.Duration) {
 	stats.elapsedTime += elapsed
 	stats.eventCount += int64(events)
 	stats.instantRateCall = float64(events) * float64(time.Second) / float64(elapsed)